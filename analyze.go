@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//offline analysis of the files an experiment leaves (see benchmarks.go). The utilization and allocation samples of
+//every host are lined up on one timeline, each value holding until the next sample, to give summary statistics, the
+//time spent in each utilization band and the cut and kill totals. The bands are the regions of the configuration,
+//a host being in the band its total resources utilization (the highest of cpu and memory) puts it in, as in the
+//registry. The report comes as JSON and as a self-contained HTML page with the charts drawn in SVG
+
+type HostPoint struct {
+	Time            time.Time `json:"time"`
+	CPU             float64   `json:"cpu"`    //percent
+	Memory          float64   `json:"memory"` //percent
+	AllocatedCPUs   int64     `json:"allocatedcpus"`
+	AllocatedMemory int64     `json:"allocatedmemory"`
+}
+
+//over the samples, the time weighted mean over the time they hold
+type SeriesStats struct {
+	Min          float64 `json:"min"`
+	Max          float64 `json:"max"`
+	Mean         float64 `json:"mean"`
+	TimeWeighted float64 `json:"timeweighted"`
+	P50          float64 `json:"p50"`
+	P95          float64 `json:"p95"`
+}
+
+type HostAnalysis struct {
+	HostIP            string             `json:"hostip"`
+	Samples           int                `json:"samples"` //utilization reports
+	AllocationSamples int                `json:"allocationsamples"`
+	Start             time.Time          `json:"start"`
+	End               time.Time          `json:"end"`
+	CPU               SeriesStats        `json:"cpu"`    //percent
+	Memory            SeriesStats        `json:"memory"` //percent
+	Total             SeriesStats        `json:"total"`  //percent, the highest of cpu and memory
+	AllocatedCPUs     SeriesStats        `json:"allocatedcpus"`
+	AllocatedMemory   SeriesStats        `json:"allocatedmemory"`
+	Bands             map[string]float64 `json:"bands"` //seconds spent in each band
+	Points            []HostPoint        `json:"points"`
+}
+
+type ExperimentAnalysis struct {
+	Directory string         `json:"directory"`
+	Start     time.Time      `json:"start"`
+	End       time.Time      `json:"end"`
+	Bands     []RegionConfig `json:"bands"`
+	Hosts     []HostAnalysis `json:"hosts"`
+	Totals    BenchmarkCuts  `json:"totals"`
+}
+
+func AnalyzeExperiment(dir string) (ExperimentAnalysis, error) {
+	analysis := ExperimentAnalysis{Directory: dir, Bands: config.Regions, Hosts: make([]HostAnalysis, 0)}
+	utilizationHosts, err := BenchmarkHosts(dir)
+	if err != nil {
+		return analysis, err
+	}
+	allocationHosts, err := AllocationHosts(dir)
+	if err != nil {
+		return analysis, err
+	}
+	samples := make(map[string][]BenchmarkSample)
+	allocations := make(map[string][]AllocationSample)
+	for _, hostIP := range utilizationHosts {
+		if samples[hostIP], err = ReadBenchmarkHost(dir, hostIP); err != nil {
+			return analysis, err
+		}
+	}
+	for _, hostIP := range allocationHosts {
+		if allocations[hostIP], err = ReadAllocationHost(dir, hostIP); err != nil {
+			return analysis, err
+		}
+	}
+	if analysis.Totals, err = ReadBenchmarkCuts(dir); err != nil {
+		return analysis, err
+	}
+
+	hostIPs := make([]string, 0, len(samples)+len(allocations))
+	for _, hostIP := range utilizationHosts {
+		hostIPs = append(hostIPs, hostIP)
+	}
+	for _, hostIP := range allocationHosts {
+		if _, ok := samples[hostIP]; !ok {
+			hostIPs = append(hostIPs, hostIP)
+		}
+	}
+	sort.Strings(hostIPs)
+	for _, hostIP := range hostIPs {
+		host := AnalyzeHost(hostIP, samples[hostIP], allocations[hostIP])
+		if len(host.Points) == 0 {
+			continue
+		}
+		if analysis.Start.IsZero() || host.Start.Before(analysis.Start) {
+			analysis.Start = host.Start
+		}
+		if host.End.After(analysis.End) {
+			analysis.End = host.End
+		}
+		analysis.Hosts = append(analysis.Hosts, host)
+	}
+	return analysis, nil
+}
+
+//lines up the samples of a host. The allocation files repeat the utilization, so every sample of either kind sets it
+//and the allocation carries over from the last allocation sample
+func AnalyzeHost(hostIP string, samples []BenchmarkSample, allocations []AllocationSample) HostAnalysis {
+	host := HostAnalysis{HostIP: hostIP, Samples: len(samples), AllocationSamples: len(allocations), Bands: make(map[string]float64)}
+	for _, region := range config.Regions {
+		host.Bands[region.Name] = 0
+	}
+	points := make([]HostPoint, 0, len(samples)+len(allocations))
+	for _, sample := range samples {
+		points = append(points, HostPoint{Time: sample.Time, CPU: sample.CPU, Memory: sample.Memory, AllocatedCPUs: -1})
+	}
+	for _, sample := range allocations {
+		points = append(points, HostPoint{Time: sample.Time, CPU: sample.CPU, Memory: sample.Memory, AllocatedCPUs: sample.AllocatedCPUs, AllocatedMemory: sample.AllocatedMemory})
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Time.Before(points[j].Time) })
+	var allocatedCPUs, allocatedMemory int64
+	for i := range points {
+		if points[i].AllocatedCPUs < 0 {
+			points[i].AllocatedCPUs, points[i].AllocatedMemory = allocatedCPUs, allocatedMemory
+		}
+		allocatedCPUs, allocatedMemory = points[i].AllocatedCPUs, points[i].AllocatedMemory
+	}
+	host.Points = points
+	if len(points) == 0 {
+		return host
+	}
+	host.Start, host.End = points[0].Time, points[len(points)-1].Time
+
+	//the time each point holds, the last one holding none
+	held := make([]float64, len(points))
+	for i := 0; i+1 < len(points); i++ {
+		held[i] = points[i+1].Time.Sub(points[i].Time).Seconds()
+		host.Bands[RegionFor(math.Max(points[i].CPU, points[i].Memory)/100).Name] += held[i]
+	}
+	series := func(value func(point HostPoint) float64) SeriesStats {
+		values := make([]float64, len(points))
+		for i, point := range points {
+			values[i] = value(point)
+		}
+		return NewSeriesStats(values, held)
+	}
+	host.CPU = series(func(point HostPoint) float64 { return point.CPU })
+	host.Memory = series(func(point HostPoint) float64 { return point.Memory })
+	host.Total = series(func(point HostPoint) float64 { return math.Max(point.CPU, point.Memory) })
+	host.AllocatedCPUs = series(func(point HostPoint) float64 { return float64(point.AllocatedCPUs) })
+	host.AllocatedMemory = series(func(point HostPoint) float64 { return float64(point.AllocatedMemory) })
+	return host
+}
+
+//weights are the seconds each value holds. Percentiles are taken on the values, by nearest rank
+func NewSeriesStats(values []float64, weights []float64) SeriesStats {
+	if len(values) == 0 {
+		return SeriesStats{}
+	}
+	stats := SeriesStats{Min: math.Inf(1), Max: math.Inf(-1)}
+	sum, weighted, weight := 0.0, 0.0, 0.0
+	for i, value := range values {
+		stats.Min = math.Min(stats.Min, value)
+		stats.Max = math.Max(stats.Max, value)
+		sum += value
+		weighted += value * weights[i]
+		weight += weights[i]
+	}
+	stats.Mean = sum / float64(len(values))
+	stats.TimeWeighted = stats.Mean
+	if weight > 0 {
+		stats.TimeWeighted = weighted / weight
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		return sorted[max(int(math.Ceil(p*float64(len(sorted))))-1, 0)]
+	}
+	stats.P50, stats.P95 = rank(0.5), rank(0.95)
+	return stats
+}
+
+var bandColors = []string{"#4caf50", "#ffb300", "#e53935", "#8e24aa", "#1e88e5", "#6d4c41"}
+
+const (
+	chartWidth  = 760
+	chartHeight = 180
+)
+
+type chartLine struct {
+	Label  string
+	Color  string
+	Points string //SVG polyline points
+}
+
+type chartGuide struct {
+	Y     float64
+	Label string
+}
+
+type chartBand struct {
+	Name    string
+	Color   string
+	X       float64
+	Width   float64
+	Seconds float64
+	Share   float64 //percent of the time of the host
+}
+
+type hostChart struct {
+	Host        HostAnalysis
+	Utilization []chartLine
+	Allocation  []chartLine
+	MaxCPUs     int64
+	MaxMemory   int64
+	Guides      []chartGuide
+	Bands       []chartBand
+}
+
+//x of a time on the experiment timeline
+func (a ExperimentAnalysis) chartX(at time.Time) float64 {
+	span := a.End.Sub(a.Start).Seconds()
+	if span <= 0 {
+		return 0
+	}
+	return at.Sub(a.Start).Seconds() / span * chartWidth
+}
+
+//the values as a step line, each one holding until the next, scaled so top is at the top of the chart
+func (a ExperimentAnalysis) stepLine(points []HostPoint, value func(point HostPoint) float64, top float64) string {
+	var line strings.Builder
+	y := func(v float64) float64 {
+		if top <= 0 {
+			return chartHeight
+		}
+		return chartHeight - math.Min(v/top, 1)*chartHeight
+	}
+	for i, point := range points {
+		if i > 0 {
+			fmt.Fprintf(&line, "%.1f,%.1f ", a.chartX(point.Time), y(value(points[i-1])))
+		}
+		fmt.Fprintf(&line, "%.1f,%.1f ", a.chartX(point.Time), y(value(point)))
+	}
+	return strings.TrimSpace(line.String())
+}
+
+func (a ExperimentAnalysis) charts() []hostChart {
+	charts := make([]hostChart, 0, len(a.Hosts))
+	for _, host := range a.Hosts {
+		chart := hostChart{Host: host, MaxCPUs: int64(host.AllocatedCPUs.Max), MaxMemory: int64(host.AllocatedMemory.Max)}
+		chart.Utilization = []chartLine{
+			{Label: "cpu", Color: "#1e88e5", Points: a.stepLine(host.Points, func(point HostPoint) float64 { return point.CPU }, 100)},
+			{Label: "memory", Color: "#e53935", Points: a.stepLine(host.Points, func(point HostPoint) float64 { return point.Memory }, 100)},
+		}
+		if host.AllocationSamples > 0 {
+			chart.Allocation = []chartLine{
+				{Label: "allocated cpu shares", Color: "#1e88e5", Points: a.stepLine(host.Points, func(point HostPoint) float64 { return float64(point.AllocatedCPUs) }, host.AllocatedCPUs.Max)},
+				{Label: "allocated memory", Color: "#e53935", Points: a.stepLine(host.Points, func(point HostPoint) float64 { return float64(point.AllocatedMemory) }, host.AllocatedMemory.Max)},
+			}
+		}
+		total := 0.0
+		for _, seconds := range host.Bands {
+			total += seconds
+		}
+		x := 0.0
+		for i, region := range a.Bands {
+			if i+1 < len(a.Bands) && region.Max > 0 && region.Max < 1 {
+				chart.Guides = append(chart.Guides, chartGuide{Y: chartHeight - region.Max*chartHeight, Label: region.Name + " / " + a.Bands[i+1].Name})
+			}
+			band := chartBand{Name: region.Name, Color: bandColors[i%len(bandColors)], X: x, Seconds: host.Bands[region.Name]}
+			if total > 0 {
+				band.Share = band.Seconds / total * 100
+				band.Width = band.Seconds / total * chartWidth
+			}
+			x += band.Width
+			chart.Bands = append(chart.Bands, band)
+		}
+		charts = append(charts, chart)
+	}
+	return charts
+}
+
+var analysisTemplate = template.Must(template.New("analysis").Funcs(template.FuncMap{
+	"percent": func(value float64) string { return fmt.Sprintf("%.1f%%", value) },
+	"seconds": func(seconds float64) string {
+		return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+	},
+	"time": func(at time.Time) string { return at.Format("2006-01-02 15:04:05 MST") },
+	"span": func(start time.Time, end time.Time) string { return end.Sub(start).Round(time.Second).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Experiment analysis {{.Analysis.Directory}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+svg { background: #fafafa; border: 1px solid #ddd; margin: 0.3em 0; }
+.legend span { display: inline-block; margin-right: 1.2em; }
+.swatch { display: inline-block; width: 0.8em; height: 0.8em; margin-right: 0.3em; }
+</style>
+</head>
+<body>
+<h1>Experiment analysis</h1>
+<p>{{.Analysis.Directory}}: {{len .Analysis.Hosts}} hosts from {{time .Analysis.Start}} to {{time .Analysis.End}} ({{span .Analysis.Start .Analysis.End}})</p>
+
+<h2>Cuts and kills</h2>
+<table>
+<tr><th>cuts</th><th>cpu shares cut</th><th>memory cut</th><th>kills</th></tr>
+<tr><td>{{.Analysis.Totals.Cuts}}</td><td>{{.Analysis.Totals.CPUCut}}</td><td>{{.Analysis.Totals.MemoryCut}}</td><td>{{.Analysis.Totals.Kills}}</td></tr>
+</table>
+
+<h2>Summary</h2>
+<table>
+<tr><th>host</th><th>samples</th><th>cpu mean</th><th>cpu p95</th><th>cpu max</th><th>memory mean</th><th>memory p95</th><th>memory max</th>
+{{- range .Analysis.Bands}}<th>{{.Name}}</th>{{end}}</tr>
+{{- range .Charts}}
+<tr><td><a href="#{{.Host.HostIP}}">{{.Host.HostIP}}</a></td><td>{{.Host.Samples}}</td>
+<td>{{percent .Host.CPU.TimeWeighted}}</td><td>{{percent .Host.CPU.P95}}</td><td>{{percent .Host.CPU.Max}}</td>
+<td>{{percent .Host.Memory.TimeWeighted}}</td><td>{{percent .Host.Memory.P95}}</td><td>{{percent .Host.Memory.Max}}</td>
+{{- range .Bands}}<td>{{percent .Share}}</td>{{end}}</tr>
+{{- end}}
+</table>
+<p>Means are weighted by the time each sample holds. Band columns give the share of the time spent in each region.</p>
+
+{{range .Charts}}
+<h2 id="{{.Host.HostIP}}">{{.Host.HostIP}}</h2>
+<p>{{.Host.Samples}} utilization and {{.Host.AllocationSamples}} allocation samples from {{time .Host.Start}} to {{time .Host.End}}</p>
+<div class="legend">{{range .Utilization}}<span><span class="swatch" style="background: {{.Color}}"></span>{{.Label}}</span>{{end}}</div>
+<svg width="{{$.Width}}" height="{{$.Height}}" viewBox="0 0 {{$.Width}} {{$.Height}}">
+{{- range .Guides}}
+<line x1="0" y1="{{.Y}}" x2="{{$.Width}}" y2="{{.Y}}" stroke="#999" stroke-dasharray="4 4"/><text x="4" y="{{.Y}}" dy="-3" font-size="10" fill="#666">{{.Label}}</text>
+{{- end}}
+{{- range .Utilization}}
+<polyline fill="none" stroke="{{.Color}}" stroke-width="1.5" points="{{.Points}}"/>
+{{- end}}
+</svg>
+{{- if .Allocation}}
+<div class="legend">{{range .Allocation}}<span><span class="swatch" style="background: {{.Color}}"></span>{{.Label}}</span>{{end}} (up to {{.MaxCPUs}} shares and {{.MaxMemory}} bytes)</div>
+<svg width="{{$.Width}}" height="{{$.Height}}" viewBox="0 0 {{$.Width}} {{$.Height}}">
+{{- range .Allocation}}
+<polyline fill="none" stroke="{{.Color}}" stroke-width="1.5" points="{{.Points}}"/>
+{{- end}}
+</svg>
+{{- end}}
+<div class="legend">{{range .Bands}}<span><span class="swatch" style="background: {{.Color}}"></span>{{.Name}} {{seconds .Seconds}} ({{percent .Share}})</span>{{end}}</div>
+<svg width="{{$.Width}}" height="20" viewBox="0 0 {{$.Width}} 20">
+{{- range .Bands}}
+<rect x="{{.X}}" y="0" width="{{.Width}}" height="20" fill="{{.Color}}"/>
+{{- end}}
+</svg>
+<table>
+<tr><th></th><th>min</th><th>mean</th><th>time weighted</th><th>p50</th><th>p95</th><th>max</th></tr>
+<tr><td>cpu</td><td>{{percent .Host.CPU.Min}}</td><td>{{percent .Host.CPU.Mean}}</td><td>{{percent .Host.CPU.TimeWeighted}}</td><td>{{percent .Host.CPU.P50}}</td><td>{{percent .Host.CPU.P95}}</td><td>{{percent .Host.CPU.Max}}</td></tr>
+<tr><td>memory</td><td>{{percent .Host.Memory.Min}}</td><td>{{percent .Host.Memory.Mean}}</td><td>{{percent .Host.Memory.TimeWeighted}}</td><td>{{percent .Host.Memory.P50}}</td><td>{{percent .Host.Memory.P95}}</td><td>{{percent .Host.Memory.Max}}</td></tr>
+<tr><td>total</td><td>{{percent .Host.Total.Min}}</td><td>{{percent .Host.Total.Mean}}</td><td>{{percent .Host.Total.TimeWeighted}}</td><td>{{percent .Host.Total.P50}}</td><td>{{percent .Host.Total.P95}}</td><td>{{percent .Host.Total.Max}}</td></tr>
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+func (a ExperimentAnalysis) WriteHTML(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return analysisTemplate.Execute(file, struct {
+		Analysis ExperimentAnalysis
+		Charts   []hostChart
+		Width    int
+		Height   int
+	}{a, a.charts(), chartWidth, chartHeight})
+}
+
+func RunAnalyzeCommand(args []string) int {
+	flags := flag.NewFlagSet("analyze", flag.ContinueOnError)
+	dir := flags.String("dir", ".", "directory with the Cpu.txt, Memory.txt, Time.txt, CPUAlloc.txt, Cuts.txt and Kills.txt files of the experiment")
+	configPath := flags.String("config", "", "registry configuration whose regions are the utilization bands")
+	htmlPath := flags.String("html", "report.html", "file the HTML report is written to, none when empty")
+	out := flags.String("out", "", "file the JSON analysis is written to, standard output when empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if config, err = LoadConfig(*configPath); err != nil {
+		log.Print(err)
+		return 1
+	}
+	analysis, err := AnalyzeExperiment(*dir)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	log.Printf("analyze: %d hosts from %s to %s, %d cuts and %d kills", len(analysis.Hosts),
+		analysis.Start.Format(time.RFC3339), analysis.End.Format(time.RFC3339), analysis.Totals.Cuts, analysis.Totals.Kills)
+
+	if *htmlPath != "" {
+		if err = analysis.WriteHTML(*htmlPath); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+	output := os.Stdout
+	if *out != "" {
+		if output, err = os.Create(*out); err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer output.Close()
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(analysis); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
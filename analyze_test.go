@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writes the allocation files the benchmarks leave for a host, the utilization in percent
+func writeAllocationHost(t *testing.T, dir string, hostIP string, samples []AllocationSample) {
+	t.Helper()
+	var cpu, memory, times strings.Builder
+	for _, sample := range samples {
+		fmt.Fprintf(&cpu, "CPU usage: %g CPU Allocated: %d\n", sample.CPU, sample.AllocatedCPUs)
+		fmt.Fprintf(&memory, "Memory usage: %g Memory allocated: %d\n", sample.Memory, sample.AllocatedMemory)
+		fmt.Fprintln(&times, sample.Time.String())
+	}
+	files := map[string]string{benchmarkCPUAllocationSuffix: cpu.String(), benchmarkMemoryAllocationSuffix: memory.String(), benchmarkTimeAllocationSuffix: times.String()}
+	for suffix, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, hostIP+suffix), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestParseGoTime(t *testing.T) {
+	expected := time.Date(2017, 3, 1, 10, 0, 0, 500000000, time.UTC)
+	for _, value := range []string{"2017-03-01 10:00:00.5 +0000 UTC", "2017-03-01 10:00:00.5 +0000 UTC m=+3.000000001", "2017-03-01 11:00:00.5 +0100 CET\r"} {
+		if parsed, err := ParseGoTime(value); err != nil || !parsed.Equal(expected) {
+			t.Errorf("%q: %s %v", value, parsed, err)
+		}
+	}
+	if _, err := ParseGoTime("2017-03-01T10:00:00Z"); err == nil {
+		t.Error("an RFC 3339 time is parsed")
+	}
+}
+
+func TestReadBenchmarkFiles(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeAllocationHost(t, dir, "10.5.60.3", []AllocationSample{{Time: start, CPU: 12.5, Memory: 30, AllocatedCPUs: 1024, AllocatedMemory: 268435456}})
+	samples, err := ReadAllocationHost(dir, "10.5.60.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0] != (AllocationSample{Time: samples[0].Time, CPU: 12.5, Memory: 30, AllocatedCPUs: 1024, AllocatedMemory: 268435456}) || !samples[0].Time.Equal(start) {
+		t.Errorf("the allocation samples are %+v", samples)
+	}
+
+	//files of different lengths are cut to the shortest, a line that does not parse names its file
+	writeBenchmarkHost(t, dir, "10.5.60.4", []BenchmarkSample{{Time: start, CPU: 10, Memory: 20}, {Time: start.Add(time.Second), CPU: 15, Memory: 25}})
+	os.WriteFile(filepath.Join(dir, "10.5.60.4"+benchmarkMemorySuffix), []byte("20\n"), 0644)
+	if samples, err := ReadBenchmarkHost(dir, "10.5.60.4"); err != nil || len(samples) != 1 {
+		t.Errorf("%d samples are read: %v", len(samples), err)
+	}
+	os.WriteFile(filepath.Join(dir, "10.5.60.4"+benchmarkCPUSuffix), []byte("ten\n"), 0644)
+	if _, err := ReadBenchmarkHost(dir, "10.5.60.4"); err == nil || !strings.Contains(err.Error(), "10.5.60.4Cpu.txt line 1") {
+		t.Errorf("a bad cpu line gives %v", err)
+	}
+
+	if totals, err := ReadBenchmarkCuts(dir); err != nil || totals != (BenchmarkCuts{}) {
+		t.Errorf("without cut and kill files the totals are %+v: %v", totals, err)
+	}
+	os.WriteFile(filepath.Join(dir, benchmarkCutsFile), []byte("2 CPU cut: 512 memory cut: 1048576\n1 CPU cut: 256 memory cut: 0\n"), 0644)
+	os.WriteFile(filepath.Join(dir, benchmarkKillsFile), []byte("1\n\n2\n"), 0644)
+	if totals, err := ReadBenchmarkCuts(dir); err != nil || totals != (BenchmarkCuts{Cuts: 3, CPUCut: 768, MemoryCut: 1048576, Kills: 3}) {
+		t.Errorf("the totals are %+v: %v", totals, err)
+	}
+}
+
+func TestAnalyzeHost(t *testing.T) {
+	useDefaultConfig(t)
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := []BenchmarkSample{
+		{Time: start, CPU: 20, Memory: 10},
+		{Time: start.Add(10 * time.Second), CPU: 60, Memory: 30},
+		{Time: start.Add(40 * time.Second), CPU: 90, Memory: 95},
+	}
+	allocations := []AllocationSample{{Time: start.Add(5 * time.Second), CPU: 30, Memory: 10, AllocatedCPUs: 1024, AllocatedMemory: 1 << 28}}
+
+	host := AnalyzeHost("10.5.60.3", samples, allocations)
+	if len(host.Points) != 4 || !host.Start.Equal(start) || !host.End.Equal(start.Add(40*time.Second)) {
+		t.Fatalf("the host is lined up as %+v", host.Points)
+	}
+	//the allocation carries over to the later utilization samples
+	if host.Points[0].AllocatedCPUs != 0 || host.Points[2].AllocatedCPUs != 1024 || host.Points[3].AllocatedMemory != 1<<28 {
+		t.Errorf("the points are %+v", host.Points)
+	}
+	//the last point holds no time
+	if host.Bands["LEE"] != 10 || host.Bands["DEE"] != 30 || host.Bands["EED"] != 0 {
+		t.Errorf("the bands are %v", host.Bands)
+	}
+	if host.CPU != (SeriesStats{Min: 20, Max: 90, Mean: 50, TimeWeighted: 51.25, P50: 30, P95: 90}) {
+		t.Errorf("the cpu stats are %+v", host.CPU)
+	}
+	if host.Total.Max != 95 || host.AllocatedCPUs.Max != 1024 {
+		t.Errorf("the total is %+v and the allocated cpu shares %+v", host.Total, host.AllocatedCPUs)
+	}
+
+	//a single sample holds no time, its mean is taken as is
+	if stats := NewSeriesStats([]float64{40}, []float64{0}); stats != (SeriesStats{Min: 40, Max: 40, Mean: 40, TimeWeighted: 40, P50: 40, P95: 40}) {
+		t.Errorf("the stats of one sample are %+v", stats)
+	}
+}
+
+func TestAnalyzeCommand(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeBenchmarkHost(t, dir, "10.5.60.3", []BenchmarkSample{{Time: start, CPU: 20, Memory: 10}, {Time: start.Add(time.Minute), CPU: 90, Memory: 40}})
+	writeAllocationHost(t, dir, "10.5.60.4", []AllocationSample{{Time: start.Add(30 * time.Second), CPU: 50, Memory: 50, AllocatedCPUs: 2048, AllocatedMemory: 1 << 30},
+		{Time: start.Add(2 * time.Minute), CPU: 10, Memory: 10}})
+	os.WriteFile(filepath.Join(dir, benchmarkKillsFile), []byte("4\n"), 0644)
+	htmlPath := filepath.Join(t.TempDir(), "report.html")
+	out := filepath.Join(t.TempDir(), "analysis.json")
+
+	if code := RunAnalyzeCommand([]string{"-dir", dir, "-html", htmlPath, "-out", out}); code != 0 {
+		t.Fatalf("the command exits with %d", code)
+	}
+	var analysis ExperimentAnalysis
+	if data, err := os.ReadFile(out); err != nil || json.Unmarshal(data, &analysis) != nil {
+		t.Fatalf("the analysis cannot be read: %v", err)
+	}
+	//a host with allocation files only is analyzed too
+	if len(analysis.Hosts) != 2 || analysis.Hosts[1].HostIP != "10.5.60.4" || analysis.Hosts[1].AllocationSamples != 2 {
+		t.Fatalf("the hosts are %+v", analysis.Hosts)
+	}
+	if !analysis.Start.Equal(start) || !analysis.End.Equal(start.Add(2*time.Minute)) || analysis.Totals.Kills != 4 || len(analysis.Bands) != 3 {
+		t.Errorf("the analysis runs from %s to %s with %+v", analysis.Start, analysis.End, analysis.Totals)
+	}
+
+	data, err := os.ReadFile(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(data)
+	for _, expected := range []string{`<h2 id="10.5.60.3">`, `<h2 id="10.5.60.4">`, "<polyline", "allocated cpu shares", "<td>4</td>"} {
+		if !strings.Contains(page, expected) {
+			t.Errorf("the report lacks %s", expected)
+		}
+	}
+	//only the host with allocation files gets an allocation chart
+	if strings.Count(page, "allocated cpu shares") != 1 {
+		t.Error("an allocation chart is drawn for a host without allocation files")
+	}
+
+	if code := RunAnalyzeCommand([]string{"-dir", filepath.Join(dir, "missing"), "-html", "", "-out", out}); code != 0 {
+		t.Errorf("a directory without experiment files exits with %d", code)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//versioned JSON API under /v2. Resources are addressed by path, payloads are JSON documents and every failure is
+//answered with an ErrorDocument. The routes of the first version are kept in myproject.go on top of the same operations
+
+type ErrorDocument struct {
+	Status  int         `json:"status"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+const maxRequestBody = 1 << 20
+
+//maps an error of the registry operations to the status and code reported to the client
+func ErrorStatus(err error) (int, string) {
+	var validationErr *ValidationError
+	var runtimeErr *RuntimeError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusBadRequest, "invalid_argument"
+	case errors.Is(err, ErrUnknownHost):
+		return http.StatusNotFound, "unknown_host"
+	case errors.Is(err, ErrHostExists):
+		return http.StatusConflict, "host_exists"
+	case errors.Is(err, ErrUnknownClass):
+		return http.StatusBadRequest, "unknown_class"
+	case errors.Is(err, ErrNoTemplate):
+		return http.StatusUnprocessableEntity, "no_template"
+	case errors.Is(err, ErrNoFreePort):
+		return http.StatusServiceUnavailable, "no_free_port"
+	case errors.Is(err, ErrInsufficientCapacity):
+		return http.StatusConflict, "insufficient_capacity"
+	case errors.Is(err, ErrUnknownReservation):
+		return http.StatusNotFound, "unknown_reservation"
+	case errors.Is(err, ErrUnknownTask):
+		return http.StatusNotFound, "unknown_task"
+	case errors.Is(err, ErrTaskExists):
+		return http.StatusConflict, "task_exists"
+	case errors.Is(err, ErrTaskTerminated):
+		return http.StatusConflict, "task_terminated"
+	case errors.Is(err, ErrTaskConflict):
+		return http.StatusConflict, "task_conflict"
+	case errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized, "unauthenticated"
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrNoLeader):
+		return http.StatusServiceUnavailable, "not_leader"
+	case errors.Is(err, ErrNotCommitted):
+		return http.StatusServiceUnavailable, "not_committed"
+	case errors.Is(err, ErrPowerState):
+		return http.StatusConflict, "power_state"
+	case errors.Is(err, ErrPowerHook):
+		return http.StatusBadGateway, "power_hook"
+	case errors.As(err, &runtimeErr):
+		return RuntimeErrorStatus(runtimeErr), "runtime_" + runtimeErr.Kind
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+func WriteJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func WriteError(w http.ResponseWriter, err error) {
+	status, code := ErrorStatus(err)
+	document := ErrorDocument{Status: status, Code: code, Message: err.Error()}
+
+	var validationErr *ValidationError
+	var runtimeErr *RuntimeError
+	var capacityErr *CapacityError
+	if errors.As(err, &validationErr) {
+		document.Details = validationErr
+	} else if errors.As(err, &runtimeErr) {
+		document.Details = runtimeErr
+	} else if errors.As(err, &capacityErr) {
+		document.Details = capacityErr
+	}
+	WriteJSON(w, status, document)
+}
+
+//decodes a JSON body, refusing unknown fields and trailing data
+func DecodeBody(req *http.Request, body interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(req.Body, maxRequestBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(body); err != nil {
+		return &ValidationError{Field: "body", Message: err.Error()}
+	}
+	if decoder.More() {
+		return &ValidationError{Field: "body", Message: "unexpected data after the JSON document"}
+	}
+	return nil
+}
+
+func queryBool(req *http.Request, name string) (bool, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &ValidationError{Field: name, Message: fmt.Sprintf("invalid boolean %q", value)}
+	}
+	return parsed, nil
+}
+
+type HostRegistration struct {
+	HostIP      string `json:"hostip"`
+	TotalMemory int64  `json:"totalmemory"`
+	TotalCPUs   int64  `json:"totalcpus"` //number of cpus, not shares
+}
+
+//pointers tell a missing value apart from 0
+type UtilizationUpdate struct {
+	CPU    *float64 `json:"cpu"`
+	Memory *float64 `json:"memory"`
+}
+
+type ClassUpdate struct {
+	Class string `json:"class"`
+}
+
+type Allocation struct {
+	CPU    int64 `json:"cpu"`    //cpu shares
+	Memory int64 `json:"memory"` //bytes
+	//optional, the task the resources are allocated to. It is added to the task table
+	TaskID   string `json:"taskid,omitempty"`
+	Class    string `json:"class,omitempty"`
+	TaskType string `json:"tasktype,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Port     int    `json:"port,omitempty"`
+}
+
+//the first API passes negative values on to release resources, the second one does not take them
+func (a Allocation) Validate() error {
+	if a.CPU < 0 {
+		return &ValidationError{Field: "cpu", Message: "must not be negative"}
+	}
+	if a.Memory < 0 {
+		return &ValidationError{Field: "memory", Message: "must not be negative"}
+	}
+	return nil
+}
+
+type TaskResize struct {
+	HostIP    string `json:"hostip"`
+	CPU       int64  `json:"cpu"`    //cpu shares after the cut
+	Memory    string `json:"memory"` //memory after the cut, docker notation
+	CPUCut    int64  `json:"cpucut"`
+	MemoryCut int64  `json:"memorycut"`
+}
+
+//cpu and memory may be left out for a task of the task table, they are checked against it otherwise
+type TaskTermination struct {
+	HostIP        string `json:"hostip"`
+	CPU           int64  `json:"cpu"`
+	Memory        int64  `json:"memory"`
+	PreviousClass string `json:"previousclass,omitempty"`
+	NewClass      string `json:"newclass,omitempty"`
+	Update        bool   `json:"update,omitempty"`
+	Port          int    `json:"port,omitempty"`
+}
+
+func (r *Registry) V2ListHosts(w http.ResponseWriter, req *http.Request) {
+	WriteJSON(w, http.StatusOK, r.HostSnapshots())
+}
+
+func (r *Registry) V2CreateHost(w http.ResponseWriter, req *http.Request) {
+	var registration HostRegistration
+	if err := DecodeBody(req, &registration); err != nil {
+		WriteError(w, err)
+		return
+	}
+	// *1024 because 1024 shares equals using 1 cpu by 100%
+	host, err := r.RegisterHost(registration.HostIP, registration.TotalMemory, registration.TotalCPUs*1024)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	created, err := r.SnapshotHost(host.HostIP)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v2/hosts/"+host.HostIP)
+	WriteJSON(w, http.StatusCreated, created)
+}
+
+func (r *Registry) V2GetHost(w http.ResponseWriter, req *http.Request) {
+	host, err := r.SnapshotHost(mux.Vars(req)["hostip"])
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, host)
+}
+
+func (r *Registry) V2DeleteHost(w http.ResponseWriter, req *http.Request) {
+	force, err := queryBool(req, "force")
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	report, status := r.RemoveHost(mux.Vars(req)["hostip"], force)
+	switch status {
+	case http.StatusOK:
+		WriteJSON(w, status, report)
+	case http.StatusNotFound:
+		WriteJSON(w, status, ErrorDocument{Status: status, Code: "unknown_host", Message: report.Error, Details: report})
+	default:
+		WriteJSON(w, status, ErrorDocument{Status: status, Code: "host_allocated", Message: report.Error, Details: report})
+	}
+}
+
+//PUT replaces both values, PATCH accepts either of them
+func (r *Registry) V2UpdateUtilization(w http.ResponseWriter, req *http.Request) {
+	var update UtilizationUpdate
+	if err := DecodeBody(req, &update); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if req.Method == http.MethodPut {
+		if update.CPU == nil {
+			WriteError(w, &ValidationError{Field: "cpu", Message: "is required"})
+			return
+		}
+		if update.Memory == nil {
+			WriteError(w, &ValidationError{Field: "memory", Message: "is required"})
+			return
+		}
+	}
+	if err := r.SetUtilization(mux.Vars(req)["hostip"], update.CPU, update.Memory); err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Registry) V2UpdateClass(w http.ResponseWriter, req *http.Request) {
+	var update ClassUpdate
+	if err := DecodeBody(req, &update); err != nil {
+		WriteError(w, err)
+		return
+	}
+	hostIP := mux.Vars(req)["hostip"]
+	if err := r.RaiseHostClass(hostIP, update.Class); err != nil {
+		WriteError(w, err)
+		return
+	}
+	r.V2GetHost(w, req)
+}
+
+func (r *Registry) V2Allocate(w http.ResponseWriter, req *http.Request) {
+	var allocation Allocation
+	if err := DecodeBody(req, &allocation); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if err := allocation.Validate(); err != nil {
+		WriteError(w, err)
+		return
+	}
+	hostIP := mux.Vars(req)["hostip"]
+	var err error
+	if allocation.TaskID != "" {
+		err = r.AllocateTask(TaskRecord{ID: allocation.TaskID, HostIP: hostIP, Class: allocation.Class, Type: allocation.TaskType, Image: allocation.Image,
+			CPU: allocation.CPU, Memory: allocation.Memory, Port: allocation.Port})
+	} else {
+		err = r.allocateResources(hostIP, allocation.CPU, allocation.Memory, allocation.Class, nil)
+	}
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	r.V2GetHost(w, req)
+}
+
+func (r *Registry) V2RescheduleTask(w http.ResponseWriter, req *http.Request) {
+	var task Task
+	if err := DecodeBody(req, &task); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if task.Image == "" {
+		WriteError(w, &ValidationError{Field: "image", Message: "is required"})
+		return
+	}
+	result, err := r.Reschedule(task)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v2/tasks/"+result.ContainerID)
+	WriteJSON(w, http.StatusCreated, result)
+}
+
+func (r *Registry) V2ResizeTask(w http.ResponseWriter, req *http.Request) {
+	var resize TaskResize
+	if err := DecodeBody(req, &resize); err != nil {
+		WriteError(w, err)
+		return
+	}
+	memory, err := ParseMemory(resize.Memory)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "memory", Message: err.Error()})
+		return
+	}
+	cut := TaskCut{TaskID: mux.Vars(req)["taskid"], HostIP: resize.HostIP, NewCPU: resize.CPU, NewMemory: memory, CPUCut: resize.CPUCut, MemoryCut: resize.MemoryCut}
+	if err = r.CutTask(cut); err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *Registry) V2TerminateTask(w http.ResponseWriter, req *http.Request) {
+	var termination TaskTermination
+	if err := DecodeBody(req, &termination); err != nil {
+		WriteError(w, err)
+		return
+	}
+	taskResources := TaskResources{CPU: termination.CPU, Memory: termination.Memory, PreviousClass: termination.PreviousClass, NewClass: termination.NewClass,
+		Update: termination.Update, IP: termination.HostIP, TaskID: mux.Vars(req)["taskid"], Port: termination.Port}
+	if err := r.TerminateTask(taskResources); err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//?class= is required, ?type=normal (default) or cut
+func (r *Registry) V2PlacementList(w http.ResponseWriter, req *http.Request) {
+	listType := "1"
+	switch req.URL.Query().Get("type") {
+	case "", "normal":
+	case "cut":
+		listType = "2"
+	default:
+		WriteError(w, &ValidationError{Field: "type", Message: "must be normal or cut"})
+		return
+	}
+	listHosts, err := r.PlacementList(req.URL.Query().Get("class"), listType)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, listHosts)
+}
+
+func (r *Registry) V2KillList(w http.ResponseWriter, req *http.Request) {
+	listHosts, err := r.KillList(req.URL.Query().Get("class"))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, listHosts)
+}
+
+//handlers of a v2 resource by method. Dispatching here instead of with mux methods gives unknown methods a 405 with
+//an Allow header and an error document
+type MethodHandlers map[string]http.HandlerFunc
+
+func (m MethodHandlers) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if handler, ok := m[req.Method]; ok {
+		handler(w, req)
+		return
+	}
+	allowed := make([]string, 0, len(m))
+	for method := range m {
+		allowed = append(allowed, method)
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteJSON(w, http.StatusMethodNotAllowed, ErrorDocument{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: req.Method + " is not allowed on " + req.URL.Path})
+}
+
+func V2NotFound(w http.ResponseWriter, req *http.Request) {
+	WriteJSON(w, http.StatusNotFound, ErrorDocument{Status: http.StatusNotFound, Code: "not_found", Message: "no such resource " + req.URL.Path})
+}
+
+func (r *Registry) RegisterV2Routes(router *mux.Router) {
+	v2 := router.PathPrefix("/v2").Subrouter()
+
+	v2.Handle("/hosts", MethodHandlers{"GET": r.V2ListHosts, "POST": r.V2CreateHost})
+	v2.Handle("/hosts/{hostip}", MethodHandlers{"GET": r.V2GetHost, "DELETE": r.V2DeleteHost})
+	v2.Handle("/hosts/{hostip}/utilization", MethodHandlers{"PUT": r.V2UpdateUtilization, "PATCH": r.V2UpdateUtilization})
+	v2.Handle("/hosts/{hostip}/class", MethodHandlers{"PATCH": r.V2UpdateClass})
+	v2.Handle("/hosts/{hostip}/allocations", MethodHandlers{"POST": r.V2Allocate})
+	v2.Handle("/hosts/{hostip}/history", MethodHandlers{"GET": r.GetHostHistory})
+	v2.Handle("/hosts/{hostip}/tasks", MethodHandlers{"GET": r.V2ListHostTasks})
+	v2.Handle("/hosts/{hostip}/power", MethodHandlers{"PUT": r.V2SetPower})
+	v2.Handle("/tasks", MethodHandlers{"GET": r.V2ListTasks, "POST": r.V2RescheduleTask})
+	v2.Handle("/tasks/{taskid}", MethodHandlers{"GET": r.V2GetTask, "PATCH": r.V2ResizeTask, "DELETE": r.V2TerminateTask})
+	v2.Handle("/reservations", MethodHandlers{"GET": r.V2ListReservations, "POST": r.V2CreateReservation})
+	v2.Handle("/reservations/{id}", MethodHandlers{"GET": r.V2GetReservation, "DELETE": r.V2AbortReservation})
+	v2.Handle("/reservations/{id}/commit", MethodHandlers{"POST": r.V2CommitReservation})
+	v2.Handle("/consistency", MethodHandlers{"GET": r.V2CheckConsistency})
+	v2.Handle("/consistency/reconcile", MethodHandlers{"POST": r.V2ReconcileClasses})
+	v2.Handle("/place", MethodHandlers{"POST": r.V2Place})
+	v2.Handle("/lists/placement", MethodHandlers{"GET": r.V2PlacementList})
+	v2.Handle("/lists/kill", MethodHandlers{"GET": r.V2KillList})
+	v2.Handle("/ports/leases", MethodHandlers{"GET": r.GetPortLeases})
+	v2.Handle("/history/records", MethodHandlers{"GET": r.GetHistoryRecords})
+	v2.Handle("/energy", MethodHandlers{"GET": r.V2Energy})
+	v2.Handle("/power", MethodHandlers{"GET": r.V2PowerStatus})
+	v2.Handle("/consolidation", MethodHandlers{"GET": r.V2PlanConsolidation, "POST": r.V2ExecuteConsolidation})
+	v2.Handle("/events", MethodHandlers{"GET": r.StreamEvents})
+	v2.Handle("/catalog", MethodHandlers{"GET": GetCatalog})
+	v2.Handle("/catalog/reload", MethodHandlers{"POST": ReloadCatalog})
+	v2.Handle("/catalog/validate", MethodHandlers{"POST": ValidateCatalog})
+	v2.Handle("/cluster", MethodHandlers{"GET": r.GetClusterStatus})
+	v2.PathPrefix("/").HandlerFunc(V2NotFound)
+}
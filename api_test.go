@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+	var document ErrorDocument
+	if err := json.Unmarshal(body, &document); err != nil {
+		t.Fatalf("%s is not an error document: %v", body, err)
+	}
+	return document.Code
+}
+
+func TestV2Errors(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/v2/hosts/10.0.0.9", nil, http.StatusNotFound, "unknown_host"},
+		{http.MethodPost, "/v2/hosts", HostRegistration{HostIP: "10.0.0.1", TotalMemory: 1 << 30, TotalCPUs: 4}, http.StatusConflict, "host_exists"},
+		{http.MethodPost, "/v2/hosts", HostRegistration{HostIP: "host1", TotalMemory: 1 << 30, TotalCPUs: 4}, http.StatusBadRequest, "invalid_argument"},
+		{http.MethodPost, "/v2/hosts", map[string]string{"hostname": "10.0.0.2"}, http.StatusBadRequest, "invalid_argument"},
+		{http.MethodPost, "/v2/hosts/10.0.0.1/allocations", Allocation{CPU: -1024}, http.StatusBadRequest, "invalid_argument"},
+		{http.MethodPatch, "/v2/hosts/10.0.0.1/class", ClassUpdate{Class: "9"}, http.StatusBadRequest, "unknown_class"},
+		{http.MethodGet, "/v2/lists/placement?class=1&type=any", nil, http.StatusBadRequest, "invalid_argument"},
+		{http.MethodGet, "/v2/lists/kill?class=9", nil, http.StatusBadRequest, "unknown_class"},
+		{http.MethodPut, "/v2/hosts", nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodGet, "/v2/nothing", nil, http.StatusNotFound, "not_found"},
+	}
+	for _, test := range tests {
+		status, body := serve(t, registry, test.method, test.path, test.body)
+		if status != test.status || errorCode(t, body) != test.code {
+			t.Errorf("%s %s answered %d %s, expected %d %s", test.method, test.path, status, body, test.status, test.code)
+		}
+	}
+}
+
+func TestV2Hosts(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t)
+
+	status, body := serve(t, registry, http.MethodPost, "/v2/hosts", HostRegistration{HostIP: "10.0.0.1", TotalMemory: 1 << 30, TotalCPUs: 4})
+	var host Host
+	if json.Unmarshal(body, &host); status != http.StatusCreated || host.TotalCPUs != 4*1024 || host.HostClass != LeastRestrictiveClass() {
+		t.Fatalf("registering answered %d %s", status, body)
+	}
+	status, body = serve(t, registry, http.MethodPost, "/v2/hosts/10.0.0.1/allocations", Allocation{CPU: 1024, Memory: 256 << 20})
+	if json.Unmarshal(body, &host); status != http.StatusOK || host.AllocatedCPUs != 1024 {
+		t.Fatalf("allocating answered %d %s", status, body)
+	}
+	//the first API releases resources with negative values
+	if status, body = serve(t, registry, http.MethodGet, "/host/updateresources/10.0.0.1&-1024&-268435456", nil); status != http.StatusOK {
+		t.Fatalf("releasing through the first API answered %d %s", status, body)
+	}
+	if host, _ = registry.SnapshotHost("10.0.0.1"); host.AllocatedCPUs != 0 || host.AllocatedMemory != 0 {
+		t.Errorf("the host has %d shares and %d bytes allocated", host.AllocatedCPUs, host.AllocatedMemory)
+	}
+
+	var listHosts []Host
+	status, body = serve(t, registry, http.MethodGet, "/v2/lists/placement?class="+LeastRestrictiveClass(), nil)
+	if json.Unmarshal(body, &listHosts); status != http.StatusOK || len(listHosts) != 1 {
+		t.Errorf("the placement list answered %d %s", status, body)
+	}
+}
+
+//the lists are encoded while the hosts in them change, which the race detector checks
+func TestListsEncodedWhileHostsChange(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2")
+	//only the hosts change, the lists keep their order
+	registry.background = func(update func()) {}
+
+	stop := make(chan struct{})
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			cpu, memory := float64(i%100)/100, 0.3
+			registry.SetUtilization("10.0.0.1", &cpu, &memory)
+			registry.AllocateResources("10.0.0.2", 1, 1)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		for _, path := range []string{"/v2/lists/placement?class=4", "/v2/lists/placement?class=4&type=cut", "/v2/lists/kill?class=4", "/host/list",
+			"/host/list/4&1", "/host/listkill/4"} {
+			if status, body := serve(t, registry, http.MethodGet, path, nil); status != http.StatusOK {
+				t.Fatalf("%s answered %d %s", path, status, body)
+			}
+		}
+	}
+	close(stop)
+	wait.Wait()
+}
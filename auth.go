@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//authentication with bearer tokens or client certificates, and authorization by role. Monitors may only report the
+//utilization of their own hosts, schedulers read the lists and update allocations and tasks, admins manage hosts and
+//peers replicate the registry. Denied requests are written to the audit log.
+//A client certificate carries its role in the organizational unit of its subject and, for monitors, the addresses of
+//their hosts in its IP addresses
+
+const (
+	RoleMonitor   = "monitor"
+	RoleScheduler = "scheduler"
+	RoleAdmin     = "admin"
+	RolePeer      = "peer"
+)
+
+//what a route does, each action being allowed to some roles
+const (
+	ActionRead      = "read"
+	ActionReport    = "report"    //utilization pushed by the monitor of a host
+	ActionAllocate  = "allocate"  //allocations, classes and tasks changed by the scheduler
+	ActionManage    = "manage"    //hosts registered and removed, configuration reloaded
+	ActionReplicate = "replicate" //consensus messages between registries
+)
+
+const identityHeader = "X-Registry-Identity" //identity of the client of a write forwarded by a follower
+
+var actionRoles = map[string][]string{
+	ActionRead:      {RoleScheduler, RoleAdmin},
+	ActionReport:    {RoleMonitor, RoleAdmin},
+	ActionAllocate:  {RoleScheduler, RoleAdmin},
+	ActionManage:    {RoleAdmin},
+	ActionReplicate: {RolePeer},
+}
+
+//action of each route, by method and path template. Routes missing here are read when fetched and managed otherwise
+var routeActions = map[string]string{
+	"GET /metrics":   ActionRead,
+	"GET /host/list": ActionRead,
+	"GET /host/list/{requestclass}&{listtype}":                                         ActionRead,
+	"GET /host/listkill/{requestclass}":                                                ActionRead,
+	"GET /host/updateclass/{requestclass}&{hostip}":                                    ActionAllocate,
+	"GET /host/createhost/{hostip}&{totalmemory}&{totalcpu}":                           ActionManage,
+	"GET /host/deletehost/{hostip}&{force}":                                            ActionManage,
+	"GET /host/deletehost/{hostip}":                                                    ActionManage,
+	"GET /host/updatetask/{taskid}&{newcpu}&{newmemory}&{hostip}&{cpucut}&{memorycut}": ActionAllocate,
+	"POST /host/killtask":                                                              ActionAllocate,
+	"POST /host/reschedule":                                                            ActionAllocate,
+	"POST /catalog/validate":                                                           ActionRead,
+	"GET /host/updateboth/{hostip}&{cpu}&{memory}":                                     ActionReport,
+	"GET /host/updatecpu/{hostip}&{cpu}":                                               ActionReport,
+	"GET /host/updatememory/{hostip}&{memory}":                                         ActionReport,
+	"GET /host/updateresources/{hostip}&{cpu}&{memory}":                                ActionAllocate,
+	"PUT /v2/hosts/{hostip}/utilization":                                               ActionReport,
+	"PATCH /v2/hosts/{hostip}/utilization":                                             ActionReport,
+	"PATCH /v2/hosts/{hostip}/class":                                                   ActionAllocate,
+	"POST /v2/hosts/{hostip}/allocations":                                              ActionAllocate,
+	"POST /v2/tasks":                                                                   ActionAllocate,
+	"PATCH /v2/tasks/{taskid}":                                                         ActionAllocate,
+	"DELETE /v2/tasks/{taskid}":                                                        ActionAllocate,
+	"POST /v2/reservations":                                                            ActionAllocate,
+	"POST /v2/reservations/{id}/commit":                                                ActionAllocate,
+	"DELETE /v2/reservations/{id}":                                                     ActionAllocate,
+	"POST /v2/place":                                                                   ActionAllocate,
+	"POST /v2/catalog/validate":                                                        ActionRead,
+	"POST /raft/":                                                                      ActionReplicate,
+}
+
+var ErrUnauthenticated = errors.New("authentication required")
+var ErrForbidden = errors.New("not allowed")
+
+type TokenConfig struct {
+	Name    string   `json:"name"`
+	Token   string   `json:"token"`
+	Role    string   `json:"role"`
+	HostIPs []string `json:"hostips,omitempty"` //hosts a monitor reports for
+}
+
+type TLSConfig struct {
+	Cert     string `json:"cert,omitempty"`     //certificate and key the registry serves https with
+	Key      string `json:"key,omitempty"`      //and presents to its peers
+	ClientCA string `json:"clientca,omitempty"` //CA of the client certificates, also trusted for the peers
+}
+
+type AuthConfig struct {
+	Tokens    []TokenConfig `json:"tokens"`
+	TLS       TLSConfig     `json:"tls"`
+	PeerToken string        `json:"peertoken,omitempty"` //token sent to the other registries when replicated
+	Audit     string        `json:"audit,omitempty"`     //file the denied requests are appended to, they are logged otherwise
+}
+
+//authentication is required as soon as a token or a client CA is configured
+func (a AuthConfig) Enabled() bool {
+	return len(a.Tokens) > 0 || a.TLS.ClientCA != ""
+}
+
+func validRole(role string) bool {
+	return role == RoleMonitor || role == RoleScheduler || role == RoleAdmin || role == RolePeer
+}
+
+func (a AuthConfig) Validate() error {
+	tokens := make(map[string]bool)
+	for i, token := range a.Tokens {
+		if token.Token == "" {
+			return fmt.Errorf("auth: token %d is empty", i)
+		}
+		if tokens[token.Token] {
+			return fmt.Errorf("auth: token %d (%s) is given twice", i, token.Name)
+		}
+		tokens[token.Token] = true
+		if !validRole(token.Role) {
+			return fmt.Errorf("auth: token %d (%s): unknown role %q", i, token.Name, token.Role)
+		}
+		if token.Role == RoleMonitor && len(token.HostIPs) == 0 {
+			return fmt.Errorf("auth: token %d (%s): a monitor token needs the hostips it reports for", i, token.Name)
+		}
+		for _, hostIP := range token.HostIPs {
+			if net.ParseIP(hostIP) == nil {
+				return fmt.Errorf("auth: token %d (%s): %q is not an IP address", i, token.Name, hostIP)
+			}
+		}
+	}
+	if (a.TLS.Cert == "") != (a.TLS.Key == "") {
+		return errors.New("auth: tls needs both cert and key")
+	}
+	if a.TLS.ClientCA != "" && a.TLS.Cert == "" {
+		return errors.New("auth: client certificates need tls cert and key")
+	}
+	return nil
+}
+
+type Identity struct {
+	Name    string   `json:"name"`
+	Role    string   `json:"role"`
+	HostIPs []string `json:"hostips,omitempty"`
+	Method  string   `json:"method"` //token, certificate or forwarded
+}
+
+type identityKey struct{}
+
+//identity of an authenticated request, nil when authentication is disabled
+func RequestIdentity(req *http.Request) *Identity {
+	identity, _ := req.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+type Authenticator struct {
+	tokens map[[sha256.Size]byte]Identity //by hash of the token
+	audit  *AuditLog
+}
+
+var authenticator *Authenticator
+
+var authDenied = NewCounterVec("hostregistry_auth_denied_total", "Requests denied by authentication or authorization.", "reason")
+
+func NewAuthenticator(authConfig AuthConfig) (*Authenticator, error) {
+	audit, err := OpenAuditLog(authConfig.Audit)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{tokens: make(map[[sha256.Size]byte]Identity), audit: audit}
+	for _, token := range authConfig.Tokens {
+		a.tokens[sha256.Sum256([]byte(token.Token))] = Identity{Name: token.Name, Role: token.Role, HostIPs: token.HostIPs, Method: "token"}
+	}
+	return a, nil
+}
+
+func (a *Authenticator) Authenticate(req *http.Request) (*Identity, error) {
+	var identity *Identity
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		token, ok := strings.CutPrefix(authorization, "Bearer ")
+		if !ok {
+			return nil, fmt.Errorf("%w: only bearer tokens are accepted", ErrUnauthenticated)
+		}
+		found, ok := a.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+		}
+		identity = &found
+	} else if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		certificate := req.TLS.VerifiedChains[0][0]
+		identity = &Identity{Name: certificate.Subject.CommonName, Method: "certificate"}
+		if len(certificate.Subject.OrganizationalUnit) > 0 {
+			identity.Role = certificate.Subject.OrganizationalUnit[0]
+		}
+		for _, ip := range certificate.IPAddresses {
+			identity.HostIPs = append(identity.HostIPs, ip.String())
+		}
+		if !validRole(identity.Role) {
+			return nil, fmt.Errorf("%w: certificate of %s has no known role in its organizational unit", ErrUnauthenticated, identity.Name)
+		}
+	} else {
+		return nil, ErrUnauthenticated
+	}
+
+	//a follower forwarding a write vouches for the client it authenticated
+	if forwarded := req.Header.Get(identityHeader); forwarded != "" && identity.Role == RolePeer {
+		var client Identity
+		if err := json.Unmarshal([]byte(forwarded), &client); err != nil || !validRole(client.Role) {
+			return nil, fmt.Errorf("%w: unreadable forwarded identity", ErrUnauthenticated)
+		}
+		client.Method = "forwarded by " + identity.Name
+		identity = &client
+	}
+	return identity, nil
+}
+
+func RouteAction(req *http.Request) (string, string) {
+	template := "unmatched"
+	if route := mux.CurrentRoute(req); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	if action, ok := routeActions[req.Method+" "+template]; ok {
+		return template, action
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return template, ActionRead
+	}
+	return template, ActionManage
+}
+
+func Authorize(identity *Identity, req *http.Request, action string) error {
+	allowed := false
+	for _, role := range actionRoles[action] {
+		if identity.Role == role {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("%w: %s may not %s", ErrForbidden, identity.Role, action)
+	}
+	//a monitor only reports for its own hosts
+	if action == ActionReport && identity.Role == RoleMonitor {
+		hostIP := mux.Vars(req)["hostip"]
+		for _, own := range identity.HostIPs {
+			if own == hostIP {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s reports for %s only", ErrForbidden, identity.Name, strings.Join(identity.HostIPs, ", "))
+	}
+	return nil
+}
+
+//middleware authenticating and authorizing every request when authentication is enabled
+func AuthenticateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if authenticator == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		route, action := RouteAction(req)
+		identity, err := authenticator.Authenticate(req)
+		if err == nil {
+			err = Authorize(identity, req, action)
+		}
+		if err != nil {
+			authenticator.audit.Deny(req, identity, route, action, err)
+			if errors.Is(err, ErrUnauthenticated) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hostregistry"`)
+			}
+			WriteError(w, err)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), identityKey{}, identity)))
+	})
+}
+
+type AuditRecord struct {
+	Time   time.Time `json:"time"`
+	Remote string    `json:"remote"`
+	Name   string    `json:"name,omitempty"`
+	Role   string    `json:"role,omitempty"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Route  string    `json:"route"`
+	Action string    `json:"action"`
+	Status int       `json:"status"`
+	Reason string    `json:"reason"`
+}
+
+type AuditLog struct {
+	mutex *sync.Mutex
+	file  *os.File
+}
+
+//appends to path, or logs when path is empty
+func OpenAuditLog(path string) (*AuditLog, error) {
+	audit := &AuditLog{mutex: &sync.Mutex{}}
+	if path == "" {
+		return audit, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	audit.file = file
+	return audit, nil
+}
+
+func (a *AuditLog) Deny(req *http.Request, identity *Identity, route string, action string, reason error) {
+	status, code := ErrorStatus(reason)
+	authDenied.Inc(code)
+	record := AuditRecord{Time: time.Now(), Remote: req.RemoteAddr, Method: req.Method, Path: req.URL.Path, Route: route, Action: action, Status: status, Reason: reason.Error()}
+	if identity != nil {
+		record.Name = identity.Name
+		record.Role = identity.Role
+	}
+	if a.file == nil {
+		log.Printf("audit: denied %s %s from %s (%s %s): %s", record.Method, record.Path, record.Remote, record.Role, record.Name, record.Reason)
+		return
+	}
+	line, _ := json.Marshal(record)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: could not write the record of %s %s: %v", record.Method, record.Path, err)
+	}
+}
+
+//server side TLS: client certificates are verified when given, tokens remain accepted without one
+func ServerTLSConfig(tlsConfig TLSConfig) (*tls.Config, error) {
+	if tlsConfig.Cert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(tlsConfig.Cert, tlsConfig.Key)
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if tlsConfig.ClientCA != "" {
+		if serverConfig.ClientCAs, err = loadCertPool(tlsConfig.ClientCA); err != nil {
+			return nil, err
+		}
+		serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return serverConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificate found", path)
+	}
+	return pool, nil
+}
+
+//client used to reach the other registries: it presents the certificate of the registry and the peer token
+func PeerClient(authConfig AuthConfig, timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if authConfig.TLS.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(authConfig.TLS.Cert, authConfig.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+		if authConfig.TLS.ClientCA != "" {
+			if transport.TLSClientConfig.RootCAs, err = loadCertPool(authConfig.TLS.ClientCA); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &http.Client{Timeout: timeout, Transport: &peerTransport{next: transport, token: authConfig.PeerToken}}, nil
+}
+
+type peerTransport struct {
+	next  http.RoundTripper
+	token string
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
+
+//sets up authentication from the configuration, before serving requests
+func InitAuth(authConfig AuthConfig) {
+	if !authConfig.Enabled() {
+		if authConfig.TLS.Cert != "" {
+			log.Printf("auth: serving https without authentication, no token or client CA is configured")
+		}
+		return
+	}
+	var err error
+	if authenticator, err = NewAuthenticator(authConfig); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//enables authentication with the tokens of the test, writing the audit log to the returned path
+func useAuth(t *testing.T) string {
+	t.Helper()
+	audit := filepath.Join(t.TempDir(), "audit.jsonl")
+	var err error
+	authenticator, err = NewAuthenticator(AuthConfig{Audit: audit, Tokens: []TokenConfig{
+		{Name: "monitor-1", Token: "m1", Role: RoleMonitor, HostIPs: []string{"10.0.0.1"}},
+		{Name: "scheduler", Token: "s1", Role: RoleScheduler},
+		{Name: "admin", Token: "a1", Role: RoleAdmin},
+		{Name: "n2", Token: "p1", Role: RolePeer},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		authenticator.audit.file.Close()
+		authenticator = nil
+	})
+	return audit
+}
+
+//sends a request through the router with the Authorization header given
+func serveAs(t *testing.T, registry *Registry, authorization string, method string, path string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	recorder := httptest.NewRecorder()
+	registry.Router().ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestAuthorizeRoutes(t *testing.T) {
+	useDefaultConfig(t)
+	audit := useAuth(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2")
+	utilization := `{"cpu":0.5,"memory":0.5}`
+
+	tests := []struct {
+		authorization string
+		method        string
+		path          string
+		body          string
+		status        int
+	}{
+		{"", http.MethodGet, "/v2/hosts", "", http.StatusUnauthorized},
+		{"Basic YWRtaW46YTE=", http.MethodGet, "/v2/hosts", "", http.StatusUnauthorized},
+		{"Bearer unknown", http.MethodGet, "/v2/hosts", "", http.StatusUnauthorized},
+		{"Bearer s1", http.MethodGet, "/v2/hosts", "", http.StatusOK},
+		{"Bearer m1", http.MethodGet, "/v2/hosts", "", http.StatusForbidden},
+		//a monitor only reports for its own hosts
+		{"Bearer m1", http.MethodPut, "/v2/hosts/10.0.0.1/utilization", utilization, http.StatusNoContent},
+		{"Bearer m1", http.MethodPut, "/v2/hosts/10.0.0.2/utilization", utilization, http.StatusForbidden},
+		{"Bearer m1", http.MethodGet, "/host/updateboth/10.0.0.2&0.5&0.5", "", http.StatusForbidden},
+		{"Bearer s1", http.MethodPut, "/v2/hosts/10.0.0.2/utilization", utilization, http.StatusForbidden},
+		{"Bearer a1", http.MethodPut, "/v2/hosts/10.0.0.2/utilization", utilization, http.StatusNoContent},
+		//the scheduler allocates, only the admin manages the hosts
+		{"Bearer s1", http.MethodPost, "/v2/hosts/10.0.0.2/allocations", `{"cpu":512,"memory":1024}`, http.StatusOK},
+		{"Bearer s1", http.MethodDelete, "/v2/hosts/10.0.0.2", "", http.StatusForbidden},
+		{"Bearer s1", http.MethodGet, "/host/createhost/10.0.0.3&1073741824&4", "", http.StatusForbidden},
+		{"Bearer a1", http.MethodGet, "/host/createhost/10.0.0.3&1073741824&4", "", http.StatusOK},
+		{"Bearer p1", http.MethodGet, "/v2/hosts", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		recorder := serveAs(t, registry, test.authorization, test.method, test.path, test.body)
+		if recorder.Code != test.status {
+			t.Errorf("%s %s as %q answered %d %s", test.method, test.path, test.authorization, recorder.Code, recorder.Body)
+		}
+		if test.status == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s as %q was answered without a challenge", test.method, test.path, test.authorization)
+		}
+	}
+
+	//every denial is audited
+	file, err := os.Open(audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []AuditRecord
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var record AuditRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 10 {
+		t.Fatalf("%d denials were audited, expected 10", len(records))
+	}
+	if record := records[4]; record.Name != "monitor-1" || record.Route != "/v2/hosts/{hostip}/utilization" || record.Action != ActionReport || record.Status != http.StatusForbidden {
+		t.Errorf("the denied report was audited as %+v", record)
+	}
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	useAuth(t)
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "monitor-7", OrganizationalUnit: []string{RoleMonitor}}, IPAddresses: []net.IP{net.ParseIP("10.0.0.7")}}
+	req := httptest.NewRequest(http.MethodPut, "/v2/hosts/10.0.0.7/utilization", nil)
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+
+	identity, err := authenticator.Authenticate(req)
+	if err != nil || identity.Name != "monitor-7" || identity.Role != RoleMonitor || len(identity.HostIPs) != 1 || identity.HostIPs[0] != "10.0.0.7" {
+		t.Fatalf("the certificate was authenticated as %+v, %v", identity, err)
+	}
+	certificate.Subject.OrganizationalUnit = []string{"operators"}
+	if _, err = authenticator.Authenticate(req); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("a certificate without a known role returned %v", err)
+	}
+}
+
+func TestAuthenticateForwardedIdentity(t *testing.T) {
+	useAuth(t)
+	req := httptest.NewRequest(http.MethodPost, "/v2/tasks", nil)
+	req.Header.Set(identityHeader, `{"name":"scheduler","role":"scheduler"}`)
+
+	//only a peer vouches for the client of a forwarded write
+	req.Header.Set("Authorization", "Bearer s1")
+	if identity, err := authenticator.Authenticate(req); err != nil || identity.Method != "token" {
+		t.Errorf("a client setting the forwarded identity was authenticated as %+v, %v", identity, err)
+	}
+	req.Header.Set("Authorization", "Bearer p1")
+	identity, err := authenticator.Authenticate(req)
+	if err != nil || identity.Role != RoleScheduler || identity.Method != "forwarded by n2" {
+		t.Errorf("a forwarded write was authenticated as %+v, %v", identity, err)
+	}
+	req.Header.Set(identityHeader, `{"name":"root","role":"root"}`)
+	if _, err = authenticator.Authenticate(req); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("a forwarded identity without a known role returned %v", err)
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	for name, auth := range map[string]AuthConfig{
+		"empty token":         {Tokens: []TokenConfig{{Name: "a", Role: RoleAdmin}}},
+		"token given twice":   {Tokens: []TokenConfig{{Name: "a", Token: "t", Role: RoleAdmin}, {Name: "b", Token: "t", Role: RoleScheduler}}},
+		"unknown role":        {Tokens: []TokenConfig{{Name: "a", Token: "t", Role: "root"}}},
+		"monitor of no host":  {Tokens: []TokenConfig{{Name: "a", Token: "t", Role: RoleMonitor}}},
+		"host not an address": {Tokens: []TokenConfig{{Name: "a", Token: "t", Role: RoleMonitor, HostIPs: []string{"host-1"}}}},
+		"cert without key":    {TLS: TLSConfig{Cert: "registry.pem"}},
+		"client ca alone":     {TLS: TLSConfig{ClientCA: "ca.pem"}},
+	} {
+		if err := auth.Validate(); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//the files the benchmarks leave, one entry per line. For every host <ip>Cpu.txt and <ip>Memory.txt with the
+//utilization in percent reported by the monitor and <ip>Time.txt with the time of each report as printed by Go, then
+//<ip>CPUAlloc.txt, <ip>MemoryAlloc.txt and <ip>TimeAlloc.txt with the utilization and the allocated resources whenever
+//an allocation changed. Cuts.txt and Kills.txt count the cuts, with the cpu shares and memory taken, and the kills
+
+const (
+	benchmarkCPUSuffix              = "Cpu.txt"
+	benchmarkMemorySuffix           = "Memory.txt"
+	benchmarkTimeSuffix             = "Time.txt"
+	benchmarkCPUAllocationSuffix    = "CPUAlloc.txt"
+	benchmarkMemoryAllocationSuffix = "MemoryAlloc.txt"
+	benchmarkTimeAllocationSuffix   = "TimeAlloc.txt"
+	benchmarkCutsFile               = "Cuts.txt"
+	benchmarkKillsFile              = "Kills.txt"
+)
+
+//layout of time.Time.String(), without the monotonic clock reading it may end with
+const goTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+type BenchmarkSample struct {
+	Time   time.Time
+	CPU    float64 //percent
+	Memory float64 //percent
+}
+
+type AllocationSample struct {
+	Time            time.Time
+	CPU             float64 //percent
+	Memory          float64 //percent
+	AllocatedCPUs   int64   //cpu shares
+	AllocatedMemory int64   //bytes
+}
+
+type BenchmarkCuts struct {
+	Cuts      int   `json:"cuts"`
+	CPUCut    int64 `json:"cpucut"` //cpu shares taken by all the cuts
+	MemoryCut int64 `json:"memorycut"`
+	Kills     int   `json:"kills"`
+}
+
+func ParseGoTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	return time.Parse(goTimeLayout, value)
+}
+
+//the hosts with utilization files in dir, by address
+func BenchmarkHosts(dir string) ([]string, error) {
+	return benchmarkPrefixes(dir, benchmarkCPUSuffix)
+}
+
+//the hosts with allocation files in dir, by address
+func AllocationHosts(dir string) ([]string, error) {
+	return benchmarkPrefixes(dir, benchmarkCPUAllocationSuffix)
+}
+
+func benchmarkPrefixes(dir string, suffix string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]string, 0, len(paths))
+	for _, path := range paths {
+		prefixes = append(prefixes, strings.TrimSuffix(filepath.Base(path), suffix))
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
+}
+
+//the samples of a host in the order they were taken. Files of different lengths are cut to the shortest one
+func ReadBenchmarkHost(dir string, hostIP string) ([]BenchmarkSample, error) {
+	cpu, err := readBenchmarkFile(filepath.Join(dir, hostIP+benchmarkCPUSuffix))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := readBenchmarkFile(filepath.Join(dir, hostIP+benchmarkMemorySuffix))
+	if err != nil {
+		return nil, err
+	}
+	times, err := readBenchmarkFile(filepath.Join(dir, hostIP+benchmarkTimeSuffix))
+	if err != nil {
+		return nil, err
+	}
+	count := min(len(cpu), len(memory), len(times))
+	if len(cpu) != count || len(memory) != count || len(times) != count {
+		log.Printf("benchmarks: %s has %d cpu, %d memory and %d time lines, using the first %d", hostIP, len(cpu), len(memory), len(times), count)
+	}
+
+	samples := make([]BenchmarkSample, 0, count)
+	for i := 0; i < count; i++ {
+		var sample BenchmarkSample
+		if sample.Time, err = ParseGoTime(times[i]); err != nil {
+			return nil, fmt.Errorf("benchmarks: %s%s line %d: %w", hostIP, benchmarkTimeSuffix, i+1, err)
+		}
+		if sample.CPU, err = strconv.ParseFloat(cpu[i], 64); err != nil {
+			return nil, fmt.Errorf("benchmarks: %s%s line %d: %w", hostIP, benchmarkCPUSuffix, i+1, err)
+		}
+		if sample.Memory, err = strconv.ParseFloat(memory[i], 64); err != nil {
+			return nil, fmt.Errorf("benchmarks: %s%s line %d: %w", hostIP, benchmarkMemorySuffix, i+1, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+//the allocation samples of a host in the order they were taken, from the "CPU usage: X CPU Allocated: Y" and
+//"Memory usage: X Memory allocated: Y" lines. Files of different lengths are cut to the shortest one
+func ReadAllocationHost(dir string, hostIP string) ([]AllocationSample, error) {
+	cpu, err := readBenchmarkFile(filepath.Join(dir, hostIP+benchmarkCPUAllocationSuffix))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := readBenchmarkFile(filepath.Join(dir, hostIP+benchmarkMemoryAllocationSuffix))
+	if err != nil {
+		return nil, err
+	}
+	times, err := readBenchmarkFile(filepath.Join(dir, hostIP+benchmarkTimeAllocationSuffix))
+	if err != nil {
+		return nil, err
+	}
+	count := min(len(cpu), len(memory), len(times))
+	if len(cpu) != count || len(memory) != count || len(times) != count {
+		log.Printf("benchmarks: %s has %d cpu, %d memory and %d time allocation lines, using the first %d", hostIP, len(cpu), len(memory), len(times), count)
+	}
+
+	samples := make([]AllocationSample, 0, count)
+	for i := 0; i < count; i++ {
+		var sample AllocationSample
+		if sample.Time, err = ParseGoTime(times[i]); err != nil {
+			return nil, fmt.Errorf("benchmarks: %s%s line %d: %w", hostIP, benchmarkTimeAllocationSuffix, i+1, err)
+		}
+		if _, err = fmt.Sscanf(cpu[i], "CPU usage: %g CPU Allocated: %d", &sample.CPU, &sample.AllocatedCPUs); err != nil {
+			return nil, fmt.Errorf("benchmarks: %s%s line %d: %w", hostIP, benchmarkCPUAllocationSuffix, i+1, err)
+		}
+		if _, err = fmt.Sscanf(memory[i], "Memory usage: %g Memory allocated: %d", &sample.Memory, &sample.AllocatedMemory); err != nil {
+			return nil, fmt.Errorf("benchmarks: %s%s line %d: %w", hostIP, benchmarkMemoryAllocationSuffix, i+1, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+//the totals of Cuts.txt and Kills.txt, zero for a missing file
+func ReadBenchmarkCuts(dir string) (BenchmarkCuts, error) {
+	var totals BenchmarkCuts
+	cuts, err := readBenchmarkFile(filepath.Join(dir, benchmarkCutsFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return totals, err
+	}
+	for i, line := range cuts {
+		var count int
+		var cpuCut, memoryCut int64
+		if _, err = fmt.Sscanf(line, "%d CPU cut: %d memory cut: %d", &count, &cpuCut, &memoryCut); err != nil {
+			return totals, fmt.Errorf("benchmarks: %s line %d: %w", benchmarkCutsFile, i+1, err)
+		}
+		totals.Cuts += count
+		totals.CPUCut += cpuCut
+		totals.MemoryCut += memoryCut
+	}
+
+	kills, err := readBenchmarkFile(filepath.Join(dir, benchmarkKillsFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return totals, err
+	}
+	for i, line := range kills {
+		count, err := strconv.Atoi(line)
+		if err != nil {
+			return totals, fmt.Errorf("benchmarks: %s line %d: %w", benchmarkKillsFile, i+1, err)
+		}
+		totals.Kills += count
+	}
+	return totals, nil
+}
+
+//the non empty lines of a file
+func readBenchmarkFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("benchmarks: %w", err)
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
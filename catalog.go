@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//workload templates describe how a rescheduled task of a given image is started. Args may use the placeholders
+//{port}, the port allocated to the task when the template exposes one, and {id}, a number unique to each reschedule
+
+type WorkloadTemplate struct {
+	Name       string   `json:"name"`  //what the scheduler sends as the task image, e.g. ffmpeg
+	Image      string   `json:"image"` //image actually run, e.g. jrottenberg/ffmpeg
+	Args       []string `json:"args,omitempty"`
+	ExposePort bool     `json:"exposeport,omitempty"` //the task listens on an allocated port published with the same number on the host
+	Volumes    []string `json:"volumes,omitempty"`    //host:container
+	WorkingDir string   `json:"workingdir,omitempty"`
+	Env        []string `json:"env,omitempty"`      //extra environment entries and swarm affinities/constraints
+	Makespan   int      `json:"makespan,omitempty"` //seconds, passed to the swarm scheduler as affinity:makespan
+}
+
+type Catalog struct {
+	mutex     *sync.RWMutex
+	path      string
+	templates map[string]WorkloadTemplate
+}
+
+var catalog = &Catalog{mutex: &sync.RWMutex{}, templates: make(map[string]WorkloadTemplate)}
+
+var placeholders = []string{"{port}", "{id}"}
+
+func (t WorkloadTemplate) Validate() []string {
+	problems := make([]string, 0)
+	if t.Name == "" {
+		problems = append(problems, "template without name")
+	}
+	if t.Image == "" {
+		problems = append(problems, t.Name+": image is required")
+	}
+	if t.Makespan < 0 {
+		problems = append(problems, t.Name+": makespan must not be negative")
+	}
+	for _, volume := range t.Volumes {
+		parts := strings.Split(volume, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+			problems = append(problems, fmt.Sprintf("%s: volume %q must be host:container[:mode]", t.Name, volume))
+		}
+	}
+	for _, arg := range t.Args {
+		remaining := arg
+		for _, placeholder := range placeholders {
+			remaining = strings.ReplaceAll(remaining, placeholder, "")
+		}
+		if strings.Contains(remaining, "{") && strings.Contains(remaining, "}") {
+			problems = append(problems, fmt.Sprintf("%s: argument %q has an unknown placeholder", t.Name, arg))
+		}
+		if strings.Contains(arg, "{port}") && !t.ExposePort {
+			problems = append(problems, fmt.Sprintf("%s: argument %q uses {port} but the template does not expose a port", t.Name, arg))
+		}
+	}
+	for _, entry := range t.Env {
+		if entry == "" || strings.HasPrefix(entry, "=") {
+			problems = append(problems, fmt.Sprintf("%s: invalid environment entry %q", t.Name, entry))
+		}
+	}
+	return problems
+}
+
+func ValidateTemplates(templates []WorkloadTemplate) []string {
+	problems := make([]string, 0)
+	names := make(map[string]bool)
+	for _, template := range templates {
+		problems = append(problems, template.Validate()...)
+		if names[template.Name] {
+			problems = append(problems, template.Name+": defined twice")
+		}
+		names[template.Name] = true
+	}
+	return problems
+}
+
+//builds the container of a rescheduled task from the template
+func (t WorkloadTemplate) Spec(task Task, port int, id int64) ContainerSpec {
+	replacer := strings.NewReplacer("{port}", strconv.Itoa(port), "{id}", strconv.FormatInt(id, 10))
+
+	spec := ContainerSpec{Image: t.Image, WorkingDir: t.WorkingDir, Volumes: append([]string{}, t.Volumes...)}
+	for _, arg := range t.Args {
+		spec.Cmd = append(spec.Cmd, replacer.Replace(arg))
+	}
+	if t.Makespan > 0 {
+		spec.Env = append(spec.Env, "affinity:makespan=="+strconv.Itoa(t.Makespan))
+	}
+	if t.ExposePort {
+		spec.Ports = []PortBinding{{HostPort: port, ContainerPort: port}}
+		spec.Env = append(spec.Env, "affinity:port=="+strconv.Itoa(port))
+	}
+	for _, entry := range t.Env {
+		spec.Env = append(spec.Env, replacer.Replace(entry))
+	}
+	spec.Env = append(spec.Env, "affinity:requestclass=="+task.TaskClass, "affinity:requesttype=="+task.TaskType)
+	return spec
+}
+
+func ReadTemplates(path string) ([]WorkloadTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var templates []WorkloadTemplate
+	if err = json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return templates, nil
+}
+
+//(re)loads the catalog file. An invalid file leaves the current templates in place
+func (c *Catalog) Load(path string) error {
+	templates, err := ReadTemplates(path)
+	if err != nil {
+		return err
+	}
+	if problems := ValidateTemplates(templates); len(problems) > 0 {
+		return fmt.Errorf("%s: %s", path, strings.Join(problems, "; "))
+	}
+
+	loaded := make(map[string]WorkloadTemplate)
+	for _, template := range templates {
+		loaded[template.Name] = template
+	}
+	c.mutex.Lock()
+	c.path = path
+	c.templates = loaded
+	c.mutex.Unlock()
+	log.Printf("catalog: loaded %d workload templates from %s", len(loaded), path)
+	return nil
+}
+
+func (c *Catalog) Reload() error {
+	c.mutex.RLock()
+	path := c.path
+	c.mutex.RUnlock()
+	return c.Load(path)
+}
+
+func (c *Catalog) Get(name string) (WorkloadTemplate, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	template, ok := c.templates[name]
+	return template, ok
+}
+
+func (c *Catalog) List() []WorkloadTemplate {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	templates := make([]WorkloadTemplate, 0, len(c.templates))
+	for _, template := range c.templates {
+		templates = append(templates, template)
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates
+}
+
+type CatalogValidation struct {
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
+
+func GetCatalog(w http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(w).Encode(catalog.List())
+}
+
+func ReloadCatalog(w http.ResponseWriter, req *http.Request) {
+	if err := catalog.Reload(); err != nil {
+		log.Printf("catalog: reload failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(CatalogValidation{Valid: false, Problems: []string{err.Error()}})
+		return
+	}
+	json.NewEncoder(w).Encode(catalog.List())
+}
+
+//checks a list of templates sent in the body without applying it
+func ValidateCatalog(w http.ResponseWriter, req *http.Request) {
+	var templates []WorkloadTemplate
+	if err := json.NewDecoder(req.Body).Decode(&templates); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(CatalogValidation{Valid: false, Problems: []string{err.Error()}})
+		return
+	}
+	problems := ValidateTemplates(templates)
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(CatalogValidation{Valid: len(problems) == 0, Problems: problems})
+}
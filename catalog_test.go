@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//puts the templates in a catalog of their own in place of the global one
+func useCatalog(t *testing.T, templates ...WorkloadTemplate) *Catalog {
+	t.Helper()
+	previous := catalog
+	catalog = &Catalog{mutex: &sync.RWMutex{}, templates: make(map[string]WorkloadTemplate)}
+	t.Cleanup(func() { catalog = previous })
+	if err := catalog.Load(writeTemplates(t, templates)); err != nil {
+		t.Fatal(err)
+	}
+	return catalog
+}
+
+func writeTemplates(t *testing.T, templates []WorkloadTemplate) string {
+	t.Helper()
+	data, err := json.Marshal(templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var redisTemplate = WorkloadTemplate{Name: "redis", Image: "library/redis", Args: []string{"--port", "{port}", "--dbfilename", "dump{id}.rdb"},
+	ExposePort: true, Makespan: 300, Env: []string{"constraint:disk==ssd"}}
+
+func TestTemplateSpec(t *testing.T) {
+	spec := redisTemplate.Spec(Task{TaskClass: "2", TaskType: "service"}, 11005, 7)
+	if spec.Image != "library/redis" || !reflect.DeepEqual(spec.Cmd, []string{"--port", "11005", "--dbfilename", "dump7.rdb"}) {
+		t.Errorf("the container runs %s %v", spec.Image, spec.Cmd)
+	}
+	if len(spec.Ports) != 1 || spec.Ports[0].HostPort != 11005 || spec.Ports[0].ContainerPort != 11005 {
+		t.Errorf("the container publishes %v", spec.Ports)
+	}
+	expected := []string{"affinity:makespan==300", "affinity:port==11005", "constraint:disk==ssd", "affinity:requestclass==2", "affinity:requesttype==service"}
+	if !reflect.DeepEqual(spec.Env, expected) {
+		t.Errorf("the container environment is %v", spec.Env)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	templates := []WorkloadTemplate{
+		redisTemplate,
+		{Name: "redis", Image: "redis"},
+		{Name: "noimage"},
+		{Name: "placeholder", Image: "busybox", Args: []string{"{host}"}},
+		{Name: "port", Image: "busybox", Args: []string{"{port}"}},
+		{Name: "volume", Image: "busybox", Volumes: []string{"/data"}},
+		{Name: "env", Image: "busybox", Env: []string{"=value"}},
+		{Name: "makespan", Image: "busybox", Makespan: -1},
+	}
+	problems := ValidateTemplates(templates)
+	for _, name := range []string{"redis: defined twice", "noimage", "placeholder", "port", "volume", "env", "makespan"} {
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, name)
+		}
+		if !found {
+			t.Errorf("no problem reported for %s in %v", name, problems)
+		}
+	}
+	if problems = ValidateTemplates([]WorkloadTemplate{redisTemplate}); len(problems) != 0 {
+		t.Errorf("a valid template has problems %v", problems)
+	}
+}
+
+func TestCatalogReloadKeepsTemplatesOfInvalidFile(t *testing.T) {
+	loaded := useCatalog(t, redisTemplate)
+	if err := os.WriteFile(loaded.path, []byte(`[{"name": "broken"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Reload(); err == nil {
+		t.Fatal("an invalid catalog was loaded")
+	}
+	if _, ok := loaded.Get("redis"); !ok || len(loaded.List()) != 1 {
+		t.Errorf("the templates were replaced by an invalid file: %v", loaded.List())
+	}
+}
+
+func TestRescheduleFromTemplate(t *testing.T) {
+	useDefaultConfig(t)
+	useCatalog(t, redisTemplate)
+	runtime := NewFakeRuntime()
+	registry := NewRegistry(runtime)
+	registry.background = func(update func()) { update() }
+	registerHosts(t, registry, "10.0.0.1")
+
+	result, err := registry.Reschedule(Task{Image: "redis", CPU: "512", Memory: "64m", TaskClass: "2", TaskType: "service", HostIP: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers := runtime.Containers()
+	if len(containers) != 1 || containers[0].Info.ID != result.ContainerID {
+		t.Fatalf("the runtime runs %v", containers)
+	}
+	spec := containers[0].Spec
+	if spec.Image != "library/redis" || spec.CPUShares != 512 || spec.Memory != 64<<20 || spec.Cmd[1] != strconv.Itoa(result.Port) {
+		t.Errorf("the task was started as %+v", spec)
+	}
+	if task, err := registry.tasks.Get(result.ContainerID); err != nil || task.CPU != 512 || task.Class != "2" {
+		t.Errorf("the task table holds %+v, %v", task, err)
+	}
+
+	if _, err = registry.Reschedule(Task{Image: "unknown", HostIP: "10.0.0.1"}); !errors.Is(err, ErrNoTemplate) {
+		t.Errorf("an image without template returned %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+package main
+
+//subcommands of the registry binary, run with their own flags instead of serving requests, e.g.
+//registry simulate -scenario scenario.json. They return the exit status
+var commands = map[string]func(args []string) int{
+	"simulate": RunSimulateCommand,
+	"replay":   RunReplayCommand,
+	"analyze":  RunAnalyzeCommand,
+}
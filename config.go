@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	OrderAscending  = "ascending"
+	OrderDescending = "descending"
+)
+
+var configFile = flag.String("config", "", "JSON file with the registry configuration (regions, ...). Built-in defaults are used when empty")
+
+//an energy region covers the hosts whose total resources utilization is in [Min, Max).
+//Max 0 on the last region means it is unbounded.
+type RegionConfig struct {
+	Name      string  `json:"name"`
+	Min       float64 `json:"min"`
+	Max       float64 `json:"max,omitempty"`
+	Order     string  `json:"order"`     //how the class lists of the region are sorted by total resources utilization
+	Placement bool    `json:"placement"` //hosts in this region are offered for initial scheduling and cuts
+	Kill      bool    `json:"kill"`      //hosts in this region are offered to the kill algorithm
+}
+
+type Config struct {
+	Regions []RegionConfig `json:"regions"`
+	Classes []string       `json:"classes"` //overbooking classes from the most to the least restrictive
+	//highest overbooking factor allowed on a host of each class. Classes missing here are not limited
+	Overbooking  map[string]float64 `json:"overbooking"`
+	Reservations ReservationConfig  `json:"reservations"`
+	Tasks        TaskConfig         `json:"tasks"`
+	Runtime      RuntimeConfig      `json:"runtime"`
+	Catalog      string             `json:"catalog"`     //file with the workload templates used for rescheduling
+	Ports        PortConfig         `json:"ports"`       //ports leased to rescheduled services
+	History      HistoryConfig      `json:"history"`     //where the utilization, allocation, cut and kill history is written
+	Power        PowerConfig        `json:"power"`       //power models of the hosts for the energy accounting
+	PowerStates  PowerStateConfig   `json:"powerstates"` //sleep and wake of the idle hosts
+
+	Replication ReplicationConfig `json:"replication"` //peers of a replicated registry
+	Auth        AuthConfig        `json:"auth"`        //tokens, certificates and audit of the clients
+}
+
+var config = DefaultConfig()
+
+//LEE=Lowest Energy Efficiency, DEE =Desired Energy Efficiency EED=Energy Efficiency Degradation
+func DefaultConfig() Config {
+	return Config{
+		Regions: []RegionConfig{
+			{Name: "LEE", Min: 0, Max: 0.5, Order: OrderDescending, Placement: true},
+			{Name: "DEE", Min: 0.5, Max: 0.85, Order: OrderDescending, Placement: true, Kill: true},
+			{Name: "EED", Min: 0.85, Order: OrderAscending, Kill: true},
+		},
+		Classes:      []string{"1", "2", "3", "4"},
+		Overbooking:  map[string]float64{"1": 1, "2": 1.25, "3": 1.5, "4": 2},
+		Reservations: ReservationConfig{DefaultTTL: "30s", MaxTTL: "10m"},
+		Tasks:        TaskConfig{Retention: "1h", TombstoneRetention: "10m"},
+		Runtime:      RuntimeConfig{Kind: "docker", Endpoint: "tcp://10.5.60.2:2377", Timeout: "30s", Retries: 1, RetryDelay: "5s"},
+		Catalog:      "catalog.json",
+		Ports:        PortConfig{PortRange: PortRange{From: 11000, To: 11998}},
+		History: HistoryConfig{
+			Sinks: []SinkConfig{
+				{Kind: "csv", Path: "history.csv"},
+				{Kind: "timeseries", Retention: "168h", RawRetention: "6h", DownsampleStep: "5m"},
+			},
+			Buffer:        4096,
+			FlushInterval: "1s",
+		},
+		Power:       PowerConfig{Models: map[string]PowerModel{"generic": {Idle: 100, Peak: 250}}, Default: "generic"},
+		PowerStates: PowerStateConfig{HookTimeout: "30s", MinIdle: "10m", MinSpare: 0.2, WakeTimeout: "5m", CheckInterval: "30s"},
+		Replication: ReplicationConfig{ElectionTimeout: "1s", HeartbeatInterval: "100ms", CommitTimeout: "5s", SnapshotEntries: 10000, Writes: WritesForward},
+	}
+}
+
+//reads the configuration file. Sections missing from the file keep their defaults
+func LoadConfig(path string) (Config, error) {
+	loaded := DefaultConfig()
+	if path == "" {
+		return loaded, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return loaded, err
+	}
+	//lists are replaced as a whole: decoding into the default ones would merge the file's entries into them
+	loaded.Regions = nil
+	loaded.Classes = nil
+	loaded.Overbooking = nil
+	loaded.History.Sinks = nil
+	loaded.Power = PowerConfig{}
+	if err = json.Unmarshal(data, &loaded); err != nil {
+		return loaded, fmt.Errorf("%s: %v", path, err)
+	}
+	defaults := DefaultConfig()
+	if len(loaded.Regions) == 0 {
+		loaded.Regions = defaults.Regions
+	}
+	if len(loaded.Classes) == 0 {
+		loaded.Classes = defaults.Classes
+	}
+	//the default limits are only meaningful for the default classes
+	if loaded.Overbooking == nil && len(loaded.Classes) == len(defaults.Classes) {
+		loaded.Overbooking = defaults.Overbooking
+		for _, class := range loaded.Classes {
+			if _, ok := defaults.Overbooking[class]; !ok {
+				loaded.Overbooking = nil
+				break
+			}
+		}
+	}
+	//an empty list of sinks disables the history, only a missing one keeps the default
+	if loaded.History.Sinks == nil {
+		loaded.History.Sinks = defaults.History.Sinks
+	}
+	//the generic model only applies when the file has none
+	if loaded.Power.Models == nil {
+		loaded.Power = defaults.Power
+	}
+	if err = loaded.Validate(); err != nil {
+		return loaded, fmt.Errorf("%s: %v", path, err)
+	}
+	return loaded, nil
+}
+
+func (c Config) Validate() error {
+	if len(c.Regions) == 0 {
+		return errors.New("at least one region is required")
+	}
+	names := make(map[string]bool)
+	for i, region := range c.Regions {
+		if region.Name == "" {
+			return fmt.Errorf("region %d has no name", i)
+		}
+		if names[region.Name] {
+			return fmt.Errorf("region %s is defined twice", region.Name)
+		}
+		names[region.Name] = true
+
+		if region.Order != OrderAscending && region.Order != OrderDescending {
+			return fmt.Errorf("region %s: order must be %q or %q", region.Name, OrderAscending, OrderDescending)
+		}
+		if i == 0 && region.Min != 0 {
+			return fmt.Errorf("region %s: the first region must start at 0", region.Name)
+		}
+		if i > 0 && region.Min != c.Regions[i-1].Max {
+			return fmt.Errorf("region %s: must start where region %s ends (%v)", region.Name, c.Regions[i-1].Name, c.Regions[i-1].Max)
+		}
+		if i < len(c.Regions)-1 && region.Max <= region.Min {
+			return fmt.Errorf("region %s: max must be greater than min", region.Name)
+		}
+		if i == len(c.Regions)-1 && region.Max != 0 && region.Max <= region.Min {
+			return fmt.Errorf("region %s: max must be greater than min or 0 for unbounded", region.Name)
+		}
+	}
+
+	if len(c.Classes) == 0 {
+		return errors.New("at least one class is required")
+	}
+	classes := make(map[string]bool)
+	for i, class := range c.Classes {
+		if class == "" {
+			return fmt.Errorf("class %d has no name", i)
+		}
+		if classes[class] {
+			return fmt.Errorf("class %s is defined twice", class)
+		}
+		classes[class] = true
+	}
+
+	for class, limit := range c.Overbooking {
+		if !classes[class] {
+			return fmt.Errorf("overbooking: unknown class %s", class)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("overbooking: the limit of class %s must be positive", class)
+		}
+	}
+	if err := c.Reservations.Validate(); err != nil {
+		return err
+	}
+	if err := c.Tasks.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Ports.Validate(); err != nil {
+		return err
+	}
+	for host, hostRange := range c.Ports.Hosts {
+		if err := hostRange.Validate(); err != nil {
+			return fmt.Errorf("host %s: %v", host, err)
+		}
+	}
+	if err := c.History.Validate(); err != nil {
+		return err
+	}
+	if err := c.Power.Validate(); err != nil {
+		return err
+	}
+	if err := c.PowerStates.Validate(); err != nil {
+		return err
+	}
+	if err := c.Replication.Validate(); err != nil {
+		return err
+	}
+	return c.Auth.Validate()
+}
+
+//returns the region a host with the given total resources utilization belongs to
+func RegionFor(utilization float64) RegionConfig {
+	for _, region := range config.Regions {
+		if utilization < region.Max || region.Max == 0 {
+			return region
+		}
+	}
+	//utilization above the last bounded region stays in the last region
+	return config.Regions[len(config.Regions)-1]
+}
+
+func RegionByName(name string) (RegionConfig, bool) {
+	for _, region := range config.Regions {
+		if region.Name == name {
+			return region, true
+		}
+	}
+	return RegionConfig{}, false
+}
+
+//regions whose hosts are offered for initial scheduling and cuts, from the least to the most utilized
+func PlacementRegions() []string {
+	names := make([]string, 0)
+	for _, region := range config.Regions {
+		if region.Placement {
+			names = append(names, region.Name)
+		}
+	}
+	return names
+}
+
+//regions whose hosts are offered to the kill algorithm, from the most to the least utilized
+func KillRegions() []string {
+	names := make([]string, 0)
+	for i := len(config.Regions) - 1; i >= 0; i-- {
+		if config.Regions[i].Kill {
+			names = append(names, config.Regions[i].Name)
+		}
+	}
+	return names
+}
+
+//position of a class in the configured order, 0 being the most restrictive class
+func ClassRank(class string) (int, bool) {
+	for i, configured := range config.Classes {
+		if configured == class {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+//highest overbooking factor allowed on a host of class, +Inf when the class is not limited
+func OverbookingLimit(class string) float64 {
+	if limit, ok := config.Overbooking[class]; ok {
+		return limit
+	}
+	return math.Inf(1)
+}
+
+//class of a host without tasks
+func LeastRestrictiveClass() string {
+	return config.Classes[len(config.Classes)-1]
+}
+
+//classes a task of requestClass can be placed on without cuts or kills: requestClass and every more restrictive class,
+//from the most restrictive one
+func NormalClasses(requestClass string) []string {
+	rank, ok := ClassRank(requestClass)
+	if !ok {
+		return nil
+	}
+	return append([]string{}, config.Classes[:rank+1]...)
+}
+
+//classes searched by the kill algorithm: requestClass first, then the less restrictive classes and finally
+//the more restrictive ones, closest first
+func KillClasses(requestClass string) []string {
+	rank, ok := ClassRank(requestClass)
+	if !ok {
+		return nil
+	}
+	classes := append([]string{}, config.Classes[rank:]...)
+	for i := rank - 1; i >= 0; i-- {
+		classes = append(classes, config.Classes[i])
+	}
+	return classes
+}
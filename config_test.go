@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const fourRegions = `{"regions": [
+	{"name": "COLD", "min": 0, "max": 0.3, "order": "ascending", "placement": true},
+	{"name": "WARM", "min": 0.3, "max": 0.6, "order": "descending", "placement": true},
+	{"name": "HOT", "min": 0.6, "max": 0.9, "order": "descending", "kill": true},
+	{"name": "MAX", "min": 0.9, "order": "ascending", "kill": true}
+]}`
+
+func loadTestConfig(t *testing.T, contents string) (Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadConfigRegions(t *testing.T) {
+	useDefaultConfig(t)
+	loaded, err := loadTestConfig(t, fourRegions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Regions) != 4 || !reflect.DeepEqual(loaded.Classes, DefaultConfig().Classes) {
+		t.Fatalf("loaded %d regions and classes %v", len(loaded.Regions), loaded.Classes)
+	}
+	config = loaded
+
+	for utilization, region := range map[float64]string{0: "COLD", 0.29: "COLD", 0.3: "WARM", 0.75: "HOT", 0.9: "MAX", 1.5: "MAX"} {
+		if got := RegionFor(utilization).Name; got != region {
+			t.Errorf("utilization %v is in %s, expected %s", utilization, got, region)
+		}
+	}
+	if placement := PlacementRegions(); !reflect.DeepEqual(placement, []string{"COLD", "WARM"}) {
+		t.Errorf("placement regions %v", placement)
+	}
+	if kill := KillRegions(); !reflect.DeepEqual(kill, []string{"MAX", "HOT"}) {
+		t.Errorf("kill regions %v", kill)
+	}
+}
+
+func TestConfigRejectsInvalidRegions(t *testing.T) {
+	tests := map[string]string{
+		"gap":         `{"regions": [{"name": "A", "min": 0, "max": 0.5, "order": "ascending"}, {"name": "B", "min": 0.6, "order": "ascending"}]}`,
+		"duplicate":   `{"regions": [{"name": "A", "min": 0, "max": 0.5, "order": "ascending"}, {"name": "A", "min": 0.5, "order": "ascending"}]}`,
+		"no name":     `{"regions": [{"min": 0, "order": "ascending"}]}`,
+		"bad order":   `{"regions": [{"name": "A", "min": 0, "order": "random"}]}`,
+		"late start":  `{"regions": [{"name": "A", "min": 0.1, "order": "ascending"}]}`,
+		"empty range": `{"regions": [{"name": "A", "min": 0, "max": 0, "order": "ascending"}, {"name": "B", "min": 0, "order": "ascending"}]}`,
+	}
+	for name, contents := range tests {
+		if _, err := loadTestConfig(t, contents); err == nil {
+			t.Errorf("%s: the configuration was accepted", name)
+		}
+	}
+}
+
+func TestHostsMoveBetweenConfiguredRegions(t *testing.T) {
+	useDefaultConfig(t)
+	loaded, err := loadTestConfig(t, fourRegions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = loaded
+	registry := newTestRegistry(t, "10.0.0.1")
+	class := LeastRestrictiveClass()
+
+	cpu, memory := 0.7, 0.2
+	if err = registry.SetUtilization("10.0.0.1", &cpu, &memory); err != nil {
+		t.Fatal(err)
+	}
+	if layout := registry.RegionLayout(); len(layout["HOT"][class]) != 1 {
+		t.Fatalf("a host at 0.7 is laid out as %v", layout)
+	}
+	if hostIPs := placementHosts(t, registry, class); len(hostIPs) != 0 {
+		t.Errorf("a host of a region without placement is offered for placement")
+	}
+	if killList, _ := registry.KillList(class); len(killList) != 1 {
+		t.Errorf("a host of a kill region is not offered to the kill algorithm")
+	}
+
+	cpu = 0.1
+	if err = registry.SetUtilization("10.0.0.1", &cpu, nil); err != nil {
+		t.Fatal(err)
+	}
+	if layout := registry.RegionLayout(); len(layout["COLD"][class]) != 1 {
+		t.Fatalf("a host at 0.2 is laid out as %v", layout)
+	}
+}
+
+const fiveClasses = `{"classes": ["gold", "silver", "bronze", "besteffort", "scavenger"], "overbooking": {"gold": 1, "silver": 1.5}}`
+
+func TestConfiguredClasses(t *testing.T) {
+	useDefaultConfig(t)
+	loaded, err := loadTestConfig(t, fiveClasses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = loaded
+
+	if normal := NormalClasses("bronze"); !reflect.DeepEqual(normal, []string{"gold", "silver", "bronze"}) {
+		t.Errorf("a bronze task is placed on %v", normal)
+	}
+	if kill := KillClasses("silver"); !reflect.DeepEqual(kill, []string{"silver", "bronze", "besteffort", "scavenger", "gold"}) {
+		t.Errorf("a silver task searches %v for kills", kill)
+	}
+	if NormalClasses("platinum") != nil || KillClasses("platinum") != nil {
+		t.Errorf("an unknown class has lists")
+	}
+	if OverbookingLimit("silver") != 1.5 || !math.IsInf(OverbookingLimit("bronze"), 1) {
+		t.Errorf("the limits are %v and %v", OverbookingLimit("silver"), OverbookingLimit("bronze"))
+	}
+	if LeastRestrictiveClass() != "scavenger" {
+		t.Errorf("the least restrictive class is %s", LeastRestrictiveClass())
+	}
+}
+
+func TestConfigRejectsInvalidClasses(t *testing.T) {
+	tests := map[string]string{
+		"duplicate":          `{"classes": ["a", "b", "a"]}`,
+		"no name":            `{"classes": ["a", ""]}`,
+		"unknown limit":      `{"classes": ["a", "b"], "overbooking": {"c": 2}}`,
+		"limit not positive": `{"classes": ["a", "b"], "overbooking": {"a": 0}}`,
+	}
+	for name, contents := range tests {
+		if _, err := loadTestConfig(t, contents); err == nil {
+			t.Errorf("%s: the configuration was accepted", name)
+		}
+	}
+}
+
+func TestHostsMoveBetweenConfiguredClasses(t *testing.T) {
+	useDefaultConfig(t)
+	loaded, err := loadTestConfig(t, fiveClasses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = loaded
+	registry := newTestRegistry(t, "10.0.0.1")
+	hostClass := func() string {
+		host, _ := registry.SnapshotHost("10.0.0.1")
+		return host.HostClass
+	}
+
+	if hostClass() != "scavenger" {
+		t.Fatalf("a new host is of class %s", hostClass())
+	}
+	if err = registry.RaiseHostClass("10.0.0.1", "silver"); err != nil || hostClass() != "silver" {
+		t.Fatalf("raising the class to silver returned %v, the host is %s", err, hostClass())
+	}
+	//a less restrictive task does not lower the class
+	if err = registry.RaiseHostClass("10.0.0.1", "bronze"); err != nil || hostClass() != "silver" {
+		t.Errorf("a bronze task returned %v, the host is %s", err, hostClass())
+	}
+	if err = registry.RaiseHostClass("10.0.0.1", "platinum"); !errors.Is(err, ErrUnknownClass) {
+		t.Errorf("an unknown class returned %v", err)
+	}
+	if layout := registry.RegionLayout(); len(layout[RegionFor(0).Name]["silver"]) != 1 {
+		t.Errorf("the host is laid out as %v", layout)
+	}
+}
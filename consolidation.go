@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+//consolidation: moves the tasks of the hosts of a low utilization region (LEE by default) to the hosts of the next
+//one (DEE) so the emptied hosts can be switched off. Hosts are emptied whole or not at all, the smallest first, and
+//their tasks go to the fullest destinations first, on hosts of the same or a more restrictive class with room under
+//the overbooking limit, as long as the utilization the task brings keeps the destination inside its region. That
+//utilization is estimated from the source host, each task taking the share of it given by its allocation. Only hosts
+//whose every task is known with its class and has a workload template can be emptied, and only the hosts that are on
+//receive tasks. The plan is computed on the current state and can be executed, the moves of a host stopping at its
+//first failure
+
+const (
+	MoveStatusPlanned = "planned"
+	MoveStatusDone    = "done"
+	MoveStatusFailed  = "failed"
+	MoveStatusSkipped = "skipped" //an earlier move of the same host failed
+)
+
+var migrationsTotal = NewCounterVec("hostregistry_migrations_total", "Task migrations of the consolidation by outcome.", "outcome")
+
+type ConsolidationRequest struct {
+	Source   string `json:"source,omitempty"`   //region emptied, the first one by default
+	Target   string `json:"target,omitempty"`   //region receiving the tasks, the one after the source by default
+	MaxMoves int    `json:"maxmoves,omitempty"` //moves planned at most, no limit when 0
+}
+
+type ConsolidationMove struct {
+	TaskID    string `json:"taskid"`
+	Image     string `json:"image"`
+	Class     string `json:"class"`
+	CPU       int64  `json:"cpu"`
+	Memory    int64  `json:"memory"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Status    string `json:"status"`
+	NewTaskID string `json:"newtaskid,omitempty"`
+	Landed    string `json:"landed,omitempty"` //host the runtime started the task on, when not the planned one
+	Error     string `json:"error,omitempty"`
+}
+
+type ConsolidationSource struct {
+	HostIP  string `json:"hostip"`
+	Tasks   int    `json:"tasks"`
+	Emptied bool   `json:"emptied"`          //by the plan, or already empty
+	Reason  string `json:"reason,omitempty"` //why the host is not emptied
+}
+
+type ConsolidationDestination struct {
+	HostIP      string  `json:"hostip"`
+	HostClass   string  `json:"hostclass"`
+	Utilization float64 `json:"totalresources"` //now
+	Estimated   float64 `json:"estimated"`      //once the planned tasks are there
+	Tasks       int     `json:"tasks"`          //planned to move there
+}
+
+type ConsolidationPlan struct {
+	Source       string                     `json:"source"`
+	Target       string                     `json:"target"`
+	Executed     bool                       `json:"executed"`
+	Emptied      int                        `json:"emptied"`
+	Moves        []ConsolidationMove        `json:"moves"`
+	Sources      []ConsolidationSource      `json:"sources"`
+	Destinations []ConsolidationDestination `json:"destinations"`
+}
+
+func (c *ConsolidationRequest) Validate() error {
+	if c.MaxMoves < 0 {
+		return &ValidationError{Field: "maxmoves", Message: "must not be negative"}
+	}
+	source := -1
+	for i, region := range config.Regions {
+		if region.Name == c.Source || (c.Source == "" && i == 0) {
+			source = i
+		}
+	}
+	if source < 0 {
+		return &ValidationError{Field: "source", Message: "unknown region " + c.Source}
+	}
+	c.Source = config.Regions[source].Name
+	if c.Target == "" {
+		if source+1 == len(config.Regions) {
+			return &ValidationError{Field: "target", Message: "the source is the last region, a target is required"}
+		}
+		c.Target = config.Regions[source+1].Name
+	}
+	if _, ok := RegionByName(c.Target); !ok {
+		return &ValidationError{Field: "target", Message: "unknown region " + c.Target}
+	}
+	if c.Target == c.Source {
+		return &ValidationError{Field: "target", Message: "must differ from the source"}
+	}
+	return nil
+}
+
+//a source host as found when planning
+type consolidationCandidate struct {
+	source    ConsolidationSource
+	allocated int64
+	cpu       float64 //utilization
+	memory    float64
+	totalCPUs int64
+	totalMem  int64
+	tasks     []TaskRecord
+}
+
+//a destination and what the plan puts on it
+type consolidationTarget struct {
+	host        *Host
+	destination ConsolidationDestination
+	totalCPUs   int64
+	totalMem    int64
+	cpu         float64 //estimated utilization
+	memory      float64
+	addedCPU    int64
+	addedMemory int64
+	registry    *Registry
+}
+
+//hosts of a region and class lists that are not dead, in list order
+func (r *Registry) regionHosts(region string) []*Host {
+	listHosts := make([]*Host, 0)
+	for _, class := range config.Classes {
+		r.locks[region].classHosts[class].Lock()
+		for _, host := range r.regions[region].classHosts[class] {
+			if host.Liveness != LivenessDead {
+				listHosts = append(listHosts, host)
+			}
+		}
+		r.locks[region].classHosts[class].Unlock()
+	}
+	return listHosts
+}
+
+func (r *Registry) PlanConsolidation(request ConsolidationRequest) ConsolidationPlan {
+	plan := ConsolidationPlan{Source: request.Source, Target: request.Target, Moves: make([]ConsolidationMove, 0),
+		Sources: make([]ConsolidationSource, 0), Destinations: make([]ConsolidationDestination, 0)}
+	target, _ := RegionByName(request.Target)
+
+	candidates := make([]*consolidationCandidate, 0)
+	for _, host := range r.regionHosts(request.Source) {
+		lock := r.LockHost(host)
+		if state := PowerStateOf(host); host.removed || host.Region != request.Source || state == PowerAsleep || state == PowerWaking {
+			lock.Unlock()
+			continue
+		}
+		check := r.CheckHostClass(host)
+		candidate := &consolidationCandidate{source: ConsolidationSource{HostIP: host.HostIP, Tasks: check.Tasks}, allocated: host.AllocatedCPUs,
+			cpu: host.CPU_Utilization, memory: host.MemoryUtilization, totalCPUs: host.TotalCPUs, totalMem: host.TotalMemory}
+		lock.Unlock()
+
+		if !check.Derivable {
+			candidate.source.Reason = check.Reason
+		} else {
+			candidate.tasks = r.tasks.List(host.HostIP, "", TaskStateRunning)
+			for _, task := range candidate.tasks {
+				if _, ok := catalog.Get(task.Image); !ok {
+					candidate.source.Reason = fmt.Sprintf("task %s has no workload template for image %s", task.ID, task.Image)
+					break
+				}
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].allocated == candidates[j].allocated {
+			return candidates[i].source.HostIP < candidates[j].source.HostIP
+		}
+		return candidates[i].allocated < candidates[j].allocated
+	})
+
+	targets := make([]*consolidationTarget, 0)
+	for _, host := range r.regionHosts(request.Target) {
+		lock := r.LockHost(host)
+		if !host.removed && host.Region == request.Target && PowerStateOf(host) == PowerOn {
+			targets = append(targets, &consolidationTarget{host: host, totalCPUs: host.TotalCPUs, totalMem: host.TotalMemory,
+				cpu: host.CPU_Utilization, memory: host.MemoryUtilization, registry: r,
+				destination: ConsolidationDestination{HostIP: host.HostIP, HostClass: host.HostClass, Utilization: host.TotalResourcesUtilization}})
+		}
+		lock.Unlock()
+	}
+	//the fullest first, so the tasks gather on as few hosts as possible
+	sort.SliceStable(targets, func(i, j int) bool {
+		if targets[i].destination.Utilization == targets[j].destination.Utilization {
+			return targets[i].destination.HostIP < targets[j].destination.HostIP
+		}
+		return targets[i].destination.Utilization > targets[j].destination.Utilization
+	})
+
+	for _, candidate := range candidates {
+		switch {
+		case candidate.source.Reason != "":
+		case len(candidate.tasks) == 0:
+			candidate.source.Emptied = true
+		case request.MaxMoves > 0 && len(plan.Moves)+len(candidate.tasks) > request.MaxMoves:
+			candidate.source.Reason = fmt.Sprintf("emptying it would go over the limit of %d moves", request.MaxMoves)
+		default:
+			moves, reason := candidate.place(targets, target)
+			if reason != "" {
+				candidate.source.Reason = reason
+			} else {
+				candidate.source.Emptied = true
+				plan.Moves = append(plan.Moves, moves...)
+			}
+		}
+		if candidate.source.Emptied {
+			plan.Emptied++
+		}
+		plan.Sources = append(plan.Sources, candidate.source)
+	}
+	for _, target := range targets {
+		target.destination.Estimated = math.Max(target.cpu, target.memory)
+		plan.Destinations = append(plan.Destinations, target.destination)
+	}
+	return plan
+}
+
+//places every task of a candidate on the targets, the biggest first, and keeps the placements only when they all
+//succeed. Returns why the host cannot be emptied otherwise
+func (c *consolidationCandidate) place(targets []*consolidationTarget, region RegionConfig) ([]ConsolidationMove, string) {
+	type placed struct {
+		target         *consolidationTarget
+		cpu, memory    float64
+		cpuShares, mem int64
+	}
+	sorted := append([]TaskRecord(nil), c.tasks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].CPU == sorted[j].CPU {
+			return sorted[i].Memory > sorted[j].Memory
+		}
+		return sorted[i].CPU > sorted[j].CPU
+	})
+
+	moves := make([]ConsolidationMove, 0, len(sorted))
+	undo := make([]placed, 0, len(sorted))
+	rollback := func() {
+		for _, p := range undo {
+			p.target.cpu -= p.cpu
+			p.target.memory -= p.memory
+			p.target.addedCPU -= p.cpuShares
+			p.target.addedMemory -= p.mem
+			p.target.destination.Tasks--
+		}
+	}
+	for _, task := range sorted {
+		//the share of the source utilization the task accounts for, on the scale of the destination
+		var used placed
+		for _, target := range targets {
+			used = placed{target: target, cpuShares: task.CPU, mem: task.Memory}
+			if c.allocated > 0 {
+				used.cpu = c.cpu * float64(task.CPU) / float64(c.allocated) * float64(c.totalCPUs) / float64(target.totalCPUs)
+			}
+			if allocatedMemory := c.allocatedMemory(); allocatedMemory > 0 {
+				used.memory = c.memory * float64(task.Memory) / float64(allocatedMemory) * float64(c.totalMem) / float64(target.totalMem)
+			}
+			if target.accepts(task, used.cpu, used.memory, region) {
+				break
+			}
+			used.target = nil
+		}
+		if used.target == nil {
+			rollback()
+			return nil, fmt.Sprintf("no host in %s can take task %s (%d cpu shares, %d bytes of memory, class %s)", region.Name, task.ID, task.CPU, task.Memory, task.Class)
+		}
+		used.target.cpu += used.cpu
+		used.target.memory += used.memory
+		used.target.addedCPU += task.CPU
+		used.target.addedMemory += task.Memory
+		used.target.destination.Tasks++
+		undo = append(undo, used)
+		moves = append(moves, ConsolidationMove{TaskID: task.ID, Image: task.Image, Class: task.Class, CPU: task.CPU, Memory: task.Memory,
+			From: task.HostIP, To: used.target.destination.HostIP, Status: MoveStatusPlanned})
+	}
+	return moves, ""
+}
+
+func (c *consolidationCandidate) allocatedMemory() int64 {
+	memory := int64(0)
+	for _, task := range c.tasks {
+		memory += task.Memory
+	}
+	return memory
+}
+
+//whether the target can take a task bringing cpu and memory utilization, with what is already planned on it
+func (t *consolidationTarget) accepts(task TaskRecord, cpu float64, memory float64, region RegionConfig) bool {
+	classOK := false
+	for _, class := range NormalClasses(task.Class) {
+		classOK = classOK || class == t.destination.HostClass
+	}
+	if !classOK {
+		return false
+	}
+	if region.Max > 0 && math.Max(t.cpu+cpu, t.memory+memory) >= region.Max {
+		return false
+	}
+	lock := t.registry.LockHost(t.host)
+	freeCPU, freeMemory := t.registry.reservations.FreeCapacity(t.host, CapacityLimit(t.host.HostClass, task.Class))
+	lock.Unlock()
+	return task.CPU <= freeCPU-t.addedCPU && task.Memory <= freeMemory-t.addedMemory
+}
+
+//performs the moves of a plan in order. The moves of a host stop at its first failure, the host is then not emptied
+func (r *Registry) ExecuteConsolidation(plan ConsolidationPlan) ConsolidationPlan {
+	plan.Executed = true
+	failed := make(map[string]string)
+	for i := range plan.Moves {
+		move := &plan.Moves[i]
+		if reason, ok := failed[move.From]; ok {
+			move.Status = MoveStatusSkipped
+			move.Error = reason
+			continue
+		}
+		migrated, err := r.MigrateTask(move.TaskID, move.To)
+		if migrated.ID != "" {
+			move.NewTaskID = migrated.ID
+			if migrated.HostIP != move.To {
+				move.Landed = migrated.HostIP
+			}
+		}
+		if err != nil {
+			move.Status = MoveStatusFailed
+			move.Error = err.Error()
+			failed[move.From] = fmt.Sprintf("move of task %s failed", move.TaskID)
+			migrationsTotal.Inc("failed")
+			continue
+		}
+		move.Status = MoveStatusDone
+		migrationsTotal.Inc("done")
+	}
+	for i := range plan.Sources {
+		if reason, ok := failed[plan.Sources[i].HostIP]; ok {
+			plan.Sources[i].Emptied = false
+			plan.Sources[i].Reason = reason
+			plan.Emptied--
+		}
+	}
+	return plan
+}
+
+//GET /v2/consolidation?source=&target=&maxmoves= plans without moving anything
+func (r *Registry) V2PlanConsolidation(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	request := ConsolidationRequest{Source: query.Get("source"), Target: query.Get("target")}
+	if value := query.Get("maxmoves"); value != "" {
+		if _, err := fmt.Sscan(value, &request.MaxMoves); err != nil {
+			WriteError(w, &ValidationError{Field: "maxmoves", Message: "must be an integer"})
+			return
+		}
+	}
+	if err := request.Validate(); err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, r.PlanConsolidation(request))
+}
+
+//POST /v2/consolidation plans and executes, the body is optional
+func (r *Registry) V2ExecuteConsolidation(w http.ResponseWriter, req *http.Request) {
+	var request ConsolidationRequest
+	if req.ContentLength != 0 {
+		if err := DecodeBody(req, &request); err != nil {
+			WriteError(w, err)
+			return
+		}
+	}
+	if err := request.Validate(); err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, r.ExecuteConsolidation(r.PlanConsolidation(request)))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+//a task of the batch template, running on a host reporting utilization
+type consolidationHost struct {
+	hostIP      string
+	tasks       []TaskRecord
+	utilization float64
+}
+
+//registers the hosts with their tasks and utilization, on a fake runtime that fails when told
+func newConsolidationRegistry(t *testing.T, hosts ...consolidationHost) (*Registry, *FakeRuntime) {
+	t.Helper()
+	useDefaultConfig(t)
+	useCatalog(t, WorkloadTemplate{Name: "batch", Image: "library/batch"})
+	runtime := NewFakeRuntime()
+	registry := NewRegistry(runtime)
+	registry.background = func(update func()) { update() }
+	for _, host := range hosts {
+		registerHosts(t, registry, host.hostIP)
+		for _, task := range host.tasks {
+			task.HostIP = host.hostIP
+			if err := registry.AllocateTask(task); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setUtilization(t, registry, host.hostIP, host.utilization, 0.1)
+	}
+	return registry, runtime
+}
+
+func batchTask(id string, image string, cpu int64) TaskRecord {
+	return TaskRecord{ID: id, Class: "4", Image: image, CPU: cpu, Memory: 64 << 20}
+}
+
+//10.0.0.1 to 10.0.0.4 in LEE: one small task, two tasks too busy to move, nothing and a task without template. In
+//DEE 10.0.0.10 and the slightly fuller 10.0.0.11
+func consolidationLayout() []consolidationHost {
+	return []consolidationHost{
+		{"10.0.0.1", []TaskRecord{batchTask("a1", "batch", 512)}, 0.2},
+		{"10.0.0.2", []TaskRecord{batchTask("b1", "batch", 1024), batchTask("b2", "batch", 1024)}, 0.4},
+		{"10.0.0.3", nil, 0.1},
+		{"10.0.0.4", []TaskRecord{batchTask("c1", "custom", 256)}, 0.3},
+		{"10.0.0.10", []TaskRecord{batchTask("d1", "batch", 1024)}, 0.6},
+		{"10.0.0.11", []TaskRecord{batchTask("e1", "batch", 1024)}, 0.62},
+	}
+}
+
+func TestConsolidationRequestValidate(t *testing.T) {
+	useDefaultConfig(t)
+	request := ConsolidationRequest{}
+	if err := request.Validate(); err != nil || request.Source != "LEE" || request.Target != "DEE" {
+		t.Errorf("the defaults are %+v: %v", request, err)
+	}
+	invalid := []ConsolidationRequest{{MaxMoves: -1}, {Source: "XYZ"}, {Source: "EED"}, {Target: "XYZ"}, {Source: "DEE", Target: "DEE"}}
+	for _, request := range invalid {
+		var validation *ValidationError
+		if err := request.Validate(); !errors.As(err, &validation) {
+			t.Errorf("%+v: %v", request, err)
+		}
+	}
+}
+
+func TestPlanConsolidation(t *testing.T) {
+	registry, _ := newConsolidationRegistry(t, consolidationLayout()...)
+	plan := registry.PlanConsolidation(ConsolidationRequest{Source: "LEE", Target: "DEE"})
+
+	//a1 brings 0.2 to the fullest destination, after that neither can take 0.2 twice more
+	if len(plan.Moves) != 1 || plan.Moves[0].TaskID != "a1" || plan.Moves[0].To != "10.0.0.11" || plan.Moves[0].Status != MoveStatusPlanned {
+		t.Fatalf("the moves are %+v", plan.Moves)
+	}
+	if plan.Emptied != 2 || len(plan.Sources) != 4 {
+		t.Fatalf("the sources are %+v", plan.Sources)
+	}
+	//by allocation, the smallest first
+	sources := make(map[string]ConsolidationSource)
+	for _, source := range plan.Sources {
+		sources[source.HostIP] = source
+	}
+	if plan.Sources[0].HostIP != "10.0.0.3" || !sources["10.0.0.3"].Emptied || !sources["10.0.0.1"].Emptied {
+		t.Errorf("the sources are %+v", plan.Sources)
+	}
+	if reason := sources["10.0.0.2"].Reason; sources["10.0.0.2"].Emptied || !strings.Contains(reason, "no host in DEE can take task b") {
+		t.Errorf("10.0.0.2 is left with %q", reason)
+	}
+	if reason := sources["10.0.0.4"].Reason; !strings.Contains(reason, "no workload template for image custom") {
+		t.Errorf("10.0.0.4 is left with %q", reason)
+	}
+
+	//b1 fitted on 10.0.0.10 before b2 failed, the rollback takes it off again
+	if len(plan.Destinations) != 2 {
+		t.Fatalf("the destinations are %+v", plan.Destinations)
+	}
+	fullest, other := plan.Destinations[0], plan.Destinations[1]
+	if fullest.HostIP != "10.0.0.11" || fullest.Tasks != 1 || !near(fullest.Estimated, 0.82) {
+		t.Errorf("10.0.0.11 is planned as %+v", fullest)
+	}
+	if other.Tasks != 0 || !near(other.Estimated, 0.6) {
+		t.Errorf("10.0.0.10 is planned as %+v", other)
+	}
+
+	//planning moves nothing
+	expectAllocated(t, registry, "10.0.0.1", 512)
+	expectAllocated(t, registry, "10.0.0.11", 1024)
+}
+
+func TestPlanConsolidationLimits(t *testing.T) {
+	layout := consolidationLayout()
+	//a class 1 task goes on no host of class 4
+	layout[0].tasks[0].Class = "1"
+	registry, _ := newConsolidationRegistry(t, layout[0], layout[4])
+	plan := registry.PlanConsolidation(ConsolidationRequest{Source: "LEE", Target: "DEE"})
+	if len(plan.Moves) != 0 || plan.Emptied != 0 || !strings.Contains(plan.Sources[0].Reason, "no host in DEE") {
+		t.Errorf("the plan is %+v", plan)
+	}
+
+	layout = consolidationLayout()
+	registry, _ = newConsolidationRegistry(t, layout[0], layout[1], layout[5])
+	plan = registry.PlanConsolidation(ConsolidationRequest{Source: "LEE", Target: "DEE", MaxMoves: 1})
+	if len(plan.Moves) != 1 || plan.Emptied != 1 || !strings.Contains(plan.Sources[1].Reason, "limit of 1 moves") {
+		t.Errorf("the plan is %+v", plan)
+	}
+}
+
+func TestExecuteConsolidation(t *testing.T) {
+	registry, _ := newConsolidationRegistry(t, consolidationLayout()...)
+	plan := registry.ExecuteConsolidation(registry.PlanConsolidation(ConsolidationRequest{Source: "LEE", Target: "DEE"}))
+	move := plan.Moves[0]
+	if !plan.Executed || plan.Emptied != 2 || move.Status != MoveStatusDone || move.NewTaskID == "" || move.Landed != "" {
+		t.Fatalf("the plan is %+v", plan)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 0)
+	expectAllocated(t, registry, "10.0.0.11", 1536)
+	if task, err := registry.tasks.Get("a1"); err != nil || task.State != TaskStateTerminated {
+		t.Errorf("the original task is %+v: %v", task, err)
+	}
+	if task, err := registry.tasks.Get(move.NewTaskID); err != nil || task.HostIP != "10.0.0.11" || task.State != TaskStateRunning {
+		t.Errorf("the copy is %+v: %v", task, err)
+	}
+}
+
+func TestExecuteConsolidationFailure(t *testing.T) {
+	registry, runtime := newConsolidationRegistry(t,
+		consolidationHost{"10.0.0.1", []TaskRecord{batchTask("a1", "batch", 512), batchTask("a2", "batch", 256)}, 0.1},
+		consolidationHost{"10.0.0.10", []TaskRecord{batchTask("d1", "batch", 1024)}, 0.6})
+	plan := registry.PlanConsolidation(ConsolidationRequest{Source: "LEE", Target: "DEE"})
+	if len(plan.Moves) != 2 || plan.Emptied != 1 {
+		t.Fatalf("the plan is %+v", plan)
+	}
+
+	//the moves of a host stop at its first failure, the host is not emptied
+	runtime.Fail("run", &RuntimeError{Op: "run", Kind: RuntimeErrUnavailable, Message: "the engine is down"})
+	plan = registry.ExecuteConsolidation(plan)
+	if plan.Moves[0].Status != MoveStatusFailed || plan.Moves[1].Status != MoveStatusSkipped || plan.Moves[1].Error != "move of task a1 failed" {
+		t.Errorf("the moves are %+v", plan.Moves)
+	}
+	if plan.Emptied != 0 || plan.Sources[0].Emptied || plan.Sources[0].Reason != "move of task a1 failed" {
+		t.Errorf("the sources are %+v", plan.Sources)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 768)
+	expectAllocated(t, registry, "10.0.0.10", 1024)
+}
+
+func TestConsolidationEndpoint(t *testing.T) {
+	registry, _ := newConsolidationRegistry(t, consolidationLayout()...)
+	var plan ConsolidationPlan
+	status, body := serve(t, registry, http.MethodGet, "/v2/consolidation", nil)
+	if status != http.StatusOK || json.Unmarshal(body, &plan) != nil || plan.Executed || len(plan.Moves) != 1 || plan.Source != "LEE" {
+		t.Fatalf("%d %s", status, body)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 512)
+
+	for _, query := range []string{"?maxmoves=some", "?maxmoves=-1", "?source=XYZ"} {
+		if status, body = serve(t, registry, http.MethodGet, "/v2/consolidation"+query, nil); status != http.StatusBadRequest {
+			t.Errorf("%s answered %d %s", query, status, body)
+		}
+	}
+
+	status, body = serve(t, registry, http.MethodPost, "/v2/consolidation", ConsolidationRequest{Target: "DEE"})
+	if status != http.StatusOK || json.Unmarshal(body, &plan) != nil || !plan.Executed || plan.Moves[0].Status != MoveStatusDone {
+		t.Fatalf("%d %s", status, body)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 0)
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//stream of registry changes served at /v2/events as server-sent events, or over a WebSocket when the request asks for
+//an upgrade. Every event gets a sequence number; the last events are kept so a client reconnecting with
+//Last-Event-ID (or ?since=) receives what it missed
+
+const (
+	EventHostCreated      = "host.created"
+	EventHostRemoved      = "host.removed"
+	EventRegionChanged    = "host.region"
+	EventClassChanged     = "host.class"
+	EventPowerChanged     = "host.power"
+	EventAllocation       = "host.allocation"
+	EventTaskCut          = "task.cut"
+	EventTaskKilled       = "task.killed"
+	EventTaskRescheduled  = "task.rescheduled"
+	EventTaskMigrated     = "task.migrated"
+	EventStreamGap        = "stream.gap" //events after the requested sequence number are no longer kept
+	subscriberBuffer      = 256
+	eventKeepAliveTimeout = 15 * time.Second
+)
+
+var eventHistory = flag.Int("eventhistory", 4096, "number of registry events kept for subscribers resuming a stream")
+
+type Event struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	HostIP    string    `json:"hostip,omitempty"`
+	Region    string    `json:"region,omitempty"`
+	HostClass string    `json:"hostclass,omitempty"`
+	From      string    `json:"from,omitempty"` //previous region, class, host or power state
+	To        string    `json:"to,omitempty"`
+	Host      *Host     `json:"host,omitempty"` //state of the host after the change
+	TaskID    string    `json:"taskid,omitempty"`
+	Image     string    `json:"image,omitempty"`
+	CPU       int64     `json:"cpu,omitempty"`    //allocated or cut cpu shares
+	Memory    int64     `json:"memory,omitempty"` //allocated or cut memory
+	Port      int       `json:"port,omitempty"`
+}
+
+//builds an event about a host from a copy of it. Must be called with the class lock of the host held
+func HostEvent(eventType string, host *Host) Event {
+	copied := *host
+	return Event{Type: eventType, HostIP: host.HostIP, Region: host.Region, HostClass: host.HostClass, Host: &copied}
+}
+
+//event about the host at hostIP, built under its class lock. A host that is not registered gives an event with its
+//address only
+func (r *Registry) HostEventAt(eventType string, hostIP string) Event {
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		return Event{Type: eventType, HostIP: hostIP}
+	}
+	lock := r.LockHost(host)
+	defer lock.Unlock()
+	return HostEvent(eventType, host)
+}
+
+//empty sets match everything
+type EventFilter struct {
+	Regions map[string]bool
+	Classes map[string]bool
+	Hosts   map[string]bool
+}
+
+func (f EventFilter) Match(event Event) bool {
+	if len(f.Hosts) > 0 && !f.Hosts[event.HostIP] {
+		return false
+	}
+	//a host leaving or entering a region or class is of interest to both sides
+	if len(f.Regions) > 0 && !f.Regions[event.Region] && !(event.Type == EventRegionChanged && (f.Regions[event.From] || f.Regions[event.To])) {
+		return false
+	}
+	if len(f.Classes) > 0 && !f.Classes[event.HostClass] && !(event.Type == EventClassChanged && (f.Classes[event.From] || f.Classes[event.To])) {
+		return false
+	}
+	return true
+}
+
+type EventSubscription struct {
+	Events chan Event //closed when the subscriber falls too far behind
+	filter EventFilter
+}
+
+type EventBroker struct {
+	mutex       *sync.Mutex
+	seq         uint64
+	keep        int
+	history     []Event
+	subscribers map[*EventSubscription]bool
+}
+
+func NewEventBroker(keep int) *EventBroker {
+	return &EventBroker{mutex: &sync.Mutex{}, keep: keep, subscribers: make(map[*EventSubscription]bool)}
+}
+
+func (b *EventBroker) Publish(event Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.seq++
+	event.Seq = b.seq
+	event.Time = Now()
+	b.history = append(b.history, event)
+	if len(b.history) >= 2*b.keep {
+		b.history = append([]Event{}, b.history[len(b.history)-b.keep:]...)
+	}
+
+	for subscription := range b.subscribers {
+		if !subscription.filter.Match(event) {
+			continue
+		}
+		select {
+		case subscription.Events <- event:
+		default:
+			//a slow subscriber must not hold the registry back, it can resume from its last sequence number
+			close(subscription.Events)
+			delete(b.subscribers, subscription)
+		}
+	}
+}
+
+//subscribes to the events after since. The kept events after since are returned to be sent first; gap is set when
+//some of them are no longer kept or when since is ahead of the stream, e.g. after a restart of the registry
+func (b *EventBroker) Subscribe(filter EventFilter, since uint64, resume bool) (subscription *EventSubscription, missed []Event, gap bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscription = &EventSubscription{Events: make(chan Event, subscriberBuffer), filter: filter}
+	b.subscribers[subscription] = true
+	if !resume {
+		return subscription, nil, false
+	}
+
+	kept := b.history
+	if len(kept) > b.keep {
+		kept = kept[len(kept)-b.keep:]
+	}
+	if since > b.seq || (len(kept) > 0 && kept[0].Seq > since+1) || (len(kept) == 0 && since < b.seq) {
+		gap = true
+	}
+	for _, event := range kept {
+		if event.Seq > since && filter.Match(event) {
+			missed = append(missed, event)
+		}
+	}
+	return subscription, missed, gap
+}
+
+func (b *EventBroker) Unsubscribe(subscription *EventSubscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscribers[subscription] {
+		close(subscription.Events)
+		delete(b.subscribers, subscription)
+	}
+}
+
+func (b *EventBroker) LastSeq() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.seq
+}
+
+func filterSet(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+//GET /v2/events?region=&class=&host=&since=. Filters take comma separated lists
+func (r *Registry) StreamEvents(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := EventFilter{Regions: filterSet(query.Get("region")), Classes: filterSet(query.Get("class")), Hosts: filterSet(query.Get("host"))}
+
+	resumeFrom := req.Header.Get("Last-Event-ID")
+	if since := query.Get("since"); since != "" {
+		resumeFrom = since
+	}
+	since := uint64(0)
+	if resumeFrom != "" {
+		parsed, err := strconv.ParseUint(resumeFrom, 10, 64)
+		if err != nil {
+			WriteError(w, &ValidationError{Field: "since", Message: "must be a sequence number"})
+			return
+		}
+		since = parsed
+	}
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		r.streamWebSocket(w, req, filter, since, resumeFrom != "")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, fmt.Errorf("streaming is not supported by the connection"))
+		return
+	}
+	subscription, missed, gap := r.events.Subscribe(filter, since, resumeFrom != "")
+	defer r.events.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if gap {
+		writeServerSentEvent(w, Event{Seq: r.events.LastSeq(), Type: EventStreamGap, Time: time.Now()})
+	}
+	for _, event := range missed {
+		writeServerSentEvent(w, event)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveTimeout)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, open := <-subscription.Events:
+			if !open { //fell behind, the client reconnects with its last sequence number
+				return
+			}
+			writeServerSentEvent(w, event)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event Event) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+}
+
+func (r *Registry) streamWebSocket(w http.ResponseWriter, req *http.Request, filter EventFilter, since uint64, resume bool) {
+	conn, err := UpgradeWebSocket(w, req)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "upgrade", Message: err.Error()})
+		return
+	}
+	defer conn.Close()
+
+	subscription, missed, gap := r.events.Subscribe(filter, since, resume)
+	defer r.events.Unsubscribe(subscription)
+
+	send := func(event Event) error {
+		data, _ := json.Marshal(event)
+		return conn.WriteText(data)
+	}
+	if gap {
+		if send(Event{Seq: r.events.LastSeq(), Type: EventStreamGap, Time: time.Now()}) != nil {
+			return
+		}
+	}
+	for _, event := range missed {
+		if send(event) != nil {
+			return
+		}
+	}
+
+	closed := conn.ReadUntilClose()
+	keepAlive := time.NewTicker(eventKeepAliveTimeout)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, open := <-subscription.Events:
+			if !open || send(event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if conn.Ping() != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventFilter(t *testing.T) {
+	filter := EventFilter{Regions: filterSet("LEE, DEE"), Classes: filterSet("1")}
+	tests := []struct {
+		event Event
+		match bool
+	}{
+		{Event{Type: EventAllocation, Region: "LEE", HostClass: "1"}, true},
+		{Event{Type: EventAllocation, Region: "LEE", HostClass: "2"}, false},
+		{Event{Type: EventAllocation, Region: "EDE", HostClass: "1"}, false},
+		//a host leaving a region or class of the filter is of interest to it
+		{Event{Type: EventRegionChanged, Region: "EDE", HostClass: "1", From: "LEE", To: "EDE"}, true},
+		{Event{Type: EventClassChanged, Region: "DEE", HostClass: "2", From: "1", To: "2"}, true},
+		{Event{Type: EventClassChanged, Region: "DEE", HostClass: "3", From: "2", To: "3"}, false},
+	}
+	for _, test := range tests {
+		if filter.Match(test.event) != test.match {
+			t.Errorf("matching %+v returned %t", test.event, !test.match)
+		}
+	}
+	if !(EventFilter{}).Match(Event{Type: EventHostCreated}) {
+		t.Errorf("an empty filter did not match")
+	}
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	broker := NewEventBroker(3)
+	for _, hostIP := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		broker.Publish(Event{Type: EventHostCreated, HostIP: hostIP})
+	}
+
+	subscription, missed, gap := broker.Subscribe(EventFilter{Hosts: filterSet("10.0.0.2,10.0.0.3")}, 1, true)
+	if gap || len(missed) != 2 || missed[0].Seq != 2 || missed[1].HostIP != "10.0.0.3" {
+		t.Fatalf("resuming after 1 returned %+v, gap %t", missed, gap)
+	}
+	broker.Publish(Event{Type: EventAllocation, HostIP: "10.0.0.1"})
+	broker.Publish(Event{Type: EventAllocation, HostIP: "10.0.0.2"})
+	if event := <-subscription.Events; event.Seq != 5 || event.HostIP != "10.0.0.2" {
+		t.Errorf("the subscriber got %+v", event)
+	}
+	broker.Unsubscribe(subscription)
+	if _, open := <-subscription.Events; open {
+		t.Errorf("an unsubscribed subscription is still open")
+	}
+
+	//events no longer kept, or a sequence number from before a restart, are reported as a gap
+	if _, missed, gap = broker.Subscribe(EventFilter{}, 1, true); !gap || len(missed) != 3 || missed[0].Seq != 3 {
+		t.Errorf("resuming after a dropped event returned %+v, gap %t", missed, gap)
+	}
+	if _, missed, gap = broker.Subscribe(EventFilter{}, 9, true); !gap || len(missed) != 0 {
+		t.Errorf("resuming ahead of the stream returned %+v, gap %t", missed, gap)
+	}
+}
+
+func TestEventBrokerDropsSlowSubscriber(t *testing.T) {
+	broker := NewEventBroker(1)
+	subscription, _, _ := broker.Subscribe(EventFilter{}, 0, false)
+	for i := 0; i <= subscriberBuffer; i++ {
+		broker.Publish(Event{Type: EventAllocation, HostIP: "10.0.0.1"})
+	}
+	received := 0
+	for range subscription.Events {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("the slow subscriber got %d events before being dropped", received)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	server := httptest.NewServer(registry.Router())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v2/events?host=10.0.0.2", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("the stream was answered with %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	//the stream is subscribed once the headers are sent, the event of the other host is filtered out
+	registerHosts(t, registry, "10.0.0.3", "10.0.0.2")
+	reader := bufio.NewReader(resp.Body)
+	fields := make(map[string]string)
+	for len(fields) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, value, ok := strings.Cut(strings.TrimSuffix(line, "\n"), ": "); ok {
+			fields[name] = value
+		}
+	}
+	var event Event
+	if err = json.Unmarshal([]byte(fields["data"]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if fields["id"] != "3" || fields["event"] != EventHostCreated || event.HostIP != "10.0.0.2" || event.Host == nil || event.Host.TotalCPUs != 4*1024 {
+		t.Errorf("the stream sent %v", fields)
+	}
+
+	if status, body := serve(t, registry, http.MethodGet, "/v2/events?since=last", nil); status != http.StatusBadRequest || errorCode(t, body) != "invalid_argument" {
+		t.Errorf("an invalid sequence number was answered with %d %s", status, body)
+	}
+}
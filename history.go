@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//history of the utilization and allocations of the hosts and of the cuts and kills, kept for post analysis.
+//Records are queued and written to the configured sinks by a background goroutine so the handlers never wait for
+//the disk; when the queue is full records are dropped and counted instead
+
+const (
+	RecordUtilization = "utilization"
+	RecordAllocation  = "allocation"
+	RecordCut         = "cut"
+	RecordKill        = "kill"
+)
+
+type HistoryRecord struct {
+	Time            time.Time `json:"time"`
+	Kind            string    `json:"kind"`
+	HostIP          string    `json:"hostip,omitempty"`
+	CPU             float64   `json:"cpu"`    //utilization, from 0 to 1
+	Memory          float64   `json:"memory"` //utilization, from 0 to 1
+	AllocatedCPUs   int64     `json:"allocatedcpus,omitempty"`
+	AllocatedMemory int64     `json:"allocatedmemory,omitempty"`
+	CPUCut          int64     `json:"cpucut,omitempty"`
+	MemoryCut       int64     `json:"memorycut,omitempty"`
+}
+
+type HistorySink interface {
+	//writes a batch of records in the order they were taken
+	Write(records []HistoryRecord) error
+	Close() error
+}
+
+type SinkConfig struct {
+	Kind string `json:"kind"`           //csv, jsonl, ring or timeseries
+	Path string `json:"path,omitempty"` //file of the csv and jsonl sinks, appended to
+	Size int    `json:"size,omitempty"` //records kept by the ring sink
+
+	//timeseries sink, durations such as 168h
+	Retention      string `json:"retention,omitempty"`      //how long samples are kept at all
+	RawRetention   string `json:"rawretention,omitempty"`   //how long samples are kept before being downsampled
+	DownsampleStep string `json:"downsamplestep,omitempty"` //width of the downsampled buckets
+}
+
+type HistoryConfig struct {
+	Sinks         []SinkConfig `json:"sinks"`
+	Buffer        int          `json:"buffer"`        //records queued before new ones are dropped
+	FlushInterval string       `json:"flushinterval"` //longest time a record waits in the queue, e.g. 1s
+}
+
+func (h HistoryConfig) Validate() error {
+	if h.Buffer <= 0 {
+		return fmt.Errorf("history: buffer must be positive")
+	}
+	if _, err := time.ParseDuration(h.FlushInterval); err != nil {
+		return fmt.Errorf("history: flushinterval: %v", err)
+	}
+	for i, sink := range h.Sinks {
+		switch sink.Kind {
+		case "csv", "jsonl":
+			if sink.Path == "" {
+				return fmt.Errorf("history sink %d: %s sink needs a path", i, sink.Kind)
+			}
+		case "ring":
+			if sink.Size <= 0 {
+				return fmt.Errorf("history sink %d: ring sink needs a positive size", i)
+			}
+		case "timeseries":
+			if err := validTimeSeriesConfig(sink); err != nil {
+				return fmt.Errorf("history sink %d: %v", i, err)
+			}
+		default:
+			return fmt.Errorf("history sink %d: unknown kind %q", i, sink.Kind)
+		}
+	}
+	return nil
+}
+
+func NewHistorySink(sinkConfig SinkConfig) (HistorySink, error) {
+	switch sinkConfig.Kind {
+	case "csv":
+		return NewCSVSink(sinkConfig.Path)
+	case "jsonl":
+		return NewJSONLSink(sinkConfig.Path)
+	case "ring":
+		return NewRingSink(sinkConfig.Size), nil
+	case "timeseries":
+		return NewTimeSeriesStore(sinkConfig)
+	}
+	return nil, fmt.Errorf("unknown history sink %q", sinkConfig.Kind)
+}
+
+var csvHeader = []string{"time", "kind", "hostip", "cpu", "memory", "allocatedcpus", "allocatedmemory", "cpucut", "memorycut"}
+
+type CSVSink struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+//appends to path, writing the header when the file is new
+func NewCSVSink(path string) (*CSVSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sink := &CSVSink{file: file, writer: csv.NewWriter(file)}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		sink.writer.Write(csvHeader)
+		sink.writer.Flush()
+	}
+	return sink, nil
+}
+
+func (s *CSVSink) Write(records []HistoryRecord) error {
+	for _, record := range records {
+		s.writer.Write([]string{
+			record.Time.Format(time.RFC3339Nano),
+			record.Kind,
+			record.HostIP,
+			strconv.FormatFloat(record.CPU, 'f', -1, 64),
+			strconv.FormatFloat(record.Memory, 'f', -1, 64),
+			strconv.FormatInt(record.AllocatedCPUs, 10),
+			strconv.FormatInt(record.AllocatedMemory, 10),
+			strconv.FormatInt(record.CPUCut, 10),
+			strconv.FormatInt(record.MemoryCut, 10),
+		})
+	}
+	s.writer.Flush()
+	return s.writer.Error()
+}
+
+func (s *CSVSink) Close() error {
+	s.writer.Flush()
+	return s.file.Close()
+}
+
+type JSONLSink struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func NewJSONLSink(path string) (*JSONLSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLSink{file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (s *JSONLSink) Write(records []HistoryRecord) error {
+	encoder := json.NewEncoder(s.writer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return s.writer.Flush()
+}
+
+func (s *JSONLSink) Close() error {
+	s.writer.Flush()
+	return s.file.Close()
+}
+
+//keeps the last records in memory, served at /history/records
+type RingSink struct {
+	mutex   *sync.Mutex
+	records []HistoryRecord
+	next    int
+	full    bool
+}
+
+func NewRingSink(size int) *RingSink {
+	return &RingSink{mutex: &sync.Mutex{}, records: make([]HistoryRecord, size)}
+}
+
+func (s *RingSink) Write(records []HistoryRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, record := range records {
+		s.records[s.next] = record
+		s.next = (s.next + 1) % len(s.records)
+		if s.next == 0 {
+			s.full = true
+		}
+	}
+	return nil
+}
+
+func (s *RingSink) Close() error {
+	return nil
+}
+
+//records from the oldest to the newest
+func (s *RingSink) Records() []HistoryRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.full {
+		return append([]HistoryRecord{}, s.records[:s.next]...)
+	}
+	return append(append([]HistoryRecord{}, s.records[s.next:]...), s.records[:s.next]...)
+}
+
+type HistoryRecorder struct {
+	queue         chan HistoryRecord
+	sinks         []HistorySink
+	sinkKinds     []string
+	flushInterval time.Duration
+	flush         chan chan struct{}
+}
+
+var historyDropped = NewCounterVec("hostregistry_history_dropped_total", "History records dropped because the queue was full.")
+var historyErrors = NewCounterVec("hostregistry_history_write_errors_total", "Failed writes of history batches by sink kind.", "sink")
+
+func NewHistoryRecorder(historyConfig HistoryConfig) (*HistoryRecorder, error) {
+	flushInterval, err := time.ParseDuration(historyConfig.FlushInterval)
+	if err != nil {
+		return nil, err
+	}
+	recorder := &HistoryRecorder{queue: make(chan HistoryRecord, historyConfig.Buffer), flushInterval: flushInterval, flush: make(chan chan struct{})}
+	for _, sinkConfig := range historyConfig.Sinks {
+		sink, err := NewHistorySink(sinkConfig)
+		if err != nil {
+			for _, opened := range recorder.sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("history sink %s: %v", sinkConfig.Kind, err)
+		}
+		recorder.sinks = append(recorder.sinks, sink)
+		recorder.sinkKinds = append(recorder.sinkKinds, sinkConfig.Kind)
+	}
+	go recorder.run()
+	return recorder, nil
+}
+
+//queues a record without ever blocking. A nil recorder records nothing
+func (r *HistoryRecorder) Record(record HistoryRecord) {
+	if r == nil || len(r.sinks) == 0 {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = Now()
+	}
+	select {
+	case r.queue <- record:
+	default:
+		historyDropped.Inc()
+	}
+}
+
+func (r *HistoryRecorder) run() {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]HistoryRecord, 0, cap(r.queue))
+	for {
+		select {
+		case record := <-r.queue:
+			batch = append(batch, record)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-r.flush:
+			//take whatever is queued right now
+			for queued := len(r.queue); queued > 0; queued-- {
+				batch = append(batch, <-r.queue)
+			}
+			r.write(batch)
+			batch = batch[:0]
+			close(done)
+			continue
+		}
+		r.write(batch)
+		batch = batch[:0]
+	}
+}
+
+func (r *HistoryRecorder) write(batch []HistoryRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	for i, sink := range r.sinks {
+		if err := sink.Write(batch); err != nil {
+			historyErrors.Inc(r.sinkKinds[i])
+			log.Printf("history: %s sink: %v", r.sinkKinds[i], err)
+		}
+	}
+}
+
+//writes the queued records now, used before exiting
+func (r *HistoryRecorder) Flush() {
+	if r == nil {
+		return
+	}
+	done := make(chan struct{})
+	r.flush <- done
+	<-done
+}
+
+//the first ring sink configured, if any
+func (r *HistoryRecorder) Ring() *RingSink {
+	if r == nil {
+		return nil
+	}
+	for _, sink := range r.sinks {
+		if ring, ok := sink.(*RingSink); ok {
+			return ring
+		}
+	}
+	return nil
+}
+
+//records kept by the ring sink, optionally only the ones of ?host= and ?kind=
+func (r *Registry) GetHistoryRecords(w http.ResponseWriter, req *http.Request) {
+	ring := r.history.Ring()
+	if ring == nil {
+		WriteJSON(w, http.StatusNotFound, ErrorDocument{Status: http.StatusNotFound, Code: "no_ring_sink", Message: "no ring history sink is configured"})
+		return
+	}
+	hostIP := req.URL.Query().Get("host")
+	kind := req.URL.Query().Get("kind")
+	records := make([]HistoryRecord, 0)
+	for _, record := range ring.Records() {
+		if (hostIP == "" || record.HostIP == hostIP) && (kind == "" || record.Kind == kind) {
+			records = append(records, record)
+		}
+	}
+	WriteJSON(w, http.StatusOK, records)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRingSinkKeepsLastRecords(t *testing.T) {
+	ring := NewRingSink(3)
+	if records := ring.Records(); len(records) != 0 {
+		t.Fatalf("an empty ring returned %v", records)
+	}
+	for _, hostIP := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		ring.Write([]HistoryRecord{{Kind: RecordKill, HostIP: hostIP}})
+	}
+	records := ring.Records()
+	if len(records) != 3 || records[0].HostIP != "10.0.0.2" || records[2].HostIP != "10.0.0.4" {
+		t.Errorf("the ring kept %v", records)
+	}
+}
+
+func TestHistoryConfigValidate(t *testing.T) {
+	valid := HistoryConfig{Buffer: 16, FlushInterval: "1s", Sinks: []SinkConfig{{Kind: "csv", Path: "history.csv"}, {Kind: "ring", Size: 8}}}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("a valid history configuration returned %v", err)
+	}
+	for name, sinks := range map[string][]SinkConfig{
+		"csv without a path": {{Kind: "csv"}},
+		"empty ring":         {{Kind: "ring"}},
+		"unknown kind":       {{Kind: "syslog"}},
+	} {
+		invalid := valid
+		invalid.Sinks = sinks
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
+
+func TestHistoryRecordedToSinks(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	dir := t.TempDir()
+	recorder, err := NewHistoryRecorder(HistoryConfig{Buffer: 16, FlushInterval: "1h", Sinks: []SinkConfig{
+		{Kind: "csv", Path: filepath.Join(dir, "history.csv")},
+		{Kind: "jsonl", Path: filepath.Join(dir, "history.jsonl")},
+		{Kind: "ring", Size: 8},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2")
+	registry.history = recorder
+
+	cpu, memory := 0.5, 0.25
+	if err = registry.SetUtilization("10.0.0.1", &cpu, &memory); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(1)
+	if err = registry.AllocateResources("10.0.0.2", 1024, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Flush()
+
+	//the csv sink writes its header once, then a row per record
+	file, err := os.Open(filepath.Join(dir, "history.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil || len(rows) != 3 || rows[0][0] != "time" {
+		t.Fatalf("the csv sink wrote %v, %v", rows, err)
+	}
+	if rows[1][1] != RecordUtilization || rows[1][2] != "10.0.0.1" || rows[1][3] != "0.5" || rows[2][1] != RecordAllocation || rows[2][5] != "1024" {
+		t.Errorf("the csv sink wrote %v", rows[1:])
+	}
+
+	file, err = os.Open(filepath.Join(dir, "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var records []HistoryRecord
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var record HistoryRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 || !records[0].Time.Equal(clock.now.Add(-1)) || records[1].AllocatedMemory != 256<<20 {
+		t.Errorf("the jsonl sink wrote %+v", records)
+	}
+
+	//the ring sink is served, filtered by host and kind
+	status, body := serve(t, registry, http.MethodGet, "/v2/history/records?kind="+RecordAllocation, nil)
+	records = nil
+	if json.Unmarshal(body, &records); status != http.StatusOK || len(records) != 1 || records[0].HostIP != "10.0.0.2" {
+		t.Errorf("the allocation records were answered with %d %s", status, body)
+	}
+	status, body = serve(t, registry, http.MethodGet, "/v2/history/records?host=10.0.0.3", nil)
+	if status != http.StatusOK || string(body) != "[]\n" {
+		t.Errorf("the records of an unknown host were answered with %d %s", status, body)
+	}
+}
+
+func TestHistoryRecordsWithoutRing(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t)
+	status, body := serve(t, registry, http.MethodGet, "/v2/history/records", nil)
+	if status != http.StatusNotFound || errorCode(t, body) != "no_ring_sink" {
+		t.Errorf("the records without a ring sink were answered with %d %s", status, body)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+//the class of a host derived from the task table: the most restrictive class of its running tasks, the least
+//restrictive class when it runs none. It can only be derived when the table accounts for everything allocated on the
+//host and every task there has a class, otherwise the class stays the one given by the scheduler. Hosts are moved to
+//their derived class whenever a known task arrives or terminates
+
+type ClassCheck struct {
+	HostIP          string `json:"hostip"`
+	Region          string `json:"region"`
+	HostClass       string `json:"hostclass"`
+	DerivedClass    string `json:"derivedclass,omitempty"`
+	Derivable       bool   `json:"derivable"`
+	Consistent      bool   `json:"consistent"`
+	Reason          string `json:"reason,omitempty"` //why the class cannot be derived
+	Tasks           int    `json:"tasks"`
+	AllocatedCPUs   int64  `json:"allocatedcpus"`
+	AllocatedMemory int64  `json:"allocatedmemory"`
+	TaskCPUs        int64  `json:"taskcpus"` //held by the running tasks of the host
+	TaskMemory      int64  `json:"taskmemory"`
+}
+
+//compares the class of a host with the one of its running tasks. Must be called with the class lock of the host held
+func (r *Registry) CheckHostClass(host *Host) ClassCheck {
+	check := ClassCheck{HostIP: host.HostIP, Region: host.Region, HostClass: host.HostClass, AllocatedCPUs: host.AllocatedCPUs, AllocatedMemory: host.AllocatedMemory}
+	derivedRank := len(config.Classes) - 1
+	unclassified := 0
+	for _, task := range r.tasks.List(host.HostIP, "", TaskStateRunning) {
+		check.Tasks++
+		check.TaskCPUs += task.CPU
+		check.TaskMemory += task.Memory
+		if rank, known := ClassRank(task.Class); known {
+			derivedRank = min(derivedRank, rank)
+		} else {
+			unclassified++
+		}
+	}
+
+	switch {
+	case check.TaskCPUs != check.AllocatedCPUs || check.TaskMemory != check.AllocatedMemory:
+		check.Reason = fmt.Sprintf("the running tasks hold %d cpu shares and %d bytes of memory, the host has %d and %d allocated",
+			check.TaskCPUs, check.TaskMemory, check.AllocatedCPUs, check.AllocatedMemory)
+	case unclassified > 0:
+		check.Reason = fmt.Sprintf("%d running tasks have no class", unclassified)
+	default:
+		check.Derivable = true
+		check.DerivedClass = config.Classes[derivedRank]
+		check.Consistent = check.DerivedClass == check.HostClass
+	}
+	return check
+}
+
+//moves a host to the class of its running tasks when it can be derived and differs from its current one
+func (r *Registry) ReconcileHostClass(hostIP string) error {
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		return err
+	}
+	lock := r.LockHost(host)
+	if host.removed {
+		lock.Unlock()
+		return fmt.Errorf("%w: %s", ErrUnknownHost, hostIP)
+	}
+	check := r.CheckHostClass(host)
+	lock.Unlock()
+
+	if check.Derivable && !check.Consistent {
+		r.UpdateHostList(check.HostClass, check.DerivedClass, host)
+	}
+	return nil
+}
+
+//class checks of every host, or of one when hostIP is set
+func (r *Registry) CheckHostClasses(hostIP string) ([]ClassCheck, error) {
+	var listHosts []*Host
+	if hostIP != "" {
+		host, err := r.LookupHost(hostIP)
+		if err != nil {
+			return nil, err
+		}
+		listHosts = []*Host{host}
+	} else {
+		listHosts = r.AllHosts()
+	}
+
+	checks := make([]ClassCheck, 0, len(listHosts))
+	for _, host := range listHosts {
+		lock := r.LockHost(host)
+		if !host.removed {
+			checks = append(checks, r.CheckHostClass(host))
+		}
+		lock.Unlock()
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].HostIP < checks[j].HostIP })
+	return checks, nil
+}
+
+type ConsistencyReport struct {
+	Hosts        int          `json:"hosts"`
+	Consistent   int          `json:"consistent"`
+	Inconsistent int          `json:"inconsistent"` //derivable hosts whose class is not the derived one
+	Underivable  int          `json:"underivable"`
+	Checks       []ClassCheck `json:"checks"`
+}
+
+func NewConsistencyReport(checks []ClassCheck) ConsistencyReport {
+	report := ConsistencyReport{Hosts: len(checks), Checks: checks}
+	for _, check := range checks {
+		switch {
+		case !check.Derivable:
+			report.Underivable++
+		case check.Consistent:
+			report.Consistent++
+		default:
+			report.Inconsistent++
+		}
+	}
+	return report
+}
+
+//?host= checks a single host
+func (r *Registry) V2CheckConsistency(w http.ResponseWriter, req *http.Request) {
+	checks, err := r.CheckHostClasses(req.URL.Query().Get("host"))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, NewConsistencyReport(checks))
+}
+
+//moves every inconsistent host to its derived class and reports the checks made afterwards
+func (r *Registry) V2ReconcileClasses(w http.ResponseWriter, req *http.Request) {
+	checks, err := r.CheckHostClasses(req.URL.Query().Get("host"))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	for _, check := range checks {
+		if check.Derivable && !check.Consistent {
+			r.ReconcileHostClass(check.HostIP)
+		}
+	}
+	if checks, err = r.CheckHostClasses(req.URL.Query().Get("host")); err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, NewConsistencyReport(checks))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func expectClass(t *testing.T, registry *Registry, hostIP string, class string) {
+	t.Helper()
+	if host, _ := registry.SnapshotHost(hostIP); host.HostClass != class {
+		t.Errorf("%s is in class %s, expected %s", hostIP, host.HostClass, class)
+	}
+}
+
+func TestHostClassFollowsTasks(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	for _, task := range []TaskRecord{{ID: "c1", Class: "2", CPU: 512}, {ID: "c2", Class: "1", CPU: 512}} {
+		task.HostIP = "10.0.0.1"
+		if err := registry.AllocateTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectClass(t, registry, "10.0.0.1", "1")
+
+	//the host goes back to the class of the tasks left, the least restrictive one once it runs none
+	if err := registry.TerminateTask(TaskResources{TaskID: "c2"}); err != nil {
+		t.Fatal(err)
+	}
+	expectClass(t, registry, "10.0.0.1", "2")
+	if err := registry.TerminateTask(TaskResources{TaskID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectClass(t, registry, "10.0.0.1", LeastRestrictiveClass())
+	if hostIPs := registry.RegionLayout()["LEE"][LeastRestrictiveClass()]; len(hostIPs) != 1 {
+		t.Errorf("the least restrictive list of LEE holds %v", hostIPs)
+	}
+}
+
+func TestConsistencyReport(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	//10.0.0.2 has resources no task accounts for, and 10.0.0.3 was moved to a class its tasks do not need
+	if err := registry.AllocateResources("10.0.0.2", 1024, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []TaskRecord{{ID: "c1", HostIP: "10.0.0.2", Class: "1", CPU: 512}, {ID: "c2", HostIP: "10.0.0.3", Class: "2", CPU: 512}} {
+		if err := registry.AllocateTask(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.RaiseHostClass("10.0.0.3", "1"); err != nil {
+		t.Fatal(err)
+	}
+	expectClass(t, registry, "10.0.0.2", LeastRestrictiveClass())
+
+	status, body := serve(t, registry, http.MethodGet, "/v2/consistency", nil)
+	var report ConsistencyReport
+	if json.Unmarshal(body, &report); status != http.StatusOK || report.Hosts != 3 || report.Consistent != 1 || report.Inconsistent != 1 || report.Underivable != 1 {
+		t.Fatalf("the consistency was reported as %d %s", status, body)
+	}
+	if check := report.Checks[1]; check.HostIP != "10.0.0.2" || check.TaskCPUs != 512 || check.AllocatedCPUs != 1536 || !strings.Contains(check.Reason, "the running tasks hold 512 cpu shares") {
+		t.Errorf("10.0.0.2 was checked as %+v", check)
+	}
+	if check := report.Checks[2]; check.HostClass != "1" || check.DerivedClass != "2" || check.Consistent {
+		t.Errorf("10.0.0.3 was checked as %+v", check)
+	}
+
+	//reconciling moves the inconsistent host only
+	status, body = serve(t, registry, http.MethodPost, "/v2/consistency/reconcile", nil)
+	report = ConsistencyReport{}
+	if json.Unmarshal(body, &report); status != http.StatusOK || report.Consistent != 2 || report.Underivable != 1 {
+		t.Errorf("reconciling answered %d %s", status, body)
+	}
+	expectClass(t, registry, "10.0.0.3", "2")
+	expectClass(t, registry, "10.0.0.2", LeastRestrictiveClass())
+
+	if status, _ = serve(t, registry, http.MethodGet, "/v2/consistency?host=10.0.0.9", nil); status != http.StatusNotFound {
+		t.Errorf("checking an unknown host answered %d", status)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+)
+
+//hosts are considered alive while their energy monitor keeps reporting. A host that stops reporting becomes
+//suspect and then dead, and dead hosts are no longer offered to the scheduler until they report again.
+
+const (
+	LivenessAlive   = "alive"
+	LivenessSuspect = "suspect"
+	LivenessDead    = "dead"
+)
+
+var suspectTimeout = flag.Duration("suspecttimeout", 5*time.Minute, "time without monitor updates before a host is marked suspect")
+var deadTimeout = flag.Duration("deadtimeout", 15*time.Minute, "time without monitor updates before a host is marked dead and excluded from placement lists")
+var livenessInterval = flag.Duration("livenessinterval", 10*time.Second, "how often host liveness is re-evaluated")
+
+//must be called with the class lock of the host held
+func MarkAlive(host *Host) {
+	host.LastSeen = Now()
+	if host.Liveness != LivenessAlive {
+		if host.Liveness != "" {
+			log.Printf("liveness: host %s is %s again (was %s)", host.HostIP, LivenessAlive, host.Liveness)
+		}
+		host.Liveness = LivenessAlive
+	}
+}
+
+func LivenessFor(lastSeen time.Time, now time.Time) string {
+	silence := now.Sub(lastSeen)
+	if silence >= *deadTimeout {
+		return LivenessDead
+	} else if silence >= *suspectTimeout {
+		return LivenessSuspect
+	}
+	return LivenessAlive
+}
+
+//re-evaluates the liveness of every host. The lists are walked under their class locks, a host moving
+//between lists at the same time is picked up on the next pass
+func (r *Registry) CheckLiveness() {
+	now := Now()
+	for region := range r.locks {
+		for class := range r.locks[region].classHosts {
+			r.locks[region].classHosts[class].Lock()
+			for _, host := range r.regions[region].classHosts[class] {
+				state := LivenessFor(host.LastSeen, now)
+				if state != host.Liveness {
+					log.Printf("liveness: host %s is %s (last update %s ago)", host.HostIP, state, now.Sub(host.LastSeen).Truncate(time.Second))
+					host.Liveness = state
+				}
+			}
+			r.locks[region].classHosts[class].Unlock()
+		}
+	}
+}
+
+func (r *Registry) RunLivenessTracker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.CheckLiveness()
+	}
+}
+
+//removes dead hosts from a list returned to the scheduler. Must be called with the class lock of the list held
+func LiveHosts(listHosts []*Host) []*Host {
+	alive := make([]*Host, 0, len(listHosts))
+	for _, host := range listHosts {
+		if host.Liveness != LivenessDead {
+			alive = append(alive, host)
+		}
+	}
+	return alive
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func placementHosts(t *testing.T, registry *Registry, requestClass string) []string {
+	t.Helper()
+	listHosts, err := registry.PlacementList(requestClass, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIPs := make([]string, 0, len(listHosts))
+	for _, host := range listHosts {
+		hostIPs = append(hostIPs, host.HostIP)
+	}
+	return hostIPs
+}
+
+func TestLivenessEvictsSilentHosts(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2")
+	class := LeastRestrictiveClass()
+
+	//10.0.0.2 keeps reporting, 10.0.0.1 goes silent
+	report := func() {
+		cpu, memory := 0.1, 0.1
+		if err := registry.SetUtilization("10.0.0.2", &cpu, &memory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.advance(*suspectTimeout)
+	report()
+	registry.CheckLiveness()
+	if host, _ := registry.SnapshotHost("10.0.0.1"); host.Liveness != LivenessSuspect {
+		t.Fatalf("a host silent for %v is %s", *suspectTimeout, host.Liveness)
+	}
+	//a suspect host is still offered
+	if hostIPs := placementHosts(t, registry, class); len(hostIPs) != 2 {
+		t.Errorf("the placement list holds %v", hostIPs)
+	}
+
+	clock.advance(*deadTimeout - *suspectTimeout)
+	report()
+	registry.CheckLiveness()
+	if host, _ := registry.SnapshotHost("10.0.0.1"); host.Liveness != LivenessDead {
+		t.Fatalf("a host silent for %v is %s", *deadTimeout, host.Liveness)
+	}
+	if hostIPs := placementHosts(t, registry, class); len(hostIPs) != 1 || hostIPs[0] != "10.0.0.2" {
+		t.Errorf("the placement list holds %v", hostIPs)
+	}
+
+	//a dead host that reports again is offered again
+	cpu := 0.2
+	if err := registry.SetUtilization("10.0.0.1", &cpu, nil); err != nil {
+		t.Fatal(err)
+	}
+	if hostIPs := placementHosts(t, registry, class); len(hostIPs) != 2 {
+		t.Errorf("the placement list holds %v after the dead host reported", hostIPs)
+	}
+}
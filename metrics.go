@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//metrics in the Prometheus text exposition format, served at /metrics. Host values are read from the registry when
+//scraped, events are counted as they happen
+
+const labelSeparator = "\xff"
+
+type CounterVec struct {
+	mutex  *sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 //by label values joined with labelSeparator
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{mutex: &sync.Mutex{}, name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 { //a counter without labels is exported from 0 on
+		counter.values[""] = 0
+	}
+	return counter
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.mutex.Lock()
+	c.values[strings.Join(labelValues, labelSeparator)] += value
+	c.mutex.Unlock()
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	WriteMetricHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		WriteSample(w, c.name, c.labels, splitLabels(key, len(c.labels)), c.values[key])
+	}
+}
+
+type histogramSeries struct {
+	counts []uint64 //per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	mutex   *sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 //upper bounds, ascending
+	series  map[string]*histogramSeries
+}
+
+//same buckets as the Prometheus client libraries, in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{mutex: &sync.Mutex{}, name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	key := strings.Join(labelValues, labelSeparator)
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *HistogramVec) Write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	WriteMetricHeader(w, h.name, h.help, "histogram")
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		labelValues := splitLabels(key, len(h.labels))
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			WriteSample(w, h.name+"_bucket", bucketLabels, append(append([]string{}, labelValues...), formatFloat(bound)), float64(cumulative))
+		}
+		WriteSample(w, h.name+"_bucket", bucketLabels, append(append([]string{}, labelValues...), "+Inf"), float64(series.count))
+		WriteSample(w, h.name+"_sum", h.labels, labelValues, series.sum)
+		WriteSample(w, h.name+"_count", h.labels, labelValues, float64(series.count))
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func splitLabels(key string, count int) []string {
+	if count == 0 {
+		return nil
+	}
+	return strings.Split(key, labelSeparator)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func WriteMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func WriteSample(w io.Writer, name string, labels []string, labelValues []string, value float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, label, labelEscaper.Replace(labelValues[i]))
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatFloat(value)+"\n")
+}
+
+var regionTransitions = NewCounterVec("hostregistry_region_transitions_total", "Hosts moved from one region to another.", "from", "to")
+var classTransitions = NewCounterVec("hostregistry_class_transitions_total", "Hosts moved from one overbooking class to another.", "from", "to")
+var cutsTotal = NewCounterVec("hostregistry_cuts_total", "Tasks whose resources were cut.")
+var killsTotal = NewCounterVec("hostregistry_kills_total", "Tasks killed to be rescheduled.")
+var reschedulesTotal = NewCounterVec("hostregistry_reschedules_total", "Reschedulings of killed tasks by outcome.", "outcome")
+var httpDuration = NewHistogramVec("hostregistry_http_request_duration_seconds", "Latency of the HTTP handlers.", DefaultBuckets, "route", "method", "code")
+
+//the gauges exported for every host, in exposition order
+var hostGauges = []struct {
+	name  string
+	help  string
+	value func(host *Host) float64
+}{
+	{"hostregistry_host_cpu_utilization", "CPU utilization reported by the host monitor, from 0 to 1.", func(host *Host) float64 { return host.CPU_Utilization }},
+	{"hostregistry_host_memory_utilization", "Memory utilization reported by the host monitor, from 0 to 1.", func(host *Host) float64 { return host.MemoryUtilization }},
+	{"hostregistry_host_total_resources_utilization", "Highest of the CPU and memory utilization, decides the region of the host.", func(host *Host) float64 { return host.TotalResourcesUtilization }},
+	{"hostregistry_host_allocated_cpu_shares", "CPU shares allocated to tasks on the host.", func(host *Host) float64 { return float64(host.AllocatedCPUs) }},
+	{"hostregistry_host_allocated_memory_bytes", "Memory allocated to tasks on the host.", func(host *Host) float64 { return float64(host.AllocatedMemory) }},
+	{"hostregistry_host_overbooking_factor", "Highest of the allocated to total CPU and memory ratios.", func(host *Host) float64 { return host.OverbookingFactor }},
+}
+
+//copies of the registered hosts taken under their class locks, ordered by IP
+func (r *Registry) HostSnapshots() []Host {
+	listHosts := r.AllHosts()
+	snapshots := make([]Host, 0, len(listHosts))
+	for _, host := range listHosts {
+		lock := r.LockHost(host)
+		if !host.removed {
+			snapshots = append(snapshots, *host)
+		}
+		lock.Unlock()
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].HostIP < snapshots[j].HostIP })
+	return snapshots
+}
+
+func (r *Registry) WriteMetrics(w io.Writer) {
+	snapshots := r.HostSnapshots()
+	hostLabels := []string{"host", "region", "class"}
+	for _, gauge := range hostGauges {
+		WriteMetricHeader(w, gauge.name, gauge.help, "gauge")
+		for i := range snapshots {
+			host := &snapshots[i]
+			WriteSample(w, gauge.name, hostLabels, []string{host.HostIP, host.Region, host.HostClass}, gauge.value(host))
+		}
+	}
+
+	//every region/class list is exported, empty ones included
+	WriteMetricHeader(w, "hostregistry_hosts", "Hosts in each region/class list.", "gauge")
+	for _, region := range config.Regions {
+		for _, class := range config.Classes {
+			r.locks[region.Name].classHosts[class].Lock()
+			count := len(r.regions[region.Name].classHosts[class])
+			r.locks[region.Name].classHosts[class].Unlock()
+			WriteSample(w, "hostregistry_hosts", []string{"region", "class"}, []string{region.Name, class}, float64(count))
+		}
+	}
+
+	//estimated by the power models
+	report := r.energy.Report(Now())
+	WriteMetricHeader(w, "hostregistry_host_power_watts", "Estimated power drawn by each host.", "gauge")
+	for _, host := range report.Hosts {
+		WriteSample(w, "hostregistry_host_power_watts", []string{"host", "region", "hardware"}, []string{host.HostIP, host.Region, host.HardwareType}, host.Watts)
+	}
+	WriteMetricHeader(w, "hostregistry_energy_joules_total", "Estimated energy spent by the hosts while in each region.", "counter")
+	for _, region := range config.Regions {
+		WriteSample(w, "hostregistry_energy_joules_total", []string{"region"}, []string{region.Name}, report.Regions[region.Name].Joules)
+	}
+
+	regionTransitions.Write(w)
+	classTransitions.Write(w)
+	cutsTotal.Write(w)
+	killsTotal.Write(w)
+	reschedulesTotal.Write(w)
+	httpDuration.Write(w)
+	historyDropped.Write(w)
+	historyErrors.Write(w)
+	authDenied.Write(w)
+	reservationsTotal.Write(w)
+	taskUpdatesRejected.Write(w)
+	migrationsTotal.Write(w)
+	powerTransitions.Write(w)
+	powerHookFailures.Write(w)
+}
+
+func (r *Registry) GetMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buffered := bufio.NewWriter(w)
+	r.WriteMetrics(buffered)
+	buffered.Flush()
+}
+
+//remembers the status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+//the event stream needs to flush and to take over the connection for websockets
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the connection cannot be hijacked")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+//router middleware observing the latency of every matched route
+func InstrumentHandlers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+
+		route := "unmatched"
+		if current := mux.CurrentRoute(req); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		httpDuration.Observe(time.Since(start).Seconds(), route, req.Method, strconv.Itoa(recorder.status))
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	counter := NewCounterVec("test_moves_total", "Moves.", "from", "to")
+	counter.Inc("LEE", "DEE")
+	counter.Add(2, "DEE", `E"D`)
+	counter.Inc("LEE", "DEE")
+
+	var buffer bytes.Buffer
+	counter.Write(&buffer)
+	expected := "# HELP test_moves_total Moves.\n# TYPE test_moves_total counter\n" +
+		"test_moves_total{from=\"DEE\",to=\"E\\\"D\"} 2\ntest_moves_total{from=\"LEE\",to=\"DEE\"} 2\n"
+	if buffer.String() != expected {
+		t.Errorf("the counter is exposed as\n%s", buffer.String())
+	}
+
+	//a counter without labels is exposed before it is incremented
+	buffer.Reset()
+	NewCounterVec("test_total", "Total.").Write(&buffer)
+	if !strings.HasSuffix(buffer.String(), "\ntest_total 0\n") {
+		t.Errorf("an unlabelled counter is exposed as\n%s", buffer.String())
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	histogram := NewHistogramVec("test_seconds", "Latency.", []float64{0.1, 1}, "route")
+	for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+		histogram.Observe(value, "/a")
+	}
+
+	var buffer bytes.Buffer
+	histogram.Write(&buffer)
+	for _, sample := range []string{`test_seconds_bucket{route="/a",le="0.1"} 2`, `test_seconds_bucket{route="/a",le="1"} 3`,
+		`test_seconds_bucket{route="/a",le="+Inf"} 4`, `test_seconds_sum{route="/a"} 3.65`, `test_seconds_count{route="/a"} 4`} {
+		if !strings.Contains(buffer.String(), sample+"\n") {
+			t.Errorf("%s is missing from\n%s", sample, buffer.String())
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	if status, _ := serve(t, registry, http.MethodPost, "/v2/hosts/10.0.0.1/allocations", Allocation{CPU: 1024, Memory: 256 << 20}); status != http.StatusOK {
+		t.Fatalf("allocating answered %d", status)
+	}
+
+	status, body := serve(t, registry, http.MethodGet, "/metrics", nil)
+	if status != http.StatusOK {
+		t.Fatalf("/metrics answered %d", status)
+	}
+	region, class := RegionFor(0).Name, LeastRestrictiveClass()
+	for _, sample := range []string{
+		`hostregistry_host_allocated_cpu_shares{host="10.0.0.1",region="` + region + `",class="` + class + `"} 1024`,
+		`hostregistry_host_allocated_memory_bytes{host="10.0.0.1",region="` + region + `",class="` + class + `"} 2.68435456e+08`,
+		`hostregistry_host_overbooking_factor{host="10.0.0.1",region="` + region + `",class="` + class + `"} 0.25`,
+		`hostregistry_hosts{region="` + region + `",class="` + class + `"} 1`,
+		`hostregistry_hosts{region="` + region + `",class="1"} 0`,
+		`hostregistry_http_request_duration_seconds_count{route="/v2/hosts/{hostip}/allocations",method="POST",code="200"}`,
+	} {
+		if !strings.Contains(string(body), sample) {
+			t.Errorf("%s is missing from /metrics", sample)
+		}
+	}
+}
@@ -2,16 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"log"
 	"net"
 	"net/http"
-	"os/exec"
 	"sync"
 	"math"
 	"strconv"	
-	"bytes"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -29,6 +30,23 @@ type Host struct {
 	OverbookingFactor         float64      `json:"overbookingfactor,omitempty"`
 	TotalMemory		  int64	       `json:"totalmemory,omitempty"`
 	TotalCPUs		  int64	       `json:"totalcpus, omitempty"`
+	LastSeen		  time.Time    `json:"lastseen"`
+	Liveness		  string       `json:"liveness,omitempty"`
+	PowerState		  string       `json:"powerstate,omitempty"`
+	PowerSince		  time.Time    `json:"powersince"` //last power state change, or registration
+	removed			  bool	       //set under the class lock when the host is deregistered
+}
+
+//result of a host deregistration
+type RemovalReport struct {
+	HostIP          string   `json:"hostip"`
+	Removed         bool     `json:"removed"`
+	Region          string   `json:"region,omitempty"`
+	HostClass       string   `json:"hostclass,omitempty"`
+	DroppedCPUs     int64    `json:"droppedcpus"`
+	DroppedMemory   int64    `json:"droppedmemory"`
+	TerminatedTasks []string `json:"terminatedtasks,omitempty"` //running tasks of a force-removed host
+	Error           string   `json:"error,omitempty"`
 }
 
 type TaskResources struct {
@@ -38,6 +56,16 @@ type TaskResources struct {
 	NewClass 		string		`json:"newclass,omitempty"`
 	Update 			bool		`json:"update,omitempty"`
 	IP			string		`json:"ip,omitempty"`
+	TaskID			string		`json:"taskid,omitempty"` //optional, releases the port leased to the task
+	Port			int		`json:"port,omitempty"`   //optional, releases the port on host IP when the task id is unknown
+}
+
+//answer to a rescheduling
+type RescheduleResult struct {
+	ContainerID	string	`json:"containerid"`
+	Image		string	`json:"image"`
+	HostIP		string	`json:"hostip,omitempty"`
+	Port		int	`json:"port,omitempty"`
 }
 
 //this struct is used when a rescheduling is performed
@@ -47,11 +75,13 @@ type Task struct {
 	TaskClass 	string	`json:"taskclass,omitempty"`
 	Image 		string 	`json:"image,omitempty"`
 	TaskType 	string  `json:"tasktype,omitempty"`
+	HostIP		string	`json:"hostip,omitempty"` //optional, the host the task is expected to run on
+	TaskID		string	`json:"taskid,omitempty"` //optional, the killed task, terminated when known
 }
 
 
-//Each region will have 4 lists, one for each overbooking class
-//LEE=Lowest Energy Efficiency, DEE =Desired Energy Efficiency EED=Energy Efficiency Degradation
+//Each region will have one list per overbooking class
+//the regions themselves come from the configuration, see DefaultConfig
 type Region struct {
 	classHosts map[string][]*Host
 }
@@ -61,16 +91,10 @@ type Lock struct {
 	lock	*sync.Mutex //to lock at region level
 }
 
-var regions map[string]Region
-
-var hosts map[string]*Host
-
-var locks map[string]Lock //for locking access to regions/class
-
-var portNumber = 11000
+var rescheduleCount int64 //used to give each rescheduled task a unique {id}
 
 //adapted binary search algorithm for inserting orderly based on total resources of a host
-//this is ascending order (for EED region)
+//this is ascending order (EED region by default)
 func Sort(classList []*Host, searchValue float64) int {
 	listLength := len(classList)
 	lowerBound := 0
@@ -99,7 +123,7 @@ func Sort(classList []*Host, searchValue float64) int {
 	}
 }
 
-//for LEE and DEE regions, since they are ordered by descending order the sort above must be reversed
+//for descending regions (LEE and DEE by default) the sort above must be reversed
 func ReverseSort(classList []*Host, searchValue float64) int {
 	listLength := len(classList)
 	lowerBound := 0
@@ -128,209 +152,161 @@ func ReverseSort(classList []*Host, searchValue float64) int {
 	}
 }
 
-//Gathers data concering cuts and kills. eventType = 1 -> cut = 2 ->kill 
-func GatherData3(eventType int, cpuCut string, memoryCut string) {
-	if eventType == 1 {
-		fileCPU, err1 := os.OpenFile("Cuts.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-             
-        	if err1 != nil {
-                	panic(err1)
-        	}
-	        defer fileCPU.Close()
-
-        	if _, err1 = fileCPU.WriteString("1 CPU cut: " + cpuCut + " memory cut: " + memoryCut + "\n"); err1 != nil {
-                	panic(err1)
-        	}
-	} else {
-		fileCPU, err1 := os.OpenFile("Kills.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-             
-        	if err1 != nil {
-                	panic(err1)
-        	}
-	        defer fileCPU.Close()
-
-        	if _, err1 = fileCPU.WriteString("1\n"); err1 != nil {
-                	panic(err1)
-        	}
-
+//returns where a host must be inserted in a class list of the region, according to the sort order configured for the region
+func SortedIndex(region string, classList []*Host, searchValue float64) int {
+	if regionConfig, _ := RegionByName(region); regionConfig.Order == OrderAscending {
+		return Sort(classList, searchValue)
 	}
+	return ReverseSort(classList, searchValue)
 }
 
-func RescheduleTask(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) RescheduleTask(w http.ResponseWriter, req *http.Request) {
 	var task Task
-	_ = json.NewDecoder(req.Body).Decode(&task)	
-
-	portNumberAux := strconv.Itoa(portNumber)
-	
-	GatherData3(2, "0", "0")
-	
-	if task.Image == "redis" {
-		args := []string{"-H", "tcp://10.5.60.2:2377", "run", "-itd", "-p", portNumberAux + ":" + portNumberAux, "-c", task.CPU, "-m", task.Memory,  "-e", "affinity:makespan==300", "-e", "affinity:port==" + portNumberAux, "-e", "affinity:requestclass==" + task.TaskClass, "-e", "affinity:requesttype==" + task.TaskType, task.Image, "--port", portNumberAux}
-		cmd := exec.Command("docker", args...)
-		portNumber++
-		var out, stderr bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &stderr
-	
-		if err := cmd.Run(); err != nil {
-			//fmt.Println("Error using docker run at rescheduling: redis")
-			//fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		}
-	} else if task.Image == "sergiomendes/timeserver" {
-		cmd := exec.Command("docker", "-H",  "tcp://10.5.60.2:2377", "run", "-itd", "-p", portNumberAux + ":" + portNumberAux, "-c", task.CPU, "-m", task.Memory,  "-e", "affinity:makespan==300", "-e", "affinity:port==" + portNumberAux, "-e", "affinity:requestclass==" + task.TaskClass, "-e", "affinity:requesttype==" + task.TaskType, "sergiomendes/timeserver", portNumberAux)
-		portNumber++
-		var out, stderr bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &stderr
-	
-		if err := cmd.Run(); err != nil {
-			//fmt.Println("Error using docker run at rescheduling: timeserver")
-			//fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		}
-	} else if task.Image == "ffmpeg" {
-		cmd := exec.Command("docker", "-H", "tcp://10.5.60.2:2377", "run", "-v", "/home/smendes:/tmp/workdir", "-w=/tmp/workdir", "-itd", "-c", task.CPU, "-m", task.Memory, "-e", "affinity:requestclass==" + task.TaskClass, "-e", "affinity:makespan==150", "-e", "affinity:requesttype==" + task.TaskType, "jrottenberg/ffmpeg", "-i", "dead.avi", "-r", "100", "-b", "700k", "-qscale", "0", "-ab", "160k", "-ar", "44100", "result"+portNumberAux+".dvd", "-y")
-		var out, stderr bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &stderr
-	
-		if err := cmd.Run(); err != nil {
-			//fmt.Println("Error using docker run at rescheduling: ffmpeg")
-			//fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		}
-	} else if task.Image == "enhance" {
-		cmd := exec.Command("docker", "-H", "tcp://10.5.60.2:2377", "run", "-v", "/home/smendes:/ne/input", "-itd", "-c", task.CPU, "-m", task.Memory, "-e", "affinity:makespan==150", "-e", "affinity:requestclass==" + task.TaskClass, "-e", "affinity:requesttype==" + task.TaskType, "alexjc/neural-enhance", "--zoom=2", "input/macos.jpg")
-		var out, stderr bytes.Buffer
-		cmd.Stdout = &out
-		cmd.Stderr = &stderr
-	
-		if err := cmd.Run(); err != nil {
-			//fmt.Println("Error using docker run at rescheduling: enhance")
-			//fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		}
+	if err := json.NewDecoder(req.Body).Decode(&task); err != nil {
+		WriteError(w, &ValidationError{Field: "body", Message: err.Error()})
+		return
 	}
 
-	//cmd := exec.Command("docker","-H", "tcp://10.5.60.2:2377","run", "-itd", "-c", task.CPU, "-m", task.Memory, "-e", "affinity:requestclass==" + task.TaskClass, "-e", "affinity:requesttype==" + task.TaskType, "-e", "affinity:rescheduled==yes", task.Image)
-	if portNumber == 11999 {
-		portNumber = 11000
+	result, err := r.Reschedule(task)
+	if err != nil {
+		WriteError(w, err)
+		return
 	}
+	json.NewEncoder(w).Encode(result)
+
 }
 
-func TaskTerminated(w http.ResponseWriter, req *http.Request) {
-	var taskResources *TaskResources
-	_ = json.NewDecoder(req.Body).Decode(&taskResources)
+func (r *Registry) TaskTerminated(w http.ResponseWriter, req *http.Request) {
+	var taskResources TaskResources
+	if err := json.NewDecoder(req.Body).Decode(&taskResources); err != nil {
+		WriteError(w, &ValidationError{Field: "body", Message: err.Error()})
+		return
+	}
 
-	hostIP := taskResources.IP
+	if err := r.TerminateTask(taskResources); err != nil {
+		WriteError(w, err)
+	}
+}
 
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
+//function responsible to update task resources when there's a cut. It will also update the allocated cpu/memory of the host
+func (r *Registry) UpdateTaskResources(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
 
-	//update resources of this host. It will have less resources since a task has terminated
-	UpdateResources(taskResources.CPU, taskResources.Memory, hostIP)
+	cut := TaskCut{TaskID: params["taskid"], HostIP: params["hostip"]}
+	var err error
+	if cut.NewCPU, err = strconv.ParseInt(params["newcpu"], 10, 64); err != nil {
+		WriteError(w, &ValidationError{Field: "newcpu", Message: err.Error()})
+		return
+	}
+	if cut.NewMemory, err = ParseMemory(params["newmemory"]); err != nil {
+		WriteError(w, &ValidationError{Field: "newmemory", Message: err.Error()})
+		return
+	}
+	if cut.CPUCut, err = strconv.ParseInt(params["cpucut"], 10, 64); err != nil {
+		WriteError(w, &ValidationError{Field: "cpucut", Message: err.Error()})
+		return
+	}
+	if cut.MemoryCut, err = strconv.ParseInt(params["memorycut"], 10, 64); err != nil {
+		WriteError(w, &ValidationError{Field: "memorycut", Message: err.Error()})
+		return
+	}
 
-	//we must check if host class should be updated. Could be last task restraining host class (e.g. last  class 1 task)
-	locks[hostRegion].classHosts[hostClass].Lock()
-	if taskResources.Update && taskResources.PreviousClass == hostClass {
-		locks[hostRegion].classHosts[hostClass].Unlock()
-		go UpdateHostList(taskResources.PreviousClass, taskResources.NewClass, hosts[hostIP])	
-	}else {
-		locks[hostRegion].classHosts[hostClass].Unlock()
+	if err = r.CutTask(cut); err != nil {
+		WriteError(w, err)
 	}
 }
 
-//function responsible to update task resources when there's a cut. It will also update the allocated cpu/memory of the host
-func UpdateTaskResources(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) CreateHost(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
-	taskID := params["taskid"]
-	newCPU := params["newcpu"]
-	newMemory := params["newmemory"]
 	hostIP := params["hostip"]
-	cpuCut := params["cpucut"]
-	memoryCut := params["memorycut"]
-
-	cpuAux , _ := strconv.ParseInt(newCPU, 10, 64)
-	
-	if cpuAux < 2 {
-		newCPU = "2"
+	totalMemory, err := strconv.ParseInt(params["totalmemory"], 10, 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "totalmemory", Message: err.Error()})
+		return
+	}
+	totalCPUs, err := strconv.ParseInt(params["totalcpu"], 10, 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "totalcpu", Message: err.Error()})
+		return
 	}
+	totalCPUs *= 1024 // *1024 because 1024 shares equals using 1 cpu by 100%	
 
-	GatherData3(1, cpuCut, memoryCut)
-	
-	cmd := exec.Command("docker","-H", "tcp://10.5.60.2:2377","update", "-m", newMemory, "-c", newCPU, taskID)
-        var out, stderr bytes.Buffer
-        cmd.Stdout = &out
-        cmd.Stderr = &stderr
-
-        if err := cmd.Run(); err != nil {
-                //fmt.Println("Error using docker run at update task resources after a cut: " + taskID)
-                //fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		//retry
-		time.Sleep(time.Second * 5)
-		
-		cmd1 := exec.Command("docker","-H", "tcp://10.5.60.2:2377","update", "-m", newMemory, "-c", newCPU, taskID)
-        	var out1, stderr1 bytes.Buffer
-        	cmd1.Stdout = &out1
-        	cmd1.Stderr = &stderr1
-
-		if err1 := cmd1.Run(); err1 != nil {
-                	//fmt.Println("Error using docker run at update task resources after a cut twice: " + taskID)
-                	//fmt.Println(fmt.Sprint(err1) + ": " + stderr1.String())
-		}
-        }
+	if _, err = r.RegisterHost(hostIP, totalMemory, totalCPUs); err != nil {
+		WriteError(w, err)
+	}
+}
 
-	//now to update the resources of the host. Because of the cut, less resources will be occupied on the host		
-	memoryReduction, _ := strconv.ParseInt(memoryCut,10,64)
-	cpuReduction, _ := strconv.ParseInt(cpuCut,10,64)
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
+//removes a host from the registry. If the host still has allocated resources the removal is refused
+//unless force is set, in which case the allocations are dropped and reported back
+func (r *Registry) DeleteHost(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	hostIP := params["hostip"]
+	force, _ := strconv.ParseBool(params["force"])
 
-	locks[hostRegion].classHosts[hostClass].Lock()
-  
-    	hosts[hostIP].AllocatedMemory -= memoryReduction
-    	hosts[hostIP].AllocatedCPUs -= cpuReduction
+	report, status := r.RemoveHost(hostIP, force)
 
-    	locks[hostRegion].classHosts[hostClass].Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
 }
 
-func CreateHost(w http.ResponseWriter, req *http.Request) {
-	params := mux.Vars(req)
-	hostIP := params["hostip"]
-	totalMemory,_ := strconv.ParseInt(params["totalmemory"],10,64)
-	totalCPUs,_ := strconv.ParseInt(params["totalcpu"],10,64) 
-	totalCPUs *= 1024 // *1024 because 1024 shares equals using 1 cpu by 100%	
+func (r *Registry) RemoveHost(hostIP string, force bool) (RemovalReport, int) {
+	report := RemovalReport{HostIP: hostIP}
 
-	//since a host is created it will not have tasks assigned to it so it goes to the LEE region to the less restrictive class
-	
-	locks["LEE"].classHosts["4"].Lock()
-	hosts[hostIP] = &Host{HostIP: hostIP, HostClass: "4", Region: "LEE", TotalMemory: totalMemory, TotalCPUs: totalCPUs, AllocatedMemory: 0, AllocatedCPUs: 0,
-	TotalResourcesUtilization: 0.0, CPU_Utilization: 0.0, MemoryUtilization: 0.0, OverbookingFactor:0.0}
-	
-	newHost := make([]*Host, 0)
-	newHost = append(newHost, hosts[hostIP])
-	
-	regions["LEE"].classHosts["4"] = append(regions["LEE"].classHosts["4"], newHost...)
-	locks["LEE"].classHosts["4"].Unlock()
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		report.Error = "unknown host"
+		return report, http.StatusNotFound
+	}
+
+	lock := r.LockHost(host)
+	if host.removed { //deregistered while we were waiting for the lock
+		lock.Unlock()
+		report.Error = "unknown host"
+		return report, http.StatusNotFound
+	}
+
+	report.Region = host.Region
+	report.HostClass = host.HostClass
+	report.DroppedCPUs = host.AllocatedCPUs
+	report.DroppedMemory = host.AllocatedMemory
+
+	if !force && (host.AllocatedCPUs > 0 || host.AllocatedMemory > 0) {
+		lock.Unlock()
+		report.DroppedCPUs = 0
+		report.DroppedMemory = 0
+		report.Error = "host still has allocated resources"
+		return report, http.StatusConflict
+	}
 
+	r.regions[host.Region].classHosts[host.HostClass] = RemoveHostFromList(r.regions[host.Region].classHosts[host.HostClass], hostIP)
+	host.removed = true
+	r.hostsLock.Lock()
+	delete(r.hosts, hostIP)
+	r.hostsLock.Unlock()
+	r.RecordMutation(OpDeleteHost, *host)
+	lock.Unlock()
+
+	//the tasks of a force-removed host are gone with it
+	for _, task := range r.tasks.TerminateHost(hostIP) {
+		report.TerminatedTasks = append(report.TerminatedTasks, task.ID)
+	}
+	r.portAllocator.ReleaseHost(hostIP)
+	r.reservations.AbortHost(hostIP)
+	r.energy.Forget(hostIP, report.Region, Now())
+	r.events.Publish(Event{Type: EventHostRemoved, HostIP: hostIP, Region: report.Region, HostClass: report.HostClass, CPU: report.DroppedCPUs, Memory: report.DroppedMemory})
+	report.Removed = true
+	return report, http.StatusOK
 }
 
 //function used to update host class when a new task arrives
 //implies list change
-func UpdateHostClass(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) UpdateHostClass(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
-	newHostClass := params["requestclass"]
-	hostIP := params["hostip"]
-
-	currentClass := hosts[hostIP].HostClass
-	hostRegion := hosts[hostIP].Region
 
-	locks[hostRegion].classHosts[currentClass].Lock()
-
-	if currentClass > newHostClass { //we only update the host class if the current class is higher
-		locks[hostRegion].classHosts[currentClass].Unlock()
-		//we need to update the list where this host is at
-		UpdateHostList(currentClass, newHostClass, hosts[hostIP])
-		return
+	if err := r.RaiseHostClass(params["hostip"], params["requestclass"]); err != nil {
+		WriteError(w, err)
 	}
-	locks[hostRegion].classHosts[currentClass].Unlock()
 }
 
 func InsertHost(classHosts []*Host, index int, host *Host) []*Host {
@@ -346,731 +322,455 @@ func InsertHost(classHosts []*Host, index int, host *Host) []*Host {
 	return tmp
 }
 
+func RemoveHostFromList(classHosts []*Host, hostIP string) []*Host {
+	for i := 0; i < len(classHosts); i++ {
+		if classHosts[i].HostIP == hostIP {
+			return append(classHosts[:i], classHosts[i+1:]...)
+		}
+	}
+	return classHosts
+}
+
 //this function needs to remove the host from its previous class and update it to the new
-func UpdateHostList(hostPreviousClass string, hostNewClass string, host *Host) {
+func (r *Registry) UpdateHostList(hostPreviousClass string, hostNewClass string, host *Host) {
+	if _, ok := ClassRank(hostNewClass); !ok {
+		log.Printf("host %s: ignoring change to unknown class %s", host.HostIP, hostNewClass)
+		return
+	}
 	hostRegion := host.Region
 	//this deletes
-	locks[hostRegion].classHosts[hostPreviousClass].Lock()
-	for i := 0; i < len(regions[hostRegion].classHosts[hostPreviousClass]); i++ {
-		if regions[hostRegion].classHosts[hostPreviousClass][i].HostIP == host.HostIP {
-			regions[hostRegion].classHosts[hostPreviousClass] = append(regions[hostRegion].classHosts[hostPreviousClass][:i], regions[hostRegion].classHosts[hostPreviousClass][i+1:]...)
+	r.locks[hostRegion].classHosts[hostPreviousClass].Lock()
+	for i := 0; i < len(r.regions[hostRegion].classHosts[hostPreviousClass]); i++ {
+		if r.regions[hostRegion].classHosts[hostPreviousClass][i].HostIP == host.HostIP {
+			r.regions[hostRegion].classHosts[hostPreviousClass] = append(r.regions[hostRegion].classHosts[hostPreviousClass][:i], r.regions[hostRegion].classHosts[hostPreviousClass][i+1:]...)
 			break
 		}
 	}
 	
-	locks[hostRegion].classHosts[hostPreviousClass].Unlock()
+	r.locks[hostRegion].classHosts[hostPreviousClass].Unlock()
 		
-	locks[hostRegion].classHosts[hostNewClass].Lock()
+	r.locks[hostRegion].classHosts[hostNewClass].Lock()
+	if host.removed { //the host was deregistered in the meantime
+		r.locks[hostRegion].classHosts[hostNewClass].Unlock()
+		return
+	}
 	//this inserts in new list
-	if hostRegion == "LEE" || hostRegion == "DEE" {
-		index := ReverseSort(regions[hostRegion].classHosts[hostNewClass], host.TotalResourcesUtilization)
-		regions[hostRegion].classHosts[hostNewClass] = InsertHost(regions[hostRegion].classHosts[hostNewClass], index, host)
-	} else {
-		index := Sort(regions[hostRegion].classHosts[hostNewClass], host.TotalResourcesUtilization)
-		regions[hostRegion].classHosts[hostNewClass] = InsertHost(regions[hostRegion].classHosts[hostNewClass], index, host)
+	index := SortedIndex(hostRegion, r.regions[hostRegion].classHosts[hostNewClass], host.TotalResourcesUtilization)
+	r.regions[hostRegion].classHosts[hostNewClass] = InsertHost(r.regions[hostRegion].classHosts[hostNewClass], index, host)
+	host.HostClass = hostNewClass
+	event := HostEvent(EventClassChanged, host)
+	r.RecordMutation(OpUpdateHostList, *host)
+	r.locks[hostRegion].classHosts[hostNewClass].Unlock()
+	if hostPreviousClass != hostNewClass {
+		classTransitions.Inc(hostPreviousClass, hostNewClass)
+		event.From = hostPreviousClass
+		event.To = hostNewClass
+		r.events.Publish(event)
 	}
-	hosts[host.HostIP].HostClass = hostNewClass
-	locks[hostRegion].classHosts[hostNewClass].Unlock()
 }
 
 //implies list change
-func UpdateHostRegion(hostIP string, newRegion string) {
-	
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
+func (r *Registry) UpdateHostRegion(host *Host, newRegion string) {
+	lock := r.LockHost(host)
+	oldRegion := host.Region
+	lock.Unlock()
 
-	locks[hostRegion].classHosts[hostClass].Lock()
-	oldRegion := hostRegion
-	
-	locks[oldRegion].classHosts[hosts[hostIP].HostClass].Unlock()
-
-	UpdateHostRegionList(oldRegion, newRegion, hosts[hostIP])
-	return
+	r.UpdateHostRegionList(oldRegion, newRegion, host)
 }
 
 //first we must remove the host from the previous region then insert it in the new onw
-func UpdateHostRegionList(oldRegion string, newRegion string, host *Host) {	
+func (r *Registry) UpdateHostRegionList(oldRegion string, newRegion string, host *Host) {	
 	hostClass := host.HostClass
 	//this deletes
-	locks[oldRegion].classHosts[hostClass].Lock()
+	r.locks[oldRegion].classHosts[hostClass].Lock()
 
-	for i := 0; i < len(regions[oldRegion].classHosts[hostClass]); i++ {
-		if regions[oldRegion].classHosts[hostClass][i].HostIP == host.HostIP {
-			regions[oldRegion].classHosts[hostClass] = append(regions[oldRegion].classHosts[hostClass][:i], regions[oldRegion].classHosts[hostClass][i+1:]...)
+	for i := 0; i < len(r.regions[oldRegion].classHosts[hostClass]); i++ {
+		if r.regions[oldRegion].classHosts[hostClass][i].HostIP == host.HostIP {
+			r.regions[oldRegion].classHosts[hostClass] = append(r.regions[oldRegion].classHosts[hostClass][:i], r.regions[oldRegion].classHosts[hostClass][i+1:]...)
 			break
 		}
 	}
-	locks[oldRegion].classHosts[hostClass].Unlock()
-	locks[newRegion].classHosts[hostClass].Lock()
+	r.locks[oldRegion].classHosts[hostClass].Unlock()
+	r.locks[newRegion].classHosts[hostClass].Lock()
+	if host.removed { //the host was deregistered in the meantime
+		r.locks[newRegion].classHosts[hostClass].Unlock()
+		return
+	}
 			
 	//this inserts in new list
-	if newRegion == "LEE" || newRegion == "DEE" {
-		index := ReverseSort(regions[newRegion].classHosts[hostClass], host.TotalResourcesUtilization)		
-		regions[newRegion].classHosts[hostClass] = InsertHost(regions[newRegion].classHosts[hostClass], index, host)
-	} else {
-		index := Sort(regions[newRegion].classHosts[hostClass], host.TotalResourcesUtilization)
-		regions[newRegion].classHosts[hostClass] = InsertHost(regions[newRegion].classHosts[hostClass], index, host)
+	index := SortedIndex(newRegion, r.regions[newRegion].classHosts[hostClass], host.TotalResourcesUtilization)
+	r.regions[newRegion].classHosts[hostClass] = InsertHost(r.regions[newRegion].classHosts[hostClass], index, host)
+
+	host.Region = newRegion
+	event := HostEvent(EventRegionChanged, host)
+	r.RecordMutation(OpUpdateHostRegionList, *host)
+	r.locks[newRegion].classHosts[hostClass].Unlock()
+	if oldRegion != newRegion { //otherwise only the position of the host in its list changed
+		regionTransitions.Inc(oldRegion, newRegion)
+		event.From = oldRegion
+		event.To = newRegion
+		r.events.Publish(event)
 	}
-
-	hosts[host.HostIP].Region = newRegion
-	locks[newRegion].classHosts[hostClass].Unlock()
 }
 
 
 
 //used by initial scheduling and cut algorithm
-func GetListHostsLEE_DEE(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) GetListHostsLEE_DEE(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
-	requestClass := params["requestclass"]
-	listType := params["listtype"]
-
-	listHosts := make([]*Host, 0)
-	listHostsDEE := make([]*Host, 0)
-
-	//1 for initial scheduling 2 for cut algorithm
-	if listType == "1" {
-		listHosts = GetHostsLEE_normal(requestClass)
-		listHostsDEE = GetHostsDEE_normal(requestClass)
-
-	} else {
-		listHosts = GetHostsLEE_cut(requestClass)
-		listHostsDEE = GetHostsDEE_cut(requestClass)
 
+	listHosts, err := r.PlacementList(params["requestclass"], params["listtype"])
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	//nothing awake for initial scheduling, a sleeping host is woken for the next attempt. the cut list does not wake
+	//anything, cutting is the scheduler's way out when the hosts that are on are full
+	if params["listtype"] == "1" && len(listHosts) == 0 {
+		r.powerManager.WakeFor(params["requestclass"], 0, 0)
 	}
-	listHosts = append(listHosts, listHostsDEE...)
 	json.NewEncoder(w).Encode(listHosts)
 
 }
 
-func GetAllHosts(w http.ResponseWriter, req *http.Request) {
-
-	listHosts := make([]*Host, 0)
-	
-	for hostIP := range hosts {
-		listHosts = append(listHosts, hosts[hostIP])
-	} 
-	
-	json.NewEncoder(w).Encode(listHosts)
+func (r *Registry) GetAllHosts(w http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(w).Encode(r.HostSnapshots())
 }
 
 
 //used by kill algorithm
-func GetListHostsEED_DEE(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) GetListHostsEED_DEE(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
-	requestClass := params["requestclass"]
-
-	listHosts := GetHostsEED(requestClass)
-	listHostsDEE := GetHostsDEE_kill(requestClass)
-
-	listHosts = append(listHosts, listHostsDEE...)
 
+	listHosts, err := r.KillList(params["requestclass"])
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
 	json.NewEncoder(w).Encode(listHosts)
 }
 
 //for initial scheduling algorithm without resorting to cuts or kills
-func GetHostsLEE_normal(requestClass string) []*Host {
+func (r *Registry) GetHostsNormal(region string, requestClass string) []Host {
 	//we only get hosts that respect requestClass >= hostClass and order them by ascending order of their class
-	//class 1 hosts are always selected
-
-	listHosts := make([]*Host, 0)
-
-	if requestClass == "1" {
-		locks["LEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["LEE"].classHosts["1"]...)
-		locks["LEE"].classHosts["1"].Unlock()
-	} else if requestClass == "2" {
-		locks["LEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["LEE"].classHosts["1"]...)
-		locks["LEE"].classHosts["1"].Unlock()
-
-		locks["LEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["LEE"].classHosts["2"]...)
-		locks["LEE"].classHosts["2"].Unlock()
-
-	} else if requestClass == "3" {
-		locks["LEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["LEE"].classHosts["1"]...)
-		locks["LEE"].classHosts["1"].Unlock()
-
-		locks["LEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["LEE"].classHosts["2"]...)
-		locks["LEE"].classHosts["2"].Unlock()
-
-		locks["LEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["LEE"].classHosts["3"]...)
-		locks["LEE"].classHosts["3"].Unlock()
-
-	} else if requestClass == "4" {
-		locks["LEE"].classHosts["1"].Lock()
-			listHosts = append(listHosts, regions["LEE"].classHosts["1"]...)
-		locks["LEE"].classHosts["1"].Unlock()
-
-		locks["LEE"].classHosts["2"].Lock()
-			listHosts = append(listHosts, regions["LEE"].classHosts["2"]...)
-		locks["LEE"].classHosts["2"].Unlock()
-
-		locks["LEE"].classHosts["3"].Lock()
-			listHosts = append(listHosts, regions["LEE"].classHosts["3"]...)
-		locks["LEE"].classHosts["3"].Unlock()
-
-		locks["LEE"].classHosts["4"].Lock()
-			listHosts = append(listHosts, regions["LEE"].classHosts["4"]...)
-		locks["LEE"].classHosts["4"].Unlock()
-
-	}
-	return listHosts
+	//the most restrictive class is always selected
+	return r.GetHostsByClass(region, NormalClasses(requestClass))
 }
 
-
 //for CUT algorithm
-func GetHostsLEE_cut(requestClass string) []*Host {
+func (r *Registry) GetHostsCut(region string, requestClass string) []Host {
 	//we get all the hosts because the incoming request could fit in any if it receives a cut. However we only check tasks to cut where requestClass <= hostClass
 	//because at the other hosts there won't be probably anything we can cut so its not waste to cost of searching them.
-
-	listHosts := make([]*Host, 0)
-
-	locks["LEE"].classHosts["1"].Lock()
-	listHosts = append(listHosts, regions["LEE"].classHosts["1"]...)
-	locks["LEE"].classHosts["1"].Unlock()
-
-	locks["LEE"].classHosts["2"].Lock()
-	listHosts = append(listHosts, regions["LEE"].classHosts["2"]...)
-	locks["LEE"].classHosts["2"].Unlock()
-		
-	locks["LEE"].classHosts["3"].Lock()
-	listHosts = append(listHosts, regions["LEE"].classHosts["3"]...)
-	locks["LEE"].classHosts["3"].Unlock()
-		
-	locks["LEE"].classHosts["4"].Lock()
-	listHosts = append(listHosts, regions["LEE"].classHosts["4"]...)
-	locks["LEE"].classHosts["4"].Unlock()
-
-	return listHosts
+	return r.GetHostsByClass(region, config.Classes)
 }
 
-//for initial scheduling algori
-func GetHostsDEE_normal(requestClass string) []*Host {
-	//we only get hosts that respect requestClass >= hostClass and order them by ascending order of their class
-	//class 1 hosts are always selected
-	listHosts := make([]*Host, 0)
-
-	if requestClass == "1" {
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-
-	} else if requestClass == "2" {
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-		
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-	} else if requestClass == "3" {
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-
-		locks["DEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-		locks["DEE"].classHosts["3"].Unlock()
-
-	} else if requestClass == "4" {
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-
-		locks["DEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-		locks["DEE"].classHosts["3"].Unlock()
-
-		locks["DEE"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["4"]...)
-		locks["DEE"].classHosts["4"].Unlock()
-	}
-	return listHosts
-}
-
-//for CUT algorithm
-func GetHostsDEE_cut(requestClass string) []*Host {
-	//we get all the hosts because the incoming request could fit in any if it receives a cut. However we only check tasks to cut where requestClass <= hostClass
-	//because at the other hosts there won't be probably anything we can cut so its not waste to cost of searching them.
-
-	listHosts := make([]*Host, 0)
-	
-	locks["DEE"].classHosts["1"].Lock()
-	listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-	locks["DEE"].classHosts["1"].Unlock()
-
-	locks["DEE"].classHosts["2"].Lock()
-	listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-	locks["DEE"].classHosts["2"].Unlock()
-
-	locks["DEE"].classHosts["3"].Lock()
-	listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-	locks["DEE"].classHosts["3"].Unlock()
-
-	locks["DEE"].classHosts["4"].Lock()
-	listHosts = append(listHosts, regions["DEE"].classHosts["4"]...)
-	locks["DEE"].classHosts["4"].Unlock()
-
-	return listHosts
+//for KILL algorithm. The class of the request is searched first, then the less restrictive classes and finally the more restrictive ones
+func (r *Registry) GetHostsKill(region string, requestClass string) []Host {
+	return r.GetHostsByClass(region, KillClasses(requestClass))
 }
 
-//for KILL algorithm
-func GetHostsDEE_kill(requestClass string) []*Host {
-	listHosts := make([]*Host, 0)
-
-	switch requestClass {
-	case "1":
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-
-		locks["DEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-		locks["DEE"].classHosts["3"].Unlock()
-
-		locks["DEE"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["4"]...)
-		locks["DEE"].classHosts["4"].Unlock()
-		break
-	case "2":
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-
-		locks["DEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-		locks["DEE"].classHosts["3"].Unlock()
-
-		locks["DEE"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["4"]...)
-		locks["DEE"].classHosts["4"].Unlock()
-
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-
-		break
-	case "3":
-		locks["DEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-		locks["DEE"].classHosts["3"].Unlock()
-	
-		locks["DEE"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["4"]...)
-		locks["DEE"].classHosts["4"].Unlock()
+//concatenates the class lists of a region in the given class order. The hosts are copied under the class lock of their
+//list, so they can be encoded while the hosts change
+func (r *Registry) GetHostsByClass(region string, classes []string) []Host {
+	listHosts := make([]Host, 0)
 
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-
-		break
-	case "4":
-		locks["DEE"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["4"]...)
-		locks["DEE"].classHosts["4"].Unlock()
-
-		locks["DEE"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["3"]...)
-		locks["DEE"].classHosts["3"].Unlock()
-
-		locks["DEE"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["2"]...)
-		locks["DEE"].classHosts["2"].Unlock()
-
-		locks["DEE"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["DEE"].classHosts["1"]...)
-		locks["DEE"].classHosts["1"].Unlock()
-		break
-	}
-	return listHosts
-}
-
-func GetHostsEED(requestClass string) []*Host {
-	listHosts := make([]*Host, 0)
-
-	switch requestClass {
-	case "1":
-		locks["EED"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["1"]...)
-		locks["EED"].classHosts["1"].Unlock()
-
-		locks["EED"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["2"]...)
-		locks["EED"].classHosts["2"].Unlock()
-
-		locks["EED"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["3"]...)
-		locks["EED"].classHosts["3"].Unlock()
-
-		locks["EED"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["4"]...)
-		locks["EED"].classHosts["4"].Unlock()
-		break
-	case "2":
-		locks["EED"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["2"]...)
-		locks["EED"].classHosts["2"].Unlock()
-
-		locks["EED"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["3"]...)
-		locks["EED"].classHosts["3"].Unlock()
-	
-		locks["EED"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["4"]...)
-		locks["EED"].classHosts["4"].Unlock()
-		
-		locks["EED"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["1"]...)
-		locks["EED"].classHosts["1"].Unlock()
-		break
-	case "3":
-		locks["EED"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["3"]...)
-		locks["EED"].classHosts["3"].Unlock()
-
-		locks["EED"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["4"]...)
-		locks["EED"].classHosts["4"].Unlock()
-
-		locks["EED"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["2"]...)
-		locks["EED"].classHosts["2"].Unlock()
-
-		locks["EED"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["1"]...)
-		locks["EED"].classHosts["1"].Unlock()
-		break
-	case "4":
-		locks["EED"].classHosts["4"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["4"]...)
-		locks["EED"].classHosts["4"].Unlock()
-
-		locks["EED"].classHosts["3"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["3"]...)
-		locks["EED"].classHosts["3"].Unlock()
-
-		locks["EED"].classHosts["2"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["2"]...)
-		locks["EED"].classHosts["2"].Unlock()
-
-		locks["EED"].classHosts["1"].Lock()
-		listHosts = append(listHosts, regions["EED"].classHosts["1"]...)
-		locks["EED"].classHosts["1"].Unlock()
-		break
+	for _, class := range classes {
+		r.locks[region].classHosts[class].Lock()
+		for _, host := range PoweredHosts(LiveHosts(r.regions[region].classHosts[class])) {
+			listHosts = append(listHosts, *host)
+		}
+		r.locks[region].classHosts[class].Unlock()
 	}
 	return listHosts
 }
 
 //updates both memory and cpu. message received from energy monitors. 
-func UpdateBothResources(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) UpdateBothResources(w http.ResponseWriter, req *http.Request) {
 	//the host is going to be identified by the IP
-
 	params := mux.Vars(req)
-	hostIP := params["hostip"]
-	cpuUpdate := params["cpu"]
-	memoryUpdate := params["memory"]
-	
-	cpuToUpdate, _ := strconv.ParseFloat(cpuUpdate,64)
-	memoryToUpdate, _ := strconv.ParseFloat(memoryUpdate,64)
 
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
-
-	locks[hostRegion].classHosts[hostClass].Lock()			
-	hosts[hostIP].CPU_Utilization = cpuToUpdate
-	hosts[hostIP].MemoryUtilization = memoryToUpdate
-	locks[hostRegion].classHosts[hostClass].Unlock()				
-
-	go UpdateTotalResourcesUtilization(cpuToUpdate, memoryToUpdate, 1, hostIP)
-}
+	cpuToUpdate, err := strconv.ParseFloat(params["cpu"], 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "cpu", Message: err.Error()})
+		return
+	}
+	memoryToUpdate, err := strconv.ParseFloat(params["memory"], 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "memory", Message: err.Error()})
+		return
+	}
 
-//benchmark: gathers data regarding cpu and memory utilization of host for post analysis
-func GatherData(cpu float64, memory float64, hostIP string) {
-	//write the data gathered to a file
-	// open files r and w
-	cpuUtilization := strconv.FormatFloat(cpu * 100, 'f', -1, 64)
-        memoryUtilization := strconv.FormatFloat(memory * 100, 'f', -1, 64)
-
-        fileCPU, err1 := os.OpenFile(hostIP+"Cpu.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-        fileMemory, err2 := os.OpenFile(hostIP+"Memory.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-        fileTime, err3 := os.OpenFile(hostIP+"Time.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-             
-        if err1 != nil || err2 != nil || err3 != nil{
-                panic(err1)
-        }
-        defer fileCPU.Close()
-        defer fileMemory.Close()
-        defer fileTime.Close()
-
-        if _, err1 = fileCPU.WriteString(cpuUtilization+"\n"); err1 != nil {
-                panic(err1)
-        }
-        if _, err2 = fileMemory.WriteString(memoryUtilization+"\n"); err2 != nil {
-                panic(err2)
-        }
-        t := time.Now()
-        if _, err3 = fileTime.WriteString(t.String()+"\n"); err3 != nil {
-                panic(err3)
-        }
+	if err = r.SetUtilization(params["hostip"], &cpuToUpdate, &memoryToUpdate); err != nil {
+		WriteError(w, err)
+	}
 }
 
 //function whose job is to check whether the total resources should be updated or not.
-func UpdateTotalResourcesUtilization(cpu float64, memory float64, updateType int, hostIP string){
+func (r *Registry) UpdateTotalResourcesUtilization(cpu float64, memory float64, updateType int, hostIP string){
+	host, err := r.LookupHost(hostIP)
+	if err != nil { //deregistered in the meantime
+		return
+	}
+
+	lock := r.LockHost(host)
 	//this will be used in case there is no region change to avoid updating the host position in its current region if its total has not changed
-	previousTotalResourceUtilization := hosts[hostIP].TotalResourcesUtilization
+	previousTotalResourceUtilization := host.TotalResourcesUtilization
 	afterTotalResourceUtilization := 0.0
-
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
-
 	//benchmark purposes, gathering data
-	locks[hostRegion].classHosts[hostClass].Lock()
-        GatherData(hosts[hostIP].CPU_Utilization, hosts[hostIP].MemoryUtilization, hostIP)
-        locks[hostRegion].classHosts[hostClass].Unlock()
-
+	r.history.Record(HistoryRecord{Kind: RecordUtilization, HostIP: hostIP, CPU: host.CPU_Utilization, Memory: host.MemoryUtilization})
 
 	//1-> both resources, 2-> cpu, 3-> memory
 	switch updateType {
 		case 1:
 			afterTotalResourceUtilization = math.Max(cpu, memory)
-
-			locks[hostRegion].classHosts[hostClass].Lock()					
-			hosts[hostIP].TotalResourcesUtilization = afterTotalResourceUtilization
-			locks[hostRegion].classHosts[hostClass].Unlock()					
-			break
 		case 2:
-			memoryCurrent := hosts[hostIP].MemoryUtilization
-			afterTotalResourceUtilization = math.Max(cpu, memoryCurrent)
-
-			locks[hostRegion].classHosts[hostClass].Lock()							
-			hosts[hostIP].TotalResourcesUtilization = afterTotalResourceUtilization
-			locks[hostRegion].classHosts[hostClass].Unlock()					
-			break
+			afterTotalResourceUtilization = math.Max(cpu, host.MemoryUtilization)
 		case 3:
-			cpuCurrent := hosts[hostIP].CPU_Utilization
-			afterTotalResourceUtilization = math.Max(cpuCurrent, memory)
-
-			locks[hostRegion].classHosts[hostClass].Lock()							
-			hosts[hostIP].TotalResourcesUtilization = afterTotalResourceUtilization
-			locks[hostRegion].classHosts[hostClass].Unlock()					
-			break
+			afterTotalResourceUtilization = math.Max(host.CPU_Utilization, memory)
 	}
+	host.TotalResourcesUtilization = afterTotalResourceUtilization
+	lock.Unlock()
+
 	//now we must check if the host region should be updated or not
-	if !CheckIfRegionUpdate(hostIP) && afterTotalResourceUtilization != previousTotalResourceUtilization { //if an update to the host region is not required then we update this host position inside its region list
-		hostRegion := hosts[hostIP].Region
-		go UpdateHostRegionList(hostRegion, hostRegion, hosts[hostIP])		
+	if !r.CheckIfRegionUpdate(host) && afterTotalResourceUtilization != previousTotalResourceUtilization { //if an update to the host region is not required then we update this host position inside its region list
+		lock = r.LockHost(host)
+		hostRegion := host.Region
+		lock.Unlock()
+		r.UpdateHostRegionList(hostRegion, hostRegion, host)
 	}
 }
 
-func CheckIfRegionUpdate(hostIP string) bool {
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
+func (r *Registry) CheckIfRegionUpdate(host *Host) bool {
+	lock := r.LockHost(host)
+	hostRegion := host.Region
+	newRegion := RegionFor(host.TotalResourcesUtilization).Name
+	lock.Unlock()
 
-	locks[hostRegion].classHosts[hostClass].Lock()					
-	if hosts[hostIP].TotalResourcesUtilization < 0.5 { //LEE region
-		if hostRegion != "LEE" { //if this is true then we must update this host region because it changed
-			locks[hostRegion].classHosts[hostClass].Unlock()					
-			UpdateHostRegion(hostIP, "LEE")
-			return true
-		}
-	} else if hosts[hostIP].TotalResourcesUtilization < 0.85 { //DEE region
-		if hostRegion != "DEE" { //if this is true then we must update this host region because it changed
-			locks[hostRegion].classHosts[hostClass].Unlock()					
-			UpdateHostRegion(hostIP, "DEE")
-			return true
-		}
-	} else { //EED region
-		if hostRegion != "EED" { //if this is true then we must update this host region because it changed
-			locks[hostRegion].classHosts[hostClass].Unlock()					
-			UpdateHostRegion(hostIP, "EED")
-			return true
-		}
+	if newRegion != hostRegion { //if this is true then we must update this host region because it changed
+		r.UpdateHostRegion(host, newRegion)
+		return true
 	}
-	locks[hostRegion].classHosts[hostClass].Unlock()					
 	return false
 }
 
 //information received from monitor
-func UpdateCPU(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) UpdateCPU(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
-	hostIP := params["hostip"]
-	cpuUpdate := params["cpu"]
-
-	cpuToUpdate, _ := strconv.ParseFloat(cpuUpdate,64)
 
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
+	cpuToUpdate, err := strconv.ParseFloat(params["cpu"], 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "cpu", Message: err.Error()})
+		return
+	}
 
-	locks[hostRegion].classHosts[hostClass].Lock()					
-	hosts[hostIP].CPU_Utilization = cpuToUpdate
-	locks[hostRegion].classHosts[hostClass].Unlock()
-	
-	go UpdateTotalResourcesUtilization(cpuToUpdate, 0.0, 2, hostIP)
-		
+	if err = r.SetUtilization(params["hostip"], &cpuToUpdate, nil); err != nil {
+		WriteError(w, err)
+	}
 }
 
 //information received from monitor
-func UpdateMemory(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) UpdateMemory(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
-	hostIP := params["hostip"]
-	memoryUpdate := params["memory"]
 
-	memoryToUpdate, _ := strconv.ParseFloat(memoryUpdate,64)
-
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
+	memoryToUpdate, err := strconv.ParseFloat(params["memory"], 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "memory", Message: err.Error()})
+		return
+	}
 
-	locks[hostRegion].classHosts[hostClass].Lock()					
-	hosts[hostIP].MemoryUtilization = memoryToUpdate
-	locks[hostRegion].classHosts[hostClass].Unlock()
-					
-	go UpdateTotalResourcesUtilization(0.0, memoryToUpdate, 3, hostIP)
+	if err = r.SetUtilization(params["hostip"], nil, &memoryToUpdate); err != nil {
+		WriteError(w, err)
+	}
 }
 
-//this function collects info regarding allocated resources and its resource utilization
-func GatherData2(cpu float64, memory float64, hostIP string, cpuAllocated int64, memoryAllocated int64 ) {
-        //write the data gathered to a file
-        // open files r and w
-        cpuUtilization := strconv.FormatFloat(cpu * 100, 'f', -1, 64)
-        memoryUtilization := strconv.FormatFloat(memory * 100, 'f', -1, 64)
-        cpuAlloc := strconv.FormatInt(cpuAllocated, 10)
-        memoryAlloc := strconv.FormatInt(memoryAllocated, 10)
-
-        fileCPU, err1 := os.OpenFile(hostIP+"CPUAlloc.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-        fileMemory, err2 := os.OpenFile(hostIP+"MemoryAlloc.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-        fileTime, err3 := os.OpenFile(hostIP+"TimeAlloc.txt", os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-
-        if err1 != nil || err2 != nil || err3 != nil{
-                panic(err1)
-        }
-        defer fileCPU.Close()
-        defer fileMemory.Close()
-	defer fileTime.Close()
-
-        if _, err1 = fileCPU.WriteString("CPU usage: " + cpuUtilization + " CPU Allocated: " + cpuAlloc + "\n"); err1 != nil {
-                panic(err1)
-        }
-        if _, err2 = fileMemory.WriteString("Memory usage: " + memoryUtilization + " Memory allocated: " + memoryAlloc + "\n"); err2 != nil {
-                panic(err2)
-        }
-        t := time.Now()
-        if _, err3 = fileTime.WriteString(t.String()+"\n"); err3 != nil {
-                panic(err3)
-        }
-
+func (r *Registry) UpdateResources(cpuUpdate int64, memoryUpdate int64, hostIP string) error {
+	return r.updateResources(cpuUpdate, memoryUpdate, hostIP, nil)
 }
 
+//admit, when given, is called under the class lock of the host and refuses the update by returning an error
+func (r *Registry) updateResources(cpuUpdate int64, memoryUpdate int64, hostIP string, admit func(host *Host) error) error {
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		return err
+	}
 
-func UpdateResources(cpuUpdate int64, memoryUpdate int64, hostIP string) {
-	hostRegion := hosts[hostIP].Region
-	hostClass := hosts[hostIP].HostClass
-
-	locks[hostRegion].classHosts[hostClass].Lock()
+	lock := r.LockHost(host)
+	if admit != nil {
+		if err = admit(host); err != nil {
+			lock.Unlock()
+			return err
+		}
+	}
     
-    	hosts[hostIP].AllocatedMemory -= memoryUpdate
-    	hosts[hostIP].AllocatedCPUs -= cpuUpdate
+    	host.AllocatedMemory -= memoryUpdate
+    	host.AllocatedCPUs -= cpuUpdate
 
-	go GatherData2(hosts[hostIP].CPU_Utilization, hosts[hostIP].MemoryUtilization, hostIP, hosts[hostIP].AllocatedCPUs, hosts[hostIP].AllocatedMemory) 
+	r.history.Record(HistoryRecord{Kind: RecordAllocation, HostIP: hostIP, CPU: host.CPU_Utilization, Memory: host.MemoryUtilization,
+		AllocatedCPUs: host.AllocatedCPUs, AllocatedMemory: host.AllocatedMemory})
 	//update overbooking of this host
-	cpuOverbooking := float64(hosts[hostIP].AllocatedCPUs) / float64(hosts[hostIP].TotalCPUs)
-    	memoryOverbooking := float64(hosts[hostIP].AllocatedMemory) / float64(hosts[hostIP].TotalMemory)
+	cpuOverbooking := float64(host.AllocatedCPUs) / float64(host.TotalCPUs)
+    	memoryOverbooking := float64(host.AllocatedMemory) / float64(host.TotalMemory)
 
-    	hosts[hostIP].OverbookingFactor = math.Max(cpuOverbooking, memoryOverbooking)
-    	locks[hostRegion].classHosts[hostClass].Unlock()
+    	host.OverbookingFactor = math.Max(cpuOverbooking, memoryOverbooking)
+	event := HostEvent(EventAllocation, host)
+	r.RecordMutation(OpUpdateResources, *host)
+    	lock.Unlock()
+	//negative when resources are released
+	event.CPU = -cpuUpdate
+	event.Memory = -memoryUpdate
+	r.events.Publish(event)
+	return nil
 }
 
 //updates information about allocated resources and recalculates overbooking factor.
 //this is information received from the Scheduler when it makes a scheduling decision
-func UpdateAllocatedResourcesAndOverbooking(w http.ResponseWriter, req *http.Request) {
+func (r *Registry) UpdateAllocatedResourcesAndOverbooking(w http.ResponseWriter, req *http.Request) {
 	//é preciso host id, cpu e memoria do request 
 	params := mux.Vars(req)
-	hostIP := params["hostip"]
-	newCPU := params["cpu"]
-	newMemory := params["memory"]
 
-	auxCPU,_ := strconv.ParseInt(newCPU,10, 64)
-	auxMemory,_ := strconv.ParseInt(newMemory,10, 64)
+	auxCPU, err := strconv.ParseInt(params["cpu"], 10, 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "cpu", Message: err.Error()})
+		return
+	}
+	auxMemory, err := strconv.ParseInt(params["memory"], 10, 64)
+	if err != nil {
+		WriteError(w, &ValidationError{Field: "memory", Message: err.Error()})
+		return
+	}
 
-	go UpdateResources(-auxCPU, -auxMemory, hostIP)
+	if err = r.AllocateResources(params["hostip"], auxCPU, auxMemory); err != nil {
+		WriteError(w, err)
+	}
 }
 
 
 func main() {
-	regions = make(map[string]Region)
-	hosts = make(map[string]*Host)
-	locks = make(map[string]Lock)	
-	ServeSchedulerRequests()
+	//subcommands run instead of the registry and parse their own flags
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	flag.Parse()
+
+	var err error
+	if config, err = LoadConfig(*configFile); err != nil {
+		log.Fatal(err)
+	}
+	if *nodeID != "" {
+		config.Replication.NodeID = *nodeID
+	}
+	runtime, err := NewRuntime(config.Runtime)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registry := NewRegistry(runtime)
+	powerHooks, err := NewPowerHooks(config.PowerStates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	registry.powerManager = NewPowerManager(registry, config.PowerStates, powerHooks)
+	if err = catalog.Load(config.Catalog); err != nil {
+		log.Fatal(err)
+	}
+	registry.events = NewEventBroker(*eventHistory)
+	if registry.history, err = NewHistoryRecorder(config.History); err != nil {
+		log.Fatal(err)
+	}
+	//queued history records are written before exiting
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		registry.history.Flush()
+		os.Exit(0)
+	}()
+	registry.ServeSchedulerRequests()
+}
+
+//creates the empty region/class lists of the configuration
+func (r *Registry) InitRegions() {
+	r.regions = make(map[string]Region)
+	r.hosts = make(map[string]*Host)
+	r.locks = make(map[string]Lock)
+	for _, region := range config.Regions {
+		lockClass := make(map[string]*sync.Mutex)
+		for _, class := range config.Classes {
+			lockClass[class] = &sync.Mutex{}
+		}
+		r.locks[region.Name] = Lock{classHosts: lockClass, lock: &sync.Mutex{}}
+		r.regions[region.Name] = Region{make(map[string][]*Host)}
+	}
+}
+
+func (r *Registry) ServeSchedulerRequests() {
+	//rebuild the region/class lists from the write-ahead log, or from the consensus log when replicated, before
+	//accepting requests
+	if config.Replication.Enabled() {
+		r.InitReplication(config.Replication)
+	} else {
+		r.InitStateStore()
+	}
+	go r.RunLivenessTracker(*livenessInterval)
+	go r.RunTaskPruner(taskPruneInterval)
+	if r.powerManager.Enabled() {
+		checkInterval, _ := time.ParseDuration(config.PowerStates.CheckInterval)
+		go r.RunPowerManager(checkInterval)
+	}
+
+	InitAuth(config.Auth)
+	if err := InitTraceRecorder(*traceFile); err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, err := ServerTLSConfig(config.Auth.TLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: ListenAddress(), Handler: r.Router(), TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
 }
 
-func ServeSchedulerRequests() {
+//the routes of the API behind the middlewares, and the ones of the consensus when replicated
+func (r *Registry) Router() *mux.Router {
 	router := mux.NewRouter()
-	
-	lockClassLEE := make(map[string]*sync.Mutex)
-	lockClassDEE := make(map[string]*sync.Mutex)
-	lockClassEED := make(map[string]*sync.Mutex)
-
-	lockClassLEE["1"] = &sync.Mutex{}
-	lockClassLEE["2"] = &sync.Mutex{}
-	lockClassLEE["3"] = &sync.Mutex{}
-	lockClassLEE["4"] = &sync.Mutex{}
-
-	lockClassDEE["1"] = &sync.Mutex{}
-	lockClassDEE["2"] = &sync.Mutex{}
-	lockClassDEE["3"] = &sync.Mutex{}
-	lockClassDEE["4"] = &sync.Mutex{}
-
-	lockClassEED["1"] = &sync.Mutex{}
-	lockClassEED["2"] = &sync.Mutex{}
-	lockClassEED["3"] = &sync.Mutex{}
-	lockClassEED["4"] = &sync.Mutex{}
-
-	locks["LEE"] = Lock{classHosts: lockClassLEE, lock: &sync.Mutex{}}
-	locks["DEE"] = Lock{lockClassDEE, &sync.Mutex{}}
-	locks["EED"] = Lock{lockClassEED, &sync.Mutex{}}
-
-
-	classLEE := make(map[string][]*Host)
-	classDEE := make(map[string][]*Host)
-	classEED := make(map[string][]*Host)
-
-	regions["LEE"] = Region{classLEE}
-	regions["DEE"] = Region{classDEE}
-	regions["EED"] = Region{classEED}
-
-	router.HandleFunc("/host/list", GetAllHosts).Methods("GET")
-	router.HandleFunc("/host/list/{requestclass}&{listtype}", GetListHostsLEE_DEE).Methods("GET")
-	router.HandleFunc("/host/listkill/{requestclass}", GetListHostsEED_DEE).Methods("GET")
-	router.HandleFunc("/host/updateclass/{requestclass}&{hostip}", UpdateHostClass).Methods("GET")
-	router.HandleFunc("/host/createhost/{hostip}&{totalmemory}&{totalcpu}", CreateHost).Methods("GET")
-	router.HandleFunc("/host/updatetask/{taskid}&{newcpu}&{newmemory}&{hostip}&{cpucut}&{memorycut}", UpdateTaskResources).Methods("GET")
-	router.HandleFunc("/host/killtask", TaskTerminated).Methods("POST")
-	router.HandleFunc("/host/reschedule", RescheduleTask).Methods("POST")
-	router.HandleFunc("/host/updateboth/{hostip}&{cpu}&{memory}", UpdateBothResources).Methods("GET")
-	router.HandleFunc("/host/updatecpu/{hostip}&{cpu}", UpdateCPU).Methods("GET")
-	router.HandleFunc("/host/updatememory/{hostip}&{memory}", UpdateMemory).Methods("GET")
-	router.HandleFunc("/host/updateresources/{hostip}&{cpu}&{memory}", UpdateAllocatedResourcesAndOverbooking).Methods("GET")
-
-	log.Fatal(http.ListenAndServe(getIPAddress()+":12345", router))
+	if r.raftNode != nil {
+		router.PathPrefix("/raft/").Handler(r.raftNode.Handler())
+	}
+	router.Use(InstrumentHandlers)
+	router.Use(AuthenticateRequests)
+	router.Use(r.ReplicateWrites)
+	router.Use(RecordTraffic)
+	r.RegisterRoutes(router)
+	return router
+}
+
+//the routes of the API, without the middlewares
+func (r *Registry) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/metrics", r.GetMetrics).Methods("GET")
+	router.HandleFunc("/host/list", r.GetAllHosts).Methods("GET")
+	router.HandleFunc("/host/list/{requestclass}&{listtype}", r.GetListHostsLEE_DEE).Methods("GET")
+	router.HandleFunc("/host/listkill/{requestclass}", r.GetListHostsEED_DEE).Methods("GET")
+	router.HandleFunc("/host/updateclass/{requestclass}&{hostip}", r.UpdateHostClass).Methods("GET")
+	router.HandleFunc("/host/createhost/{hostip}&{totalmemory}&{totalcpu}", r.CreateHost).Methods("GET")
+	router.HandleFunc("/host/deletehost/{hostip}&{force}", r.DeleteHost).Methods("GET", "DELETE")
+	router.HandleFunc("/host/deletehost/{hostip}", r.DeleteHost).Methods("GET", "DELETE")
+	router.HandleFunc("/host/updatetask/{taskid}&{newcpu}&{newmemory}&{hostip}&{cpucut}&{memorycut}", r.UpdateTaskResources).Methods("GET")
+	router.HandleFunc("/host/killtask", r.TaskTerminated).Methods("POST")
+	router.HandleFunc("/host/reschedule", r.RescheduleTask).Methods("POST")
+	router.HandleFunc("/ports/leases", r.GetPortLeases).Methods("GET")
+	router.HandleFunc("/history/records", r.GetHistoryRecords).Methods("GET")
+	router.HandleFunc("/catalog", GetCatalog).Methods("GET")
+	router.HandleFunc("/catalog/reload", ReloadCatalog).Methods("POST")
+	router.HandleFunc("/catalog/validate", ValidateCatalog).Methods("POST")
+	router.HandleFunc("/host/updateboth/{hostip}&{cpu}&{memory}", r.UpdateBothResources).Methods("GET")
+	router.HandleFunc("/host/updatecpu/{hostip}&{cpu}", r.UpdateCPU).Methods("GET")
+	router.HandleFunc("/host/updatememory/{hostip}&{memory}", r.UpdateMemory).Methods("GET")
+	router.HandleFunc("/host/updateresources/{hostip}&{cpu}&{memory}", r.UpdateAllocatedResourcesAndOverbooking).Methods("GET")
+	r.RegisterV2Routes(router)
 }
 
 func getIPAddress() string {
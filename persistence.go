@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//the registry state is persisted as a write-ahead log of host and task mutations plus a periodic compacted snapshot.
+//each log record carries the full state of the host or task after the mutation so replaying is idempotent.
+
+const (
+	OpCreateHost           = "createhost"
+	OpUpdateHostList       = "updatehostlist"
+	OpUpdateHostRegionList = "updatehostregionlist"
+	OpUpdateResources      = "updateresources"
+	OpUpdateTaskResources  = "updatetaskresources"
+	OpUpdatePowerState     = "updatepowerstate"
+	OpDeleteHost           = "deletehost"
+	OpCreateTask           = "createtask"
+	OpUpdateTask           = "updatetask"
+	OpDeleteTask           = "deletetask"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	logFile      = "wal.log"
+)
+
+var stateDir = flag.String("statedir", "state", "directory for the registry write-ahead log and snapshots (empty disables persistence)")
+var snapshotInterval = flag.Duration("snapshotinterval", 5*time.Minute, "how often the write-ahead log is compacted into a snapshot")
+
+type StateRecord struct {
+	Seq  uint64      `json:"seq"`
+	Op   string      `json:"op"`
+	Time time.Time   `json:"time"`
+	Host Host        `json:"host"`
+	Task *TaskRecord `json:"task,omitempty"` //set on the task mutations instead of the host
+}
+
+type Snapshot struct {
+	Seq   uint64       `json:"seq"`
+	Time  time.Time    `json:"time"`
+	Hosts []Host       `json:"hosts"`
+	Tasks []TaskRecord `json:"tasks,omitempty"`
+}
+
+type StateStore struct {
+	dir      string
+	mutex    *sync.Mutex
+	log      *os.File
+	seq      uint64
+	pending  int //records appended since the last snapshot
+	registry *Registry
+}
+
+func OpenStateStore(registry *Registry, dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &StateStore{dir: dir, mutex: &sync.Mutex{}, log: file, registry: registry}, nil
+}
+
+//records a mutation of a host, in the consensus log when replicated. It is a no-op when persistence is disabled. Must
+//be called with the class lock of the host held, host being its copy, so the records of a host follow its changes
+func (r *Registry) RecordMutation(op string, host Host) {
+	if r.raftNode != nil {
+		r.ProposeMutation(op, host)
+		return
+	}
+	if r.stateStore == nil {
+		return
+	}
+	r.stateStore.Append(op, host)
+}
+
+//records a mutation of a task. It is a no-op when persistence is disabled
+func (r *Registry) RecordTaskMutation(op string, id string) {
+	if r.raftNode != nil {
+		r.ProposeTaskMutation(op, id)
+		return
+	}
+	if r.stateStore == nil {
+		return
+	}
+	r.stateStore.AppendTask(op, id)
+}
+
+func (s *StateStore) Append(op string, host Host) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	record := StateRecord{Seq: s.seq, Op: op, Time: time.Now(), Host: host}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("state: could not encode %s record for %s: %v", op, host.HostIP, err)
+		return
+	}
+	if _, err = s.log.Write(append(line, '\n')); err != nil {
+		log.Printf("state: could not append %s record for %s: %v", op, host.HostIP, err)
+		return
+	}
+	s.pending++
+}
+
+func (s *StateStore) AppendTask(op string, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	//the task is copied inside the store lock so the last record of a task always holds its newest state
+	record := StateRecord{Seq: s.seq, Op: op, Time: time.Now(), Task: s.registry.TaskState(op, id)}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("state: could not encode %s record for task %s: %v", op, id, err)
+		return
+	}
+	if _, err = s.log.Write(append(line, '\n')); err != nil {
+		log.Printf("state: could not append %s record for task %s: %v", op, id, err)
+		return
+	}
+	s.pending++
+}
+
+//state of a task recorded for op, only its id once it is deleted
+func (r *Registry) TaskState(op string, id string) *TaskRecord {
+	if task := r.tasks.lookup(id); task != nil && op != OpDeleteTask {
+		return task
+	}
+	return &TaskRecord{ID: id}
+}
+
+//writes the state to the snapshot file and drops the records it holds from the log. The hosts are copied under their
+//class locks, which the records are appended under, so the store lock is not held meanwhile: every record up to the
+//sequence read before copying is in the copies and the later ones stay in the log
+func (s *StateStore) Snapshot() error {
+	s.mutex.Lock()
+	seq := s.seq
+	s.mutex.Unlock()
+
+	snapshot := Snapshot{Seq: seq, Time: time.Now(), Hosts: s.registry.HostSnapshots(), Tasks: s.registry.tasks.Snapshot()}
+
+	tmpPath := filepath.Join(s.dir, snapshotFile+".tmp")
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(file).Encode(snapshot); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.truncate(seq)
+}
+
+//drops the records up to seq from the log. Must be called with the mutex held
+func (s *StateStore) truncate(seq uint64) error {
+	kept := make([][]byte, 0)
+	if s.seq > seq {
+		if _, err := s.log.Seek(0, 0); err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(s.log)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var record StateRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err == nil && record.Seq > seq {
+				kept = append(kept, append(append([]byte{}, scanner.Bytes()...), '\n'))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, 0); err != nil {
+		return err
+	}
+	for _, line := range kept {
+		if _, err := s.log.Write(line); err != nil {
+			return err
+		}
+	}
+	s.pending = len(kept)
+	return nil
+}
+
+//periodically compacts the log. Meant to run on its own goroutine
+func (s *StateStore) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.mutex.Lock()
+		pending := s.pending
+		s.mutex.Unlock()
+
+		if pending == 0 {
+			continue
+		}
+		if err := s.Snapshot(); err != nil {
+			log.Printf("state: snapshot failed: %v", err)
+		}
+	}
+}
+
+//loads the snapshot, replays the log on top of it and rebuilds the region/class lists.
+//must be called after the regions and locks are initialized and before serving requests
+func (s *StateStore) Restore() error {
+	restored := make(map[string]Host)
+	restoredTasks := make(map[string]TaskRecord)
+
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var snapshot Snapshot
+		if err = json.Unmarshal(data, &snapshot); err != nil {
+			return err
+		}
+		for _, host := range snapshot.Hosts {
+			restored[host.HostIP] = host
+		}
+		for _, task := range snapshot.Tasks {
+			restoredTasks[task.ID] = task
+		}
+		s.seq = snapshot.Seq
+	}
+
+	if _, err = s.log.Seek(0, 0); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(s.log)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	replayed := 0
+	valid := int64(0) //length of the log up to the last readable record
+	torn := false
+	for scanner.Scan() {
+		var record StateRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			//a torn write at the end of the log, everything before it is still valid
+			log.Printf("state: dropping unreadable log record after seq %d: %v", s.seq, err)
+			torn = true
+			break
+		}
+		valid += int64(len(scanner.Bytes())) + 1
+		if record.Seq <= s.seq {
+			continue
+		}
+		if record.Task != nil {
+			if record.Op == OpDeleteTask {
+				delete(restoredTasks, record.Task.ID)
+			} else {
+				restoredTasks[record.Task.ID] = *record.Task
+			}
+		} else if record.Op == OpDeleteHost {
+			delete(restored, record.Host.HostIP)
+		} else {
+			restored[record.Host.HostIP] = record.Host
+		}
+		s.seq = record.Seq
+		replayed++
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	//the new records must follow the last readable one, or the next restore would stop at the torn one before them
+	if torn {
+		if err = s.log.Truncate(valid); err != nil {
+			return err
+		}
+	}
+	end, err := s.log.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	if end < valid {
+		//the last record was written without its newline
+		if _, err = s.log.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	s.pending = replayed
+
+	for hostIP := range restored {
+		host := restored[hostIP]
+		s.registry.RestoreHost(&host)
+	}
+	listTasks := make([]TaskRecord, 0, len(restoredTasks))
+	for _, task := range restoredTasks {
+		listTasks = append(listTasks, task)
+	}
+	s.registry.tasks.restore(listTasks)
+	log.Printf("state: restored %d hosts and %d tasks (%d log records replayed)", len(restored), len(listTasks), replayed)
+	return nil
+}
+
+//puts a restored host back in the hosts map and in its region/class list, keeping the list sorted
+func (r *Registry) RestoreHost(host *Host) {
+	if _, ok := r.regions[host.Region]; !ok {
+		newRegion := RegionFor(host.TotalResourcesUtilization).Name
+		log.Printf("state: host %s has unknown region %s, moving it to %s", host.HostIP, host.Region, newRegion)
+		host.Region = newRegion
+	}
+	if _, ok := r.locks[host.Region].classHosts[host.HostClass]; !ok {
+		log.Printf("state: host %s has unknown class %s, moving it to class %s", host.HostIP, host.HostClass, LeastRestrictiveClass())
+		host.HostClass = LeastRestrictiveClass()
+	}
+
+	r.locks[host.Region].classHosts[host.HostClass].Lock()
+	//a restarted registry gives every host a full timeout to report again
+	MarkAlive(host)
+	r.hostsLock.Lock()
+	r.hosts[host.HostIP] = host
+	r.hostsLock.Unlock()
+	index := SortedIndex(host.Region, r.regions[host.Region].classHosts[host.HostClass], host.TotalResourcesUtilization)
+	r.regions[host.Region].classHosts[host.HostClass] = InsertHost(r.regions[host.Region].classHosts[host.HostClass], index, host)
+	r.locks[host.Region].classHosts[host.HostClass].Unlock()
+}
+
+//opens the state directory given on the command line and restores from it
+func (r *Registry) InitStateStore() {
+	if *stateDir == "" {
+		return
+	}
+	store, err := OpenStateStore(r, *stateDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = store.Restore(); err != nil {
+		log.Fatal(err)
+	}
+	r.stateStore = store
+	go r.stateStore.Run(*snapshotInterval)
+}
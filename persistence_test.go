@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//a registry persisting to dir, as InitStateStore opens it
+func openPersisted(t *testing.T, dir string) *Registry {
+	t.Helper()
+	registry := NewRegistry(NewFakeRuntime())
+	store, err := OpenStateStore(registry, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.log.Close() })
+	if err = store.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	registry.stateStore = store
+	registry.background = func(update func()) { update() }
+	return registry
+}
+
+func registerHosts(t *testing.T, registry *Registry, hostIPs ...string) {
+	t.Helper()
+	for _, hostIP := range hostIPs {
+		if _, err := registry.RegisterHost(hostIP, 1<<30, 4*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectHosts(t *testing.T, registry *Registry, hostIPs ...string) {
+	t.Helper()
+	snapshots := registry.HostSnapshots()
+	if len(snapshots) != len(hostIPs) {
+		t.Fatalf("restored %d hosts, expected %v", len(snapshots), hostIPs)
+	}
+	for _, hostIP := range hostIPs {
+		if _, err := registry.SnapshotHost(hostIP); err != nil {
+			t.Errorf("%s was not restored: %v", hostIP, err)
+		}
+	}
+}
+
+func TestStateStoreRestoresSnapshotAndLog(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	registry := openPersisted(t, dir)
+	registerHosts(t, registry, "10.0.0.1", "10.0.0.2")
+	if err := registry.AllocateTask(TaskRecord{ID: "c1", HostIP: "10.0.0.1", CPU: 1024, Memory: 256 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.stateStore.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the records after the snapshot are replayed on top of it
+	registerHosts(t, registry, "10.0.0.3")
+	if err := registry.AllocateResources("10.0.0.3", 512, 128<<20); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := registry.RemoveHost("10.0.0.2", false); !report.Removed {
+		t.Fatalf("removing 10.0.0.2 failed: %s", report.Error)
+	}
+
+	restored := openPersisted(t, dir)
+	expectHosts(t, restored, "10.0.0.1", "10.0.0.3")
+	host, _ := restored.SnapshotHost("10.0.0.3")
+	if host.AllocatedCPUs != 512 || host.AllocatedMemory != 128<<20 {
+		t.Errorf("10.0.0.3 was restored with %d shares and %d bytes allocated", host.AllocatedCPUs, host.AllocatedMemory)
+	}
+	if task, err := restored.tasks.Get("c1"); err != nil || task.HostIP != "10.0.0.1" || task.CPU != 1024 {
+		t.Errorf("task c1 was restored as %+v, %v", task, err)
+	}
+}
+
+func TestStateStoreDropsTornTail(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	registry := openPersisted(t, dir)
+	registerHosts(t, registry, "10.0.0.1")
+	tearLog(t, dir)
+
+	restored := openPersisted(t, dir)
+	expectHosts(t, restored, "10.0.0.1")
+	if data, _ := os.ReadFile(filepath.Join(dir, logFile)); strings.Contains(string(data), `"seq":99`) || !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("the torn record was kept in the log: %q", data)
+	}
+}
+
+func TestStateStoreAppendsAfterTornTail(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	registry := openPersisted(t, dir)
+	registerHosts(t, registry, "10.0.0.1")
+	tearLog(t, dir)
+
+	//the records written after a torn one survive the next restart
+	registry = openPersisted(t, dir)
+	registerHosts(t, registry, "10.0.0.2")
+	if err := registry.AllocateResources("10.0.0.2", 512, 128<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := openPersisted(t, dir)
+	expectHosts(t, restored, "10.0.0.1", "10.0.0.2")
+	if host, _ := restored.SnapshotHost("10.0.0.2"); host.AllocatedCPUs != 512 {
+		t.Errorf("10.0.0.2 was restored with %d shares allocated", host.AllocatedCPUs)
+	}
+}
+
+//appends half a record, as a crash in the middle of a write leaves it
+func tearLog(t *testing.T, dir string) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(`{"seq":99,"op":"create`); err != nil {
+		t.Fatal(err)
+	}
+}
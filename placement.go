@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+//server side placement: the hosts a task can go to without cuts or kills, ranked the way the scheduler walks the
+//normal lists (placement regions from the least utilized, the task's class and the more restrictive ones, each list
+//in its region order), keeping only the hosts with enough free capacity under their overbooking limit.
+//Every other host is reported with the reason it was left out
+
+const defaultPlacementChoices = 5
+
+var ErrNoPlacement = errors.New("no host can take the task")
+
+type PlacementRequest struct {
+	CPU      int64  `json:"cpu"`    //cpu shares
+	Memory   int64  `json:"memory"` //bytes
+	Class    string `json:"class"`
+	TaskType string `json:"tasktype,omitempty"`
+	Choices  int    `json:"choices,omitempty"` //hosts returned at most, 5 by default
+	Reserve  bool   `json:"reserve,omitempty"` //reserve the best host that still fits
+	TTL      string `json:"ttl,omitempty"`     //of the reservation
+}
+
+type PlacementChoice struct {
+	Rank        int     `json:"rank"`
+	HostIP      string  `json:"hostip"`
+	Region      string  `json:"region"`
+	HostClass   string  `json:"hostclass"`
+	Utilization float64 `json:"totalresources"`
+	FreeCPU     int64   `json:"freecpu"`
+	FreeMemory  int64   `json:"freememory"`
+	Limit       float64 `json:"limit,omitempty"` //overbooking limit applied, omitted when the class is not limited
+	Overbooking float64 `json:"overbooking"`     //overbooking factor of the host once the task is placed
+}
+
+type PlacementRejection struct {
+	HostIP    string `json:"hostip"`
+	Region    string `json:"region"`
+	HostClass string `json:"hostclass"`
+	Reason    string `json:"reason"`
+}
+
+type Placement struct {
+	Class       string               `json:"class"`
+	TaskType    string               `json:"tasktype,omitempty"` //echoed, the lists do not depend on it
+	Choices     []PlacementChoice    `json:"choices"`
+	Rejected    []PlacementRejection `json:"rejected"`
+	Reservation *Reservation         `json:"reservation,omitempty"`
+}
+
+func (p PlacementRequest) Validate() error {
+	if p.CPU < 0 {
+		return &ValidationError{Field: "cpu", Message: "must not be negative"}
+	}
+	if p.Memory < 0 {
+		return &ValidationError{Field: "memory", Message: "must not be negative"}
+	}
+	if p.Choices < 0 {
+		return &ValidationError{Field: "choices", Message: "must not be negative"}
+	}
+	if _, known := ClassRank(p.Class); !known {
+		return fmt.Errorf("%w: %s", ErrUnknownClass, p.Class)
+	}
+	return nil
+}
+
+//ranks every host for the task
+func (r *Registry) Place(request PlacementRequest) Placement {
+	placement := Placement{Class: request.Class, TaskType: request.TaskType, Choices: make([]PlacementChoice, 0), Rejected: make([]PlacementRejection, 0)}
+	normal := make(map[string]bool)
+	for _, class := range NormalClasses(request.Class) {
+		normal[class] = true
+	}
+	reject := func(host *Host, reason string) {
+		placement.Rejected = append(placement.Rejected, PlacementRejection{HostIP: host.HostIP, Region: host.Region, HostClass: host.HostClass, Reason: reason})
+	}
+
+	//the candidates in the order of the normal lists
+	for _, region := range PlacementRegions() {
+		for _, class := range NormalClasses(request.Class) {
+			r.locks[region].classHosts[class].Lock()
+			for _, host := range r.regions[region].classHosts[class] {
+				if host.Liveness == LivenessDead {
+					reject(host, "the host is dead")
+					continue
+				}
+				if state := PowerStateOf(host); state != PowerOn {
+					reject(host, "the host is "+state)
+					continue
+				}
+				limit := CapacityLimit(host.HostClass, request.Class)
+				freeCPU, freeMemory := r.reservations.FreeCapacity(host, limit)
+				if request.CPU > freeCPU || request.Memory > freeMemory {
+					reject(host, fmt.Sprintf("needs %d cpu shares and %d bytes of memory, %d and %d are free under overbooking limit %v",
+						request.CPU, request.Memory, freeCPU, freeMemory, limit))
+					continue
+				}
+				choice := PlacementChoice{Rank: len(placement.Choices) + 1, HostIP: host.HostIP, Region: region, HostClass: class,
+					Utilization: host.TotalResourcesUtilization, FreeCPU: freeCPU, FreeMemory: freeMemory,
+					Overbooking: math.Max(float64(host.AllocatedCPUs+request.CPU)/float64(host.TotalCPUs), float64(host.AllocatedMemory+request.Memory)/float64(host.TotalMemory))}
+				if !math.IsInf(limit, 1) {
+					choice.Limit = limit
+				}
+				placement.Choices = append(placement.Choices, choice)
+			}
+			r.locks[region].classHosts[class].Unlock()
+		}
+	}
+
+	//and the hosts no normal list offers
+	for _, regionConfig := range config.Regions {
+		for _, class := range config.Classes {
+			if regionConfig.Placement && normal[class] {
+				continue
+			}
+			r.locks[regionConfig.Name].classHosts[class].Lock()
+			for _, host := range r.regions[regionConfig.Name].classHosts[class] {
+				if !regionConfig.Placement {
+					reject(host, fmt.Sprintf("region %s is not offered for placement", regionConfig.Name))
+				} else {
+					reject(host, fmt.Sprintf("class %s is less restrictive than the class %s of the task", class, request.Class))
+				}
+			}
+			r.locks[regionConfig.Name].classHosts[class].Unlock()
+		}
+	}
+	return placement
+}
+
+//POST /v2/place
+func (r *Registry) V2Place(w http.ResponseWriter, req *http.Request) {
+	var request PlacementRequest
+	if err := DecodeBody(req, &request); err != nil {
+		WriteError(w, err)
+		return
+	}
+	if err := request.Validate(); err != nil {
+		WriteError(w, err)
+		return
+	}
+	var ttl time.Duration
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil {
+			WriteError(w, &ValidationError{Field: "ttl", Message: err.Error()})
+			return
+		}
+		ttl = parsed
+	}
+	choices := request.Choices
+	if choices == 0 {
+		choices = defaultPlacementChoices
+	}
+
+	placement := r.Place(request)
+	if request.Reserve {
+		owner := ""
+		if identity := RequestIdentity(req); identity != nil {
+			owner = identity.Name
+		}
+		//the capacity may have been taken since the ranking, the next host is tried then
+		for i, choice := range placement.Choices {
+			reservation, err := r.reservations.Reserve(choice.HostIP, request.CPU, request.Memory, request.Class, ttl, owner)
+			if err == nil {
+				placement.Reservation = reservation
+				break
+			}
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				WriteError(w, err)
+				return
+			}
+			placement.Rejected = append(placement.Rejected, PlacementRejection{HostIP: choice.HostIP, Region: choice.Region, HostClass: choice.HostClass, Reason: err.Error()})
+			placement.Choices[i].Rank = 0
+		}
+		ranked := placement.Choices[:0]
+		for _, choice := range placement.Choices {
+			if choice.Rank > 0 {
+				choice.Rank = len(ranked) + 1
+				ranked = append(ranked, choice)
+			}
+		}
+		placement.Choices = ranked
+	}
+	if len(placement.Choices) > choices {
+		placement.Choices = placement.Choices[:choices]
+	}
+
+	if len(placement.Choices) == 0 {
+		//a sleeping host is woken for the next attempt
+		woken := r.powerManager.WakeFor(request.Class, request.CPU, request.Memory)
+		for i := range placement.Rejected {
+			if woken != "" && placement.Rejected[i].HostIP == woken {
+				placement.Rejected[i].Reason = "the host is waking up for the task"
+			}
+		}
+		WriteJSON(w, http.StatusConflict, ErrorDocument{Status: http.StatusConflict, Code: "no_placement", Message: ErrNoPlacement.Error(), Details: placement})
+		return
+	}
+	WriteJSON(w, http.StatusOK, placement)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+//four class 4 hosts: 10.0.0.1 and 10.0.0.4 in LEE, the second one nearly full, 10.0.0.2 in DEE and 10.0.0.3 in EED
+func newPlacementRegistry(t *testing.T) *Registry {
+	t.Helper()
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	for hostIP, utilization := range map[string]float64{"10.0.0.1": 0.3, "10.0.0.2": 0.6, "10.0.0.3": 0.9, "10.0.0.4": 0.1} {
+		cpu, memory := utilization, utilization
+		if err := registry.SetUtilization(hostIP, &cpu, &memory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.AllocateResources("10.0.0.4", 7168, 0); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestPlace(t *testing.T) {
+	registry := newPlacementRegistry(t)
+	placement := registry.Place(PlacementRequest{CPU: 2048, Memory: 1 << 20, Class: "4"})
+
+	hostIPs := make([]string, 0)
+	for _, choice := range placement.Choices {
+		hostIPs = append(hostIPs, choice.HostIP)
+	}
+	if strings.Join(hostIPs, ",") != "10.0.0.1,10.0.0.2" {
+		t.Fatalf("the task is placed on %v", hostIPs)
+	}
+	if first := placement.Choices[0]; first.Rank != 1 || first.Region != "LEE" || first.FreeCPU != 8192 || first.Limit != 2 || first.Overbooking != 0.5 {
+		t.Errorf("the first choice is %+v", first)
+	}
+	reasons := make(map[string]string)
+	for _, rejection := range placement.Rejected {
+		reasons[rejection.HostIP] = rejection.Reason
+	}
+	if len(reasons) != 2 || !strings.Contains(reasons["10.0.0.4"], "1024 and 2147483648 are free") || !strings.Contains(reasons["10.0.0.3"], "region EED is not offered") {
+		t.Errorf("the hosts were rejected for %v", reasons)
+	}
+
+	//a more restrictive task only goes to hosts of its class or a more restrictive one
+	placement = registry.Place(PlacementRequest{CPU: 1024, Class: "2"})
+	if len(placement.Choices) != 0 || len(placement.Rejected) != 4 || !strings.Contains(placement.Rejected[0].Reason, "less restrictive than the class 2") {
+		t.Errorf("a class 2 task was placed as %+v", placement)
+	}
+}
+
+func TestPlaceEndpoint(t *testing.T) {
+	registry := newPlacementRegistry(t)
+
+	status, body := serve(t, registry, http.MethodPost, "/v2/place", PlacementRequest{CPU: 2048, Class: "4", Choices: 1, Reserve: true, TTL: "1m"})
+	var placement Placement
+	if err := json.Unmarshal(body, &placement); status != http.StatusOK || err != nil {
+		t.Fatalf("placing answered %d %s", status, body)
+	}
+	if len(placement.Choices) != 1 || placement.Reservation == nil || placement.Reservation.HostIP != "10.0.0.1" || placement.Reservation.CPU != 2048 {
+		t.Fatalf("placing with a reservation answered %s", body)
+	}
+
+	//the reserved capacity is no longer offered, the reservation moves to the next host
+	status, body = serve(t, registry, http.MethodPost, "/v2/place", PlacementRequest{CPU: 7168, Class: "4", Reserve: true})
+	placement = Placement{}
+	if json.Unmarshal(body, &placement); status != http.StatusOK || placement.Reservation == nil || placement.Reservation.HostIP != "10.0.0.2" {
+		t.Fatalf("placing past the reserved capacity answered %d %s", status, body)
+	}
+
+	status, body = serve(t, registry, http.MethodPost, "/v2/place", PlacementRequest{CPU: 6145, Class: "4"})
+	var document struct {
+		Code    string    `json:"code"`
+		Details Placement `json:"details"`
+	}
+	if json.Unmarshal(body, &document); status != http.StatusConflict || document.Code != "no_placement" || len(document.Details.Rejected) != 4 {
+		t.Errorf("placing on full hosts answered %d %s", status, body)
+	}
+	for _, request := range []PlacementRequest{{CPU: -1, Class: "4"}, {CPU: 1, Class: "5"}, {CPU: 1, Class: "4", TTL: "soon"}} {
+		if status, body = serve(t, registry, http.MethodPost, "/v2/place", request); status != http.StatusBadRequest {
+			t.Errorf("placing %+v answered %d %s", request, status, body)
+		}
+	}
+}
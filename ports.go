@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//ports of rescheduled services are leased per host until the task terminates. The swarm decides where a task runs,
+//so a lease taken before the task is started has no host yet and blocks its port on every host until the runtime
+//reports where the task landed
+
+type PortRange struct {
+	From int `json:"from"`
+	To   int `json:"to"` //inclusive
+}
+
+type PortConfig struct {
+	PortRange
+	Hosts map[string]PortRange `json:"hosts,omitempty"` //hosts with a range other than the default one
+}
+
+type PortLease struct {
+	Host        string    `json:"host,omitempty"` //empty while the host of the task is unknown
+	Port        int       `json:"port"`
+	ContainerID string    `json:"containerid,omitempty"`
+	Image       string    `json:"image,omitempty"`
+	Since       time.Time `json:"since"`
+}
+
+type PortAllocator struct {
+	mutex  *sync.Mutex
+	config PortConfig
+	leases map[int][]*PortLease //by port
+	next   map[string]int       //where the search for a free port starts, per host
+}
+
+var ErrNoFreePort = errors.New("no free port left in range")
+
+func NewPortAllocator(portConfig PortConfig) *PortAllocator {
+	return &PortAllocator{mutex: &sync.Mutex{}, config: portConfig, leases: make(map[int][]*PortLease), next: make(map[string]int)}
+}
+
+func (r PortRange) Validate() error {
+	if r.From <= 0 || r.To > 65535 || r.To < r.From {
+		return fmt.Errorf("invalid port range %d-%d", r.From, r.To)
+	}
+	return nil
+}
+
+func (p *PortAllocator) rangeFor(host string) PortRange {
+	if hostRange, ok := p.config.Hosts[host]; ok {
+		return hostRange
+	}
+	return p.config.PortRange
+}
+
+//must be called with the mutex held
+func (p *PortAllocator) free(host string, port int) bool {
+	for _, lease := range p.leases[port] {
+		//a lease without host may end up on any host, and a task without host may land next to any lease
+		if lease.Host == "" || host == "" || lease.Host == host {
+			return false
+		}
+	}
+	return true
+}
+
+//leases a free port of the host's range. host may be empty when it is not known where the task will run
+func (p *PortAllocator) Acquire(host string, image string) (*PortLease, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	portRange := p.rangeFor(host)
+	size := portRange.To - portRange.From + 1
+	start := p.next[host]
+	if start < portRange.From || start > portRange.To {
+		start = portRange.From
+	}
+	for i := 0; i < size; i++ {
+		port := portRange.From + (start-portRange.From+i)%size
+		if !p.free(host, port) {
+			continue
+		}
+		lease := &PortLease{Host: host, Port: port, Image: image, Since: Now()}
+		p.leases[port] = append(p.leases[port], lease)
+		p.next[host] = port + 1
+		return lease, nil
+	}
+	return nil, ErrNoFreePort
+}
+
+//records the container holding the lease and, once known, the host it runs on
+func (p *PortAllocator) Bind(lease *PortLease, containerID string, host string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	lease.ContainerID = containerID
+	if host != "" {
+		lease.Host = host
+	}
+}
+
+//must be called with the mutex held
+func (p *PortAllocator) remove(port int, match func(*PortLease) bool) int {
+	kept := p.leases[port][:0]
+	released := 0
+	for _, lease := range p.leases[port] {
+		if match(lease) {
+			released++
+		} else {
+			kept = append(kept, lease)
+		}
+	}
+	if len(kept) == 0 {
+		delete(p.leases, port)
+	} else {
+		p.leases[port] = kept
+	}
+	return released
+}
+
+func (p *PortAllocator) Release(lease *PortLease) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.remove(lease.Port, func(candidate *PortLease) bool { return candidate == lease })
+}
+
+//releases the lease of a port on a host. Leases still without host are matched too, since the task may be the one
+//that was never located
+func (p *PortAllocator) ReleasePort(host string, port int) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.remove(port, func(lease *PortLease) bool { return lease.Host == host || lease.Host == "" })
+}
+
+func (p *PortAllocator) ReleaseContainer(containerID string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	released := 0
+	for port := range p.leases {
+		released += p.remove(port, func(lease *PortLease) bool { return lease.ContainerID == containerID })
+	}
+	return released
+}
+
+//releases every lease of a host, for a host that is removed
+func (p *PortAllocator) ReleaseHost(host string) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	released := 0
+	for port := range p.leases {
+		released += p.remove(port, func(lease *PortLease) bool { return lease.Host == host })
+	}
+	return released
+}
+
+//current leases ordered by host and port. An empty host returns every lease
+func (p *PortAllocator) Leases(host string) []PortLease {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	list := make([]PortLease, 0)
+	for _, leases := range p.leases {
+		for _, lease := range leases {
+			if host == "" || lease.Host == host {
+				list = append(list, *lease)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Host != list[j].Host {
+			return list[i].Host < list[j].Host
+		}
+		return list[i].Port < list[j].Port
+	})
+	return list
+}
+
+func (r *Registry) GetPortLeases(w http.ResponseWriter, req *http.Request) {
+	json.NewEncoder(w).Encode(r.portAllocator.Leases(req.URL.Query().Get("host")))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPortAllocatorLeases(t *testing.T) {
+	allocator := NewPortAllocator(PortConfig{PortRange: PortRange{From: 11000, To: 11002}, Hosts: map[string]PortRange{"10.0.0.9": {From: 12000, To: 12000}}})
+	acquire := func(host string) int {
+		t.Helper()
+		lease, err := allocator.Acquire(host, "redis")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lease.Port
+	}
+
+	//ports are leased per host
+	if first, second := acquire("10.0.0.1"), acquire("10.0.0.1"); first != 11000 || second != 11001 {
+		t.Errorf("10.0.0.1 got ports %d and %d", first, second)
+	}
+	if port := acquire("10.0.0.2"); port != 11000 {
+		t.Errorf("10.0.0.2 got port %d", port)
+	}
+	if port := acquire("10.0.0.9"); port != 12000 {
+		t.Errorf("a host with a range of its own got port %d", port)
+	}
+	if _, err := allocator.Acquire("10.0.0.9", "redis"); !errors.Is(err, ErrNoFreePort) {
+		t.Errorf("a full range returned %v", err)
+	}
+
+	//a lease without host blocks its port on every host until it is bound
+	unplaced, err := allocator.Acquire("", "redis")
+	if err != nil || unplaced.Port != 11002 {
+		t.Fatalf("a task without host got %v, %v", unplaced, err)
+	}
+	if _, err = allocator.Acquire("10.0.0.2", "redis"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = allocator.Acquire("10.0.0.2", "redis"); !errors.Is(err, ErrNoFreePort) {
+		t.Errorf("the port of a lease without host was leased again: %v", err)
+	}
+	allocator.Bind(unplaced, "c1", "10.0.0.1")
+	if port := acquire("10.0.0.2"); port != 11002 {
+		t.Errorf("the port of a bound lease is still blocked on other hosts, got %d", port)
+	}
+
+	if released := allocator.ReleaseContainer("c1"); released != 1 || len(allocator.Leases("10.0.0.1")) != 2 {
+		t.Errorf("releasing the container released %d leases", released)
+	}
+	if released := allocator.ReleasePort("10.0.0.1", 11000); released != 1 {
+		t.Errorf("releasing a port released %d leases", released)
+	}
+	if released := allocator.ReleaseHost("10.0.0.2"); released != 3 || len(allocator.Leases("10.0.0.2")) != 0 {
+		t.Errorf("releasing the host released %d leases", released)
+	}
+	if leases := allocator.Leases(""); len(leases) != 2 {
+		t.Errorf("the leases left are %v", leases)
+	}
+}
+
+func TestReschedulePortLeases(t *testing.T) {
+	useDefaultConfig(t)
+	useCatalog(t, redisTemplate)
+	runtime := NewFakeRuntime()
+	registry := NewRegistry(runtime)
+	registry.background = func(update func()) { update() }
+	registerHosts(t, registry, "10.0.0.1")
+	task := Task{Image: "redis", CPU: "512", Memory: "64m", TaskClass: "2", HostIP: "10.0.0.1"}
+
+	//a task that did not start gives its port back
+	runtime.Fail("run", &RuntimeError{Op: "run", Kind: RuntimeErrConflict, Message: "port is already allocated"})
+	if _, err := registry.Reschedule(task); RuntimeErrorKind(err) != RuntimeErrConflict {
+		t.Fatalf("a failed start returned %v", err)
+	}
+	if leases := registry.portAllocator.Leases(""); len(leases) != 0 {
+		t.Fatalf("a failed start kept %v", leases)
+	}
+
+	result, err := registry.Reschedule(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := registry.portAllocator.Leases("10.0.0.1")
+	if len(leases) != 1 || leases[0].Port != result.Port || leases[0].ContainerID != result.ContainerID {
+		t.Fatalf("the started task holds %v", leases)
+	}
+
+	//the lease goes with the task
+	if err = registry.TerminateTask(TaskResources{IP: "10.0.0.1", TaskID: result.ContainerID}); err != nil {
+		t.Fatal(err)
+	}
+	if leases = registry.portAllocator.Leases(""); len(leases) != 0 {
+		t.Errorf("a terminated task kept %v", leases)
+	}
+
+	//and with its host
+	if result, err = registry.Reschedule(task); err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := registry.RemoveHost("10.0.0.1", true); !report.Removed {
+		t.Fatalf("removing the host failed: %s", report.Error)
+	}
+	if leases = registry.portAllocator.Leases(""); len(leases) != 0 {
+		t.Errorf("a removed host kept %v", leases)
+	}
+}
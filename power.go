@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//energy accounting. Each hardware type has a power model turning the cpu utilization into watts, either linear from
+//the idle to the peak power or a piecewise linear curve like the SPECpower measurements. Every monitor report closes
+//the interval since the previous one: the host is taken to have drawn the power of its previous report all along, in
+//the region it sat in, so the joules add up per host, region and cluster. Intervals longer than the dead timeout only
+//count up to it, the power of a host that stopped reporting is unknown. The accounting is kept in memory by the node
+//receiving the reports and starts over with it
+
+type PowerModel struct {
+	Idle  float64   `json:"idle,omitempty"`  //watts at 0% cpu, linear model
+	Peak  float64   `json:"peak,omitempty"`  //watts at 100% cpu
+	Curve []float64 `json:"curve,omitempty"` //watts at evenly spaced loads from 0% to 100%, e.g. the 11 SPECpower levels
+}
+
+type PowerConfig struct {
+	Models  map[string]PowerModel `json:"models"`  //by hardware type
+	Hosts   map[string]string     `json:"hosts"`   //hardware type of the hosts, by address
+	Default string                `json:"default"` //hardware type of the other hosts, none leaves them out of the accounting
+}
+
+func (m PowerModel) Validate() error {
+	if len(m.Curve) > 0 {
+		if m.Idle != 0 || m.Peak != 0 {
+			return errors.New("a curve excludes idle and peak")
+		}
+		if len(m.Curve) < 2 {
+			return errors.New("a curve needs the power at 0% and 100% at least")
+		}
+		for _, watts := range m.Curve {
+			if watts < 0 {
+				return errors.New("the power must not be negative")
+			}
+		}
+		return nil
+	}
+	if m.Idle < 0 || m.Peak < m.Idle {
+		return errors.New("idle must not be negative nor above peak")
+	}
+	return nil
+}
+
+//estimated power at a cpu utilization from 0 to 1
+func (m PowerModel) Watts(utilization float64) float64 {
+	utilization = math.Min(math.Max(utilization, 0), 1)
+	if len(m.Curve) == 0 {
+		return m.Idle + (m.Peak-m.Idle)*utilization
+	}
+	position := utilization * float64(len(m.Curve)-1)
+	lower := min(int(position), len(m.Curve)-2)
+	return m.Curve[lower] + (m.Curve[lower+1]-m.Curve[lower])*(position-float64(lower))
+}
+
+func (p PowerConfig) Validate() error {
+	for hardware, model := range p.Models {
+		if err := model.Validate(); err != nil {
+			return fmt.Errorf("power: model %s: %v", hardware, err)
+		}
+	}
+	for host, hardware := range p.Hosts {
+		if _, ok := p.Models[hardware]; !ok {
+			return fmt.Errorf("power: host %s: unknown hardware type %s", host, hardware)
+		}
+	}
+	if _, ok := p.Models[p.Default]; p.Default != "" && !ok {
+		return fmt.Errorf("power: unknown default hardware type %s", p.Default)
+	}
+	return nil
+}
+
+//the hardware type of a host, false when it is not accounted
+func (p PowerConfig) HardwareType(hostIP string) (string, bool) {
+	if hardware, ok := p.Hosts[hostIP]; ok {
+		return hardware, true
+	}
+	return p.Default, p.Default != ""
+}
+
+type hostEnergy struct {
+	hardware string
+	watts    float64
+	since    time.Time          //of the last report
+	joules   map[string]float64 //by region
+}
+
+type EnergyMeter struct {
+	mutex    *sync.Mutex
+	hosts    map[string]*hostEnergy
+	removed  map[string]float64 //joules by region of the deregistered hosts
+	registry *Registry
+}
+
+func NewEnergyMeter(registry *Registry) *EnergyMeter {
+	return &EnergyMeter{mutex: &sync.Mutex{}, hosts: make(map[string]*hostEnergy), removed: make(map[string]float64), registry: registry}
+}
+
+//seconds of an interval that count, at most the dead timeout
+func meteredSeconds(since time.Time, now time.Time) float64 {
+	return math.Max(math.Min(now.Sub(since).Seconds(), deadTimeout.Seconds()), 0)
+}
+
+//closes the interval since the last report of a host, spent in region, and sets the power drawn from now on
+func (m *EnergyMeter) Observe(hostIP string, region string, cpu float64, now time.Time) {
+	hardware, ok := config.Power.HardwareType(hostIP)
+	if !ok {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	host, ok := m.hosts[hostIP]
+	if !ok {
+		host = &hostEnergy{joules: make(map[string]float64)}
+		m.hosts[hostIP] = host
+	} else {
+		host.joules[region] += host.watts * meteredSeconds(host.since, now)
+	}
+	host.hardware = hardware
+	host.watts = config.Power.Models[hardware].Watts(cpu)
+	host.since = now
+}
+
+//closes the last interval of a deregistered host, its energy stays in the totals
+func (m *EnergyMeter) Forget(hostIP string, region string, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	host, ok := m.hosts[hostIP]
+	if !ok {
+		return
+	}
+	host.joules[region] += host.watts * meteredSeconds(host.since, now)
+	for name, joules := range host.joules {
+		m.removed[name] += joules
+	}
+	delete(m.hosts, hostIP)
+}
+
+//closes the last interval of a host put to sleep, it draws no power until it reports again
+func (m *EnergyMeter) Suspend(hostIP string, region string, now time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	host, ok := m.hosts[hostIP]
+	if !ok {
+		return
+	}
+	host.joules[region] += host.watts * meteredSeconds(host.since, now)
+	host.watts = 0
+	host.since = now
+}
+
+type HostEnergy struct {
+	HostIP       string             `json:"hostip"`
+	Region       string             `json:"region"`
+	HardwareType string             `json:"hardwaretype"`
+	Watts        float64            `json:"watts"` //estimated from the last report, 0 once the host is dead
+	Joules       float64            `json:"joules"`
+	RegionJoules map[string]float64 `json:"regionjoules"` //spent while in each region
+}
+
+type RegionEnergy struct {
+	Hosts  int     `json:"hosts"`  //accounted hosts in the region now
+	Watts  float64 `json:"watts"`  //drawn by them
+	Joules float64 `json:"joules"` //spent by the hosts while they sat in the region
+	Share  float64 `json:"share"`  //of the energy of the cluster
+}
+
+type EnergyReport struct {
+	Time    time.Time               `json:"time"`
+	Watts   float64                 `json:"watts"`
+	Joules  float64                 `json:"joules"`
+	Regions map[string]RegionEnergy `json:"regions"`
+	Hosts   []HostEnergy            `json:"hosts"`
+}
+
+//the energy up to now, the open intervals counted in the region each host is in
+func (m *EnergyMeter) Report(now time.Time) EnergyReport {
+	report := EnergyReport{Time: now, Regions: make(map[string]RegionEnergy), Hosts: make([]HostEnergy, 0)}
+	for _, region := range config.Regions {
+		report.Regions[region.Name] = RegionEnergy{}
+	}
+	snapshots := m.registry.HostSnapshots()
+
+	m.mutex.Lock()
+	for name, joules := range m.removed {
+		region := report.Regions[name]
+		region.Joules += joules
+		report.Regions[name] = region
+	}
+	for _, snapshot := range snapshots {
+		metered, ok := m.hosts[snapshot.HostIP]
+		if !ok {
+			continue
+		}
+		host := HostEnergy{HostIP: snapshot.HostIP, Region: snapshot.Region, HardwareType: metered.hardware, RegionJoules: make(map[string]float64)}
+		for name, joules := range metered.joules {
+			host.RegionJoules[name] = joules
+		}
+		host.RegionJoules[snapshot.Region] += metered.watts * meteredSeconds(metered.since, now)
+		if snapshot.Liveness != LivenessDead {
+			host.Watts = metered.watts
+		}
+
+		region := report.Regions[snapshot.Region]
+		region.Hosts++
+		region.Watts += host.Watts
+		report.Regions[snapshot.Region] = region
+		for name, joules := range host.RegionJoules {
+			host.Joules += joules
+			region := report.Regions[name]
+			region.Joules += joules
+			report.Regions[name] = region
+		}
+		report.Watts += host.Watts
+		report.Hosts = append(report.Hosts, host)
+	}
+	m.mutex.Unlock()
+
+	for _, region := range report.Regions {
+		report.Joules += region.Joules
+	}
+	for name, region := range report.Regions {
+		if report.Joules > 0 {
+			region.Share = region.Joules / report.Joules
+		}
+		report.Regions[name] = region
+	}
+	sort.Slice(report.Hosts, func(i, j int) bool { return report.Hosts[i].HostIP < report.Hosts[j].HostIP })
+	return report
+}
+
+//GET /v2/energy, ?host= reports a single host
+func (r *Registry) V2Energy(w http.ResponseWriter, req *http.Request) {
+	report := r.energy.Report(Now())
+	hostIP := req.URL.Query().Get("host")
+	if hostIP == "" {
+		WriteJSON(w, http.StatusOK, report)
+		return
+	}
+
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	for _, hostEnergy := range report.Hosts {
+		if hostEnergy.HostIP == hostIP {
+			WriteJSON(w, http.StatusOK, hostEnergy)
+			return
+		}
+	}
+	//not reported yet or without power model
+	lock := r.LockHost(host)
+	region := host.Region
+	lock.Unlock()
+	hardware, _ := config.Power.HardwareType(hostIP)
+	WriteJSON(w, http.StatusOK, HostEnergy{HostIP: hostIP, Region: region, HardwareType: hardware, RegionJoules: make(map[string]float64)})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPowerModelWatts(t *testing.T) {
+	linear := PowerModel{Idle: 100, Peak: 250}
+	curve := PowerModel{Curve: []float64{50, 100, 200}}
+	cases := []struct {
+		model       PowerModel
+		utilization float64
+		watts       float64
+	}{
+		{linear, 0, 100},
+		{linear, 0.5, 175},
+		{linear, 1.5, 250},
+		{linear, -1, 100},
+		{curve, 0.25, 75},
+		{curve, 0.5, 100},
+		{curve, 0.75, 150},
+		{curve, 1, 200},
+	}
+	for _, c := range cases {
+		if watts := c.model.Watts(c.utilization); !near(watts, c.watts) {
+			t.Errorf("%+v at %v draws %v watts, expected %v", c.model, c.utilization, watts, c.watts)
+		}
+	}
+}
+
+func TestPowerConfigValidate(t *testing.T) {
+	invalid := []PowerConfig{
+		{Models: map[string]PowerModel{"small": {Idle: 200, Peak: 100}}},
+		{Models: map[string]PowerModel{"small": {Idle: -1, Peak: 100}}},
+		{Models: map[string]PowerModel{"spec": {Curve: []float64{50}}}},
+		{Models: map[string]PowerModel{"spec": {Curve: []float64{50, -1}}}},
+		{Models: map[string]PowerModel{"spec": {Idle: 50, Curve: []float64{50, 100}}}},
+		{Models: map[string]PowerModel{"small": {Idle: 100, Peak: 200}}, Hosts: map[string]string{"10.0.0.1": "big"}},
+		{Models: map[string]PowerModel{"small": {Idle: 100, Peak: 200}}, Default: "big"},
+	}
+	for _, power := range invalid {
+		if err := power.Validate(); err == nil {
+			t.Errorf("%+v is valid", power)
+		}
+	}
+	power := PowerConfig{Models: map[string]PowerModel{"small": {Idle: 100, Peak: 200}}, Hosts: map[string]string{"10.0.0.1": "small"}}
+	if err := power.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	//without a default hardware type only the listed hosts are accounted
+	if _, ok := power.HardwareType("10.0.0.2"); ok {
+		t.Error("a host without hardware type is accounted")
+	}
+}
+
+//10.0.0.2 has a SPECpower like curve, the other hosts a linear model
+func useEnergyConfig(t *testing.T) {
+	useDefaultConfig(t)
+	config.Power = PowerConfig{Models: map[string]PowerModel{"small": {Idle: 100, Peak: 200}, "spec": {Curve: []float64{50, 100, 200}}},
+		Hosts: map[string]string{"10.0.0.2": "spec"}, Default: "small"}
+}
+
+func setUtilization(t *testing.T, registry *Registry, hostIP string, cpu float64, memory float64) {
+	t.Helper()
+	if err := registry.SetUtilization(hostIP, &cpu, &memory); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnergyAccounting(t *testing.T) {
+	useEnergyConfig(t)
+	clock := useClock(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+
+	//each report closes the interval since the previous one, at the power and in the region of that one
+	setUtilization(t, registry, "10.0.0.1", 0.4, 0.2)
+	setUtilization(t, registry, "10.0.0.2", 0.25, 0.1)
+	clock.advance(10 * time.Second)
+	setUtilization(t, registry, "10.0.0.1", 0.9, 0.2)
+	clock.advance(10 * time.Second)
+
+	report := registry.energy.Report(Now())
+	//10.0.0.3 never reported
+	if len(report.Hosts) != 2 {
+		t.Fatalf("the hosts are %+v", report.Hosts)
+	}
+	busy, spec := report.Hosts[0], report.Hosts[1]
+	if busy.Region != "EED" || busy.HardwareType != "small" || busy.Watts != 190 || !near(busy.Joules, 3300) ||
+		!near(busy.RegionJoules["LEE"], 1400) || !near(busy.RegionJoules["EED"], 1900) {
+		t.Errorf("10.0.0.1 reports %+v", busy)
+	}
+	if spec.HardwareType != "spec" || spec.Watts != 75 || !near(spec.Joules, 1500) {
+		t.Errorf("10.0.0.2 reports %+v", spec)
+	}
+	if report.Watts != 265 || !near(report.Joules, 4800) || !near(report.Regions["LEE"].Joules, 2900) || report.Regions["EED"].Hosts != 1 ||
+		!near(report.Regions["EED"].Share, 1900.0/4800) || report.Regions["DEE"].Joules != 0 {
+		t.Errorf("the cluster reports %+v", report)
+	}
+
+	//a deregistered host keeps its energy in the totals
+	if _, status := registry.RemoveHost("10.0.0.2", false); status != http.StatusOK {
+		t.Fatalf("the removal answered %d", status)
+	}
+	report = registry.energy.Report(Now())
+	if len(report.Hosts) != 1 || !near(report.Regions["LEE"].Joules, 2900) || report.Regions["LEE"].Hosts != 0 {
+		t.Errorf("after the removal the cluster reports %+v", report)
+	}
+
+	//the interval of a silent host counts up to the dead timeout, the host draws nothing once dead
+	clock.advance(*deadTimeout + time.Hour)
+	registry.CheckLiveness()
+	report = registry.energy.Report(Now())
+	if report.Watts != 0 || !near(report.Hosts[0].RegionJoules["EED"], 190*deadTimeout.Seconds()) {
+		t.Errorf("the dead host reports %+v", report.Hosts[0])
+	}
+}
+
+func TestEnergySuspended(t *testing.T) {
+	useEnergyConfig(t)
+	clock := useClock(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	setUtilization(t, registry, "10.0.0.1", 0.5, 0.2)
+	clock.advance(10 * time.Second)
+
+	//a sleeping host draws no power until it reports again
+	registry.energy.Suspend("10.0.0.1", "DEE", Now())
+	clock.advance(time.Minute)
+	report := registry.energy.Report(Now())
+	if report.Watts != 0 || !near(report.Joules, 1500) {
+		t.Errorf("the suspended host reports %+v", report)
+	}
+	setUtilization(t, registry, "10.0.0.1", 0, 0)
+	clock.advance(10 * time.Second)
+	if report = registry.energy.Report(Now()); report.Watts != 100 || !near(report.Joules, 2500) {
+		t.Errorf("the woken host reports %+v", report)
+	}
+}
+
+func TestEnergyEndpoint(t *testing.T) {
+	useEnergyConfig(t)
+	clock := useClock(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2")
+	setUtilization(t, registry, "10.0.0.1", 0.5, 0.2)
+	clock.advance(10 * time.Second)
+
+	status, body := serve(t, registry, http.MethodGet, "/v2/energy", nil)
+	var report EnergyReport
+	if status != http.StatusOK || json.Unmarshal(body, &report) != nil || report.Watts != 150 || !near(report.Joules, 1500) {
+		t.Errorf("%d %s", status, body)
+	}
+
+	var host HostEnergy
+	status, body = serve(t, registry, http.MethodGet, "/v2/energy?host=10.0.0.1", nil)
+	if status != http.StatusOK || json.Unmarshal(body, &host) != nil || host.HostIP != "10.0.0.1" || !near(host.Joules, 1500) {
+		t.Errorf("%d %s", status, body)
+	}
+	//a host that has not reported yet
+	status, body = serve(t, registry, http.MethodGet, "/v2/energy?host=10.0.0.2", nil)
+	if status != http.StatusOK || json.Unmarshal(body, &host) != nil || host.HardwareType != "spec" || host.Joules != 0 {
+		t.Errorf("%d %s", status, body)
+	}
+	if status, body = serve(t, registry, http.MethodGet, "/v2/energy?host=10.0.0.9", nil); status != http.StatusNotFound || errorCode(t, body) != "unknown_host" {
+		t.Errorf("an unknown host answered %d %s", status, body)
+	}
+}
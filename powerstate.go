@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//power states of the hosts. A host is put to sleep through a hook, e.g. a command suspending it over ssh or IPMI, and
+//is then left out of every list given to the scheduler until it is woken. A host asked to sleep while it still runs
+//something drains first: it is no longer offered to the scheduler and sleeps once it has been empty for the minimum
+//idle time. Hosts only go to sleep while the hosts that are on keep the minimum spare capacity, the free share of
+//their cpu and memory; when it falls below, or the scheduler finds no host for a task (an empty initial scheduling
+//list or a placement without choice), a sleeping host is woken. A waking host is on again with its first monitor
+//report. Only the registry alone or the leader runs the hooks
+
+const (
+	PowerOn       = "on"
+	PowerDraining = "draining" //no longer offered to the scheduler, sleeps once idle
+	PowerAsleep   = "asleep"
+	PowerWaking   = "waking" //the wake hook ran, the host has not reported yet
+)
+
+var (
+	ErrPowerState = errors.New("power state change refused")
+	ErrPowerHook  = errors.New("power hook failed")
+)
+
+var powerTransitions = NewCounterVec("hostregistry_power_transitions_total", "Host power state changes by new state.", "state")
+var powerHookFailures = NewCounterVec("hostregistry_power_hook_failures_total", "Sleep and wake hooks that failed.", "hook")
+
+type PowerHooks interface {
+	Sleep(hostIP string) error
+	Wake(hostIP string) error
+}
+
+type PowerStateConfig struct {
+	Hooks         string  `json:"hooks"`                  //shell or fake, none keeps every host on
+	SleepCommand  string  `json:"sleepcommand,omitempty"` //run by the shell with the address of the host in $HOST
+	WakeCommand   string  `json:"wakecommand,omitempty"`
+	HookTimeout   string  `json:"hooktimeout"`
+	MinIdle       string  `json:"minidle"`       //time a host must have been empty before it sleeps
+	MinSpare      float64 `json:"minspare"`      //free share of the cpu and memory of the hosts that are on, from 0 to 1
+	WakeTimeout   string  `json:"waketimeout"`   //a waking host that has not reported by then is taken as asleep again
+	AutoSleep     bool    `json:"autosleep"`     //puts the idle hosts to sleep without being asked
+	CheckInterval string  `json:"checkinterval"` //of the idle, spare capacity and wake timeout checks
+}
+
+func (p PowerStateConfig) Validate() error {
+	switch p.Hooks {
+	case "", "fake":
+	case "shell":
+		if p.SleepCommand == "" || p.WakeCommand == "" {
+			return errors.New("powerstates: the shell hooks need a sleepcommand and a wakecommand")
+		}
+	default:
+		return fmt.Errorf("powerstates: unknown hooks %q", p.Hooks)
+	}
+	durations := []struct {
+		name  string
+		value string
+	}{{"hooktimeout", p.HookTimeout}, {"minidle", p.MinIdle}, {"waketimeout", p.WakeTimeout}, {"checkinterval", p.CheckInterval}}
+	for _, duration := range durations {
+		if parsed, err := time.ParseDuration(duration.value); err != nil || parsed <= 0 {
+			return fmt.Errorf("powerstates: %s must be a positive duration", duration.name)
+		}
+	}
+	if p.MinSpare < 0 || p.MinSpare >= 1 {
+		return errors.New("powerstates: minspare must be at least 0 and below 1")
+	}
+	return nil
+}
+
+func NewPowerHooks(powerStates PowerStateConfig) (PowerHooks, error) {
+	switch powerStates.Hooks {
+	case "":
+		return nil, nil
+	case "shell":
+		timeout, err := time.ParseDuration(powerStates.HookTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("power hook timeout: %v", err)
+		}
+		return &ShellPowerHooks{SleepCommand: powerStates.SleepCommand, WakeCommand: powerStates.WakeCommand, Timeout: timeout}, nil
+	case "fake":
+		return NewFakePowerHooks(), nil
+	}
+	return nil, fmt.Errorf("unknown power hooks %q", powerStates.Hooks)
+}
+
+//runs the commands through the shell. The address of the host is passed in $HOST rather than in the command line
+type ShellPowerHooks struct {
+	SleepCommand string
+	WakeCommand  string
+	Timeout      time.Duration
+}
+
+func (s *ShellPowerHooks) Sleep(hostIP string) error {
+	return s.run("sleep", s.SleepCommand, hostIP)
+}
+
+func (s *ShellPowerHooks) Wake(hostIP string) error {
+	return s.run("wake", s.WakeCommand, hostIP)
+}
+
+func (s *ShellPowerHooks) run(hook string, command string, hostIP string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "HOST="+hostIP)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s hook for %s: %v: %s", hook, hostIP, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+type PowerHookCall struct {
+	Hook   string `json:"hook"`
+	HostIP string `json:"hostip"`
+}
+
+//records the calls and fails the ones it is told to, in order
+type FakePowerHooks struct {
+	mutex    *sync.Mutex
+	calls    []PowerHookCall
+	failures map[string][]error
+}
+
+func NewFakePowerHooks() *FakePowerHooks {
+	return &FakePowerHooks{mutex: &sync.Mutex{}, calls: make([]PowerHookCall, 0), failures: make(map[string][]error)}
+}
+
+//makes the next call of hook (sleep or wake) return err
+func (f *FakePowerHooks) Fail(hook string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures[hook] = append(f.failures[hook], err)
+}
+
+func (f *FakePowerHooks) Sleep(hostIP string) error {
+	return f.call("sleep", hostIP)
+}
+
+func (f *FakePowerHooks) Wake(hostIP string) error {
+	return f.call("wake", hostIP)
+}
+
+func (f *FakePowerHooks) call(hook string, hostIP string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = append(f.calls, PowerHookCall{Hook: hook, HostIP: hostIP})
+	if len(f.failures[hook]) == 0 {
+		return nil
+	}
+	err := f.failures[hook][0]
+	f.failures[hook] = f.failures[hook][1:]
+	return err
+}
+
+func (f *FakePowerHooks) Calls() []PowerHookCall {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]PowerHookCall(nil), f.calls...)
+}
+
+//hosts restored from a state saved before the power states have none, they are on
+func PowerStateOf(host *Host) string {
+	if host.PowerState == "" {
+		return PowerOn
+	}
+	return host.PowerState
+}
+
+//removes the hosts that are not on from a list returned to the scheduler. Must be called with the class lock of the
+//list held
+func PoweredHosts(listHosts []*Host) []*Host {
+	powered := make([]*Host, 0, len(listHosts))
+	for _, host := range listHosts {
+		if PowerStateOf(host) == PowerOn {
+			powered = append(powered, host)
+		}
+	}
+	return powered
+}
+
+//changes and records the power state of a host and returns the event to publish with publishPowerState. Must be
+//called with the class lock of the host held
+func (r *Registry) setPowerState(host *Host, state string) Event {
+	previous := PowerStateOf(host)
+	host.PowerState = state
+	host.PowerSince = Now()
+	r.RecordMutation(OpUpdatePowerState, *host)
+	event := HostEvent(EventPowerChanged, host)
+	event.From = previous
+	event.To = state
+	return event
+}
+
+func (r *Registry) publishPowerState(event Event) {
+	log.Printf("power: host %s is %s (was %s)", event.HostIP, event.To, event.From)
+	powerTransitions.Inc(event.To)
+	r.events.Publish(event)
+}
+
+//a waking host reported, it is on again. Must be called with the class lock of the host held
+func (r *Registry) MarkAwake(host *Host) *Event {
+	if host.PowerState != PowerWaking {
+		return nil
+	}
+	event := r.setPowerState(host, PowerOn)
+	return &event
+}
+
+//whether this node runs the background changes, the power hooks and the pruning: the registry alone or the leader of a
+//replicated one
+func (r *Registry) isLeader() bool {
+	if r.raftNode == nil {
+		return true
+	}
+	_, _, isLeader := r.raftNode.Leader()
+	return isLeader
+}
+
+type PowerManager struct {
+	hooks       PowerHooks
+	minIdle     time.Duration
+	minSpare    float64
+	wakeTimeout time.Duration
+	autoSleep   bool
+	mutex       *sync.Mutex
+	busy        map[string]time.Time //last time each host was seen running something
+	registry    *Registry
+}
+
+//the configuration must be valid, nil hooks keep every host on
+func NewPowerManager(registry *Registry, powerStates PowerStateConfig, hooks PowerHooks) *PowerManager {
+	minIdle, _ := time.ParseDuration(powerStates.MinIdle)
+	wakeTimeout, _ := time.ParseDuration(powerStates.WakeTimeout)
+	return &PowerManager{hooks: hooks, minIdle: minIdle, minSpare: powerStates.MinSpare, wakeTimeout: wakeTimeout,
+		autoSleep: powerStates.AutoSleep, mutex: &sync.Mutex{}, busy: make(map[string]time.Time), registry: registry}
+}
+
+func (m *PowerManager) Enabled() bool {
+	return m.hooks != nil
+}
+
+//whether nothing runs nor is reserved on a host. Must be called with the class lock of the host held
+func (r *Registry) hostEmpty(host *Host) bool {
+	return host.AllocatedCPUs == 0 && host.AllocatedMemory == 0 && len(r.tasks.List(host.HostIP, "", TaskStateRunning)) == 0 &&
+		len(r.reservations.List(host.HostIP)) == 0
+}
+
+//how long a host has been empty, as far as the checks saw. Counts from its last power change at most, a woken host
+//gets a full idle time before sleeping again. Must be called with the class lock of the host held
+func (m *PowerManager) idleFor(host *Host, now time.Time) time.Duration {
+	if !m.registry.hostEmpty(host) {
+		m.mutex.Lock()
+		m.busy[host.HostIP] = now
+		m.mutex.Unlock()
+		return 0
+	}
+	since := host.PowerSince
+	m.mutex.Lock()
+	if busy := m.busy[host.HostIP]; busy.After(since) {
+		since = busy
+	}
+	m.mutex.Unlock()
+	return now.Sub(since)
+}
+
+//free share of the cpu and memory of the live hosts that are on, leaving out except
+func (r *Registry) SpareCapacity(except string) float64 {
+	var totalCPUs, totalMemory, allocatedCPUs, allocatedMemory int64
+	for _, snapshot := range r.HostSnapshots() {
+		if snapshot.HostIP == except || snapshot.Liveness == LivenessDead || PowerStateOf(&snapshot) != PowerOn {
+			continue
+		}
+		totalCPUs += snapshot.TotalCPUs
+		totalMemory += snapshot.TotalMemory
+		allocatedCPUs += snapshot.AllocatedCPUs
+		allocatedMemory += snapshot.AllocatedMemory
+	}
+	if totalCPUs == 0 || totalMemory == 0 {
+		return 0
+	}
+	return math.Max(math.Min(1-float64(allocatedCPUs)/float64(totalCPUs), 1-float64(allocatedMemory)/float64(totalMemory)), 0)
+}
+
+//puts a host to sleep, or to drain until it can. A host that is on is refused when the others would not keep the
+//minimum spare capacity
+func (m *PowerManager) Sleep(hostIP string) (Host, error) {
+	if !m.Enabled() {
+		return Host{}, fmt.Errorf("%w: no power hooks are configured", ErrPowerState)
+	}
+	host, err := m.registry.LookupHost(hostIP)
+	if err != nil {
+		return Host{}, err
+	}
+	spare := m.registry.SpareCapacity(hostIP)
+
+	lock := m.registry.LockHost(host)
+	if host.removed {
+		lock.Unlock()
+		return Host{}, fmt.Errorf("%w: %s", ErrUnknownHost, hostIP)
+	}
+	state := PowerStateOf(host)
+	switch {
+	case state == PowerWaking:
+		lock.Unlock()
+		return Host{}, fmt.Errorf("%w: %s is waking up", ErrPowerState, hostIP)
+	case state == PowerOn && spare < m.minSpare:
+		lock.Unlock()
+		return Host{}, fmt.Errorf("%w: the other hosts would keep %.0f%% of spare capacity, %.0f%% is required", ErrPowerState, spare*100, m.minSpare*100)
+	case state == PowerAsleep || (state == PowerDraining && m.idleFor(host, Now()) < m.minIdle):
+		copied := *host
+		lock.Unlock()
+		return copied, nil
+	case m.idleFor(host, Now()) < m.minIdle:
+		event := m.registry.setPowerState(host, PowerDraining)
+		copied := *host
+		lock.Unlock()
+		m.registry.publishPowerState(event)
+		return copied, nil
+	}
+	lock.Unlock()
+	return m.sleep(host)
+}
+
+//runs the sleep hook of an idle host that is on or draining, which goes back to its state when the hook fails
+func (m *PowerManager) sleep(host *Host) (Host, error) {
+	lock := m.registry.LockHost(host)
+	state := PowerStateOf(host)
+	if host.removed || (state != PowerOn && state != PowerDraining) || !m.registry.hostEmpty(host) {
+		copied := *host
+		lock.Unlock()
+		return copied, nil
+	}
+	event := m.registry.setPowerState(host, PowerAsleep)
+	lock.Unlock()
+	m.registry.publishPowerState(event)
+
+	if err := m.hooks.Sleep(host.HostIP); err != nil {
+		powerHookFailures.Inc("sleep")
+		lock = m.registry.LockHost(host)
+		event = m.registry.setPowerState(host, state)
+		copied := *host
+		lock.Unlock()
+		m.registry.publishPowerState(event)
+		return copied, fmt.Errorf("%w: %v", ErrPowerHook, err)
+	}
+	lock = m.registry.LockHost(host)
+	m.registry.energy.Suspend(host.HostIP, host.Region, Now())
+	copied := *host
+	lock.Unlock()
+	return copied, nil
+}
+
+//wakes a sleeping host, or puts a draining one back in service
+func (m *PowerManager) Wake(hostIP string) (Host, error) {
+	host, err := m.registry.LookupHost(hostIP)
+	if err != nil {
+		return Host{}, err
+	}
+	lock := m.registry.LockHost(host)
+	if host.removed {
+		lock.Unlock()
+		return Host{}, fmt.Errorf("%w: %s", ErrUnknownHost, hostIP)
+	}
+	switch PowerStateOf(host) {
+	case PowerDraining:
+		event := m.registry.setPowerState(host, PowerOn)
+		copied := *host
+		lock.Unlock()
+		m.registry.publishPowerState(event)
+		return copied, nil
+	case PowerAsleep:
+	default:
+		copied := *host
+		lock.Unlock()
+		return copied, nil
+	}
+	if !m.Enabled() {
+		lock.Unlock()
+		return Host{}, fmt.Errorf("%w: no power hooks are configured", ErrPowerState)
+	}
+	event := m.registry.setPowerState(host, PowerWaking)
+	lock.Unlock()
+	m.registry.publishPowerState(event)
+
+	if err = m.hooks.Wake(hostIP); err != nil {
+		powerHookFailures.Inc("wake")
+		lock = m.registry.LockHost(host)
+		event = m.registry.setPowerState(host, PowerAsleep)
+		copied := *host
+		lock.Unlock()
+		m.registry.publishPowerState(event)
+		return copied, fmt.Errorf("%w: %v", ErrPowerHook, err)
+	}
+	lock = m.registry.LockHost(host)
+	copied := *host
+	lock.Unlock()
+	return copied, nil
+}
+
+//wakes a sleeping host a task of class could be placed on, walking the lists like the placement does. Returns the
+//host woken, or the one already waking for it, empty when there is none
+func (m *PowerManager) WakeFor(class string, cpu int64, memory int64) string {
+	if !m.Enabled() || !m.registry.isLeader() {
+		return ""
+	}
+	candidate := ""
+	for _, region := range PlacementRegions() {
+		for _, hostClass := range NormalClasses(class) {
+			m.registry.locks[region].classHosts[hostClass].Lock()
+			for _, host := range m.registry.regions[region].classHosts[hostClass] {
+				state := PowerStateOf(host)
+				if state != PowerAsleep && state != PowerWaking {
+					continue
+				}
+				freeCPU, freeMemory := m.registry.reservations.FreeCapacity(host, CapacityLimit(host.HostClass, class))
+				if cpu > freeCPU || memory > freeMemory {
+					continue
+				}
+				if state == PowerWaking {
+					m.registry.locks[region].classHosts[hostClass].Unlock()
+					return host.HostIP
+				}
+				if candidate == "" {
+					candidate = host.HostIP
+				}
+			}
+			m.registry.locks[region].classHosts[hostClass].Unlock()
+		}
+	}
+	if candidate == "" {
+		return ""
+	}
+	if _, err := m.Wake(candidate); err != nil {
+		log.Printf("power: waking %s for a task of class %s: %v", candidate, class, err)
+		return ""
+	}
+	return candidate
+}
+
+//puts the draining hosts that have been idle long enough to sleep, and the other idle ones when asked to, gives
+//up on the hosts that did not wake in time and wakes the host asleep the longest when the spare capacity is short
+func (m *PowerManager) Check(now time.Time) {
+	if !m.Enabled() {
+		return
+	}
+	listHosts := m.registry.AllHosts()
+	sort.Slice(listHosts, func(i, j int) bool { return listHosts[i].HostIP < listHosts[j].HostIP })
+
+	draining := make([]*Host, 0)
+	idle := make([]*Host, 0)
+	var asleep *Host
+	var asleepSince time.Time
+	waking := false
+	for _, host := range listHosts {
+		lock := m.registry.LockHost(host)
+		if host.removed {
+			lock.Unlock()
+			continue
+		}
+		switch PowerStateOf(host) {
+		case PowerDraining:
+			if m.idleFor(host, now) >= m.minIdle {
+				draining = append(draining, host)
+			}
+		case PowerOn:
+			if m.idleFor(host, now) >= m.minIdle && m.autoSleep && host.Liveness == LivenessAlive {
+				idle = append(idle, host)
+			}
+		case PowerWaking:
+			if now.Sub(host.PowerSince) >= m.wakeTimeout {
+				log.Printf("power: host %s did not report within %v of waking", host.HostIP, m.wakeTimeout)
+				event := m.registry.setPowerState(host, PowerAsleep)
+				lock.Unlock()
+				m.registry.publishPowerState(event)
+				continue
+			}
+			waking = true
+		case PowerAsleep:
+			if asleep == nil || host.PowerSince.Before(asleepSince) {
+				asleep, asleepSince = host, host.PowerSince
+			}
+		}
+		lock.Unlock()
+	}
+
+	for _, host := range draining {
+		if _, err := m.sleep(host); err != nil {
+			log.Printf("power: %v", err)
+		}
+	}
+	//one at a time, each sleep lowers the spare capacity of the others
+	for _, host := range idle {
+		if m.registry.SpareCapacity(host.HostIP) < m.minSpare {
+			break
+		}
+		if _, err := m.sleep(host); err != nil {
+			log.Printf("power: %v", err)
+		}
+	}
+	if asleep != nil && !waking && m.registry.SpareCapacity("") < m.minSpare {
+		log.Printf("power: spare capacity below %.0f%%, waking %s", m.minSpare*100, asleep.HostIP)
+		if _, err := m.Wake(asleep.HostIP); err != nil {
+			log.Printf("power: %v", err)
+		}
+	}
+}
+
+func (r *Registry) RunPowerManager(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if r.isLeader() {
+			r.powerManager.Check(Now())
+		}
+	}
+}
+
+type HostPower struct {
+	HostIP string    `json:"hostip"`
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+	Idle   string    `json:"idle,omitempty"` //time the host has been empty, for the hosts that are on or draining
+}
+
+type PowerStatus struct {
+	Enabled  bool           `json:"enabled"`
+	Spare    float64        `json:"spare"` //of the hosts that are on
+	MinSpare float64        `json:"minspare"`
+	MinIdle  string         `json:"minidle"`
+	States   map[string]int `json:"states"` //hosts in each state
+	Hosts    []HostPower    `json:"hosts"`
+}
+
+//GET /v2/power
+func (r *Registry) V2PowerStatus(w http.ResponseWriter, req *http.Request) {
+	status := PowerStatus{Enabled: r.powerManager.Enabled(), Spare: r.SpareCapacity(""), MinSpare: r.powerManager.minSpare, MinIdle: r.powerManager.minIdle.String(),
+		States: map[string]int{PowerOn: 0, PowerDraining: 0, PowerAsleep: 0, PowerWaking: 0}, Hosts: make([]HostPower, 0)}
+	listHosts := r.AllHosts()
+	sort.Slice(listHosts, func(i, j int) bool { return listHosts[i].HostIP < listHosts[j].HostIP })
+	now := Now()
+	for _, host := range listHosts {
+		lock := r.LockHost(host)
+		if host.removed {
+			lock.Unlock()
+			continue
+		}
+		power := HostPower{HostIP: host.HostIP, State: PowerStateOf(host), Since: host.PowerSince}
+		if power.State == PowerOn || power.State == PowerDraining {
+			power.Idle = r.powerManager.idleFor(host, now).Truncate(time.Second).String()
+		}
+		lock.Unlock()
+		status.States[power.State]++
+		status.Hosts = append(status.Hosts, power)
+	}
+	WriteJSON(w, http.StatusOK, status)
+}
+
+type PowerRequest struct {
+	State string `json:"state"` //asleep, drained first when needed, or on
+}
+
+//PUT /v2/hosts/{hostip}/power
+func (r *Registry) V2SetPower(w http.ResponseWriter, req *http.Request) {
+	var request PowerRequest
+	if err := DecodeBody(req, &request); err != nil {
+		WriteError(w, err)
+		return
+	}
+	hostIP := mux.Vars(req)["hostip"]
+	var host Host
+	var err error
+	switch request.State {
+	case PowerAsleep:
+		host, err = r.powerManager.Sleep(hostIP)
+	case PowerOn:
+		host, err = r.powerManager.Wake(hostIP)
+	default:
+		err = &ValidationError{Field: "state", Message: fmt.Sprintf("must be %q or %q", PowerAsleep, PowerOn)}
+	}
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, host)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//a registry of two idle hosts with fake power hooks, on a clock the test moves
+type powerTest struct {
+	*testClock
+	registry *Registry
+	hooks    *FakePowerHooks
+}
+
+func newPowerTest(t *testing.T) *powerTest {
+	useDefaultConfig(t)
+	test := &powerTest{testClock: useClock(t), registry: NewRegistry(NewFakeRuntime()), hooks: NewFakePowerHooks()}
+
+	test.registry.background = func(update func()) { update() }
+	powerStates := config.PowerStates
+	powerStates.Hooks = "fake"
+	powerStates.MinSpare = 0
+	test.registry.powerManager = NewPowerManager(test.registry, powerStates, test.hooks)
+	for _, hostIP := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, err := test.registry.RegisterHost(hostIP, 1<<30, 4*1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the hosts have been empty long enough to sleep
+	test.advance(test.registry.powerManager.minIdle)
+	return test
+}
+
+func (p *powerTest) expectState(t *testing.T, hostIP string, state string) {
+	t.Helper()
+	host, err := p.registry.SnapshotHost(hostIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if PowerStateOf(&host) != state {
+		t.Fatalf("%s is %s, expected %s", hostIP, PowerStateOf(&host), state)
+	}
+}
+
+func (p *powerTest) expectCalls(t *testing.T, calls ...PowerHookCall) {
+	t.Helper()
+	if got := p.hooks.Calls(); len(got) != len(calls) || (len(calls) > 0 && !reflect.DeepEqual(got, calls)) {
+		t.Fatalf("the hooks got %v, expected %v", got, calls)
+	}
+}
+
+func TestPowerStateTransitions(t *testing.T) {
+	p := newPowerTest(t)
+	manager := p.registry.powerManager
+	if err := p.registry.AllocateResources("10.0.0.1", 1024, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	//a host running something drains instead of sleeping
+	host, err := manager.Sleep("10.0.0.1")
+	if err != nil || PowerStateOf(&host) != PowerDraining {
+		t.Fatalf("sleeping a busy host returned %s, %v", PowerStateOf(&host), err)
+	}
+	p.expectCalls(t)
+
+	//and sleeps once it has been empty for the minimum idle time
+	if err = p.registry.UpdateResources(1024, 256<<20, "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	p.advance(manager.minIdle / 2)
+	manager.Check(Now())
+	p.expectState(t, "10.0.0.1", PowerDraining)
+	p.advance(manager.minIdle / 2)
+	manager.Check(Now())
+	p.expectState(t, "10.0.0.1", PowerAsleep)
+	p.expectCalls(t, PowerHookCall{Hook: "sleep", HostIP: "10.0.0.1"})
+
+	host, err = manager.Wake("10.0.0.1")
+	if err != nil || PowerStateOf(&host) != PowerWaking {
+		t.Fatalf("waking a sleeping host returned %s, %v", PowerStateOf(&host), err)
+	}
+	if _, err = manager.Sleep("10.0.0.1"); !errors.Is(err, ErrPowerState) {
+		t.Errorf("sleeping a waking host returned %v", err)
+	}
+
+	//the first report of the monitor puts it back in service
+	cpu, memory := 0.1, 0.1
+	if err = p.registry.SetUtilization("10.0.0.1", &cpu, &memory); err != nil {
+		t.Fatal(err)
+	}
+	p.expectState(t, "10.0.0.1", PowerOn)
+	p.expectCalls(t, PowerHookCall{Hook: "sleep", HostIP: "10.0.0.1"}, PowerHookCall{Hook: "wake", HostIP: "10.0.0.1"})
+}
+
+func TestPowerStateDrainingHostWoken(t *testing.T) {
+	p := newPowerTest(t)
+	if err := p.registry.AllocateResources("10.0.0.1", 1024, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.registry.powerManager.Sleep("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	//a draining host is still on, it goes back in service without running a hook
+	if host, err := p.registry.powerManager.Wake("10.0.0.1"); err != nil || PowerStateOf(&host) != PowerOn {
+		t.Fatalf("waking a draining host returned %s, %v", PowerStateOf(&host), err)
+	}
+	p.expectCalls(t)
+}
+
+func TestPowerStateWakeTimeout(t *testing.T) {
+	p := newPowerTest(t)
+	manager := p.registry.powerManager
+	if _, err := manager.Sleep("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Wake("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	p.advance(manager.wakeTimeout)
+	manager.Check(Now())
+	p.expectState(t, "10.0.0.1", PowerAsleep)
+}
+
+func TestPowerHookFailures(t *testing.T) {
+	p := newPowerTest(t)
+	manager := p.registry.powerManager
+	hookErr := errors.New("ssh: connection refused")
+
+	//an idle host whose sleep hook fails stays on
+	p.hooks.Fail("sleep", hookErr)
+	host, err := manager.Sleep("10.0.0.1")
+	if !errors.Is(err, ErrPowerHook) || PowerStateOf(&host) != PowerOn {
+		t.Fatalf("a failed sleep hook returned %s, %v", PowerStateOf(&host), err)
+	}
+	p.expectState(t, "10.0.0.1", PowerOn)
+
+	//a draining host whose sleep hook fails keeps draining, and sleeps after another idle time
+	if err = p.registry.AllocateResources("10.0.0.2", 1024, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = manager.Sleep("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.registry.UpdateResources(1024, 256<<20, "10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	p.hooks.Fail("sleep", hookErr)
+	p.advance(manager.minIdle)
+	manager.Check(Now())
+	p.expectState(t, "10.0.0.2", PowerDraining)
+	manager.Check(Now())
+	p.expectState(t, "10.0.0.2", PowerDraining)
+	p.advance(manager.minIdle)
+	manager.Check(Now())
+	p.expectState(t, "10.0.0.2", PowerAsleep)
+
+	//a sleeping host whose wake hook fails stays asleep
+	p.hooks.Fail("wake", hookErr)
+	host, err = manager.Wake("10.0.0.2")
+	if !errors.Is(err, ErrPowerHook) || PowerStateOf(&host) != PowerAsleep {
+		t.Fatalf("a failed wake hook returned %s, %v", PowerStateOf(&host), err)
+	}
+	p.expectState(t, "10.0.0.2", PowerAsleep)
+	p.expectCalls(t,
+		PowerHookCall{Hook: "sleep", HostIP: "10.0.0.1"},
+		PowerHookCall{Hook: "sleep", HostIP: "10.0.0.2"},
+		PowerHookCall{Hook: "sleep", HostIP: "10.0.0.2"},
+		PowerHookCall{Hook: "wake", HostIP: "10.0.0.2"})
+}
+
+func TestPowerStateEmptyListWakes(t *testing.T) {
+	p := newPowerTest(t)
+	manager := p.registry.powerManager
+	if _, err := manager.Sleep("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a host is still on, nothing is woken
+	if status, body := serve(t, p.registry, http.MethodGet, "/host/list/4&1", nil); status != http.StatusOK || !strings.Contains(string(body), "10.0.0.2") {
+		t.Fatalf("%d %s", status, body)
+	}
+	if _, err := manager.Sleep("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	p.expectCalls(t, PowerHookCall{Hook: "sleep", HostIP: "10.0.0.1"}, PowerHookCall{Hook: "sleep", HostIP: "10.0.0.2"})
+
+	//an empty cut list wakes nothing
+	if status, body := serve(t, p.registry, http.MethodGet, "/host/list/4&2", nil); status != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Fatalf("%d %s", status, body)
+	}
+	p.expectState(t, "10.0.0.1", PowerAsleep)
+
+	//an empty initial scheduling list wakes a host once, the next requests wait for it
+	for i := 0; i < 2; i++ {
+		if status, body := serve(t, p.registry, http.MethodGet, "/host/list/4&1", nil); status != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+			t.Fatalf("%d %s", status, body)
+		}
+	}
+	p.expectState(t, "10.0.0.1", PowerWaking)
+	p.expectState(t, "10.0.0.2", PowerAsleep)
+	p.expectCalls(t, PowerHookCall{Hook: "sleep", HostIP: "10.0.0.1"}, PowerHookCall{Hook: "sleep", HostIP: "10.0.0.2"},
+		PowerHookCall{Hook: "wake", HostIP: "10.0.0.1"})
+}
@@ -0,0 +1,980 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//consensus log of the replicated mode, following Raft: leader election, log replication and snapshots. A node knows
+//nothing about hosts: committed entries are handed to the apply function and snapshots are taken and restored through
+//the functions given in its options, so several nodes can run in one process, each with its own handler
+
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+	raftBatch     = 256 //entries sent in one append request
+)
+
+const (
+	raftStateFile    = "raft.json"
+	raftLogFile      = "raft.log"
+	raftSnapshotFile = "raft.snapshot"
+)
+
+var ErrNotLeader = errors.New("this node is not the leader")
+var ErrNoLeader = errors.New("no leader is elected")
+var ErrNotCommitted = errors.New("the change was not committed by a majority in time")
+
+type RaftEntry struct {
+	Index  uint64          `json:"index"`
+	Term   uint64          `json:"term"`
+	Origin string          `json:"origin,omitempty"` //incarnation of the node that proposed the entry
+	Data   json.RawMessage `json:"data,omitempty"`   //empty for the entry a new leader commits its term with
+}
+
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"lastlogindex"`
+	LastLogTerm  uint64 `json:"lastlogterm"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term         uint64      `json:"term"`
+	Leader       string      `json:"leader"`
+	PrevLogIndex uint64      `json:"prevlogindex"`
+	PrevLogTerm  uint64      `json:"prevlogterm"`
+	Entries      []RaftEntry `json:"entries,omitempty"`
+	LeaderCommit uint64      `json:"leadercommit"`
+}
+
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	LastIndex uint64 `json:"lastindex"`        //last entry of the follower, lets the leader move back faster
+	Resync    bool   `json:"resync,omitempty"` //the follower applied changes that were never committed and needs a snapshot
+}
+
+type SnapshotRequest struct {
+	Term     uint64          `json:"term"`
+	Leader   string          `json:"leader"`
+	Index    uint64          `json:"index"`
+	LastTerm uint64          `json:"lastterm"`
+	Data     json.RawMessage `json:"data"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+type RaftOptions struct {
+	ID                string
+	Peers             map[string]string //node id -> base URL the raft handler is reachable at, this node included
+	ElectionTimeout   time.Duration     //randomized between once and twice this value
+	HeartbeatInterval time.Duration
+	Dir               string       //where the term, vote, log and snapshot are kept, empty keeps them in memory only
+	SnapshotEntries   int          //log entries kept before the log is compacted into a snapshot
+	Client            *http.Client //used to reach the peers, a plain client when nil
+
+	//called in log order with the committed entries, except the ones this node proposed since it started: the
+	//proposer has applied those already
+	Apply    func(entry RaftEntry)
+	Snapshot func() (json.RawMessage, error)
+	Restore  func(data json.RawMessage) error
+	//called with the node lock held when this node stops being the leader, optional
+	Demoted func()
+}
+
+type commitWaiter struct {
+	index uint64
+	done  chan error
+}
+
+type RaftNode struct {
+	options     RaftOptions
+	incarnation string
+	client      *http.Client
+
+	mutex         *sync.Mutex
+	state         string
+	term          uint64
+	votedFor      string
+	leader        string
+	entries       []RaftEntry //after the snapshot
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshotData  json.RawMessage
+	commitIndex   uint64
+	lastApplied   uint64
+	deadline      time.Time //of the election timer
+	nextIndex     map[string]uint64
+	matchIndex    map[string]uint64
+	needSnapshot  map[string]bool
+	resync        bool //changes applied as leader were never committed, the state must come from a snapshot
+	triggers      map[string]chan struct{}
+	waiters       []commitWaiter
+	logFile       *os.File
+
+	applyMutex *sync.Mutex //held while entries are applied and while snapshots are taken or restored
+	applyReady chan struct{}
+	stopped    chan struct{}
+}
+
+func NewRaftNode(options RaftOptions) (*RaftNode, error) {
+	if _, ok := options.Peers[options.ID]; !ok {
+		return nil, fmt.Errorf("raft: node %s is not one of the peers", options.ID)
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: options.ElectionTimeout}
+	}
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	node := &RaftNode{
+		options:      options,
+		incarnation:  options.ID + "-" + hex.EncodeToString(nonce),
+		client:       options.Client,
+		mutex:        &sync.Mutex{},
+		state:        RaftFollower,
+		nextIndex:    make(map[string]uint64),
+		matchIndex:   make(map[string]uint64),
+		needSnapshot: make(map[string]bool),
+		triggers:     make(map[string]chan struct{}),
+		applyMutex:   &sync.Mutex{},
+		applyReady:   make(chan struct{}, 1),
+		stopped:      make(chan struct{}),
+	}
+	for peer := range options.Peers {
+		node.triggers[peer] = make(chan struct{}, 1)
+	}
+	if options.Dir != "" {
+		if err := node.load(); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+//starts the election timer and the apply loop
+func (n *RaftNode) Start() {
+	n.mutex.Lock()
+	n.resetDeadline()
+	n.mutex.Unlock()
+	go n.runElectionTimer()
+	go n.runApply()
+}
+
+func (n *RaftNode) Stop() {
+	close(n.stopped)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.state == RaftLeader {
+		n.demoted()
+	}
+	n.state = RaftFollower
+	n.failWaiters(ErrNotLeader)
+	if n.logFile != nil {
+		n.logFile.Close()
+	}
+}
+
+//handles the requests of the other nodes, under /raft/
+func (n *RaftNode) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", func(w http.ResponseWriter, req *http.Request) {
+		var vote VoteRequest
+		if json.NewDecoder(req.Body).Decode(&vote) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(n.HandleVote(vote))
+	})
+	mux.HandleFunc("/raft/append", func(w http.ResponseWriter, req *http.Request) {
+		var appendReq AppendRequest
+		if json.NewDecoder(req.Body).Decode(&appendReq) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(n.HandleAppend(appendReq))
+	})
+	mux.HandleFunc("/raft/snapshot", func(w http.ResponseWriter, req *http.Request) {
+		var snapshot SnapshotRequest
+		if json.NewDecoder(req.Body).Decode(&snapshot) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(n.HandleSnapshot(snapshot))
+	})
+	return mux
+}
+
+type RaftStatus struct {
+	ID          string            `json:"id"`
+	State       string            `json:"state"`
+	Term        uint64            `json:"term"`
+	Leader      string            `json:"leader,omitempty"`
+	LeaderURL   string            `json:"leaderurl,omitempty"`
+	LastIndex   uint64            `json:"lastindex"`
+	CommitIndex uint64            `json:"commitindex"`
+	LastApplied uint64            `json:"lastapplied"`
+	Snapshot    uint64            `json:"snapshotindex"`
+	Peers       map[string]string `json:"peers"`
+	Match       map[string]uint64 `json:"matchindex,omitempty"` //known only by the leader
+}
+
+func (n *RaftNode) Status() RaftStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	status := RaftStatus{ID: n.options.ID, State: n.state, Term: n.term, Leader: n.leader, LeaderURL: n.options.Peers[n.leader],
+		LastIndex: n.lastIndex(), CommitIndex: n.commitIndex, LastApplied: n.lastApplied, Snapshot: n.snapshotIndex, Peers: n.options.Peers}
+	if n.state == RaftLeader {
+		status.Match = make(map[string]uint64)
+		for peer, match := range n.matchIndex {
+			status.Match[peer] = match
+		}
+	}
+	return status
+}
+
+//id and URL of the current leader as far as this node knows, and whether it is this node
+func (n *RaftNode) Leader() (string, string, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leader, n.options.Peers[n.leader], n.state == RaftLeader
+}
+
+func (n *RaftNode) LastIndex() uint64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.lastIndex()
+}
+
+//appends an entry to the log of the leader. encode is called with the index of the entry under the node lock, so
+//entries are encoded in the order they are appended
+func (n *RaftNode) Propose(encode func(index uint64) (json.RawMessage, error)) (uint64, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != RaftLeader {
+		return 0, ErrNotLeader
+	}
+	entry := RaftEntry{Index: n.lastIndex() + 1, Term: n.term, Origin: n.incarnation}
+	data, err := encode(entry.Index)
+	if err != nil {
+		return 0, err
+	}
+	entry.Data = data
+	n.appendEntries([]RaftEntry{entry})
+	n.matchIndex[n.options.ID] = entry.Index
+	n.advanceCommit()
+	n.triggerReplication()
+	return entry.Index, nil
+}
+
+//waits until the entry at index is committed. Fails when the node loses the leadership before
+func (n *RaftNode) WaitCommitted(index uint64, timeout time.Duration) error {
+	n.mutex.Lock()
+	if n.commitIndex >= index {
+		n.mutex.Unlock()
+		return nil
+	}
+	if n.state != RaftLeader {
+		n.mutex.Unlock()
+		return ErrNotLeader
+	}
+	waiter := commitWaiter{index: index, done: make(chan error, 1)}
+	n.waiters = append(n.waiters, waiter)
+	n.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-waiter.done:
+		return err
+	case <-timer.C:
+		return ErrNotCommitted
+	}
+}
+
+//gives up the leadership. The changes this node applied that are not committed yet are then replaced by the state of
+//the next leader, unless this node is elected again and commits them itself
+func (n *RaftNode) StepDown() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.stepDown(n.term)
+}
+
+func (n *RaftNode) HandleVote(vote VoteRequest) VoteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if vote.Term > n.term {
+		n.stepDown(vote.Term)
+	}
+	response := VoteResponse{Term: n.term}
+	if vote.Term < n.term || (n.votedFor != "" && n.votedFor != vote.Candidate) {
+		return response
+	}
+	//only a candidate whose log is at least as up to date as ours can hold every committed entry
+	lastTerm := n.termAt(n.lastIndex())
+	if vote.LastLogTerm < lastTerm || (vote.LastLogTerm == lastTerm && vote.LastLogIndex < n.lastIndex()) {
+		return response
+	}
+	n.votedFor = vote.Candidate
+	n.persistState()
+	n.resetDeadline()
+	response.Granted = true
+	return response
+}
+
+func (n *RaftNode) HandleAppend(appendReq AppendRequest) AppendResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if appendReq.Term < n.term {
+		return AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	}
+	if appendReq.Term > n.term || n.state != RaftFollower {
+		n.stepDown(appendReq.Term)
+	}
+	n.leader = appendReq.Leader
+	n.resetDeadline()
+
+	response := AppendResponse{Term: n.term}
+	if n.resync {
+		response.Resync = true
+		return response
+	}
+
+	prevIndex := appendReq.PrevLogIndex
+	entries := appendReq.Entries
+	//entries already in our snapshot are committed and match
+	if prevIndex < n.snapshotIndex {
+		for len(entries) > 0 && entries[0].Index <= n.snapshotIndex {
+			entries = entries[1:]
+		}
+		prevIndex = n.snapshotIndex
+	} else if prevIndex > n.lastIndex() || n.termAt(prevIndex) != appendReq.PrevLogTerm {
+		response.LastIndex = n.lastIndex()
+		if prevIndex <= n.lastIndex() {
+			response.LastIndex = prevIndex - 1
+		}
+		return response
+	}
+
+	for i, entry := range entries {
+		if entry.Index <= n.lastIndex() {
+			if n.termAt(entry.Index) == entry.Term {
+				continue
+			}
+			//a conflicting entry and everything after it were never committed
+			n.truncateFrom(entry.Index)
+		}
+		n.appendEntries(entries[i:])
+		break
+	}
+
+	lastNew := prevIndex
+	if len(entries) > 0 {
+		lastNew = entries[len(entries)-1].Index
+	}
+	if appendReq.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(appendReq.LeaderCommit, lastNew)
+		n.signalApply()
+	}
+	response.Success = true
+	response.LastIndex = n.lastIndex()
+	return response
+}
+
+func (n *RaftNode) HandleSnapshot(snapshot SnapshotRequest) SnapshotResponse {
+	n.mutex.Lock()
+	if snapshot.Term < n.term {
+		defer n.mutex.Unlock()
+		return SnapshotResponse{Term: n.term}
+	}
+	if snapshot.Term > n.term || n.state != RaftFollower {
+		n.stepDown(snapshot.Term)
+	}
+	n.leader = snapshot.Leader
+	n.resetDeadline()
+	if snapshot.Index <= n.snapshotIndex && !n.resync {
+		defer n.mutex.Unlock()
+		return SnapshotResponse{Term: n.term}
+	}
+	n.mutex.Unlock()
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	if err := n.options.Restore(snapshot.Data); err != nil {
+		log.Printf("raft: could not restore the snapshot at %d from %s: %v", snapshot.Index, snapshot.Leader, err)
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return SnapshotResponse{Term: n.term}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	//the entries following the snapshot are kept when the log agrees with it
+	kept := make([]RaftEntry, 0)
+	if snapshot.Index <= n.lastIndex() && n.termAt(snapshot.Index) == snapshot.LastTerm {
+		for _, entry := range n.entries {
+			if entry.Index > snapshot.Index {
+				kept = append(kept, entry)
+			}
+		}
+	}
+	n.entries = kept
+	n.snapshotIndex = snapshot.Index
+	n.snapshotTerm = snapshot.LastTerm
+	n.snapshotData = snapshot.Data
+	n.commitIndex = min(max(n.commitIndex, snapshot.Index), n.lastIndex())
+	n.lastApplied = snapshot.Index
+	n.resync = false
+	n.persistSnapshot()
+	n.rewriteLog()
+	n.persistState()
+	log.Printf("raft: restored the snapshot at %d sent by %s", snapshot.Index, snapshot.Leader)
+	return SnapshotResponse{Term: n.term}
+}
+
+//the methods below are called with the node lock held
+
+func (n *RaftNode) lastIndex() uint64 {
+	if len(n.entries) > 0 {
+		return n.entries[len(n.entries)-1].Index
+	}
+	return n.snapshotIndex
+}
+
+func (n *RaftNode) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	}
+	if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-n.snapshotIndex-1].Term
+}
+
+func (n *RaftNode) quorum() int {
+	return len(n.options.Peers)/2 + 1
+}
+
+func (n *RaftNode) resetDeadline() {
+	timeout := n.options.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(mathrand.Int63n(int64(timeout))))
+}
+
+//becomes a follower, in a newer term when term is greater than ours
+func (n *RaftNode) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.persistState()
+	}
+	if n.state == RaftLeader {
+		log.Printf("raft: %s is no longer the leader (term %d)", n.options.ID, n.term)
+		//what this node applied as leader and never got committed may be lost, its state is replaced by the
+		//one of the next leader
+		for _, entry := range n.entries {
+			if entry.Index > n.commitIndex && entry.Origin == n.incarnation && len(entry.Data) > 0 {
+				n.resync = true
+				break
+			}
+		}
+		n.failWaiters(ErrNotLeader)
+		n.demoted()
+	}
+	n.state = RaftFollower
+	n.resetDeadline()
+}
+
+func (n *RaftNode) demoted() {
+	if n.options.Demoted != nil {
+		n.options.Demoted()
+	}
+}
+
+func (n *RaftNode) failWaiters(err error) {
+	for _, waiter := range n.waiters {
+		waiter.done <- err
+	}
+	n.waiters = nil
+}
+
+func (n *RaftNode) triggerReplication() {
+	for peer, trigger := range n.triggers {
+		if peer == n.options.ID {
+			continue
+		}
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *RaftNode) signalApply() {
+	select {
+	case n.applyReady <- struct{}{}:
+	default:
+	}
+}
+
+//commits the newest entry of the current term stored on a majority. Entries of older terms are committed with it
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+		replicas := 0
+		for peer := range n.options.Peers {
+			if n.matchIndex[peer] >= index {
+				replicas++
+			}
+		}
+		if replicas >= n.quorum() {
+			n.commitIndex = index
+			n.signalApply()
+			pending := n.waiters[:0]
+			for _, waiter := range n.waiters {
+				if waiter.index <= index {
+					waiter.done <- nil
+				} else {
+					pending = append(pending, waiter)
+				}
+			}
+			n.waiters = pending
+			return
+		}
+	}
+}
+
+func (n *RaftNode) runElectionTimer() {
+	ticker := time.NewTicker(n.options.ElectionTimeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-ticker.C:
+		}
+		n.mutex.Lock()
+		expired := n.state != RaftLeader && time.Now().After(n.deadline)
+		n.mutex.Unlock()
+		if expired {
+			n.startElection()
+		}
+	}
+}
+
+func (n *RaftNode) startElection() {
+	n.mutex.Lock()
+	n.state = RaftCandidate
+	n.term++
+	n.votedFor = n.options.ID
+	n.leader = ""
+	n.persistState()
+	n.resetDeadline()
+	term := n.term
+	vote := VoteRequest{Term: term, Candidate: n.options.ID, LastLogIndex: n.lastIndex(), LastLogTerm: n.termAt(n.lastIndex())}
+	n.mutex.Unlock()
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.mutex.Lock()
+		n.becomeLeader(term)
+		n.mutex.Unlock()
+		return
+	}
+	for peer, peerURL := range n.options.Peers {
+		if peer == n.options.ID {
+			continue
+		}
+		go func(peerURL string) {
+			var response VoteResponse
+			if err := n.call(peerURL, "/raft/vote", vote, &response); err != nil {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if response.Term > n.term {
+				n.stepDown(response.Term)
+				return
+			}
+			if n.state != RaftCandidate || n.term != term || !response.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader(term)
+			}
+		}(peerURL)
+	}
+}
+
+func (n *RaftNode) becomeLeader(term uint64) {
+	if n.state != RaftCandidate || n.term != term {
+		return
+	}
+	log.Printf("raft: %s is the leader for term %d", n.options.ID, term)
+	n.state = RaftLeader
+	n.leader = n.options.ID
+	for peer := range n.options.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+		n.needSnapshot[peer] = false
+	}
+	//entries of previous terms can only be committed along with one of the current term
+	n.appendEntries([]RaftEntry{{Index: n.lastIndex() + 1, Term: term, Origin: n.incarnation}})
+	n.matchIndex[n.options.ID] = n.lastIndex()
+	n.advanceCommit()
+	for peer, peerURL := range n.options.Peers {
+		if peer != n.options.ID {
+			go n.replicateTo(peer, peerURL, term)
+		}
+	}
+}
+
+//sends the log to one follower for as long as this node leads term
+func (n *RaftNode) replicateTo(peer string, peerURL string, term uint64) {
+	heartbeat := time.NewTicker(n.options.HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		n.mutex.Lock()
+		if n.state != RaftLeader || n.term != term {
+			n.mutex.Unlock()
+			return
+		}
+		next := n.nextIndex[peer]
+		if next <= n.snapshotIndex || n.needSnapshot[peer] {
+			n.mutex.Unlock()
+			n.sendSnapshot(peer, peerURL, term)
+		} else {
+			appendReq := AppendRequest{Term: term, Leader: n.options.ID, PrevLogIndex: next - 1, PrevLogTerm: n.termAt(next - 1), LeaderCommit: n.commitIndex}
+			last := min(n.lastIndex(), next+raftBatch-1)
+			if next <= last {
+				appendReq.Entries = append([]RaftEntry{}, n.entries[next-n.snapshotIndex-1:last-n.snapshotIndex]...)
+			}
+			n.mutex.Unlock()
+
+			var response AppendResponse
+			if err := n.call(peerURL, "/raft/append", appendReq, &response); err == nil {
+				n.mutex.Lock()
+				if response.Term > n.term {
+					n.stepDown(response.Term)
+				} else if n.state == RaftLeader && n.term == term {
+					switch {
+					case response.Resync:
+						n.needSnapshot[peer] = true
+					case response.Success:
+						match := appendReq.PrevLogIndex + uint64(len(appendReq.Entries))
+						n.matchIndex[peer] = max(n.matchIndex[peer], match)
+						n.nextIndex[peer] = n.matchIndex[peer] + 1
+						n.advanceCommit()
+					default:
+						n.nextIndex[peer] = max(1, min(next-1, response.LastIndex+1))
+					}
+				}
+				behind := n.nextIndex[peer] <= n.lastIndex() || n.needSnapshot[peer]
+				n.mutex.Unlock()
+				if behind {
+					continue
+				}
+			}
+		}
+
+		select {
+		case <-n.stopped:
+			return
+		case <-heartbeat.C:
+		case <-n.triggers[peer]:
+		}
+	}
+}
+
+func (n *RaftNode) sendSnapshot(peer string, peerURL string, term uint64) {
+	n.mutex.Lock()
+	fresh := n.snapshotData == nil
+	n.mutex.Unlock()
+	//a follower needing a resync before the first compaction gets a snapshot taken for it
+	if fresh {
+		n.applyMutex.Lock()
+		n.compact()
+		n.applyMutex.Unlock()
+	}
+
+	n.mutex.Lock()
+	snapshot := SnapshotRequest{Term: term, Leader: n.options.ID, Index: n.snapshotIndex, LastTerm: n.snapshotTerm, Data: n.snapshotData}
+	n.mutex.Unlock()
+
+	var response SnapshotResponse
+	if err := n.call(peerURL, "/raft/snapshot", snapshot, &response); err != nil {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if response.Term > n.term {
+		n.stepDown(response.Term)
+		return
+	}
+	if n.state == RaftLeader && n.term == term {
+		n.needSnapshot[peer] = false
+		n.matchIndex[peer] = max(n.matchIndex[peer], snapshot.Index)
+		n.nextIndex[peer] = snapshot.Index + 1
+	}
+}
+
+func (n *RaftNode) call(peerURL string, path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	httpResponse, err := n.client.Post(peerURL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft: %s%s answered %s", peerURL, path, httpResponse.Status)
+	}
+	return json.NewDecoder(httpResponse.Body).Decode(response)
+}
+
+//applies the committed entries and compacts the log once it grows past the configured size
+func (n *RaftNode) runApply() {
+	for {
+		select {
+		case <-n.stopped:
+			return
+		case <-n.applyReady:
+		}
+
+		n.applyMutex.Lock()
+		n.mutex.Lock()
+		from := max(n.lastApplied, n.snapshotIndex) + 1
+		var committed []RaftEntry
+		if n.commitIndex >= from {
+			committed = append(committed, n.entries[from-n.snapshotIndex-1:n.commitIndex-n.snapshotIndex]...)
+		}
+		n.mutex.Unlock()
+
+		for _, entry := range committed {
+			if entry.Origin != n.incarnation && len(entry.Data) > 0 {
+				n.options.Apply(entry)
+			}
+		}
+
+		n.mutex.Lock()
+		if len(committed) > 0 {
+			n.lastApplied = committed[len(committed)-1].Index
+		}
+		compact := n.options.SnapshotEntries > 0 && len(n.entries) > n.options.SnapshotEntries && n.lastApplied > n.snapshotIndex
+		n.mutex.Unlock()
+		if compact {
+			n.compact()
+		}
+		n.applyMutex.Unlock()
+	}
+}
+
+//replaces the applied entries by a snapshot of the state. Must be called with the apply lock held
+func (n *RaftNode) compact() {
+	data, err := n.options.Snapshot()
+	if err != nil {
+		log.Printf("raft: could not take a snapshot: %v", err)
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	index := max(n.lastApplied, n.snapshotIndex)
+	n.snapshotTerm = n.termAt(index)
+	n.entries = append([]RaftEntry{}, n.entries[index-n.snapshotIndex:]...)
+	n.snapshotIndex = index
+	n.snapshotData = data
+	n.persistSnapshot()
+	n.rewriteLog()
+	n.persistState()
+}
+
+//persistence of the term, vote, log and snapshot. The log is appended to and only rewritten when entries are
+//truncated or compacted
+
+type raftPersistentState struct {
+	Term          uint64 `json:"term"`
+	VotedFor      string `json:"votedfor,omitempty"`
+	SnapshotIndex uint64 `json:"snapshotindex"`
+	SnapshotTerm  uint64 `json:"snapshotterm"`
+}
+
+func (n *RaftNode) load() error {
+	dir := n.options.Dir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, raftStateFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var persisted raftPersistentState
+		if err = json.Unmarshal(data, &persisted); err != nil {
+			return fmt.Errorf("raft: %s: %v", raftStateFile, err)
+		}
+		n.term = persisted.Term
+		n.votedFor = persisted.VotedFor
+		n.snapshotIndex = persisted.SnapshotIndex
+		n.snapshotTerm = persisted.SnapshotTerm
+	}
+
+	if n.snapshotIndex > 0 {
+		if n.snapshotData, err = os.ReadFile(filepath.Join(dir, raftSnapshotFile)); err != nil {
+			return err
+		}
+		if err = n.options.Restore(n.snapshotData); err != nil {
+			return fmt.Errorf("raft: %s: %v", raftSnapshotFile, err)
+		}
+		n.commitIndex = n.snapshotIndex
+		n.lastApplied = n.snapshotIndex
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry RaftEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("raft: ignoring unreadable log entry after %d: %v", n.lastIndex(), err)
+			break
+		}
+		if entry.Index <= n.snapshotIndex {
+			continue
+		}
+		if entry.Index != n.lastIndex()+1 {
+			log.Printf("raft: ignoring log entries from %d, %d was expected", entry.Index, n.lastIndex()+1)
+			break
+		}
+		n.entries = append(n.entries, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return err
+	}
+	n.logFile = file
+	//a torn or out of place write at the end is dropped for good
+	n.rewriteLog()
+	log.Printf("raft: %s loaded term %d, snapshot at %d and %d log entries", n.options.ID, n.term, n.snapshotIndex, len(n.entries))
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (n *RaftNode) persistState() {
+	if n.options.Dir == "" {
+		return
+	}
+	data, _ := json.Marshal(raftPersistentState{Term: n.term, VotedFor: n.votedFor, SnapshotIndex: n.snapshotIndex, SnapshotTerm: n.snapshotTerm})
+	if err := writeFileAtomic(filepath.Join(n.options.Dir, raftStateFile), data); err != nil {
+		log.Printf("raft: could not save the term and vote: %v", err)
+	}
+}
+
+func (n *RaftNode) persistSnapshot() {
+	if n.options.Dir == "" {
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(n.options.Dir, raftSnapshotFile), n.snapshotData); err != nil {
+		log.Printf("raft: could not save the snapshot: %v", err)
+	}
+}
+
+func (n *RaftNode) appendEntries(entries []RaftEntry) {
+	n.entries = append(n.entries, entries...)
+	if n.logFile == nil {
+		return
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, entry := range entries {
+		encoder.Encode(entry)
+	}
+	//an entry is only acknowledged once it is on disk
+	if _, err := n.logFile.Write(buffer.Bytes()); err != nil {
+		log.Printf("raft: could not append to the log: %v", err)
+		return
+	}
+	n.logFile.Sync()
+}
+
+func (n *RaftNode) truncateFrom(index uint64) {
+	n.entries = n.entries[:index-n.snapshotIndex-1]
+	n.rewriteLog()
+}
+
+func (n *RaftNode) rewriteLog() {
+	if n.logFile == nil {
+		return
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, entry := range n.entries {
+		encoder.Encode(entry)
+	}
+	path := filepath.Join(n.options.Dir, raftLogFile)
+	if err := writeFileAtomic(path, buffer.Bytes()); err != nil {
+		log.Printf("raft: could not rewrite the log: %v", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		log.Printf("raft: could not reopen the log: %v", err)
+		return
+	}
+	n.logFile.Close()
+	n.logFile = file
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//operations on the registry shared by the v1 handlers and the v2 API. They validate their input and report
+//unknown hosts and other failures as errors instead of leaving it to the handlers
+
+var ErrUnknownHost = errors.New("unknown host")
+var ErrHostExists = errors.New("host already registered")
+var ErrUnknownClass = errors.New("unknown class")
+var ErrNoTemplate = errors.New("no workload template for image")
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+//the time the registry logic runs on. The simulation and the replay replace it with their virtual clock
+var Now = time.Now
+
+//the state of a registry node: its hosts in their region/class lists, its tasks, reservations and port leases, and
+//what records and replicates their changes. The process serves one, the tests run several side by side
+type Registry struct {
+	regions          map[string]Region
+	hosts            map[string]*Host
+	hostsLock        *sync.RWMutex   //guards insertions and removals in the hosts map
+	locks            map[string]Lock //for locking access to regions/class
+	tasks            *TaskTable
+	reservations     *ReservationStore
+	portAllocator    *PortAllocator
+	events           *EventBroker
+	energy           *EnergyMeter
+	powerManager     *PowerManager
+	history          *HistoryRecorder //nil when not recorded
+	containerRuntime Runtime
+	stateStore       *StateStore   //nil when not persisted
+	raftNode         *RaftNode     //nil when not replicated
+	peerClient       *http.Client  //reaches the other nodes, writes are forwarded with it
+	commitTimeout    time.Duration //longest time a replicated write waits for a majority
+	//runs the list updates that follow a request without holding it up. The replay runs them in line so they happen
+	//in the order of the trace, and so does a replicated node so they are committed before the request is answered
+	background func(update func())
+}
+
+//an empty registry for the configuration, running its containers on runtime. It keeps no history nor events for
+//subscribers resuming a stream, its hosts stay on and it is neither persisted nor replicated
+func NewRegistry(runtime Runtime) *Registry {
+	r := &Registry{hostsLock: &sync.RWMutex{}, containerRuntime: runtime, background: func(update func()) { go update() }}
+	r.InitRegions()
+	r.tasks = NewTaskTable(r)
+	r.reservations = NewReservationStore(r)
+	r.portAllocator = NewPortAllocator(config.Ports)
+	r.events = NewEventBroker(1)
+	r.energy = NewEnergyMeter(r)
+	r.powerManager = NewPowerManager(r, config.PowerStates, nil)
+	return r
+}
+
+func (r *Registry) LookupHost(hostIP string) (*Host, error) {
+	r.hostsLock.RLock()
+	host, ok := r.hosts[hostIP]
+	r.hostsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownHost, hostIP)
+	}
+	return host, nil
+}
+
+//copy of a host taken under its class lock, for the answers that encode it
+func (r *Registry) SnapshotHost(hostIP string) (Host, error) {
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		return Host{}, err
+	}
+	lock := r.LockHost(host)
+	defer lock.Unlock()
+	if host.removed {
+		return Host{}, fmt.Errorf("%w: %s", ErrUnknownHost, hostIP)
+	}
+	return *host, nil
+}
+
+func (r *Registry) AllHosts() []*Host {
+	r.hostsLock.RLock()
+	defer r.hostsLock.RUnlock()
+
+	listHosts := make([]*Host, 0, len(r.hosts))
+	for hostIP := range r.hosts {
+		listHosts = append(listHosts, r.hosts[hostIP])
+	}
+	return listHosts
+}
+
+//locks the class list the host is currently in and returns its lock. The host may move to another list while we
+//wait for the lock, in which case we try again on the new list
+func (r *Registry) LockHost(host *Host) *sync.Mutex {
+	for {
+		hostRegion := host.Region
+		hostClass := host.HostClass
+		lock := r.locks[hostRegion].classHosts[hostClass]
+		lock.Lock()
+		if host.Region == hostRegion && host.HostClass == hostClass {
+			return lock
+		}
+		lock.Unlock()
+	}
+}
+
+//totalCPUs is in cpu shares, 1024 per cpu
+func (r *Registry) RegisterHost(hostIP string, totalMemory int64, totalCPUs int64) (*Host, error) {
+	if net.ParseIP(hostIP) == nil {
+		return nil, &ValidationError{Field: "hostip", Message: "must be an IP address"}
+	}
+	if totalMemory <= 0 {
+		return nil, &ValidationError{Field: "totalmemory", Message: "must be positive"}
+	}
+	if totalCPUs <= 0 {
+		return nil, &ValidationError{Field: "totalcpus", Message: "must be positive"}
+	}
+
+	//since a host is created it will not have tasks assigned to it so it goes to the lowest region (LEE by default) to the less restrictive class
+	initialRegion := RegionFor(0.0).Name
+	initialClass := LeastRestrictiveClass()
+
+	r.locks[initialRegion].classHosts[initialClass].Lock()
+	r.hostsLock.Lock()
+	if _, exists := r.hosts[hostIP]; exists {
+		r.hostsLock.Unlock()
+		r.locks[initialRegion].classHosts[initialClass].Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrHostExists, hostIP)
+	}
+	host := &Host{HostIP: hostIP, HostClass: initialClass, Region: initialRegion, TotalMemory: totalMemory, TotalCPUs: totalCPUs,
+		PowerState: PowerOn, PowerSince: Now()}
+	MarkAlive(host)
+	r.hosts[hostIP] = host
+	r.hostsLock.Unlock()
+
+	r.regions[initialRegion].classHosts[initialClass] = append(r.regions[initialRegion].classHosts[initialClass], host)
+	event := HostEvent(EventHostCreated, host)
+	r.RecordMutation(OpCreateHost, *host)
+	r.locks[initialRegion].classHosts[initialClass].Unlock()
+	r.events.Publish(event)
+	return host, nil
+}
+
+func validUtilization(field string, value *float64) error {
+	if value != nil && (*value < 0 || *value > 1) {
+		return &ValidationError{Field: field, Message: "must be between 0 and 1"}
+	}
+	return nil
+}
+
+//applies a report of the energy monitor. cpu or memory may be nil when only the other one is reported
+func (r *Registry) SetUtilization(hostIP string, cpu *float64, memory *float64) error {
+	if cpu == nil && memory == nil {
+		return &ValidationError{Field: "cpu", Message: "cpu or memory is required"}
+	}
+	if err := validUtilization("cpu", cpu); err != nil {
+		return err
+	}
+	if err := validUtilization("memory", memory); err != nil {
+		return err
+	}
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		return err
+	}
+
+	lock := r.LockHost(host)
+	if cpu != nil {
+		host.CPU_Utilization = *cpu
+	}
+	if memory != nil {
+		host.MemoryUtilization = *memory
+	}
+	MarkAlive(host)
+	awake := r.MarkAwake(host)
+	r.energy.Observe(hostIP, host.Region, host.CPU_Utilization, Now())
+	lock.Unlock()
+	if awake != nil {
+		r.publishPowerState(*awake)
+	}
+
+	//1-> both resources, 2-> cpu, 3-> memory
+	if cpu != nil && memory != nil {
+		r.background(func() { r.UpdateTotalResourcesUtilization(*cpu, *memory, 1, hostIP) })
+	} else if cpu != nil {
+		r.background(func() { r.UpdateTotalResourcesUtilization(*cpu, 0.0, 2, hostIP) })
+	} else {
+		r.background(func() { r.UpdateTotalResourcesUtilization(0.0, *memory, 3, hostIP) })
+	}
+	return nil
+}
+
+//records resources the scheduler allocated on a host. Negative values release resources
+func (r *Registry) AllocateResources(hostIP string, cpu int64, memory int64) error {
+	return r.allocateResources(hostIP, cpu, memory, "", nil)
+}
+
+//allocates on a host what fits in its free capacity under the overbooking limits of the host and of class, reserved
+//capacity excepted. An allocation held by a reservation is not checked again, the capacity was taken when reserving
+func (r *Registry) allocateResources(hostIP string, cpu int64, memory int64, class string, reservation *Reservation) error {
+	if reservation != nil {
+		return r.UpdateResources(-cpu, -memory, hostIP)
+	}
+	return r.updateResources(-cpu, -memory, hostIP, func(host *Host) error {
+		limit := CapacityLimit(host.HostClass, class)
+		freeCPU, freeMemory := r.reservations.FreeCapacity(host, limit)
+		if cpu > freeCPU || memory > freeMemory {
+			return &CapacityError{HostIP: hostIP, Limit: limit, FreeCPU: freeCPU, FreeMemory: freeMemory}
+		}
+		return nil
+	})
+}
+
+//a task of class newHostClass arrived at the host. The host only moves when the class is more restrictive than its current one
+func (r *Registry) RaiseHostClass(hostIP string, newHostClass string) error {
+	if _, known := ClassRank(newHostClass); !known {
+		return fmt.Errorf("%w: %s", ErrUnknownClass, newHostClass)
+	}
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		return err
+	}
+
+	lock := r.LockHost(host)
+	currentClass := host.HostClass
+	currentRank, _ := ClassRank(currentClass)
+	newRank, _ := ClassRank(newHostClass)
+	lock.Unlock()
+
+	if currentRank > newRank { //we only update the host class if the current class is less restrictive
+		//we need to update the list where this host is at
+		r.UpdateHostList(currentClass, newHostClass, host)
+	}
+	return nil
+}
+
+func (r *Registry) TerminateTask(taskResources TaskResources) error {
+	if taskResources.Update {
+		if _, known := ClassRank(taskResources.NewClass); !known {
+			return fmt.Errorf("%w: %s", ErrUnknownClass, taskResources.NewClass)
+		}
+	}
+	hostIP := taskResources.IP
+	unknown := false
+	//a known task releases what the table says it holds, once
+	if taskResources.TaskID != "" {
+		task, known, err := r.tasks.Terminate(taskResources.TaskID, hostIP, taskResources.CPU, taskResources.Memory)
+		if err != nil {
+			return err
+		}
+		if known {
+			hostIP = task.HostIP
+			taskResources.CPU = task.CPU
+			taskResources.Memory = task.Memory
+		}
+		unknown = !known
+	}
+	host, err := r.LookupHost(hostIP)
+	if err != nil {
+		//nothing was released, the termination of an unknown task can be sent again
+		if unknown {
+			r.tasks.remove(taskResources.TaskID)
+		}
+		return err
+	}
+
+	//a terminated service no longer holds its port
+	if taskResources.TaskID != "" {
+		r.portAllocator.ReleaseContainer(taskResources.TaskID)
+	} else if taskResources.Port != 0 {
+		r.portAllocator.ReleasePort(hostIP, taskResources.Port)
+	}
+
+	//update resources of this host. It will have less resources since a task has terminated
+	if err = r.UpdateResources(taskResources.CPU, taskResources.Memory, hostIP); err != nil {
+		return err
+	}
+
+	//we must check if host class should be updated. Could be last task restraining host class (e.g. last  class 1 task).
+	//When the task table knows every task of the host the class follows them, the caller's update is only used otherwise
+	lock := r.LockHost(host)
+	check := r.CheckHostClass(host)
+	lock.Unlock()
+	if check.Derivable {
+		if !check.Consistent {
+			r.UpdateHostList(check.HostClass, check.DerivedClass, host)
+		}
+		return nil
+	}
+	if taskResources.Update && taskResources.PreviousClass == check.HostClass {
+		r.background(func() { r.UpdateHostList(taskResources.PreviousClass, taskResources.NewClass, host) })
+	}
+	return nil
+}
+
+//a cut: the task is resized to newCPU/newMemory, which frees cpuCut/memoryCut on its host
+type TaskCut struct {
+	TaskID    string
+	HostIP    string
+	NewCPU    int64
+	NewMemory int64
+	CPUCut    int64
+	MemoryCut int64
+}
+
+func (r *Registry) CutTask(cut TaskCut) error {
+	if cut.TaskID == "" {
+		return &ValidationError{Field: "taskid", Message: "is required"}
+	}
+	if cut.NewMemory < 0 {
+		return &ValidationError{Field: "memory", Message: "must not be negative"}
+	}
+	if cut.CPUCut < 0 || cut.MemoryCut < 0 {
+		return &ValidationError{Field: "cpucut", Message: "cuts must not be negative"}
+	}
+	host, err := r.LookupHost(cut.HostIP)
+	if err != nil {
+		return err
+	}
+	if cut.NewCPU < 2 {
+		cut.NewCPU = 2
+	}
+
+	if _, err = r.tasks.Cut(cut.TaskID, cut.HostIP, cut.CPUCut, cut.MemoryCut, false); err != nil {
+		return err
+	}
+
+	r.history.Record(HistoryRecord{Kind: RecordCut, HostIP: cut.HostIP, CPUCut: cut.CPUCut, MemoryCut: cut.MemoryCut})
+
+	//temporary failures are retried, see UpdateContainer
+	if err = r.UpdateContainer(cut.TaskID, cut.NewCPU, cut.NewMemory); err != nil {
+		//the container keeps its resources so the host allocation must not be reduced
+		log.Printf("updating task %s after a cut: %v", cut.TaskID, err)
+		return err
+	}
+	//the task may have been terminated while its container was updated
+	if _, err = r.tasks.Cut(cut.TaskID, cut.HostIP, cut.CPUCut, cut.MemoryCut, true); err != nil {
+		return err
+	}
+
+	//now to update the resources of the host. Because of the cut, less resources will be occupied on the host
+	lock := r.LockHost(host)
+	host.AllocatedMemory -= cut.MemoryCut
+	host.AllocatedCPUs -= cut.CPUCut
+	event := HostEvent(EventTaskCut, host)
+	r.RecordMutation(OpUpdateTaskResources, *host)
+	lock.Unlock()
+	cutsTotal.Inc()
+	event.TaskID = cut.TaskID
+	event.CPU = cut.CPUCut
+	event.Memory = cut.MemoryCut
+	r.events.Publish(event)
+	return nil
+}
+
+//starts a new container for a killed task. The killed task, when named and known, is terminated and the new one is
+//added to the task table with its resources allocated on the host it landed on
+func (r *Registry) Reschedule(task Task) (result RescheduleResult, err error) {
+	if task.TaskID != "" {
+		if killed, err := r.tasks.Get(task.TaskID); err == nil && killed.State == TaskStateRunning {
+			if err = r.TerminateTask(TaskResources{IP: task.HostIP, TaskID: task.TaskID}); err != nil {
+				return RescheduleResult{}, err
+			}
+		}
+		err = nil
+	}
+	r.history.Record(HistoryRecord{Kind: RecordKill, HostIP: task.HostIP})
+	killed := r.HostEventAt(EventTaskKilled, task.HostIP)
+	killed.TaskID = task.TaskID
+	killed.Image = task.Image
+	r.events.Publish(killed)
+	killsTotal.Inc()
+	defer func() {
+		if err != nil {
+			reschedulesTotal.Inc("failed")
+		} else {
+			reschedulesTotal.Inc("started")
+		}
+	}()
+
+	template, ok := catalog.Get(task.Image)
+	if !ok {
+		log.Printf("rescheduling %s: no workload template", task.Image)
+		return RescheduleResult{}, fmt.Errorf("%w %s", ErrNoTemplate, task.Image)
+	}
+
+	cpuShares, err := ParseCPUShares(task.CPU)
+	if err != nil {
+		return RescheduleResult{}, &ValidationError{Field: "cpu", Message: err.Error()}
+	}
+	memory, err := ParseMemory(task.Memory)
+	if err != nil {
+		return RescheduleResult{}, &ValidationError{Field: "memory", Message: err.Error()}
+	}
+
+	var lease *PortLease
+	port := 0
+	if template.ExposePort {
+		if lease, err = r.portAllocator.Acquire(task.HostIP, template.Image); err != nil {
+			log.Printf("rescheduling %s: %v", task.Image, err)
+			return RescheduleResult{}, err
+		}
+		port = lease.Port
+	}
+
+	spec := template.Spec(task, port, atomic.AddInt64(&rescheduleCount, 1))
+	spec.CPUShares = cpuShares
+	spec.Memory = memory
+
+	containerID, err := r.containerRuntime.Run(spec)
+	if err != nil {
+		log.Printf("rescheduling %s: %v", task.Image, err)
+		if lease != nil {
+			r.portAllocator.Release(lease)
+		}
+		return RescheduleResult{}, err
+	}
+	hostIP := task.HostIP
+	//the swarm picked the host, ask the runtime where the task landed so the lease and the allocation go to that host
+	if info, err := r.containerRuntime.Inspect(containerID); err == nil && info.HostIP != "" {
+		hostIP = info.HostIP
+	}
+	if lease != nil {
+		r.portAllocator.Bind(lease, containerID, hostIP)
+	}
+	newTask := TaskRecord{ID: containerID, HostIP: hostIP, Class: task.TaskClass, Type: task.TaskType, Image: spec.Image, CPU: cpuShares, Memory: memory, Port: port}
+	if _, lookupErr := r.LookupHost(hostIP); lookupErr == nil {
+		if allocateErr := r.AllocateTask(newTask); allocateErr != nil {
+			log.Printf("rescheduling %s: allocating task %s: %v", task.Image, containerID, allocateErr)
+		}
+	} else if addErr := r.tasks.Add(newTask); addErr != nil {
+		log.Printf("rescheduling %s: %v", task.Image, addErr)
+	}
+	event := r.HostEventAt(EventTaskRescheduled, hostIP)
+	event.TaskID = containerID
+	event.Image = spec.Image
+	event.CPU = cpuShares
+	event.Memory = memory
+	event.Port = port
+	r.events.Publish(event)
+	return RescheduleResult{ContainerID: containerID, Image: spec.Image, HostIP: hostIP, Port: port}, nil
+}
+
+//starts a copy of a known task on another host, then stops the original and releases what it held. The copy is
+//constrained to the host, a runtime starting it elsewhere gets the allocation where it landed. When the original
+//cannot be stopped both keep running and the error is returned along with the copy
+func (r *Registry) MigrateTask(taskID string, to string) (TaskRecord, error) {
+	task, err := r.tasks.Get(taskID)
+	if err != nil {
+		return TaskRecord{}, err
+	}
+	if task.State != TaskStateRunning {
+		return TaskRecord{}, fmt.Errorf("%w: %s", ErrTaskTerminated, taskID)
+	}
+	if _, err = r.LookupHost(to); err != nil {
+		return TaskRecord{}, err
+	}
+	template, ok := catalog.Get(task.Image)
+	if !ok {
+		return TaskRecord{}, fmt.Errorf("%w %s", ErrNoTemplate, task.Image)
+	}
+
+	var lease *PortLease
+	port := 0
+	if template.ExposePort {
+		if lease, err = r.portAllocator.Acquire(to, template.Image); err != nil {
+			return TaskRecord{}, err
+		}
+		port = lease.Port
+	}
+	spec := template.Spec(Task{TaskClass: task.Class, TaskType: task.Type, Image: task.Image, HostIP: to}, port, atomic.AddInt64(&rescheduleCount, 1))
+	spec.CPUShares = task.CPU
+	spec.Memory = task.Memory
+	spec.Env = append(spec.Env, "constraint:node=="+to)
+
+	containerID, err := r.containerRuntime.Run(spec)
+	if err != nil {
+		if lease != nil {
+			r.portAllocator.Release(lease)
+		}
+		return TaskRecord{}, err
+	}
+	hostIP := to
+	if info, err := r.containerRuntime.Inspect(containerID); err == nil && info.HostIP != "" {
+		hostIP = info.HostIP
+	}
+	if lease != nil {
+		r.portAllocator.Bind(lease, containerID, hostIP)
+	}
+	migrated := TaskRecord{ID: containerID, HostIP: hostIP, Class: task.Class, Type: task.Type, Image: task.Image, CPU: task.CPU, Memory: task.Memory, Port: port}
+	//the original keeps running when the copy cannot be accounted for
+	if err = r.AllocateTask(migrated); err != nil {
+		if stopErr := r.containerRuntime.Stop(containerID); stopErr != nil {
+			log.Printf("migrating %s: stopping the copy %s: %v", taskID, containerID, stopErr)
+		}
+		r.portAllocator.ReleaseContainer(containerID)
+		return TaskRecord{}, err
+	}
+	event := r.HostEventAt(EventTaskMigrated, hostIP)
+	event.From = task.HostIP
+	event.To = hostIP
+	event.TaskID = containerID
+	event.Image = spec.Image
+	event.CPU = task.CPU
+	event.Memory = task.Memory
+	event.Port = port
+	r.events.Publish(event)
+
+	if err = r.containerRuntime.Stop(taskID); err != nil && RuntimeErrorKind(err) != RuntimeErrNotFound {
+		return migrated, err
+	}
+	return migrated, r.TerminateTask(TaskResources{IP: task.HostIP, TaskID: taskID})
+}
+
+//copies of the hosts offered for initial scheduling (listType 1) or for the cut algorithm (listType 2)
+func (r *Registry) PlacementList(requestClass string, listType string) ([]Host, error) {
+	if _, known := ClassRank(requestClass); !known {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownClass, requestClass)
+	}
+	listHosts := make([]Host, 0)
+
+	//the placement regions go from the least to the most utilized (LEE then DEE by default)
+	for _, region := range PlacementRegions() {
+		//1 for initial scheduling 2 for cut algorithm
+		if listType == "1" {
+			listHosts = append(listHosts, r.GetHostsNormal(region, requestClass)...)
+		} else {
+			listHosts = append(listHosts, r.GetHostsCut(region, requestClass)...)
+		}
+	}
+	return listHosts, nil
+}
+
+//copies of the hosts offered to the kill algorithm
+func (r *Registry) KillList(requestClass string) ([]Host, error) {
+	if _, known := ClassRank(requestClass); !known {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownClass, requestClass)
+	}
+	listHosts := make([]Host, 0)
+
+	//the kill regions go from the most to the least utilized (EED then DEE by default)
+	for _, region := range KillRegions() {
+		listHosts = append(listHosts, r.GetHostsKill(region, requestClass)...)
+	}
+	return listHosts, nil
+}
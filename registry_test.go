@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//the registry clock, moved by the test
+type testClock struct {
+	now time.Time
+}
+
+func useClock(t *testing.T) *testClock {
+	clock := &testClock{now: time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)}
+	Now = func() time.Time { return clock.now }
+	t.Cleanup(func() { Now = time.Now })
+	return clock
+}
+
+func (c *testClock) advance(duration time.Duration) {
+	c.now = c.now.Add(duration)
+}
+
+//a registry on the current configuration whose list updates run in line
+func newTestRegistry(t *testing.T, hostIPs ...string) *Registry {
+	t.Helper()
+	registry := NewRegistry(NewFakeRuntime())
+	registry.background = func(update func()) { update() }
+	registerHosts(t, registry, hostIPs...)
+	return registry
+}
+
+//sends a request through the router of the registry, with its middlewares
+func serve(t *testing.T, registry *Registry, method string, path string, body interface{}) (int, []byte) {
+	t.Helper()
+	var buffer bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buffer).Encode(body)
+	}
+	recorder := httptest.NewRecorder()
+	registry.Router().ServeHTTP(recorder, httptest.NewRequest(method, path, &buffer))
+	return recorder.Code, recorder.Body.Bytes()
+}
+
+//the hosts of a layout, whatever their list
+func layoutHosts(layout map[string]map[string][]string) []string {
+	hostIPs := make([]string, 0)
+	for _, classes := range layout {
+		for _, listHosts := range classes {
+			hostIPs = append(hostIPs, listHosts...)
+		}
+	}
+	return hostIPs
+}
+
+func TestRemoveHost(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1", "10.0.0.2")
+	if err := registry.AllocateResources("10.0.0.1", 1024, 256<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	//a host still running something is only removed when forced
+	status, body := serve(t, registry, http.MethodDelete, "/v2/hosts/10.0.0.1", nil)
+	var document ErrorDocument
+	if json.Unmarshal(body, &document); status != http.StatusConflict || document.Code != "host_allocated" {
+		t.Fatalf("removing an allocated host answered %d %s", status, body)
+	}
+	if _, err := registry.SnapshotHost("10.0.0.1"); err != nil {
+		t.Fatalf("a refused removal removed the host: %v", err)
+	}
+
+	status, body = serve(t, registry, http.MethodDelete, "/v2/hosts/10.0.0.1?force=true", nil)
+	var report RemovalReport
+	if json.Unmarshal(body, &report); status != http.StatusOK || !report.Removed || report.DroppedCPUs != 1024 || report.DroppedMemory != 256<<20 {
+		t.Fatalf("forcing the removal answered %d %s", status, body)
+	}
+	if status, _ = serve(t, registry, http.MethodGet, "/v2/hosts/10.0.0.1", nil); status != http.StatusNotFound {
+		t.Errorf("a removed host is answered with %d", status)
+	}
+	if status, _ = serve(t, registry, http.MethodDelete, "/v2/hosts/10.0.0.1", nil); status != http.StatusNotFound {
+		t.Errorf("removing a removed host answered %d", status)
+	}
+
+	//an empty host is removed through the first API as well
+	status, body = serve(t, registry, http.MethodGet, "/host/deletehost/10.0.0.2", nil)
+	if json.Unmarshal(body, &report); status != http.StatusOK || !report.Removed {
+		t.Fatalf("removing an empty host answered %d %s", status, body)
+	}
+	if hostIPs := layoutHosts(registry.RegionLayout()); len(hostIPs) != 0 {
+		t.Errorf("the lists still hold %v", hostIPs)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//replicated mode: several registries agree on the hosts through the consensus log of raft.go. The log takes the place
+//of the write-ahead log, carrying the same records with the full state of a host after each mutation. The leader
+//makes the changes and answers writes once they are committed by a majority; followers apply the committed records,
+//serve reads from their own copy and forward writes to the leader, or redirect the client to it.
+//Port leases, the runtime and the events of a change are handled by the node that made the change, the leader
+
+const (
+	WritesForward   = "forward"
+	WritesRedirect  = "redirect"
+	forwardedHeader = "X-Registry-Forwarded" //set on writes forwarded by a follower, they are never forwarded twice
+)
+
+var nodeID = flag.String("nodeid", "", "id of this node in the replication peers, overrides the configuration so nodes can share one file")
+var listenAddress = flag.String("listen", "", "address to serve on. Defaults to this node's peer URL when replicated, to the host address on port 12345 otherwise")
+
+type ReplicationConfig struct {
+	NodeID            string            `json:"nodeid"`
+	Peers             map[string]string `json:"peers"` //node id -> base URL of its registry, e.g. http://10.5.60.3:12345, this node included. Empty runs a single registry
+	ElectionTimeout   string            `json:"electiontimeout"`
+	HeartbeatInterval string            `json:"heartbeatinterval"`
+	CommitTimeout     string            `json:"committimeout"` //longest time a write waits for a majority
+	SnapshotEntries   int               `json:"snapshotentries"`
+	Writes            string            `json:"writes"` //what followers do with writes: forward or redirect
+}
+
+func (r ReplicationConfig) Enabled() bool {
+	return len(r.Peers) > 0
+}
+
+func (r ReplicationConfig) Validate() error {
+	if !r.Enabled() {
+		return nil
+	}
+	//the node id may also come from -nodeid
+	if _, ok := r.Peers[r.NodeID]; r.NodeID != "" && !ok {
+		return fmt.Errorf("replication: nodeid %q is not one of the peers", r.NodeID)
+	}
+	for id, peerURL := range r.Peers {
+		parsed, err := url.Parse(peerURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("replication: peer %s: %q is not an http URL", id, peerURL)
+		}
+	}
+	durations := map[string]string{"electiontimeout": r.ElectionTimeout, "heartbeatinterval": r.HeartbeatInterval, "committimeout": r.CommitTimeout}
+	for name, value := range durations {
+		if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			return fmt.Errorf("replication: %s must be a positive duration", name)
+		}
+	}
+	election, _ := time.ParseDuration(r.ElectionTimeout)
+	heartbeat, _ := time.ParseDuration(r.HeartbeatInterval)
+	if heartbeat >= election {
+		return fmt.Errorf("replication: heartbeatinterval must be shorter than electiontimeout")
+	}
+	if r.SnapshotEntries <= 0 {
+		return fmt.Errorf("replication: snapshotentries must be positive")
+	}
+	if r.Writes != WritesForward && r.Writes != WritesRedirect {
+		return fmt.Errorf("replication: writes must be %q or %q", WritesForward, WritesRedirect)
+	}
+	return nil
+}
+
+//joins the peers of the configuration, replacing the write-ahead log. Must be called after the regions and locks are
+//initialized and before serving requests
+func (r *Registry) InitReplication(replication ReplicationConfig) {
+	if _, ok := replication.Peers[replication.NodeID]; !ok {
+		log.Fatalf("replication: nodeid %q is not one of the peers, set it in the configuration or with -nodeid", replication.NodeID)
+	}
+	electionTimeout, _ := time.ParseDuration(replication.ElectionTimeout)
+	heartbeatInterval, _ := time.ParseDuration(replication.HeartbeatInterval)
+	r.commitTimeout, _ = time.ParseDuration(replication.CommitTimeout)
+	//the list updates that follow a request are proposed before it is answered, so waiting for the last index of the
+	//log covers them too
+	r.background = func(update func()) { update() }
+	var err error
+	if r.peerClient, err = PeerClient(config.Auth, electionTimeout); err != nil {
+		log.Fatal(err)
+	}
+
+	options := RaftOptions{
+		ID:                replication.NodeID,
+		Peers:             replication.Peers,
+		ElectionTimeout:   electionTimeout,
+		HeartbeatInterval: heartbeatInterval,
+		SnapshotEntries:   replication.SnapshotEntries,
+		Apply:             r.ApplyReplicatedRecord,
+		Snapshot:          r.SnapshotState,
+		Restore:           r.RestoreState,
+		Demoted:           func() { r.reservations.AbortAll() },
+		Client:            r.peerClient,
+	}
+	if *stateDir != "" {
+		options.Dir = filepath.Join(*stateDir, "raft")
+	} else {
+		log.Printf("replication: no state directory, node %s keeps its log in memory only", replication.NodeID)
+	}
+	node, err := NewRaftNode(options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.raftNode = node
+	r.raftNode.Start()
+}
+
+//proposes the new state of a host to the other nodes, the replicated counterpart of the write-ahead log. host is the
+//copy taken by RecordMutation under the class lock
+func (r *Registry) ProposeMutation(op string, host Host) {
+	_, err := r.raftNode.Propose(func(index uint64) (json.RawMessage, error) {
+		return json.Marshal(StateRecord{Seq: index, Op: op, Time: time.Now(), Host: host})
+	})
+	if err != nil {
+		log.Printf("replication: %s of %s was not proposed: %v", op, host.HostIP, err)
+	}
+}
+
+//proposes the new state of a task, copied when the entry is encoded
+func (r *Registry) ProposeTaskMutation(op string, id string) {
+	_, err := r.raftNode.Propose(func(index uint64) (json.RawMessage, error) {
+		return json.Marshal(StateRecord{Seq: index, Op: op, Time: time.Now(), Task: r.TaskState(op, id)})
+	})
+	if err != nil {
+		log.Printf("replication: %s of task %s was not proposed: %v", op, id, err)
+	}
+}
+
+func (r *Registry) ApplyReplicatedRecord(entry RaftEntry) {
+	var record StateRecord
+	if err := json.Unmarshal(entry.Data, &record); err != nil {
+		log.Printf("replication: ignoring unreadable entry %d: %v", entry.Index, err)
+		return
+	}
+	if record.Task != nil {
+		if record.Op == OpDeleteTask {
+			r.tasks.delete(record.Task.ID)
+		} else {
+			r.tasks.put(*record.Task)
+		}
+		return
+	}
+	if record.Op == OpDeleteHost {
+		if host, err := r.LookupHost(record.Host.HostIP); err == nil {
+			r.detachHost(host)
+		}
+		return
+	}
+	r.PutHost(&record.Host)
+}
+
+//state carried by the snapshots of the consensus log
+type ReplicatedState struct {
+	Hosts []Host       `json:"hosts"`
+	Tasks []TaskRecord `json:"tasks"`
+}
+
+func (r *Registry) SnapshotState() (json.RawMessage, error) {
+	return json.Marshal(ReplicatedState{Hosts: r.HostSnapshots(), Tasks: r.tasks.Snapshot()})
+}
+
+//replaces every host and task by the ones of a snapshot. Snapshots taken before the task table only hold the hosts
+func (r *Registry) RestoreState(data json.RawMessage) error {
+	var restored ReplicatedState
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &restored.Hosts); err != nil {
+			return err
+		}
+	} else if err := json.Unmarshal(data, &restored); err != nil {
+		return err
+	}
+	for _, host := range r.AllHosts() {
+		r.detachHost(host)
+	}
+	for i := range restored.Hosts {
+		r.PutHost(&restored.Hosts[i])
+	}
+	r.tasks.restore(restored.Tasks)
+	return nil
+}
+
+//removes a host from its list and from the hosts map
+func (r *Registry) detachHost(host *Host) {
+	lock := r.LockHost(host)
+	defer lock.Unlock()
+	if host.removed {
+		return
+	}
+	r.regions[host.Region].classHosts[host.HostClass] = RemoveHostFromList(r.regions[host.Region].classHosts[host.HostClass], host.HostIP)
+	host.removed = true
+	r.hostsLock.Lock()
+	if r.hosts[host.HostIP] == host {
+		delete(r.hosts, host.HostIP)
+	}
+	r.hostsLock.Unlock()
+}
+
+//puts the replicated state of a host in place of the current one, moving it to the list of its region and class
+func (r *Registry) PutHost(host *Host) {
+	if current, err := r.LookupHost(host.HostIP); err == nil {
+		r.detachHost(current)
+	}
+	if _, ok := r.regions[host.Region]; !ok {
+		host.Region = RegionFor(host.TotalResourcesUtilization).Name
+	}
+	if _, ok := r.locks[host.Region].classHosts[host.HostClass]; !ok {
+		host.HostClass = LeastRestrictiveClass()
+	}
+
+	lock := r.locks[host.Region].classHosts[host.HostClass]
+	lock.Lock()
+	r.hostsLock.Lock()
+	r.hosts[host.HostIP] = host
+	r.hostsLock.Unlock()
+	index := SortedIndex(host.Region, r.regions[host.Region].classHosts[host.HostClass], host.TotalResourcesUtilization)
+	r.regions[host.Region].classHosts[host.HostClass] = InsertHost(r.regions[host.Region].classHosts[host.HostClass], index, host)
+	lock.Unlock()
+}
+
+//GET routes of the first API that change the registry
+var v1WriteRoutes = map[string]bool{
+	"/host/updateclass/{requestclass}&{hostip}":                                    true,
+	"/host/createhost/{hostip}&{totalmemory}&{totalcpu}":                           true,
+	"/host/deletehost/{hostip}&{force}":                                            true,
+	"/host/deletehost/{hostip}":                                                    true,
+	"/host/updatetask/{taskid}&{newcpu}&{newmemory}&{hostip}&{cpucut}&{memorycut}": true,
+	"/host/updateboth/{hostip}&{cpu}&{memory}":                                     true,
+	"/host/updatecpu/{hostip}&{cpu}":                                               true,
+	"/host/updatememory/{hostip}&{memory}":                                         true,
+	"/host/updateresources/{hostip}&{cpu}&{memory}":                                true,
+}
+
+//POST routes that only concern the node they are sent to
+var localRoutes = map[string]bool{
+	"/catalog/reload":      true,
+	"/catalog/validate":    true,
+	"/v2/catalog/reload":   true,
+	"/v2/catalog/validate": true,
+}
+
+//GET routes of what only the leader keeps in memory
+var leaderRoutes = map[string]bool{
+	"/ports/leases":         true,
+	"/v2/ports/leases":      true,
+	"/v2/reservations":      true,
+	"/v2/reservations/{id}": true,
+	"/v2/energy":            true,
+	"/v2/consolidation":     true,
+	"/v2/power":             true,
+}
+
+//whether the request must be served by the leader: writes and reads of what only the leader keeps
+func ForLeader(req *http.Request) bool {
+	template := ""
+	if route := mux.CurrentRoute(req); route != nil {
+		template, _ = route.GetPathTemplate()
+	}
+	if strings.HasPrefix(req.URL.Path, "/raft/") || localRoutes[template] {
+		return false
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead || req.Method == http.MethodOptions {
+		return v1WriteRoutes[template] || leaderRoutes[template]
+	}
+	return true
+}
+
+//middleware sending writes, and reads of the leader's memory, to the leader. On the leader the answer is held back until the changes made by the
+//request, the list updates that follow it included, are committed
+func (r *Registry) ReplicateWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.raftNode == nil || !ForLeader(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		leaderID, leaderURL, isLeader := r.raftNode.Leader()
+		if !isLeader {
+			switch {
+			case req.Header.Get(forwardedHeader) != "":
+				WriteError(w, ErrNotLeader)
+			case leaderID == "":
+				WriteError(w, ErrNoLeader)
+			case config.Replication.Writes == WritesRedirect:
+				http.Redirect(w, req, strings.TrimSuffix(leaderURL, "/")+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+			default:
+				r.forwardToLeader(w, req, leaderID, leaderURL)
+			}
+			return
+		}
+
+		buffered := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(buffered, req)
+		if err := r.raftNode.WaitCommitted(r.raftNode.LastIndex(), r.commitTimeout); err != nil {
+			//the changes were applied here already, a leader that cannot commit them must not keep serving them
+			r.raftNode.StepDown()
+			WriteError(w, err)
+			return
+		}
+		buffered.WriteTo(w)
+	})
+}
+
+func (r *Registry) forwardToLeader(w http.ResponseWriter, req *http.Request, leaderID string, leaderURL string) {
+	target, err := url.Parse(leaderURL)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = r.peerClient.Transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		WriteJSON(w, http.StatusBadGateway, ErrorDocument{Status: http.StatusBadGateway, Code: "leader_unreachable", Message: fmt.Sprintf("leader %s: %v", leaderID, err)})
+	}
+	req.Header.Set(forwardedHeader, r.raftNode.Status().ID)
+	//the leader authorizes the client this node authenticated, the request itself carries the peer credentials
+	req.Header.Del(identityHeader)
+	if identity := RequestIdentity(req); identity != nil {
+		encoded, _ := json.Marshal(identity)
+		req.Header.Set(identityHeader, string(encoded))
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+//holds an answer back until the write is committed
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteTo(w http.ResponseWriter) {
+	for name, values := range b.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+//GET /v2/cluster, the replication state as seen by this node
+func (r *Registry) GetClusterStatus(w http.ResponseWriter, req *http.Request) {
+	if r.raftNode == nil {
+		WriteJSON(w, http.StatusOK, map[string]string{"state": "standalone"})
+		return
+	}
+	WriteJSON(w, http.StatusOK, r.raftNode.Status())
+}
+
+//where the registry listens: the -listen flag, this node's peer URL when replicated, port 12345 of the host otherwise
+func ListenAddress() string {
+	if *listenAddress != "" {
+		return *listenAddress
+	}
+	if config.Replication.Enabled() {
+		if parsed, err := url.Parse(config.Replication.Peers[config.Replication.NodeID]); err == nil {
+			return parsed.Host
+		}
+	}
+	return getIPAddress() + ":12345"
+}
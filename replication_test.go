@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//a registry node of the test cluster, served over loopback
+type testNode struct {
+	id       string
+	url      string
+	registry *Registry
+	server   *http.Server
+	stopped  bool
+	isolated int32 //set atomically, the raft requests to and from the node are refused
+}
+
+func (n *testNode) stop() {
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	n.server.Close()
+	n.registry.raftNode.Stop()
+}
+
+//starts size replicated nodes on 127.0.0.1, each with a registry of its own
+func startCluster(t *testing.T, size int) []*testNode {
+	useDefaultConfig(t)
+	previousStateDir := *stateDir
+	*stateDir = "" //the consensus logs stay in memory
+	t.Cleanup(func() { *stateDir = previousStateDir })
+
+	listeners := make([]net.Listener, size)
+	peers := make(map[string]string)
+	for i := range listeners {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = listener
+		peers[fmt.Sprintf("n%d", i+1)] = "http://" + listener.Addr().String()
+	}
+	config.Replication = ReplicationConfig{Peers: peers, ElectionTimeout: "300ms", HeartbeatInterval: "50ms", CommitTimeout: "2s",
+		SnapshotEntries: 10000, Writes: WritesForward}
+
+	nodes := make([]*testNode, size)
+	for i := range listeners {
+		node := &testNode{id: fmt.Sprintf("n%d", i+1), registry: NewRegistry(NewFakeRuntime())}
+		node.url = peers[node.id]
+		replication := config.Replication
+		replication.NodeID = node.id
+		node.registry.InitReplication(replication)
+		nodes[i] = node
+	}
+	for i, node := range nodes {
+		node.server = &http.Server{Handler: partitionable(node, nodes)}
+		go node.server.Serve(listeners[i])
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	})
+	return nodes
+}
+
+//the router of node, refusing the raft requests between an isolated node and the others
+func partitionable(node *testNode, nodes []*testNode) http.Handler {
+	router := node.registry.Router()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/raft/") {
+			router.ServeHTTP(w, req)
+			return
+		}
+		data, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		var sender struct {
+			Leader    string `json:"leader"`
+			Candidate string `json:"candidate"`
+		}
+		json.Unmarshal(data, &sender)
+		for _, other := range append([]*testNode{node}, nodes...) {
+			if atomic.LoadInt32(&other.isolated) == 1 && (other == node || other.id == sender.Leader || other.id == sender.Candidate) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		router.ServeHTTP(w, req)
+	})
+}
+
+//waits for the running nodes to agree on a leader
+func waitLeader(t *testing.T, nodes []*testNode) *testNode {
+	t.Helper()
+	var leader *testNode
+	eventually(t, 10*time.Second, func() error {
+		leader = nil
+		leaderID := ""
+		for _, node := range nodes {
+			if node.stopped {
+				continue
+			}
+			id, _, isLeader := node.registry.raftNode.Leader()
+			if id == "" || (leaderID != "" && id != leaderID) {
+				return fmt.Errorf("%s does not know the leader", node.id)
+			}
+			leaderID = id
+			if isLeader {
+				leader = node
+			}
+		}
+		if leader == nil {
+			return fmt.Errorf("no running node is the leader %s", leaderID)
+		}
+		return nil
+	})
+	return leader
+}
+
+func follower(nodes []*testNode, leader *testNode) *testNode {
+	for _, node := range nodes {
+		if node != leader && !node.stopped {
+			return node
+		}
+	}
+	return nil
+}
+
+func eventually(t *testing.T, timeout time.Duration, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func request(t *testing.T, method string, url string, body interface{}) (int, []byte) {
+	t.Helper()
+	var buffer bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buffer).Encode(body)
+	}
+	req, err := http.NewRequest(method, url, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	var answer bytes.Buffer
+	answer.ReadFrom(response.Body)
+	return response.StatusCode, answer.Bytes()
+}
+
+//waits for the running nodes to serve a host matching check from their own state
+func waitConverged(t *testing.T, nodes []*testNode, hostIP string, check func(Host) error) {
+	t.Helper()
+	for _, node := range nodes {
+		if node.stopped {
+			continue
+		}
+		eventually(t, 5*time.Second, func() error {
+			host, err := node.registry.SnapshotHost(hostIP)
+			if err != nil {
+				return fmt.Errorf("%s: %v", node.id, err)
+			}
+			if err = check(host); err != nil {
+				return fmt.Errorf("%s: %v", node.id, err)
+			}
+			return nil
+		})
+		status, body := request(t, http.MethodGet, node.url+"/v2/hosts/"+hostIP, nil)
+		var host Host
+		if err := json.Unmarshal(body, &host); status != http.StatusOK || err != nil {
+			t.Fatalf("%s: GET /v2/hosts/%s answered %d %s", node.id, hostIP, status, body)
+		}
+		if err := check(host); err != nil {
+			t.Fatalf("%s: GET /v2/hosts/%s: %v", node.id, hostIP, err)
+		}
+	}
+}
+
+func TestReplicationLeaderFailover(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+
+	//a write sent to a follower is forwarded to the leader and answered once committed
+	status, body := request(t, http.MethodPost, follower(nodes, leader).url+"/v2/hosts", HostRegistration{HostIP: "10.0.0.1", TotalMemory: 1 << 30, TotalCPUs: 4})
+	if status != http.StatusCreated {
+		t.Fatalf("registering through a follower answered %d %s", status, body)
+	}
+	waitConverged(t, nodes, "10.0.0.1", func(host Host) error {
+		if host.TotalMemory != 1<<30 || host.TotalCPUs != 4*1024 {
+			return fmt.Errorf("host has %d bytes and %d shares", host.TotalMemory, host.TotalCPUs)
+		}
+		return nil
+	})
+
+	leader.stop()
+	newLeader := waitLeader(t, nodes)
+	if newLeader == leader {
+		t.Fatal("the stopped node is still the leader")
+	}
+
+	//the remaining follower forwards to the new leader, and the list move that follows the update reaches it too
+	cpu, memory := 0.95, 0.95
+	status, body = request(t, http.MethodPut, follower(nodes, newLeader).url+"/v2/hosts/10.0.0.1/utilization", UtilizationUpdate{CPU: &cpu, Memory: &memory})
+	if status != http.StatusNoContent {
+		t.Fatalf("updating through a follower after the failover answered %d %s", status, body)
+	}
+	hotRegion := RegionFor(0.95).Name
+	waitConverged(t, nodes, "10.0.0.1", func(host Host) error {
+		if host.CPU_Utilization != 0.95 || host.Region != hotRegion {
+			return fmt.Errorf("host is at %v cpu in %s, not 0.95 in %s", host.CPU_Utilization, host.Region, hotRegion)
+		}
+		return nil
+	})
+	for _, node := range nodes {
+		if node.stopped {
+			continue
+		}
+		layout := node.registry.RegionLayout()
+		if hosts := layout[hotRegion][LeastRestrictiveClass()]; len(hosts) != 1 || hosts[0] != "10.0.0.1" {
+			t.Errorf("%s lists %v in %s", node.id, layout, hotRegion)
+		}
+	}
+}
+
+func TestReplicationUncommittedWriteRolledBack(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	atomic.StoreInt32(&leader.isolated, 1)
+
+	//the isolated leader applies the registration but cannot commit it, it steps down instead of serving it
+	status, body := request(t, http.MethodPost, leader.url+"/v2/hosts", HostRegistration{HostIP: "10.0.0.9", TotalMemory: 1 << 30, TotalCPUs: 4})
+	if status != http.StatusServiceUnavailable || errorCode(t, body) != "not_committed" {
+		t.Fatalf("an uncommitted registration answered %d %s", status, body)
+	}
+	if _, _, isLeader := leader.registry.raftNode.Leader(); isLeader {
+		t.Fatal("the leader kept its leadership after failing to commit")
+	}
+	others := make([]*testNode, 0)
+	for _, node := range nodes {
+		if node != leader {
+			others = append(others, node)
+		}
+	}
+	waitLeader(t, others)
+
+	//once it is reachable again it takes the state of the new leader, without the registration
+	atomic.StoreInt32(&leader.isolated, 0)
+	eventually(t, 10*time.Second, func() error {
+		status, body = request(t, http.MethodPost, leader.url+"/v2/hosts", HostRegistration{HostIP: "10.0.0.1", TotalMemory: 1 << 30, TotalCPUs: 4})
+		if status == http.StatusServiceUnavailable {
+			return fmt.Errorf("registering after the partition answered %d %s", status, body)
+		}
+		return nil
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("registering after the partition answered %d %s", status, body)
+	}
+	waitConverged(t, nodes, "10.0.0.1", func(host Host) error { return nil })
+	for _, node := range nodes {
+		eventually(t, 5*time.Second, func() error {
+			if _, err := node.registry.SnapshotHost("10.0.0.9"); err == nil {
+				return fmt.Errorf("%s still has the uncommitted host", node.id)
+			}
+			return nil
+		})
+	}
+}
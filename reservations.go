@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//capacity reservations taken by a scheduler between picking a host from a list and allocating on it. Reserving checks
+//the free capacity of the host under its overbooking limit and holds it, under the class lock of the host so two
+//schedulers cannot both take the last capacity. A reservation becomes an allocation when committed and is released
+//when aborted or when its ttl runs out, on the clock of the registry so replays and simulations expire them on their
+//own time. Expired reservations are dropped whenever the store is read. Allocations made without a reservation are
+//refused when they do not fit in what the reservations leave free.
+//Reservations live in the memory of the registry and are not replicated: when replicated they are taken on the leader,
+//which aborts its pending reservations when it stops leading, and schedulers reserve again on the next leader
+
+const (
+	ReservationPending    = "pending"
+	ReservationCommitting = "committing"
+	ReservationCommitted  = "committed"
+)
+
+var ErrInsufficientCapacity = errors.New("insufficient free capacity")
+var ErrUnknownReservation = errors.New("unknown reservation")
+
+type ReservationConfig struct {
+	DefaultTTL string `json:"defaultttl"` //ttl of a reservation that does not ask for one
+	MaxTTL     string `json:"maxttl"`
+}
+
+func (r ReservationConfig) Validate() error {
+	defaultTTL, err := time.ParseDuration(r.DefaultTTL)
+	if err != nil || defaultTTL <= 0 {
+		return fmt.Errorf("reservations: defaultttl must be a positive duration")
+	}
+	maxTTL, err := time.ParseDuration(r.MaxTTL)
+	if err != nil || maxTTL < defaultTTL {
+		return fmt.Errorf("reservations: maxttl must be a duration of at least defaultttl")
+	}
+	return nil
+}
+
+//what a host can still take, reported when a reservation does not fit
+type CapacityError struct {
+	HostIP     string  `json:"hostip"`
+	Limit      float64 `json:"limit"` //overbooking limit applied
+	FreeCPU    int64   `json:"freecpu"`
+	FreeMemory int64   `json:"freememory"`
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("%v on %s: %d cpu shares and %d bytes of memory free under overbooking limit %v", ErrInsufficientCapacity, e.HostIP, e.FreeCPU, e.FreeMemory, e.Limit)
+}
+
+func (e *CapacityError) Unwrap() error {
+	return ErrInsufficientCapacity
+}
+
+type Reservation struct {
+	ID      string    `json:"id"`
+	HostIP  string    `json:"hostip"`
+	CPU     int64     `json:"cpu"`    //cpu shares
+	Memory  int64     `json:"memory"` //bytes
+	Class   string    `json:"class,omitempty"`
+	Owner   string    `json:"owner,omitempty"` //name of the client that reserved, when authenticated
+	State   string    `json:"state"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+type reservedCapacity struct {
+	cpu    int64
+	memory int64
+}
+
+type ReservationStore struct {
+	mutex        *sync.Mutex
+	reservations map[string]*Reservation
+	reserved     map[string]reservedCapacity //by host
+	registry     *Registry
+}
+
+var reservationsTotal = NewCounterVec("hostregistry_reservations_total", "Capacity reservations by outcome.", "outcome")
+
+func NewReservationStore(registry *Registry) *ReservationStore {
+	return &ReservationStore{mutex: &sync.Mutex{}, reservations: make(map[string]*Reservation), reserved: make(map[string]reservedCapacity), registry: registry}
+}
+
+//overbooking limit of a host of hostClass taking a task of taskClass: the one of the most restrictive of both
+func CapacityLimit(hostClass string, taskClass string) float64 {
+	limit := OverbookingLimit(hostClass)
+	if taskClass != "" {
+		limit = math.Min(limit, OverbookingLimit(taskClass))
+	}
+	return limit
+}
+
+//cpu shares and memory a host can still take under limit, minus what is reserved on it. Must be called with the class
+//lock of the host held
+func (s *ReservationStore) FreeCapacity(host *Host, limit float64) (int64, int64) {
+	s.mutex.Lock()
+	s.expire(Now())
+	reserved := s.reserved[host.HostIP]
+	s.mutex.Unlock()
+
+	if math.IsInf(limit, 1) {
+		return math.MaxInt64, math.MaxInt64
+	}
+	freeCPU := int64(limit*float64(host.TotalCPUs)) - host.AllocatedCPUs - reserved.cpu
+	freeMemory := int64(limit*float64(host.TotalMemory)) - host.AllocatedMemory - reserved.memory
+	return max(freeCPU, 0), max(freeMemory, 0)
+}
+
+func newReservationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//holds cpu shares and memory on a host for ttl, 0 taking the default one
+func (s *ReservationStore) Reserve(hostIP string, cpu int64, memory int64, class string, ttl time.Duration, owner string) (*Reservation, error) {
+	if cpu < 0 {
+		return nil, &ValidationError{Field: "cpu", Message: "must not be negative"}
+	}
+	if memory < 0 {
+		return nil, &ValidationError{Field: "memory", Message: "must not be negative"}
+	}
+	if cpu == 0 && memory == 0 {
+		return nil, &ValidationError{Field: "cpu", Message: "cpu or memory must be positive"}
+	}
+	if _, known := ClassRank(class); class != "" && !known {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownClass, class)
+	}
+	defaultTTL, _ := time.ParseDuration(config.Reservations.DefaultTTL)
+	maxTTL, _ := time.ParseDuration(config.Reservations.MaxTTL)
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	if ttl < 0 || ttl > maxTTL {
+		return nil, &ValidationError{Field: "ttl", Message: fmt.Sprintf("must be positive and at most %v", maxTTL)}
+	}
+	host, err := s.registry.LookupHost(hostIP)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := s.registry.LockHost(host)
+	defer lock.Unlock()
+	if host.removed {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownHost, hostIP)
+	}
+	if state := PowerStateOf(host); state != PowerOn {
+		return nil, fmt.Errorf("%w: %s is %s", ErrPowerState, hostIP, state)
+	}
+	limit := CapacityLimit(host.HostClass, class)
+	freeCPU, freeMemory := s.FreeCapacity(host, limit)
+	if cpu > freeCPU || memory > freeMemory {
+		reservationsTotal.Inc("rejected")
+		return nil, &CapacityError{HostIP: hostIP, Limit: limit, FreeCPU: freeCPU, FreeMemory: freeMemory}
+	}
+
+	now := Now()
+	reservation := &Reservation{ID: newReservationID(), HostIP: hostIP, CPU: cpu, Memory: memory, Class: class, Owner: owner,
+		State: ReservationPending, Created: now, Expires: now.Add(ttl)}
+	s.mutex.Lock()
+	s.reservations[reservation.ID] = reservation
+	s.hold(reservation, 1)
+	copied := *reservation
+	s.mutex.Unlock()
+	reservationsTotal.Inc("created")
+	return &copied, nil
+}
+
+//adds (sign 1) or removes (sign -1) a reservation from the capacity reserved on its host. Must be called with the
+//mutex held
+func (s *ReservationStore) hold(reservation *Reservation, sign int64) {
+	reserved := s.reserved[reservation.HostIP]
+	reserved.cpu += sign * reservation.CPU
+	reserved.memory += sign * reservation.Memory
+	if reserved.cpu == 0 && reserved.memory == 0 {
+		delete(s.reserved, reservation.HostIP)
+	} else {
+		s.reserved[reservation.HostIP] = reserved
+	}
+}
+
+//must be called with the mutex held
+func (s *ReservationStore) remove(reservation *Reservation) {
+	delete(s.reservations, reservation.ID)
+	s.hold(reservation, -1)
+}
+
+//drops the pending reservations whose ttl ran out by now. Must be called with the mutex held
+func (s *ReservationStore) expire(now time.Time) {
+	for _, reservation := range s.reservations {
+		if reservation.State == ReservationPending && !reservation.Expires.After(now) {
+			s.remove(reservation)
+			reservationsTotal.Inc("expired")
+		}
+	}
+}
+
+//optional body of a commit naming the task the reservation is for. It is added to the task table
+type ReservationCommit struct {
+	TaskID   string `json:"taskid,omitempty"`
+	TaskType string `json:"tasktype,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Port     int    `json:"port,omitempty"`
+}
+
+//turns a reservation into an allocation through UpdateResources, of a task when the commit names one, raising the
+//class of the host when the reservation has one. The capacity stays held until the allocation is made so nobody can
+//take it in between
+func (s *ReservationStore) Commit(id string, commit ReservationCommit) (Reservation, error) {
+	s.mutex.Lock()
+	s.expire(Now())
+	reservation, ok := s.reservations[id]
+	if !ok || reservation.State != ReservationPending {
+		s.mutex.Unlock()
+		return Reservation{}, fmt.Errorf("%w: %s", ErrUnknownReservation, id)
+	}
+	reservation.State = ReservationCommitting
+	s.mutex.Unlock()
+
+	var err error
+	if commit.TaskID != "" {
+		err = s.registry.allocateTask(TaskRecord{ID: commit.TaskID, HostIP: reservation.HostIP, Class: reservation.Class, Type: commit.TaskType, Image: commit.Image,
+			CPU: reservation.CPU, Memory: reservation.Memory, Port: commit.Port}, reservation)
+	} else {
+		err = s.registry.allocateResources(reservation.HostIP, reservation.CPU, reservation.Memory, reservation.Class, reservation)
+	}
+	if err == nil && reservation.Class != "" {
+		err = s.registry.RaiseHostClass(reservation.HostIP, reservation.Class)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(reservation)
+	if err != nil {
+		reservationsTotal.Inc("failed")
+		return Reservation{}, err
+	}
+	reservationsTotal.Inc("committed")
+	reservation.State = ReservationCommitted
+	return *reservation, nil
+}
+
+func (s *ReservationStore) Abort(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(Now())
+	reservation, ok := s.reservations[id]
+	if !ok || reservation.State != ReservationPending {
+		return fmt.Errorf("%w: %s", ErrUnknownReservation, id)
+	}
+	s.remove(reservation)
+	reservationsTotal.Inc("aborted")
+	return nil
+}
+
+//aborts the pending reservations of a host, for a host that is removed
+func (s *ReservationStore) AbortHost(hostIP string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	aborted := 0
+	for _, reservation := range s.reservations {
+		if reservation.HostIP == hostIP && reservation.State == ReservationPending {
+			s.remove(reservation)
+			reservationsTotal.Inc("aborted")
+			aborted++
+		}
+	}
+	return aborted
+}
+
+//aborts every pending reservation, for a leader that stops leading. The ones being committed are released by their
+//commit
+func (s *ReservationStore) AbortAll() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	aborted := 0
+	for _, reservation := range s.reservations {
+		if reservation.State == ReservationPending {
+			s.remove(reservation)
+			reservationsTotal.Inc("aborted")
+			aborted++
+		}
+	}
+	return aborted
+}
+
+func (s *ReservationStore) Get(id string) (Reservation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(Now())
+	reservation, ok := s.reservations[id]
+	if !ok {
+		return Reservation{}, fmt.Errorf("%w: %s", ErrUnknownReservation, id)
+	}
+	return *reservation, nil
+}
+
+//current reservations ordered by expiry. An empty host returns every reservation
+func (s *ReservationStore) List(hostIP string) []Reservation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.expire(Now())
+
+	list := make([]Reservation, 0)
+	for _, reservation := range s.reservations {
+		if hostIP == "" || reservation.HostIP == hostIP {
+			list = append(list, *reservation)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+type ReservationRequest struct {
+	HostIP string `json:"hostip"`
+	CPU    int64  `json:"cpu"`             //cpu shares
+	Memory int64  `json:"memory"`          //bytes
+	Class  string `json:"class,omitempty"` //class of the task, its overbooking limit applies when more restrictive
+	TTL    string `json:"ttl,omitempty"`   //e.g. 30s
+}
+
+func (r *Registry) V2ListReservations(w http.ResponseWriter, req *http.Request) {
+	WriteJSON(w, http.StatusOK, r.reservations.List(req.URL.Query().Get("host")))
+}
+
+func (r *Registry) V2CreateReservation(w http.ResponseWriter, req *http.Request) {
+	var request ReservationRequest
+	if err := DecodeBody(req, &request); err != nil {
+		WriteError(w, err)
+		return
+	}
+	var ttl time.Duration
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil {
+			WriteError(w, &ValidationError{Field: "ttl", Message: err.Error()})
+			return
+		}
+		ttl = parsed
+	}
+	owner := ""
+	if identity := RequestIdentity(req); identity != nil {
+		owner = identity.Name
+	}
+	reservation, err := r.reservations.Reserve(request.HostIP, request.CPU, request.Memory, request.Class, ttl, owner)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/v2/reservations/"+reservation.ID)
+	WriteJSON(w, http.StatusCreated, reservation)
+}
+
+func (r *Registry) V2GetReservation(w http.ResponseWriter, req *http.Request) {
+	reservation, err := r.reservations.Get(mux.Vars(req)["id"])
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, reservation)
+}
+
+func (r *Registry) V2CommitReservation(w http.ResponseWriter, req *http.Request) {
+	var commit ReservationCommit
+	if req.ContentLength != 0 {
+		if err := DecodeBody(req, &commit); err != nil {
+			WriteError(w, err)
+			return
+		}
+	}
+	reservation, err := r.reservations.Commit(mux.Vars(req)["id"], commit)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, reservation)
+}
+
+func (r *Registry) V2AbortReservation(w http.ResponseWriter, req *http.Request) {
+	if err := r.reservations.Abort(mux.Vars(req)["id"]); err != nil {
+		WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//reserves through the API, failing the test when refused
+func reserve(t *testing.T, registry *Registry, request ReservationRequest) Reservation {
+	t.Helper()
+	status, body := serve(t, registry, http.MethodPost, "/v2/reservations", request)
+	var reservation Reservation
+	if err := json.Unmarshal(body, &reservation); status != http.StatusCreated || err != nil {
+		t.Fatalf("reserving %+v answered %d %s", request, status, body)
+	}
+	return reservation
+}
+
+func TestReservationHoldsCapacity(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	//a class 4 host of 4 cpus and 1 GiB takes 8192 shares and 2 GiB
+	reserve(t, registry, ReservationRequest{HostIP: "10.0.0.1", CPU: 6144, Memory: 1 << 30})
+
+	status, body := serve(t, registry, http.MethodPost, "/v2/reservations", ReservationRequest{HostIP: "10.0.0.1", CPU: 4096, Memory: 1 << 20})
+	var capacity CapacityError
+	if json.Unmarshal(body, &ErrorDocument{Details: &capacity}); status != http.StatusConflict || capacity.FreeCPU != 2048 || capacity.FreeMemory != 1<<30 {
+		t.Errorf("reserving past the free capacity answered %d %s", status, body)
+	}
+	//the allocations made without a reservation only take what is left
+	if status, body = serve(t, registry, http.MethodPost, "/v2/hosts/10.0.0.1/allocations", Allocation{CPU: 4096, Memory: 1 << 20}); status != http.StatusConflict || errorCode(t, body) != "insufficient_capacity" {
+		t.Errorf("allocating reserved capacity answered %d %s", status, body)
+	}
+	if status, body = serve(t, registry, http.MethodGet, "/host/updateresources/10.0.0.1&4096&0", nil); status != http.StatusConflict {
+		t.Errorf("allocating reserved capacity through the first API answered %d %s", status, body)
+	}
+	err := registry.AllocateTask(TaskRecord{ID: "c1", HostIP: "10.0.0.1", CPU: 4096, Memory: 1 << 20})
+	if !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("allocating a task on reserved capacity returned %v", err)
+	}
+	if _, err = registry.tasks.Get("c1"); err == nil {
+		t.Errorf("a refused task was kept in the table")
+	}
+
+	if status, body = serve(t, registry, http.MethodGet, "/host/updateresources/10.0.0.1&2048&0", nil); status != http.StatusOK {
+		t.Fatalf("allocating the free capacity answered %d %s", status, body)
+	}
+	//releasing through the first API is never refused
+	if status, body = serve(t, registry, http.MethodGet, "/host/updateresources/10.0.0.1&-1024&0", nil); status != http.StatusOK {
+		t.Fatalf("releasing answered %d %s", status, body)
+	}
+	if host, _ := registry.SnapshotHost("10.0.0.1"); host.AllocatedCPUs != 1024 {
+		t.Errorf("the host has %d shares allocated, expected 1024", host.AllocatedCPUs)
+	}
+}
+
+func TestReservationCommit(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	reservation := reserve(t, registry, ReservationRequest{HostIP: "10.0.0.1", CPU: 4096, Memory: 512 << 20, Class: "2"})
+	if reservation.State != ReservationPending || reservation.Expires.Sub(reservation.Created) != 30*time.Second {
+		t.Errorf("the reservation was created as %+v", reservation)
+	}
+
+	//the capacity held by the reservation is not counted against its own commit
+	status, body := serve(t, registry, http.MethodPost, "/v2/reservations/"+reservation.ID+"/commit", ReservationCommit{TaskID: "c1", Image: "nginx"})
+	var committed Reservation
+	if json.Unmarshal(body, &committed); status != http.StatusOK || committed.State != ReservationCommitted {
+		t.Fatalf("committing answered %d %s", status, body)
+	}
+	host, _ := registry.SnapshotHost("10.0.0.1")
+	if host.AllocatedCPUs != 4096 || host.AllocatedMemory != 512<<20 || host.HostClass != "2" {
+		t.Errorf("after the commit the host has %d shares and %d bytes allocated in class %s", host.AllocatedCPUs, host.AllocatedMemory, host.HostClass)
+	}
+	if task, err := registry.tasks.Get("c1"); err != nil || task.CPU != 4096 || task.Class != "2" {
+		t.Errorf("the committed task was recorded as %+v, %v", task, err)
+	}
+	if reservations := registry.reservations.List(""); len(reservations) != 0 {
+		t.Errorf("the committed reservation is still held: %+v", reservations)
+	}
+	if status, body = serve(t, registry, http.MethodPost, "/v2/reservations/"+reservation.ID+"/commit", nil); status != http.StatusNotFound || errorCode(t, body) != "unknown_reservation" {
+		t.Errorf("committing twice answered %d %s", status, body)
+	}
+}
+
+func TestReservationExpiryAndAbort(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	expiring := reserve(t, registry, ReservationRequest{HostIP: "10.0.0.1", CPU: 4096, Memory: 1 << 30, TTL: "10s"})
+	aborted := reserve(t, registry, ReservationRequest{HostIP: "10.0.0.1", CPU: 4096, Memory: 1 << 30, TTL: "1m"})
+
+	if status, body := serve(t, registry, http.MethodPost, "/v2/reservations", ReservationRequest{HostIP: "10.0.0.1", CPU: 1, TTL: "1h"}); status != http.StatusBadRequest {
+		t.Errorf("a ttl past the maximum answered %d %s", status, body)
+	}
+	if status, _ := serve(t, registry, http.MethodDelete, "/v2/reservations/"+aborted.ID, nil); status != http.StatusNoContent {
+		t.Fatalf("aborting answered %d", status)
+	}
+
+	clock.advance(9 * time.Second)
+	if _, err := registry.reservations.Get(expiring.ID); err != nil {
+		t.Fatalf("the reservation expired before its ttl: %v", err)
+	}
+	clock.advance(time.Second)
+	if status, body := serve(t, registry, http.MethodPost, "/v2/reservations/"+expiring.ID+"/commit", nil); status != http.StatusNotFound {
+		t.Errorf("committing an expired reservation answered %d %s", status, body)
+	}
+	//both released their capacity
+	if err := registry.AllocateResources("10.0.0.1", 8192, 2<<30); err != nil {
+		t.Errorf("the capacity of the expired and aborted reservations is still held: %v", err)
+	}
+}
+
+func TestReservationsAbortedByFormerLeader(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := waitLeader(t, nodes)
+	if status, body := request(t, http.MethodPost, leader.url+"/v2/hosts", HostRegistration{HostIP: "10.0.0.1", TotalMemory: 1 << 30, TotalCPUs: 4}); status != http.StatusCreated {
+		t.Fatalf("registering answered %d %s", status, body)
+	}
+	status, body := request(t, http.MethodPost, follower(nodes, leader).url+"/v2/reservations", ReservationRequest{HostIP: "10.0.0.1", CPU: 1024, Memory: 1 << 20})
+	if status != http.StatusCreated {
+		t.Fatalf("reserving through a follower answered %d %s", status, body)
+	}
+	if reservations := leader.registry.reservations.List(""); len(reservations) != 1 {
+		t.Fatalf("the leader holds %+v", reservations)
+	}
+
+	//reservations are not replicated, a leader that stops leading releases them
+	leader.stop()
+	if reservations := leader.registry.reservations.List(""); len(reservations) != 0 {
+		t.Errorf("the former leader still holds %+v", reservations)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//the container runtime is how the registry starts and resizes tasks in the swarm (reschedules and cuts)
+
+type PortBinding struct {
+	HostPort      int    `json:"hostport"`
+	ContainerPort int    `json:"containerport"`
+	Protocol      string `json:"protocol,omitempty"` //tcp when empty
+}
+
+type ContainerSpec struct {
+	Image      string
+	Cmd        []string
+	Env        []string //swarm affinities are passed as environment entries, e.g. affinity:requestclass==1
+	CPUShares  int64
+	Memory     int64 //bytes
+	Ports      []PortBinding
+	Volumes    []string //host:container
+	WorkingDir string
+}
+
+type ContainerInfo struct {
+	ID        string `json:"id"`
+	Image     string `json:"image"`
+	Status    string `json:"status"`
+	Running   bool   `json:"running"`
+	CPUShares int64  `json:"cpushares"`
+	Memory    int64  `json:"memory"`
+	HostIP    string `json:"hostip,omitempty"` //where the container runs, when the runtime knows it
+}
+
+type Runtime interface {
+	Run(spec ContainerSpec) (string, error)
+	Update(id string, cpuShares int64, memory int64) error
+	Stop(id string) error
+	Inspect(id string) (ContainerInfo, error)
+}
+
+//kinds of runtime failures, so that callers can decide whether to retry
+const (
+	RuntimeErrNotFound    = "notfound"    //unknown container or image
+	RuntimeErrConflict    = "conflict"    //e.g. the port is already allocated
+	RuntimeErrBadRequest  = "badrequest"  //the runtime rejected the parameters
+	RuntimeErrUnavailable = "unavailable" //the runtime could not be reached
+	RuntimeErrServer      = "server"      //the runtime failed while handling the request
+)
+
+type RuntimeError struct {
+	Op         string `json:"op"`
+	Container  string `json:"container,omitempty"`
+	Kind       string `json:"kind"`
+	StatusCode int    `json:"statuscode,omitempty"` //status returned by the runtime, if any
+	Message    string `json:"message"`
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Container != "" {
+		return fmt.Sprintf("runtime %s %s: %s: %s", e.Op, e.Container, e.Kind, e.Message)
+	}
+	return fmt.Sprintf("runtime %s: %s: %s", e.Op, e.Kind, e.Message)
+}
+
+//only failures that may go away by themselves are worth retrying
+func (e *RuntimeError) Temporary() bool {
+	return e.Kind == RuntimeErrUnavailable || e.Kind == RuntimeErrServer
+}
+
+func RuntimeErrorKind(err error) string {
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		return runtimeErr.Kind
+	}
+	return ""
+}
+
+//http status the registry answers with when a runtime call fails
+func RuntimeErrorStatus(err error) int {
+	switch RuntimeErrorKind(err) {
+	case RuntimeErrNotFound:
+		return http.StatusNotFound
+	case RuntimeErrConflict:
+		return http.StatusConflict
+	case RuntimeErrBadRequest:
+		return http.StatusBadRequest
+	case RuntimeErrUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+type RuntimeConfig struct {
+	Kind       string `json:"kind"`     //docker or fake
+	Endpoint   string `json:"endpoint"` //swarm manager, e.g. tcp://10.5.60.2:2377
+	APIVersion string `json:"apiversion,omitempty"`
+	Timeout    string `json:"timeout,omitempty"` //duration, e.g. 30s
+	Retries    int    `json:"retries"`           //extra attempts of an update after a temporary failure
+	RetryDelay string `json:"retrydelay,omitempty"`
+}
+
+func NewRuntime(runtimeConfig RuntimeConfig) (Runtime, error) {
+	switch runtimeConfig.Kind {
+	case "docker", "":
+		timeout, err := time.ParseDuration(runtimeConfig.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("runtime timeout: %v", err)
+		}
+		return NewDockerRuntime(runtimeConfig.Endpoint, runtimeConfig.APIVersion, timeout)
+	case "fake":
+		return NewFakeRuntime(), nil
+	}
+	return nil, fmt.Errorf("unknown runtime %q", runtimeConfig.Kind)
+}
+
+//updates the resources of a container, retrying temporary failures as configured
+func (r *Registry) UpdateContainer(id string, cpuShares int64, memory int64) error {
+	delay, err := time.ParseDuration(config.Runtime.RetryDelay)
+	if err != nil {
+		delay = 5 * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err = r.containerRuntime.Update(id, cpuShares, memory)
+		var runtimeErr *RuntimeError
+		if err == nil || attempt >= config.Runtime.Retries || !errors.As(err, &runtimeErr) || !runtimeErr.Temporary() {
+			return err
+		}
+		log.Printf("%v, retrying in %s", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+//parses a memory amount the way the docker cli does: bytes, or a number followed by b, k, m or g
+func ParseMemory(original string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(original))
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'b':
+			value = value[:len(value)-1]
+		case 'k':
+			multiplier = 1024
+			value = value[:len(value)-1]
+		case 'm':
+			multiplier = 1024 * 1024
+			value = value[:len(value)-1]
+		case 'g':
+			multiplier = 1024 * 1024 * 1024
+			value = value[:len(value)-1]
+		}
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid memory amount %q", original)
+	}
+	return int64(amount * float64(multiplier)), nil
+}
+
+//cpu shares of a task, an empty value leaves the container without cpu limit
+func ParseCPUShares(original string) (int64, error) {
+	value := strings.TrimSpace(original)
+	if value == "" {
+		return 0, nil
+	}
+	shares, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || shares < 0 {
+		return 0, fmt.Errorf("invalid cpu shares %q", original)
+	}
+	return shares, nil
+}
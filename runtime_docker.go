@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//talks to the Docker Engine (or classic swarm manager) HTTP API directly instead of going through the docker cli
+
+type DockerRuntime struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewDockerRuntime(endpoint string, apiVersion string, timeout time.Duration) (*DockerRuntime, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("runtime endpoint: %v", err)
+	}
+	switch parsed.Scheme {
+	case "tcp", "http":
+		parsed.Scheme = "http"
+	case "https":
+	default:
+		return nil, fmt.Errorf("runtime endpoint %q: unsupported scheme %q", endpoint, parsed.Scheme)
+	}
+	baseURL := strings.TrimSuffix(parsed.String(), "/")
+	if apiVersion != "" {
+		baseURL += "/v" + strings.TrimPrefix(apiVersion, "v")
+	}
+	return &DockerRuntime{baseURL: baseURL, client: &http.Client{Timeout: timeout}}, nil
+}
+
+type dockerCreateRequest struct {
+	Image        string              `json:"Image"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Tty          bool                `json:"Tty"`
+	OpenStdin    bool                `json:"OpenStdin"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	HostConfig   dockerHostConfig    `json:"HostConfig"`
+}
+
+type dockerHostConfig struct {
+	CpuShares    int64                          `json:"CpuShares,omitempty"`
+	Memory       int64                          `json:"Memory,omitempty"`
+	Binds        []string                       `json:"Binds,omitempty"`
+	PortBindings map[string][]dockerPortBinding `json:"PortBindings,omitempty"`
+}
+
+type dockerPortBinding struct {
+	HostPort string `json:"HostPort"`
+}
+
+type dockerUpdateRequest struct {
+	CpuShares int64 `json:"CpuShares,omitempty"`
+	Memory    int64 `json:"Memory,omitempty"`
+}
+
+type dockerInspectResponse struct {
+	ID     string `json:"Id"`
+	Config struct {
+		Image string `json:"Image"`
+	} `json:"Config"`
+	State struct {
+		Status  string `json:"Status"`
+		Running bool   `json:"Running"`
+	} `json:"State"`
+	HostConfig dockerHostConfig `json:"HostConfig"`
+	//only set by swarm managers
+	Node *struct {
+		IP string `json:"IP"`
+	} `json:"Node,omitempty"`
+}
+
+//same as docker run -itd: the container is created and started detached
+func (d *DockerRuntime) Run(spec ContainerSpec) (string, error) {
+	create := dockerCreateRequest{
+		Image:      spec.Image,
+		Cmd:        spec.Cmd,
+		Env:        spec.Env,
+		WorkingDir: spec.WorkingDir,
+		Tty:        true,
+		OpenStdin:  true,
+		HostConfig: dockerHostConfig{CpuShares: spec.CPUShares, Memory: spec.Memory, Binds: spec.Volumes},
+	}
+	if len(spec.Ports) > 0 {
+		create.ExposedPorts = make(map[string]struct{})
+		create.HostConfig.PortBindings = make(map[string][]dockerPortBinding)
+		for _, port := range spec.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			key := strconv.Itoa(port.ContainerPort) + "/" + protocol
+			create.ExposedPorts[key] = struct{}{}
+			create.HostConfig.PortBindings[key] = append(create.HostConfig.PortBindings[key], dockerPortBinding{HostPort: strconv.Itoa(port.HostPort)})
+		}
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := d.call("run", "", "POST", "/containers/create", create, &created); err != nil {
+		return "", err
+	}
+	if err := d.call("run", created.ID, "POST", "/containers/"+url.PathEscape(created.ID)+"/start", nil, nil); err != nil {
+		//the callers drop a container that did not start, it must not keep its port bindings
+		if removeErr := d.call("remove", created.ID, "DELETE", "/containers/"+url.PathEscape(created.ID)+"?force=1", nil, nil); removeErr != nil {
+			log.Printf("removing container %s that did not start: %v", created.ID, removeErr)
+		}
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (d *DockerRuntime) Update(id string, cpuShares int64, memory int64) error {
+	return d.call("update", id, "POST", "/containers/"+url.PathEscape(id)+"/update", dockerUpdateRequest{CpuShares: cpuShares, Memory: memory}, nil)
+}
+
+func (d *DockerRuntime) Stop(id string) error {
+	return d.call("stop", id, "POST", "/containers/"+url.PathEscape(id)+"/stop", nil, nil)
+}
+
+func (d *DockerRuntime) Inspect(id string) (ContainerInfo, error) {
+	var inspected dockerInspectResponse
+	if err := d.call("inspect", id, "GET", "/containers/"+url.PathEscape(id)+"/json", nil, &inspected); err != nil {
+		return ContainerInfo{}, err
+	}
+	hostIP := ""
+	if inspected.Node != nil {
+		hostIP = inspected.Node.IP
+	}
+	return ContainerInfo{
+		ID:        inspected.ID,
+		HostIP:    hostIP,
+		Image:     inspected.Config.Image,
+		Status:    inspected.State.Status,
+		Running:   inspected.State.Running,
+		CPUShares: inspected.HostConfig.CpuShares,
+		Memory:    inspected.HostConfig.Memory,
+	}, nil
+}
+
+//sends a request to the engine and turns failures into a *RuntimeError
+func (d *DockerRuntime) call(op string, container string, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return &RuntimeError{Op: op, Container: container, Kind: RuntimeErrBadRequest, Message: err.Error()}
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, d.baseURL+path, reader)
+	if err != nil {
+		return &RuntimeError{Op: op, Container: container, Kind: RuntimeErrBadRequest, Message: err.Error()}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return &RuntimeError{Op: op, Container: container, Kind: RuntimeErrUnavailable, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	//304 is returned when a container is already started or stopped
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if result == nil {
+			return nil
+		}
+		if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return &RuntimeError{Op: op, Container: container, Kind: RuntimeErrServer, StatusCode: resp.StatusCode, Message: "invalid response: " + err.Error()}
+		}
+		return nil
+	}
+
+	//the engine answers errors with {"message": "..."}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var engineError struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(message, &engineError) == nil && engineError.Message != "" {
+		message = []byte(engineError.Message)
+	}
+
+	kind := RuntimeErrServer
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		kind = RuntimeErrNotFound
+	case http.StatusConflict:
+		kind = RuntimeErrConflict
+	case http.StatusBadRequest:
+		kind = RuntimeErrBadRequest
+	case http.StatusServiceUnavailable:
+		kind = RuntimeErrUnavailable
+	}
+	return &RuntimeError{Op: op, Container: container, Kind: kind, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+//in-memory runtime for tests and offline runs. Containers are just records, nothing is executed
+
+type FakeRuntime struct {
+	mutex      *sync.Mutex
+	containers map[string]*FakeContainer
+	nextID     int
+	failures   map[string][]error              //errors returned by the next calls of an operation
+	place      func(spec ContainerSpec) string //host a container lands on, as the swarm would decide. None when nil
+}
+
+type FakeContainer struct {
+	Info ContainerInfo
+	Spec ContainerSpec
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{mutex: &sync.Mutex{}, containers: make(map[string]*FakeContainer), failures: make(map[string][]error)}
+}
+
+//makes the next call of op (run, update, stop or inspect) fail with err. Calls queue up
+func (f *FakeRuntime) Fail(op string, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failures[op] = append(f.failures[op], err)
+}
+
+func (f *FakeRuntime) SetPlacement(place func(spec ContainerSpec) string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.place = place
+}
+
+//must be called with the mutex held
+func (f *FakeRuntime) nextFailure(op string) error {
+	if len(f.failures[op]) == 0 {
+		return nil
+	}
+	err := f.failures[op][0]
+	f.failures[op] = f.failures[op][1:]
+	return err
+}
+
+func (f *FakeRuntime) Run(spec ContainerSpec) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.nextFailure("run"); err != nil {
+		return "", err
+	}
+	for _, container := range f.containers {
+		if !container.Info.Running {
+			continue
+		}
+		for _, used := range container.Spec.Ports {
+			for _, port := range spec.Ports {
+				if used.HostPort == port.HostPort {
+					return "", &RuntimeError{Op: "run", Kind: RuntimeErrConflict, Message: "port " + strconv.Itoa(port.HostPort) + " is already allocated"}
+				}
+			}
+		}
+	}
+
+	f.nextID++
+	id := "fake" + strconv.Itoa(f.nextID)
+	f.containers[id] = &FakeContainer{
+		Info: ContainerInfo{ID: id, Image: spec.Image, Status: "running", Running: true, CPUShares: spec.CPUShares, Memory: spec.Memory},
+		Spec: spec,
+	}
+	if f.place != nil {
+		f.containers[id].Info.HostIP = f.place(spec)
+	}
+	return id, nil
+}
+
+func (f *FakeRuntime) Update(id string, cpuShares int64, memory int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.nextFailure("update"); err != nil {
+		return err
+	}
+	container, ok := f.containers[id]
+	if !ok {
+		return &RuntimeError{Op: "update", Container: id, Kind: RuntimeErrNotFound, Message: "no such container"}
+	}
+	if cpuShares > 0 {
+		container.Info.CPUShares = cpuShares
+	}
+	if memory > 0 {
+		container.Info.Memory = memory
+	}
+	return nil
+}
+
+func (f *FakeRuntime) Stop(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.nextFailure("stop"); err != nil {
+		return err
+	}
+	container, ok := f.containers[id]
+	if !ok {
+		return &RuntimeError{Op: "stop", Container: id, Kind: RuntimeErrNotFound, Message: "no such container"}
+	}
+	container.Info.Running = false
+	container.Info.Status = "exited"
+	return nil
+}
+
+func (f *FakeRuntime) Inspect(id string) (ContainerInfo, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.nextFailure("inspect"); err != nil {
+		return ContainerInfo{}, err
+	}
+	container, ok := f.containers[id]
+	if !ok {
+		return ContainerInfo{}, &RuntimeError{Op: "inspect", Container: id, Kind: RuntimeErrNotFound, Message: "no such container"}
+	}
+	return container.Info, nil
+}
+
+//every container the fake has run, in no particular order
+func (f *FakeRuntime) Containers() []FakeContainer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	list := make([]FakeContainer, 0, len(f.containers))
+	for _, container := range f.containers {
+		list = append(list, *container)
+	}
+	return list
+}
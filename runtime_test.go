@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+//runs the tests on the default configuration and puts the previous one back afterwards
+func useDefaultConfig(t *testing.T) {
+	previous := config
+	config = DefaultConfig()
+	t.Cleanup(func() { config = previous })
+}
+
+//an engine that answers every request with the next of its responses, the last one is repeated
+type fakeEngine struct {
+	mutex     sync.Mutex
+	responses []engineResponse
+	requests  []*http.Request
+	bodies    [][]byte
+}
+
+type engineResponse struct {
+	status int
+	body   interface{}
+}
+
+func startEngine(t *testing.T, responses ...engineResponse) (*fakeEngine, *DockerRuntime) {
+	engine := &fakeEngine{responses: responses}
+	server := httptest.NewServer(engine)
+	t.Cleanup(server.Close)
+	runtime, err := NewDockerRuntime(server.URL, "1.41", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine, runtime
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	e.mutex.Lock()
+	body, _ := io.ReadAll(req.Body)
+	e.requests = append(e.requests, req)
+	e.bodies = append(e.bodies, body)
+	response := e.responses[0]
+	if len(e.responses) > 1 {
+		e.responses = e.responses[1:]
+	}
+	e.mutex.Unlock()
+
+	if response.body == nil {
+		w.WriteHeader(response.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.status)
+	json.NewEncoder(w).Encode(response.body)
+}
+
+func (e *fakeEngine) calls() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return len(e.requests)
+}
+
+func engineError(message string) map[string]string {
+	return map[string]string{"message": message}
+}
+
+func TestDockerRuntimeNotFound(t *testing.T) {
+	engine, runtime := startEngine(t, engineResponse{http.StatusNotFound, engineError("No such container: c1")})
+
+	_, err := runtime.Inspect("c1")
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("inspecting an unknown container returned %v", err)
+	}
+	if runtimeErr.Kind != RuntimeErrNotFound || runtimeErr.StatusCode != http.StatusNotFound || runtimeErr.Message != "No such container: c1" {
+		t.Errorf("unexpected error %+v", runtimeErr)
+	}
+	if runtimeErr.Temporary() || RuntimeErrorStatus(err) != http.StatusNotFound {
+		t.Errorf("%v is retried or answered with %d", err, RuntimeErrorStatus(err))
+	}
+	if request := engine.requests[0]; request.Method != http.MethodGet || request.URL.Path != "/v1.41/containers/c1/json" {
+		t.Errorf("inspect sent %s %s", request.Method, request.URL.Path)
+	}
+}
+
+func TestDockerRuntimeConflict(t *testing.T) {
+	engine, runtime := startEngine(t,
+		engineResponse{http.StatusCreated, map[string]string{"Id": "c1"}},
+		engineResponse{http.StatusConflict, engineError("port is already allocated")},
+		engineResponse{http.StatusNoContent, nil})
+
+	id, err := runtime.Run(ContainerSpec{Image: "nginx", CPUShares: 512, Ports: []PortBinding{{HostPort: 31000, ContainerPort: 80}}})
+	if id != "" || RuntimeErrorKind(err) != RuntimeErrConflict || RuntimeErrorStatus(err) != http.StatusConflict {
+		t.Fatalf("starting on an allocated port returned %q, %v", id, err)
+	}
+	//the container that did not start is removed so that it releases its port binding
+	if engine.calls() != 3 || engine.requests[1].URL.Path != "/v1.41/containers/c1/start" {
+		t.Fatalf("expected a create, a start and a remove, the engine got %d requests", engine.calls())
+	}
+	if remove := engine.requests[2]; remove.Method != http.MethodDelete || remove.URL.Path != "/v1.41/containers/c1" || remove.URL.Query().Get("force") != "1" {
+		t.Errorf("the container was removed with %s %s", remove.Method, remove.URL)
+	}
+
+	var created dockerCreateRequest
+	if err = json.Unmarshal(engine.bodies[0], &created); err != nil {
+		t.Fatal(err)
+	}
+	bindings := created.HostConfig.PortBindings["80/tcp"]
+	if created.Image != "nginx" || created.HostConfig.CpuShares != 512 || len(bindings) != 1 || bindings[0].HostPort != "31000" {
+		t.Errorf("unexpected create request %s", engine.bodies[0])
+	}
+}
+
+func TestDockerRuntimeNotModified(t *testing.T) {
+	_, runtime := startEngine(t, engineResponse{http.StatusNotModified, nil})
+	if err := runtime.Stop("c1"); err != nil {
+		t.Errorf("stopping a stopped container returned %v", err)
+	}
+}
+
+func TestUpdateContainerRetries(t *testing.T) {
+	useDefaultConfig(t)
+	config.Runtime.Retries = 2
+	config.Runtime.RetryDelay = "1ms"
+
+	tests := []struct {
+		name      string
+		responses []engineResponse
+		calls     int
+		kind      string //of the returned error, none when empty
+	}{
+		{"temporary failures", []engineResponse{{http.StatusServiceUnavailable, engineError("manager is busy")}, {http.StatusInternalServerError, engineError("try again")}, {http.StatusOK, nil}}, 3, ""},
+		{"retries exhausted", []engineResponse{{http.StatusServiceUnavailable, engineError("manager is busy")}}, 3, RuntimeErrUnavailable},
+		{"not found", []engineResponse{{http.StatusNotFound, engineError("No such container: c1")}}, 1, RuntimeErrNotFound},
+		{"conflict", []engineResponse{{http.StatusConflict, engineError("container is not running")}}, 1, RuntimeErrConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine, runtime := startEngine(t, test.responses...)
+			registry := NewRegistry(runtime)
+
+			err := registry.UpdateContainer("c1", 256, 1<<20)
+			if RuntimeErrorKind(err) != test.kind || (test.kind == "" && err != nil) {
+				t.Errorf("update returned %v", err)
+			}
+			if engine.calls() != test.calls {
+				t.Errorf("the engine got %d updates, expected %d", engine.calls(), test.calls)
+			}
+			var update dockerUpdateRequest
+			if err = json.Unmarshal(engine.bodies[0], &update); err != nil || update.CpuShares != 256 || update.Memory != 1<<20 {
+				t.Errorf("unexpected update request %s", engine.bodies[0])
+			}
+		})
+	}
+}
+
+func TestCutTaskOnFakeRuntime(t *testing.T) {
+	useDefaultConfig(t)
+	config.Runtime.RetryDelay = "1ms"
+	runtime := NewFakeRuntime()
+	registry := NewRegistry(runtime)
+	if _, err := registry.RegisterHost("10.0.0.1", 1<<30, 4*1024); err != nil {
+		t.Fatal(err)
+	}
+	id, err := runtime.Run(ContainerSpec{Image: "nginx", CPUShares: 1024, Memory: 512 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = registry.AllocateTask(TaskRecord{ID: id, HostIP: "10.0.0.1", CPU: 1024, Memory: 512 << 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	//a temporary failure is retried and the cut goes through
+	runtime.Fail("update", &RuntimeError{Op: "update", Container: id, Kind: RuntimeErrUnavailable, Message: "manager is busy"})
+	if err = registry.CutTask(TaskCut{TaskID: id, HostIP: "10.0.0.1", NewCPU: 768, NewMemory: 384 << 20, CPUCut: 256, MemoryCut: 128 << 20}); err != nil {
+		t.Fatalf("cut after a temporary failure returned %v", err)
+	}
+	info, _ := runtime.Inspect(id)
+	host, _ := registry.SnapshotHost("10.0.0.1")
+	if info.CPUShares != 768 || info.Memory != 384<<20 || host.AllocatedCPUs != 768 || host.AllocatedMemory != 384<<20 {
+		t.Errorf("the container has %d shares and %d bytes, the host %d and %d", info.CPUShares, info.Memory, host.AllocatedCPUs, host.AllocatedMemory)
+	}
+
+	//the container keeps its resources when the runtime refuses the update, and so does the host
+	runtime.Fail("update", &RuntimeError{Op: "update", Container: id, Kind: RuntimeErrConflict, Message: "container is restarting"})
+	err = registry.CutTask(TaskCut{TaskID: id, HostIP: "10.0.0.1", NewCPU: 512, NewMemory: 256 << 20, CPUCut: 256, MemoryCut: 128 << 20})
+	if RuntimeErrorKind(err) != RuntimeErrConflict {
+		t.Fatalf("cut refused by the runtime returned %v", err)
+	}
+	info, _ = runtime.Inspect(id)
+	host, _ = registry.SnapshotHost("10.0.0.1")
+	task, _ := registry.tasks.Get(id)
+	if info.CPUShares != 768 || host.AllocatedCPUs != 768 || task.CPU != 768 {
+		t.Errorf("after a refused cut the container has %d shares, the host %d and the task %d", info.CPUShares, host.AllocatedCPUs, task.CPU)
+	}
+}
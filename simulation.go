@@ -0,0 +1,703 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//discrete-event simulation: synthetic hosts receive tasks from arrival streams and report the utilization their tasks
+//would cause, on a virtual clock, while the registry logic of the live service (lists, regions, classes, task table,
+//cuts and reschedules through the fake runtime) decides where everything goes. The simulation plays the scheduler the
+//way its clients use the registry: the first host of the normal placement, else cuts of less restrictive tasks on the
+//cut list, else kills on the kill list, the killed tasks being rescheduled on another host. The report gives the
+//region occupancy over time, the overbooking and the cuts, kills and reschedules
+
+const (
+	DistributionConstant    = "constant"
+	DistributionUniform     = "uniform"
+	DistributionExponential = "exponential"
+	DistributionNormal      = "normal"
+)
+
+type Distribution struct {
+	Kind   string  `json:"kind"`
+	Value  float64 `json:"value,omitempty"` //constant
+	Mean   float64 `json:"mean,omitempty"`  //exponential and normal
+	StdDev float64 `json:"stddev,omitempty"`
+	Min    float64 `json:"min,omitempty"` //uniform
+	Max    float64 `json:"max,omitempty"`
+}
+
+func (d Distribution) Validate(name string) error {
+	switch d.Kind {
+	case DistributionConstant:
+		if d.Value < 0 {
+			return fmt.Errorf("%s: value must not be negative", name)
+		}
+	case DistributionUniform:
+		if d.Min < 0 || d.Max < d.Min {
+			return fmt.Errorf("%s: min and max must satisfy 0 <= min <= max", name)
+		}
+	case DistributionExponential:
+		if d.Mean <= 0 {
+			return fmt.Errorf("%s: mean must be positive", name)
+		}
+	case DistributionNormal:
+		if d.Mean < 0 || d.StdDev < 0 {
+			return fmt.Errorf("%s: mean and stddev must not be negative", name)
+		}
+	default:
+		return fmt.Errorf("%s: kind must be %s, %s, %s or %s", name, DistributionConstant, DistributionUniform, DistributionExponential, DistributionNormal)
+	}
+	return nil
+}
+
+func (d Distribution) alwaysZero() bool {
+	return (d.Kind == DistributionConstant && d.Value == 0) || (d.Kind == DistributionUniform && d.Max == 0) ||
+		(d.Kind == DistributionNormal && d.Mean == 0 && d.StdDev == 0)
+}
+
+//draws a value, never negative
+func (d Distribution) Sample(rng *rand.Rand) float64 {
+	value := 0.0
+	switch d.Kind {
+	case DistributionConstant:
+		value = d.Value
+	case DistributionUniform:
+		value = d.Min + rng.Float64()*(d.Max-d.Min)
+	case DistributionExponential:
+		value = rng.ExpFloat64() * d.Mean
+	case DistributionNormal:
+		value = d.Mean + rng.NormFloat64()*d.StdDev
+	}
+	return math.Max(value, 0)
+}
+
+type SimulatedHosts struct {
+	Count   int    `json:"count"`
+	FirstIP string `json:"firstip"` //the next hosts take the following addresses
+	CPUs    int64  `json:"cpus"`    //cores
+	Memory  string `json:"memory"`  //docker notation, e.g. 8g
+}
+
+type ArrivalStream struct {
+	Image        string       `json:"image"` //name in the catalog, e.g. redis
+	Class        string       `json:"class"`
+	TaskType     string       `json:"tasktype,omitempty"`
+	CPU          int64        `json:"cpu"`             //cpu shares
+	Memory       string       `json:"memory"`          //docker notation
+	Interarrival Distribution `json:"interarrival"`    //seconds between two arrivals
+	Runtime      Distribution `json:"runtime"`         //seconds a task runs, started over when it is killed
+	Count        int          `json:"count,omitempty"` //arrivals at most, no limit when 0
+}
+
+//share of its cpu shares and memory a task actually uses, drawn at every monitor report
+type UtilizationModel struct {
+	CPU    Distribution `json:"cpu"`
+	Memory Distribution `json:"memory"`
+}
+
+type Scenario struct {
+	Seed        int64                       `json:"seed"`
+	Start       time.Time                   `json:"start"` //of the virtual clock
+	Duration    string                      `json:"duration"`
+	Monitor     string                      `json:"monitor"`     //interval of the utilization reports of the hosts
+	Sample      string                      `json:"sample"`      //interval of the samples of the report
+	CutFraction float64                     `json:"cutfraction"` //share of its resources a cut takes from a task
+	Hosts       []SimulatedHosts            `json:"hosts"`
+	Arrivals    []ArrivalStream             `json:"arrivals"`
+	Models      map[string]UtilizationModel `json:"models"` //by image, replacing the default ones
+}
+
+//utilization of the images of the benchmarks, looked up by the image or its last path element
+func DefaultModels() map[string]UtilizationModel {
+	return map[string]UtilizationModel{
+		"redis":      {CPU: Distribution{Kind: DistributionNormal, Mean: 0.3, StdDev: 0.1}, Memory: Distribution{Kind: DistributionNormal, Mean: 0.7, StdDev: 0.05}},
+		"timeserver": {CPU: Distribution{Kind: DistributionNormal, Mean: 0.1, StdDev: 0.05}, Memory: Distribution{Kind: DistributionConstant, Value: 0.3}},
+		"ffmpeg":     {CPU: Distribution{Kind: DistributionUniform, Min: 0.8, Max: 1}, Memory: Distribution{Kind: DistributionNormal, Mean: 0.5, StdDev: 0.1}},
+		"enhance":    {CPU: Distribution{Kind: DistributionNormal, Mean: 0.6, StdDev: 0.2}, Memory: Distribution{Kind: DistributionUniform, Min: 0.7, Max: 1}},
+	}
+}
+
+var defaultModel = UtilizationModel{CPU: Distribution{Kind: DistributionConstant, Value: 0.5}, Memory: Distribution{Kind: DistributionConstant, Value: 0.5}}
+
+func DefaultScenario() Scenario {
+	return Scenario{
+		Seed:        1,
+		Start:       time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		Duration:    "1h",
+		Monitor:     "10s",
+		Sample:      "1m",
+		CutFraction: 0.5,
+		Models:      DefaultModels(),
+	}
+}
+
+func LoadScenario(path string) (Scenario, error) {
+	scenario := DefaultScenario()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scenario, err
+	}
+	if err = json.Unmarshal(data, &scenario); err != nil {
+		return scenario, fmt.Errorf("%s: %v", path, err)
+	}
+	if err = scenario.Validate(); err != nil {
+		return scenario, fmt.Errorf("%s: %v", path, err)
+	}
+	return scenario, nil
+}
+
+func (s Scenario) Validate() error {
+	durations := map[string]string{"duration": s.Duration, "monitor": s.Monitor, "sample": s.Sample}
+	for name, value := range durations {
+		if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+			return fmt.Errorf("%s must be a positive duration", name)
+		}
+	}
+	if s.CutFraction <= 0 || s.CutFraction >= 1 {
+		return errors.New("cutfraction must be between 0 and 1")
+	}
+	if len(s.Hosts) == 0 {
+		return errors.New("at least one group of hosts is required")
+	}
+	for i, group := range s.Hosts {
+		if group.Count <= 0 || group.CPUs <= 0 {
+			return fmt.Errorf("hosts %d: count and cpus must be positive", i)
+		}
+		if ip := net.ParseIP(group.FirstIP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("hosts %d: firstip must be an IPv4 address", i)
+		}
+		if memory, err := ParseMemory(group.Memory); err != nil || memory <= 0 {
+			return fmt.Errorf("hosts %d: memory must be a positive amount", i)
+		}
+	}
+	for i, stream := range s.Arrivals {
+		if _, known := ClassRank(stream.Class); !known {
+			return fmt.Errorf("arrivals %d: %w: %s", i, ErrUnknownClass, stream.Class)
+		}
+		if stream.CPU <= 0 {
+			return fmt.Errorf("arrivals %d: cpu must be positive", i)
+		}
+		if _, err := ParseMemory(stream.Memory); err != nil {
+			return fmt.Errorf("arrivals %d: %v", i, err)
+		}
+		if err := stream.Interarrival.Validate(fmt.Sprintf("arrivals %d: interarrival", i)); err != nil {
+			return err
+		}
+		if stream.Count == 0 && stream.Interarrival.alwaysZero() {
+			return fmt.Errorf("arrivals %d: an unlimited stream needs interarrivals above 0", i)
+		}
+		if err := stream.Runtime.Validate(fmt.Sprintf("arrivals %d: runtime", i)); err != nil {
+			return err
+		}
+	}
+	for image, model := range s.Models {
+		if err := model.CPU.Validate("models " + image + ": cpu"); err != nil {
+			return err
+		}
+		if err := model.Memory.Validate("models " + image + ": memory"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//addresses of the hosts of a group
+func (g SimulatedHosts) Addresses() []string {
+	first := net.ParseIP(g.FirstIP).To4()
+	base := uint32(first[0])<<24 | uint32(first[1])<<16 | uint32(first[2])<<8 | uint32(first[3])
+	addresses := make([]string, 0, g.Count)
+	for i := 0; i < g.Count; i++ {
+		address := base + uint32(i)
+		addresses = append(addresses, net.IPv4(byte(address>>24), byte(address>>16), byte(address>>8), byte(address)).String())
+	}
+	return addresses
+}
+
+type SimulationSample struct {
+	Time            time.Time      `json:"time"`
+	Regions         map[string]int `json:"regions"` //hosts in each region
+	Tasks           int            `json:"tasks"`
+	MeanOverbooking float64        `json:"meanoverbooking"`
+	MaxOverbooking  float64        `json:"maxoverbooking"`
+	MeanUtilization float64        `json:"meanutilization"`
+}
+
+type SimulationTotals struct {
+	Arrivals         int `json:"arrivals"`
+	Placed           int `json:"placed"`          //without cuts nor kills
+	PlacedAfterCuts  int `json:"placedaftercuts"` //on a host of the cut list, with the cuts it needed
+	PlacedAfterKills int `json:"placedafterkills"`
+	Rejected         int `json:"rejected"` //no host even after cuts and kills
+	Completed        int `json:"completed"`
+	Cuts             int `json:"cuts"`
+	Kills            int `json:"kills"`
+	Reschedules      int `json:"reschedules"`
+	Dropped          int `json:"dropped"` //killed tasks no host could take
+}
+
+type SimulationReport struct {
+	Start          time.Time          `json:"start"`
+	End            time.Time          `json:"end"`
+	Hosts          int                `json:"hosts"`
+	Totals         SimulationTotals   `json:"totals"`
+	Occupancy      map[string]float64 `json:"occupancy"` //share of the host time spent in each region
+	MaxOverbooking float64            `json:"maxoverbooking"`
+	Energy         EnergyReport       `json:"energy"` //at the end of the run, by the power models of the configuration
+	Samples        []SimulationSample `json:"samples"`
+}
+
+const (
+	simArrival = iota
+	simCompletion
+	simMonitor
+	simSample
+)
+
+type simEvent struct {
+	at     time.Time
+	seq    int64 //events at the same time are handled in the order they were scheduled
+	kind   int
+	stream int
+	taskID string
+}
+
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	event := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return event
+}
+
+type Simulation struct {
+	scenario    Scenario
+	rng         *rand.Rand
+	now         time.Time
+	end         time.Time
+	monitor     time.Duration
+	sample      time.Duration
+	queue       simQueue
+	seq         int64
+	runtime     *FakeRuntime
+	registry    *Registry
+	destination string         //host the next container started lands on
+	running     map[string]int //stream of the running tasks, by container id
+	arrivals    []int          //by stream
+	memory      []int64        //of the tasks of each stream
+	report      SimulationReport
+}
+
+func NewSimulation(scenario Scenario) *Simulation {
+	duration, _ := time.ParseDuration(scenario.Duration)
+	monitor, _ := time.ParseDuration(scenario.Monitor)
+	sample, _ := time.ParseDuration(scenario.Sample)
+	simulation := &Simulation{scenario: scenario, rng: rand.New(rand.NewSource(scenario.Seed)), now: scenario.Start, end: scenario.Start.Add(duration),
+		monitor: monitor, sample: sample, runtime: NewFakeRuntime(), running: make(map[string]int), arrivals: make([]int, len(scenario.Arrivals)),
+		report: SimulationReport{Start: scenario.Start, End: scenario.Start.Add(duration), Occupancy: make(map[string]float64), Samples: make([]SimulationSample, 0)}}
+	for _, stream := range scenario.Arrivals {
+		memory, _ := ParseMemory(stream.Memory)
+		simulation.memory = append(simulation.memory, memory)
+	}
+	simulation.registry = NewRegistry(simulation.runtime)
+	simulation.registry.background = func(update func()) { update() } //on the virtual clock, in the order of the events
+	simulation.runtime.SetPlacement(func(spec ContainerSpec) string { return simulation.destination })
+	return simulation
+}
+
+func (s *Simulation) schedule(at time.Time, kind int, stream int, taskID string) {
+	s.seq++
+	heap.Push(&s.queue, &simEvent{at: at, seq: s.seq, kind: kind, stream: stream, taskID: taskID})
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+//registers empty synthetic hosts in the registry of the simulation and runs the scenario to its end. The clock of the
+//process is used, a simulation cannot run next to a serving registry
+func (s *Simulation) Run() (SimulationReport, error) {
+	Now = func() time.Time { return s.now }
+	defer func() { Now = time.Now }()
+
+	for _, group := range s.scenario.Hosts {
+		memory, _ := ParseMemory(group.Memory)
+		for _, address := range group.Addresses() {
+			if _, err := s.registry.RegisterHost(address, memory, group.CPUs*1024); err != nil {
+				return s.report, err
+			}
+			s.report.Hosts++
+		}
+	}
+
+	for i, stream := range s.scenario.Arrivals {
+		s.schedule(s.now.Add(secondsDuration(stream.Interarrival.Sample(s.rng))), simArrival, i, "")
+	}
+	s.schedule(s.now.Add(s.monitor), simMonitor, 0, "")
+	s.schedule(s.now, simSample, 0, "")
+
+	for s.queue.Len() > 0 {
+		event := heap.Pop(&s.queue).(*simEvent)
+		if event.at.After(s.end) {
+			break
+		}
+		s.now = event.at
+		switch event.kind {
+		case simArrival:
+			s.arrive(event.stream)
+		case simCompletion:
+			s.complete(event.taskID)
+		case simMonitor:
+			s.reportUtilization()
+			s.schedule(s.now.Add(s.monitor), simMonitor, 0, "")
+		case simSample:
+			s.takeSample()
+			s.schedule(s.now.Add(s.sample), simSample, 0, "")
+		}
+	}
+
+	for region := range s.report.Occupancy {
+		s.report.Occupancy[region] /= float64(len(s.report.Samples) * s.report.Hosts)
+	}
+	s.report.Energy = s.registry.energy.Report(s.now)
+	return s.report, nil
+}
+
+func (s *Simulation) arrive(stream int) {
+	arrival := s.scenario.Arrivals[stream]
+	s.arrivals[stream]++
+	s.report.Totals.Arrivals++
+	if arrival.Count == 0 || s.arrivals[stream] < arrival.Count {
+		s.schedule(s.now.Add(secondsDuration(arrival.Interarrival.Sample(s.rng))), simArrival, stream, "")
+	}
+
+	request := PlacementRequest{CPU: arrival.CPU, Memory: s.memory[stream], Class: arrival.Class, TaskType: arrival.TaskType}
+	hostIP := s.makeRoom(request)
+	if hostIP == "" {
+		s.report.Totals.Rejected++
+		return
+	}
+
+	spec := ContainerSpec{Image: arrival.Image, CPUShares: arrival.CPU, Memory: s.memory[stream]}
+	if template, ok := catalog.Get(arrival.Image); ok {
+		spec = template.Spec(Task{TaskClass: arrival.Class, TaskType: arrival.TaskType}, 0, int64(s.report.Totals.Arrivals))
+		spec.CPUShares = arrival.CPU
+		spec.Memory = s.memory[stream]
+		spec.Ports = nil //ports are only leased to rescheduled tasks
+	}
+	s.destination = hostIP
+	containerID, err := s.runtime.Run(spec)
+	if err != nil {
+		log.Printf("simulation: starting %s: %v", arrival.Image, err)
+		s.report.Totals.Rejected++
+		return
+	}
+	task := TaskRecord{ID: containerID, HostIP: hostIP, Class: arrival.Class, Type: arrival.TaskType, Image: arrival.Image, CPU: arrival.CPU, Memory: s.memory[stream]}
+	if err = s.registry.AllocateTask(task); err != nil {
+		log.Printf("simulation: allocating %s: %v", containerID, err)
+		s.report.Totals.Rejected++
+		return
+	}
+	s.started(containerID, stream)
+}
+
+func (s *Simulation) started(containerID string, stream int) {
+	s.running[containerID] = stream
+	s.schedule(s.now.Add(secondsDuration(s.scenario.Arrivals[stream].Runtime.Sample(s.rng))), simCompletion, stream, containerID)
+}
+
+//host the task goes to, after cutting or killing less restrictive tasks when no host takes it as it is. Empty when
+//even that fails
+func (s *Simulation) makeRoom(request PlacementRequest) string {
+	if placement := s.registry.Place(request); len(placement.Choices) > 0 {
+		s.report.Totals.Placed++
+		return placement.Choices[0].HostIP
+	}
+
+	cutList, _ := s.registry.PlacementList(request.Class, "2")
+	for _, host := range cutList {
+		if cuts := s.planCuts(host, request); cuts != nil {
+			for _, cut := range cuts {
+				if err := s.registry.CutTask(cut); err != nil {
+					log.Printf("simulation: cutting %s: %v", cut.TaskID, err)
+					continue
+				}
+				s.report.Totals.Cuts++
+			}
+			s.report.Totals.PlacedAfterCuts++
+			return host.HostIP
+		}
+	}
+
+	killList, _ := s.registry.KillList(request.Class)
+	for _, host := range killList {
+		if victims := s.planKills(host, request); victims != nil {
+			for _, victim := range victims {
+				s.kill(victim)
+			}
+			s.report.Totals.PlacedAfterKills++
+			return host.HostIP
+		}
+	}
+	return ""
+}
+
+//cpu shares and memory a host lacks to take the task. Unlike the free capacity, it counts what an overbooked host has
+//above its limit. host is a copy from a list
+func (s *Simulation) missing(host Host, request PlacementRequest) (int64, int64) {
+	limit := CapacityLimit(host.HostClass, request.Class)
+	if math.IsInf(limit, 1) {
+		return 0, 0
+	}
+	return request.CPU + host.AllocatedCPUs - int64(limit*float64(host.TotalCPUs)), request.Memory + host.AllocatedMemory - int64(limit*float64(host.TotalMemory))
+}
+
+//running tasks of a host less restrictive than class, the least restrictive and biggest first
+func (s *Simulation) victims(hostIP string, class string) []TaskRecord {
+	rank, _ := ClassRank(class)
+	victims := make([]TaskRecord, 0)
+	for _, task := range s.registry.tasks.List(hostIP, "", TaskStateRunning) {
+		if taskRank, known := ClassRank(task.Class); known && taskRank > rank {
+			victims = append(victims, task)
+		}
+	}
+	sort.SliceStable(victims, func(i, j int) bool {
+		rankI, _ := ClassRank(victims[i].Class)
+		rankJ, _ := ClassRank(victims[j].Class)
+		if rankI != rankJ {
+			return rankI > rankJ
+		}
+		return victims[i].CPU > victims[j].CPU
+	})
+	return victims
+}
+
+//cuts making room for the task on the host, nil when they cannot
+func (s *Simulation) planCuts(host Host, request PlacementRequest) []TaskCut {
+	missingCPU, missingMemory := s.missing(host, request)
+	cuts := make([]TaskCut, 0)
+	for _, task := range s.victims(host.HostIP, request.Class) {
+		if missingCPU <= 0 && missingMemory <= 0 {
+			break
+		}
+		//a cut task keeps the 2 cpu shares CutTask leaves at least
+		cpuCut := min(int64(float64(task.CPU)*s.scenario.CutFraction), max(task.CPU-2, 0))
+		memoryCut := int64(float64(task.Memory) * s.scenario.CutFraction)
+		cuts = append(cuts, TaskCut{TaskID: task.ID, HostIP: host.HostIP, NewCPU: task.CPU - cpuCut, NewMemory: task.Memory - memoryCut, CPUCut: cpuCut, MemoryCut: memoryCut})
+		missingCPU -= cpuCut
+		missingMemory -= memoryCut
+	}
+	if missingCPU > 0 || missingMemory > 0 {
+		return nil
+	}
+	return cuts
+}
+
+//tasks to kill to make room for the task on the host, nil when killing cannot
+func (s *Simulation) planKills(host Host, request PlacementRequest) []TaskRecord {
+	missingCPU, missingMemory := s.missing(host, request)
+	kills := make([]TaskRecord, 0)
+	for _, task := range s.victims(host.HostIP, request.Class) {
+		if missingCPU <= 0 && missingMemory <= 0 {
+			break
+		}
+		kills = append(kills, task)
+		missingCPU -= task.CPU
+		missingMemory -= task.Memory
+	}
+	if missingCPU > 0 || missingMemory > 0 {
+		return nil
+	}
+	return kills
+}
+
+//kills a task and reschedules it at its requested size on the first other host that takes it
+func (s *Simulation) kill(victim TaskRecord) {
+	stream := s.running[victim.ID]
+	delete(s.running, victim.ID)
+	s.runtime.Stop(victim.ID)
+	s.report.Totals.Kills++
+
+	s.destination = ""
+	request := PlacementRequest{CPU: victim.RequestedCPU, Memory: victim.RequestedMemory, Class: victim.Class}
+	for _, choice := range s.registry.Place(request).Choices {
+		if choice.HostIP != victim.HostIP {
+			s.destination = choice.HostIP
+			break
+		}
+	}
+	if s.destination == "" {
+		s.registry.TerminateTask(TaskResources{IP: victim.HostIP, TaskID: victim.ID})
+		s.report.Totals.Dropped++
+		return
+	}
+
+	task := Task{CPU: strconv.FormatInt(victim.RequestedCPU, 10), Memory: strconv.FormatInt(victim.RequestedMemory, 10), TaskClass: victim.Class,
+		Image: victim.Image, TaskType: victim.Type, HostIP: victim.HostIP, TaskID: victim.ID}
+	result, err := s.registry.Reschedule(task)
+	if err != nil {
+		log.Printf("simulation: rescheduling %s: %v", victim.ID, err)
+		if current, getErr := s.registry.tasks.Get(victim.ID); getErr == nil && current.State == TaskStateRunning {
+			s.registry.TerminateTask(TaskResources{IP: victim.HostIP, TaskID: victim.ID})
+		}
+		s.report.Totals.Dropped++
+		return
+	}
+	s.report.Totals.Reschedules++
+	s.started(result.ContainerID, stream)
+}
+
+func (s *Simulation) complete(containerID string) {
+	if _, running := s.running[containerID]; !running { //killed in the meantime
+		return
+	}
+	delete(s.running, containerID)
+	s.runtime.Stop(containerID)
+	if err := s.registry.TerminateTask(TaskResources{TaskID: containerID}); err != nil {
+		log.Printf("simulation: terminating %s: %v", containerID, err)
+		return
+	}
+	s.report.Totals.Completed++
+}
+
+func (s *Simulation) model(image string) UtilizationModel {
+	if model, ok := s.scenario.Models[image]; ok {
+		return model
+	}
+	if model, ok := s.scenario.Models[path.Base(image)]; ok {
+		return model
+	}
+	return defaultModel
+}
+
+func (r *Registry) sortedHosts() []*Host {
+	listHosts := r.AllHosts()
+	sort.Slice(listHosts, func(i, j int) bool { return listHosts[i].HostIP < listHosts[j].HostIP })
+	return listHosts
+}
+
+//what the energy monitor of every host would report, applied like SetUtilization but without its goroutine so the
+//run stays deterministic
+func (s *Simulation) reportUtilization() {
+	for _, host := range s.registry.sortedHosts() {
+		usedCPU, usedMemory := 0.0, 0.0
+		for _, task := range s.registry.tasks.List(host.HostIP, "", TaskStateRunning) {
+			model := s.model(task.Image)
+			usedCPU += math.Min(model.CPU.Sample(s.rng), 1) * float64(task.CPU)
+			usedMemory += math.Min(model.Memory.Sample(s.rng), 1) * float64(task.Memory)
+		}
+		cpu := math.Min(usedCPU/float64(host.TotalCPUs), 1)
+		memory := math.Min(usedMemory/float64(host.TotalMemory), 1)
+
+		lock := s.registry.LockHost(host)
+		host.CPU_Utilization = cpu
+		host.MemoryUtilization = memory
+		MarkAlive(host)
+		s.registry.energy.Observe(host.HostIP, host.Region, cpu, s.now)
+		lock.Unlock()
+		s.registry.UpdateTotalResourcesUtilization(cpu, memory, 1, host.HostIP)
+	}
+}
+
+func (s *Simulation) takeSample() {
+	sample := SimulationSample{Time: s.now, Regions: make(map[string]int), Tasks: len(s.registry.tasks.List("", "", TaskStateRunning))}
+	for _, region := range config.Regions {
+		sample.Regions[region.Name] = 0
+	}
+	listHosts := s.registry.sortedHosts()
+	for _, host := range listHosts {
+		lock := s.registry.LockHost(host)
+		sample.Regions[host.Region]++
+		sample.MeanOverbooking += host.OverbookingFactor
+		sample.MaxOverbooking = math.Max(sample.MaxOverbooking, host.OverbookingFactor)
+		sample.MeanUtilization += host.TotalResourcesUtilization
+		lock.Unlock()
+	}
+	if len(listHosts) > 0 {
+		sample.MeanOverbooking /= float64(len(listHosts))
+		sample.MeanUtilization /= float64(len(listHosts))
+	}
+	for region, count := range sample.Regions {
+		s.report.Occupancy[region] += float64(count)
+	}
+	s.report.MaxOverbooking = math.Max(s.report.MaxOverbooking, sample.MaxOverbooking)
+	s.report.Samples = append(s.report.Samples, sample)
+}
+
+//registry simulate -scenario scenario.json [-config registry.json] [-out report.json]
+func RunSimulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	scenarioFile := flags.String("scenario", "", "JSON file with the hosts, arrivals and utilization models to simulate")
+	configPath := flags.String("config", "", "registry configuration whose regions, classes, overbooking limits and catalog are simulated")
+	out := flags.String("out", "", "file the JSON report is written to, standard output when empty")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *scenarioFile == "" {
+		log.Print("simulate: -scenario is required")
+		return 2
+	}
+
+	var err error
+	if config, err = LoadConfig(*configPath); err != nil {
+		log.Print(err)
+		return 1
+	}
+	scenario, err := LoadScenario(*scenarioFile)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	//without templates killed tasks cannot be rescheduled and are dropped
+	if err = catalog.Load(config.Catalog); err != nil {
+		log.Printf("simulate: %v, killed tasks will not be rescheduled", err)
+	}
+
+	report, err := NewSimulation(scenario).Run()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	log.Printf("simulate: %d arrivals, %d placed, %d after cuts, %d after kills, %d rejected; %d cuts, %d kills, %d reschedules, %d dropped",
+		report.Totals.Arrivals, report.Totals.Placed, report.Totals.PlacedAfterCuts, report.Totals.PlacedAfterKills, report.Totals.Rejected,
+		report.Totals.Cuts, report.Totals.Kills, report.Totals.Reschedules, report.Totals.Dropped)
+
+	output := os.Stdout
+	if *out != "" {
+		if output, err = os.Create(*out); err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer output.Close()
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func constant(value float64) Distribution {
+	return Distribution{Kind: DistributionConstant, Value: value}
+}
+
+//a 1 cpu host running a class 4 task on all its cpu shares, using the share busy of them, when a class 1 task arrives
+func crowdedScenario(cutFraction float64, busy float64) Scenario {
+	scenario := DefaultScenario()
+	scenario.Duration = "10m"
+	scenario.CutFraction = cutFraction
+	scenario.Models["batch"] = UtilizationModel{CPU: constant(busy), Memory: constant(1)}
+	scenario.Hosts = []SimulatedHosts{{Count: 1, FirstIP: "10.0.0.1", CPUs: 1, Memory: "1g"}}
+	scenario.Arrivals = []ArrivalStream{
+		{Image: "batch", Class: "4", CPU: 1024, Memory: "64m", Interarrival: constant(1), Runtime: constant(3600), Count: 1},
+		{Image: "redis", Class: "1", CPU: 512, Memory: "256m", Interarrival: constant(30), Runtime: constant(60), Count: 1},
+	}
+	return scenario
+}
+
+func runScenario(t *testing.T, scenario Scenario) SimulationReport {
+	t.Helper()
+	if err := scenario.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := NewSimulation(scenario).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestDistributionSample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		if value := constant(3).Sample(rng); value != 3 {
+			t.Fatalf("a constant distribution drew %v", value)
+		}
+		if value := (Distribution{Kind: DistributionUniform, Min: 2, Max: 4}).Sample(rng); value < 2 || value > 4 {
+			t.Fatalf("a uniform distribution on [2, 4] drew %v", value)
+		}
+		if value := (Distribution{Kind: DistributionNormal, Mean: 0, StdDev: 1}).Sample(rng); value < 0 {
+			t.Fatalf("a normal distribution drew %v", value)
+		}
+	}
+
+	invalid := []Distribution{
+		{Kind: "poisson"},
+		{Kind: DistributionConstant, Value: -1},
+		{Kind: DistributionUniform, Min: 4, Max: 2},
+		{Kind: DistributionExponential},
+		{Kind: DistributionNormal, Mean: 1, StdDev: -1},
+	}
+	for _, distribution := range invalid {
+		if err := distribution.Validate("runtime"); err == nil || !strings.HasPrefix(err.Error(), "runtime: ") {
+			t.Errorf("%+v: %v", distribution, err)
+		}
+	}
+}
+
+func TestScenarioValidate(t *testing.T) {
+	useDefaultConfig(t)
+	cases := map[string]func(scenario *Scenario){
+		"duration":    func(scenario *Scenario) { scenario.Duration = "0s" },
+		"sample":      func(scenario *Scenario) { scenario.Sample = "often" },
+		"cutfraction": func(scenario *Scenario) { scenario.CutFraction = 1 },
+		"no hosts":    func(scenario *Scenario) { scenario.Hosts = nil },
+		"host cpus":   func(scenario *Scenario) { scenario.Hosts[0].CPUs = 0 },
+		"firstip":     func(scenario *Scenario) { scenario.Hosts[0].FirstIP = "fe80::1" },
+		"host memory": func(scenario *Scenario) { scenario.Hosts[0].Memory = "lots" },
+		"class":       func(scenario *Scenario) { scenario.Arrivals[0].Class = "9" },
+		"task cpu":    func(scenario *Scenario) { scenario.Arrivals[0].CPU = 0 },
+		"unlimited": func(scenario *Scenario) {
+			scenario.Arrivals[0].Count = 0
+			scenario.Arrivals[0].Interarrival = constant(0)
+		},
+		"runtime": func(scenario *Scenario) { scenario.Arrivals[0].Runtime = Distribution{Kind: DistributionExponential} },
+		"model": func(scenario *Scenario) {
+			scenario.Models["batch"] = UtilizationModel{CPU: constant(-1), Memory: constant(1)}
+		},
+	}
+	if err := crowdedScenario(0.5, 0.3).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, change := range cases {
+		scenario := crowdedScenario(0.5, 0.3)
+		change(&scenario)
+		if err := scenario.Validate(); err == nil {
+			t.Errorf("%s: the scenario is valid", name)
+		}
+	}
+}
+
+func TestSimulatedHostsAddresses(t *testing.T) {
+	addresses := SimulatedHosts{Count: 3, FirstIP: "10.0.0.254"}.Addresses()
+	if !reflect.DeepEqual(addresses, []string{"10.0.0.254", "10.0.0.255", "10.0.1.0"}) {
+		t.Errorf("the hosts take %v", addresses)
+	}
+}
+
+func TestSimulationCuts(t *testing.T) {
+	useDefaultConfig(t)
+	report := runScenario(t, crowdedScenario(0.5, 0.3))
+
+	//the class 1 task only fits once half of the cpu shares of the class 4 one are cut, the host staying on the cut list
+	expected := SimulationTotals{Arrivals: 2, Placed: 1, PlacedAfterCuts: 1, Completed: 1, Cuts: 1}
+	if report.Totals != expected {
+		t.Errorf("the totals are %+v", report.Totals)
+	}
+	if report.Hosts != 1 || len(report.Samples) != 11 || !report.Samples[0].Time.Equal(report.Start) {
+		t.Fatalf("%d hosts and %d samples", report.Hosts, len(report.Samples))
+	}
+	if report.Samples[1].Tasks != 2 || report.Samples[2].Tasks != 1 || report.Samples[2].MaxOverbooking != 0.5 {
+		t.Errorf("the samples are %+v", report.Samples[:3])
+	}
+	if report.MaxOverbooking != 1 {
+		t.Errorf("the overbooking reached %v", report.MaxOverbooking)
+	}
+}
+
+func TestSimulationKills(t *testing.T) {
+	useDefaultConfig(t)
+	useCatalog(t, WorkloadTemplate{Name: "batch", Image: "library/batch", Makespan: 300})
+
+	//a cut of a tenth is not enough and the busy host is not on the cut list anyway, the class 4 task is killed and no
+	//other host takes it
+	report := runScenario(t, crowdedScenario(0.1, 1))
+	expected := SimulationTotals{Arrivals: 2, Placed: 1, PlacedAfterKills: 1, Completed: 1, Kills: 1, Dropped: 1}
+	if report.Totals != expected {
+		t.Errorf("the totals are %+v", report.Totals)
+	}
+
+	//a host with little memory is left for the killed task, not for the class 1 one
+	scenario := crowdedScenario(0.1, 1)
+	scenario.Hosts = append(scenario.Hosts, SimulatedHosts{Count: 1, FirstIP: "10.0.1.1", CPUs: 1, Memory: "128m"})
+	report = runScenario(t, scenario)
+	expected = SimulationTotals{Arrivals: 2, Placed: 1, PlacedAfterKills: 1, Completed: 1, Kills: 1, Reschedules: 1}
+	if report.Totals != expected {
+		t.Errorf("the totals are %+v", report.Totals)
+	}
+	if report.Samples[1].Regions["EED"] != 1 || report.Samples[2].Tasks != 1 {
+		t.Errorf("the samples are %+v", report.Samples[:3])
+	}
+	occupancy := 0.0
+	for _, share := range report.Occupancy {
+		occupancy += share
+	}
+	if !near(occupancy, 1) {
+		t.Errorf("the occupancy is %v", report.Occupancy)
+	}
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	useDefaultConfig(t)
+	scenario := DefaultScenario()
+	scenario.Hosts = []SimulatedHosts{{Count: 4, FirstIP: "10.0.0.1", CPUs: 2, Memory: "2g"}}
+	scenario.Arrivals = []ArrivalStream{
+		{Image: "redis", Class: "1", CPU: 512, Memory: "256m", Interarrival: Distribution{Kind: DistributionExponential, Mean: 30},
+			Runtime: Distribution{Kind: DistributionExponential, Mean: 300}},
+		{Image: "ffmpeg", Class: "4", CPU: 1024, Memory: "512m", Interarrival: Distribution{Kind: DistributionUniform, Min: 10, Max: 60},
+			Runtime: Distribution{Kind: DistributionNormal, Mean: 600, StdDev: 120}},
+	}
+
+	report := runScenario(t, scenario)
+	totals := report.Totals
+	if totals.Arrivals == 0 || totals.Arrivals != totals.Placed+totals.PlacedAfterCuts+totals.PlacedAfterKills+totals.Rejected {
+		t.Errorf("the totals are %+v", totals)
+	}
+	//the energy is summed in the order of a map, it may differ in its last digits
+	again := runScenario(t, scenario)
+	if again.Totals != report.Totals || !reflect.DeepEqual(again.Samples, report.Samples) || !reflect.DeepEqual(again.Occupancy, report.Occupancy) ||
+		math.Abs(again.Energy.Joules-report.Energy.Joules) > 1e-9*report.Energy.Joules {
+		t.Errorf("a run with the same seed reported %+v then %+v", report.Totals, again.Totals)
+	}
+}
+
+func TestSimulateCommand(t *testing.T) {
+	useDefaultConfig(t)
+	useCatalog(t)
+	directory := t.TempDir()
+	scenarioFile := filepath.Join(directory, "scenario.json")
+	out := filepath.Join(directory, "report.json")
+
+	if code := RunSimulateCommand(nil); code != 2 {
+		t.Errorf("without a scenario the command exits with %d", code)
+	}
+	data, _ := json.Marshal(crowdedScenario(0.5, 0.3))
+	if err := os.WriteFile(scenarioFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := RunSimulateCommand([]string{"-scenario", scenarioFile, "-out", out}); code != 0 {
+		t.Fatalf("the command exits with %d", code)
+	}
+	var report SimulationReport
+	if data, err := os.ReadFile(out); err != nil || json.Unmarshal(data, &report) != nil {
+		t.Fatalf("the report cannot be read: %v", err)
+	}
+	if report.Totals.PlacedAfterCuts != 1 || len(report.Samples) != 11 {
+		t.Errorf("the report is %+v", report.Totals)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//the tasks the registry knows about, with the resources each one holds on its host. Allocations that name a task,
+//committed reservations that name one and rescheduled tasks are added to it, cuts and terminations of a known task
+//are checked against it and the resources released come from it instead of the caller. Updates of tasks the registry
+//never saw keep the old behaviour and trust the caller. Terminated tasks are kept for a while so a second termination
+//is refused instead of releasing the resources twice; the terminations of tasks the table never had leave a tombstone
+//with a retention of its own. Both are pruned on a timer, and a task added again with the id of a terminated one
+//replaces it
+
+const (
+	TaskStateRunning    = "running"
+	TaskStateTerminated = "terminated"
+)
+
+var ErrUnknownTask = errors.New("unknown task")
+var ErrTaskExists = errors.New("task already registered")
+var ErrTaskTerminated = errors.New("task already terminated")
+var ErrTaskConflict = errors.New("update does not match the task")
+
+//how often the terminated tasks past their retention are pruned
+const taskPruneInterval = time.Minute
+
+type TaskConfig struct {
+	Retention          string `json:"retention"`          //how long terminated tasks are kept
+	TombstoneRetention string `json:"tombstoneretention"` //how long the terminations of tasks the table never had are kept
+}
+
+func (t TaskConfig) Validate() error {
+	if retention, err := time.ParseDuration(t.Retention); err != nil || retention <= 0 {
+		return fmt.Errorf("tasks: retention must be a positive duration")
+	}
+	if retention, err := time.ParseDuration(t.TombstoneRetention); err != nil || retention <= 0 {
+		return fmt.Errorf("tasks: tombstoneretention must be a positive duration")
+	}
+	return nil
+}
+
+type TaskRecord struct {
+	ID              string     `json:"taskid"`
+	HostIP          string     `json:"hostip"`
+	Class           string     `json:"class,omitempty"`
+	Type            string     `json:"tasktype,omitempty"`
+	Image           string     `json:"image,omitempty"`
+	RequestedCPU    int64      `json:"requestedcpu"`    //cpu shares
+	RequestedMemory int64      `json:"requestedmemory"` //bytes
+	CPU             int64      `json:"cpu"`             //cpu shares held on the host, the requested ones minus the cuts
+	Memory          int64      `json:"memory"`
+	Port            int        `json:"port,omitempty"`
+	State           string     `json:"state"`
+	Started         time.Time  `json:"started"`
+	Terminated      *time.Time `json:"terminated,omitempty"`
+	Tombstone       bool       `json:"tombstone,omitempty"` //terminated without the table having the task, kept to refuse a second termination
+}
+
+type TaskTable struct {
+	mutex    *sync.Mutex
+	tasks    map[string]*TaskRecord
+	registry *Registry
+}
+
+var taskUpdatesRejected = NewCounterVec("hostregistry_task_updates_rejected_total", "Task updates refused because they do not match the task table.", "reason")
+
+func NewTaskTable(registry *Registry) *TaskTable {
+	return &TaskTable{mutex: &sync.Mutex{}, tasks: make(map[string]*TaskRecord), registry: registry}
+}
+
+//adds a running task. A terminated task of the same id is replaced, a running one is refused
+func (t *TaskTable) Add(task TaskRecord) error {
+	t.mutex.Lock()
+	if existing, exists := t.tasks[task.ID]; exists && existing.State != TaskStateTerminated {
+		t.mutex.Unlock()
+		taskUpdatesRejected.Inc("exists")
+		return fmt.Errorf("%w: %s", ErrTaskExists, task.ID)
+	}
+	task.RequestedCPU = task.CPU
+	task.RequestedMemory = task.Memory
+	task.State = TaskStateRunning
+	task.Terminated = nil
+	task.Tombstone = false
+	if task.Started.IsZero() {
+		task.Started = Now()
+	}
+	t.tasks[task.ID] = &task
+	t.mutex.Unlock()
+	t.registry.RecordTaskMutation(OpCreateTask, task.ID)
+	return nil
+}
+
+//drops a task that was added but whose allocation failed
+func (t *TaskTable) remove(id string) {
+	t.mutex.Lock()
+	delete(t.tasks, id)
+	t.mutex.Unlock()
+	t.registry.RecordTaskMutation(OpDeleteTask, id)
+}
+
+func (t *TaskTable) Get(id string) (TaskRecord, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	task, ok := t.tasks[id]
+	if !ok {
+		return TaskRecord{}, fmt.Errorf("%w: %s", ErrUnknownTask, id)
+	}
+	return *task, nil
+}
+
+//copy of a task for the state records, nil once it is gone
+func (t *TaskTable) lookup(id string) *TaskRecord {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	task, ok := t.tasks[id]
+	if !ok {
+		return nil
+	}
+	copied := *task
+	return &copied
+}
+
+//tasks ordered by start time then id. Empty filters match every task
+func (t *TaskTable) List(hostIP string, class string, state string) []TaskRecord {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	list := make([]TaskRecord, 0)
+	for _, task := range t.tasks {
+		if (hostIP == "" || task.HostIP == hostIP) && (class == "" || task.Class == class) && (state == "" || task.State == state) {
+			list = append(list, *task)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Started.Equal(list[j].Started) {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+//checks an update of a known task sent for hostIP, cpu and memory being what the caller believes the task holds.
+//Zero values are not checked. Must be called with the mutex held
+func (t *TaskTable) check(task *TaskRecord, hostIP string, cpu int64, memory int64) error {
+	if task.State == TaskStateTerminated {
+		taskUpdatesRejected.Inc("terminated")
+		return fmt.Errorf("%w: %s", ErrTaskTerminated, task.ID)
+	}
+	if hostIP != "" && hostIP != task.HostIP {
+		taskUpdatesRejected.Inc("host")
+		return fmt.Errorf("%w: task %s runs on %s, not %s", ErrTaskConflict, task.ID, task.HostIP, hostIP)
+	}
+	if (cpu != 0 && cpu != task.CPU) || (memory != 0 && memory != task.Memory) {
+		taskUpdatesRejected.Inc("resources")
+		return fmt.Errorf("%w: task %s holds %d cpu shares and %d bytes of memory, not %d and %d", ErrTaskConflict, task.ID, task.CPU, task.Memory, cpu, memory)
+	}
+	return nil
+}
+
+//marks a task terminated and returns what it held. known is false for a task the table does not have: the release is
+//left to the caller and a terminated record is kept for the id so a second termination or a cut of it is refused
+func (t *TaskTable) Terminate(id string, hostIP string, cpu int64, memory int64) (task TaskRecord, known bool, err error) {
+	t.mutex.Lock()
+	record, ok := t.tasks[id]
+	if !ok {
+		now := Now()
+		t.tasks[id] = &TaskRecord{ID: id, HostIP: hostIP, CPU: cpu, Memory: memory, State: TaskStateTerminated, Started: now, Terminated: &now, Tombstone: true}
+		t.mutex.Unlock()
+		t.registry.RecordTaskMutation(OpCreateTask, id)
+		return TaskRecord{}, false, nil
+	}
+	if err = t.check(record, hostIP, cpu, memory); err != nil {
+		t.mutex.Unlock()
+		return TaskRecord{}, true, err
+	}
+	now := Now()
+	record.State = TaskStateTerminated
+	record.Terminated = &now
+	task = *record
+	t.mutex.Unlock()
+
+	t.registry.RecordTaskMutation(OpUpdateTask, id)
+	return task, true, nil
+}
+
+//marks every running task of a host terminated, for a host removed with its tasks, and returns them
+func (t *TaskTable) TerminateHost(hostIP string) []TaskRecord {
+	t.mutex.Lock()
+	now := Now()
+	terminated := make([]TaskRecord, 0)
+	for _, task := range t.tasks {
+		if task.HostIP == hostIP && task.State == TaskStateRunning {
+			task.State = TaskStateTerminated
+			task.Terminated = &now
+			terminated = append(terminated, *task)
+		}
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(terminated, func(i, j int) bool { return terminated[i].ID < terminated[j].ID })
+	for _, task := range terminated {
+		t.registry.RecordTaskMutation(OpUpdateTask, task.ID)
+	}
+	return terminated
+}
+
+//drops the terminated tasks and the tombstones older than their retention and returns how many were dropped
+func (t *TaskTable) Prune(now time.Time) int {
+	retention, _ := time.ParseDuration(config.Tasks.Retention)
+	tombstoneRetention, _ := time.ParseDuration(config.Tasks.TombstoneRetention)
+	t.mutex.Lock()
+	pruned := make([]string, 0)
+	for id, task := range t.tasks {
+		if task.State != TaskStateTerminated {
+			continue
+		}
+		if (task.Tombstone && now.Sub(*task.Terminated) > tombstoneRetention) || (!task.Tombstone && now.Sub(*task.Terminated) > retention) {
+			delete(t.tasks, id)
+			pruned = append(pruned, id)
+		}
+	}
+	t.mutex.Unlock()
+
+	sort.Strings(pruned)
+	for _, id := range pruned {
+		t.registry.RecordTaskMutation(OpDeleteTask, id)
+	}
+	return len(pruned)
+}
+
+//prunes the task table on the leader, the followers get the deletions through the log
+func (r *Registry) RunTaskPruner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if r.isLeader() {
+			r.tasks.Prune(Now())
+		}
+	}
+}
+
+//checks that a cut fits what a task holds, and applies it when apply is set. known is false for a task the table does
+//not have
+func (t *TaskTable) Cut(id string, hostIP string, cpuCut int64, memoryCut int64, apply bool) (known bool, err error) {
+	t.mutex.Lock()
+	task, ok := t.tasks[id]
+	if !ok {
+		t.mutex.Unlock()
+		return false, nil
+	}
+	if err = t.check(task, hostIP, 0, 0); err != nil {
+		t.mutex.Unlock()
+		return true, err
+	}
+	if cpuCut > task.CPU || memoryCut > task.Memory {
+		t.mutex.Unlock()
+		taskUpdatesRejected.Inc("resources")
+		return true, fmt.Errorf("%w: task %s holds %d cpu shares and %d bytes of memory, less than the cut", ErrTaskConflict, id, task.CPU, task.Memory)
+	}
+	if !apply {
+		t.mutex.Unlock()
+		return true, nil
+	}
+	task.CPU -= cpuCut
+	task.Memory -= memoryCut
+	t.mutex.Unlock()
+	t.registry.RecordTaskMutation(OpUpdateTask, id)
+	return true, nil
+}
+
+//every task, for the snapshots
+func (t *TaskTable) Snapshot() []TaskRecord {
+	return t.List("", "", "")
+}
+
+//puts the persisted or replicated state of a task in place of the current one
+func (t *TaskTable) put(task TaskRecord) {
+	t.mutex.Lock()
+	t.tasks[task.ID] = &task
+	t.mutex.Unlock()
+}
+
+func (t *TaskTable) delete(id string) {
+	t.mutex.Lock()
+	delete(t.tasks, id)
+	t.mutex.Unlock()
+}
+
+//replaces every task by the ones of a snapshot
+func (t *TaskTable) restore(restored []TaskRecord) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.tasks = make(map[string]*TaskRecord, len(restored))
+	for i := range restored {
+		t.tasks[restored[i].ID] = &restored[i]
+	}
+}
+
+//allocates the resources of a new task on its host, adds the task to the table and moves the host to the class of its
+//tasks when it can be derived
+func (r *Registry) AllocateTask(task TaskRecord) error {
+	return r.allocateTask(task, nil)
+}
+
+//allocateTask of a task whose capacity is held by reservation, checked against the free capacity of the host when nil
+func (r *Registry) allocateTask(task TaskRecord, reservation *Reservation) error {
+	if task.ID == "" {
+		return &ValidationError{Field: "taskid", Message: "is required"}
+	}
+	if task.CPU < 0 {
+		return &ValidationError{Field: "cpu", Message: "must not be negative"}
+	}
+	if task.Memory < 0 {
+		return &ValidationError{Field: "memory", Message: "must not be negative"}
+	}
+	if _, known := ClassRank(task.Class); task.Class != "" && !known {
+		return fmt.Errorf("%w: %s", ErrUnknownClass, task.Class)
+	}
+	if _, err := r.LookupHost(task.HostIP); err != nil {
+		return err
+	}
+	if err := r.tasks.Add(task); err != nil {
+		return err
+	}
+	if err := r.allocateResources(task.HostIP, task.CPU, task.Memory, task.Class, reservation); err != nil {
+		r.tasks.remove(task.ID)
+		return err
+	}
+	return r.ReconcileHostClass(task.HostIP)
+}
+
+//?host= ?class= filter the tasks, ?state=running (default), terminated or all
+func (r *Registry) V2ListTasks(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	state := query.Get("state")
+	switch state {
+	case "":
+		state = TaskStateRunning
+	case "all":
+		state = ""
+	case TaskStateRunning, TaskStateTerminated:
+	default:
+		WriteError(w, &ValidationError{Field: "state", Message: "must be running, terminated or all"})
+		return
+	}
+	WriteJSON(w, http.StatusOK, r.tasks.List(query.Get("host"), query.Get("class"), state))
+}
+
+func (r *Registry) V2GetTask(w http.ResponseWriter, req *http.Request) {
+	task, err := r.tasks.Get(mux.Vars(req)["taskid"])
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, task)
+}
+
+func (r *Registry) V2ListHostTasks(w http.ResponseWriter, req *http.Request) {
+	hostIP := mux.Vars(req)["hostip"]
+	if _, err := r.LookupHost(hostIP); err != nil {
+		WriteError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, r.tasks.List(hostIP, "", TaskStateRunning))
+}
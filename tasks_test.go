@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func expectAllocated(t *testing.T, registry *Registry, hostIP string, cpu int64) {
+	t.Helper()
+	if host, _ := registry.SnapshotHost(hostIP); host.AllocatedCPUs != cpu {
+		t.Errorf("%s has %d shares allocated, expected %d", hostIP, host.AllocatedCPUs, cpu)
+	}
+}
+
+func TestTaskTerminatedOnce(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	if err := registry.AllocateTask(TaskRecord{ID: "c1", HostIP: "10.0.0.1", CPU: 1024, Memory: 256 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	//a running task is not added twice
+	if err := registry.AllocateTask(TaskRecord{ID: "c1", HostIP: "10.0.0.1", CPU: 512}); !errors.Is(err, ErrTaskExists) {
+		t.Errorf("adding a running task again returned %v", err)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 1024)
+
+	//the resources released come from the table, the caller's ones are checked against it
+	if status, body := serve(t, registry, http.MethodDelete, "/v2/tasks/c1", TaskTermination{HostIP: "10.0.0.1", CPU: 2048}); status != http.StatusConflict || errorCode(t, body) != "task_conflict" {
+		t.Errorf("terminating with other resources answered %d %s", status, body)
+	}
+	if status, body := serve(t, registry, http.MethodDelete, "/v2/tasks/c1", TaskTermination{}); status != http.StatusNoContent {
+		t.Fatalf("terminating answered %d %s", status, body)
+	}
+	if status, body := serve(t, registry, http.MethodDelete, "/v2/tasks/c1", TaskTermination{}); status != http.StatusConflict || errorCode(t, body) != "task_terminated" {
+		t.Errorf("terminating twice answered %d %s", status, body)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 0)
+
+	//the id of a terminated task can be used again
+	if err := registry.AllocateTask(TaskRecord{ID: "c1", HostIP: "10.0.0.1", CPU: 512, Memory: 128 << 20}); err != nil {
+		t.Fatalf("adding a terminated task again returned %v", err)
+	}
+	if task, _ := registry.tasks.Get("c1"); task.State != TaskStateRunning || task.Terminated != nil || task.RequestedCPU != 512 {
+		t.Errorf("the task was added again as %+v", task)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 512)
+}
+
+func TestTaskTombstone(t *testing.T) {
+	useDefaultConfig(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	if err := registry.AllocateResources("10.0.0.1", 2048, 512<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	//a task the table never had is released as the caller says, once
+	termination := TaskResources{TaskID: "c9", IP: "10.0.0.1", CPU: 1024, Memory: 256 << 20}
+	if err := registry.TerminateTask(termination); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.TerminateTask(termination); !errors.Is(err, ErrTaskTerminated) {
+		t.Errorf("terminating an unknown task twice returned %v", err)
+	}
+	expectAllocated(t, registry, "10.0.0.1", 1024)
+	if task, err := registry.tasks.Get("c9"); err != nil || !task.Tombstone || task.State != TaskStateTerminated {
+		t.Errorf("the termination left %+v, %v", task, err)
+	}
+
+	//a tombstone does not keep a task from being added
+	if err := registry.AllocateTask(TaskRecord{ID: "c9", HostIP: "10.0.0.1", CPU: 512}); err != nil {
+		t.Fatalf("adding a task over its tombstone returned %v", err)
+	}
+	if task, _ := registry.tasks.Get("c9"); task.Tombstone || task.State != TaskStateRunning {
+		t.Errorf("the task was added over its tombstone as %+v", task)
+	}
+}
+
+func TestTaskPrune(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	registry := newTestRegistry(t, "10.0.0.1")
+	for _, id := range []string{"c1", "c2"} {
+		if err := registry.AllocateTask(TaskRecord{ID: id, HostIP: "10.0.0.1", CPU: 512}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registry.TerminateTask(TaskResources{TaskID: "c1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.TerminateTask(TaskResources{TaskID: "c9", IP: "10.0.0.1", CPU: 512}); err != nil {
+		t.Fatal(err)
+	}
+
+	//tombstones go first, the terminated tasks after the retention, the running ones stay
+	clock.advance(10 * time.Minute)
+	if pruned := registry.tasks.Prune(Now()); pruned != 0 {
+		t.Errorf("%d tasks were pruned at their retention", pruned)
+	}
+	clock.advance(time.Second)
+	if pruned := registry.tasks.Prune(Now()); pruned != 1 {
+		t.Errorf("%d tasks were pruned past the retention of the tombstones", pruned)
+	}
+	if _, err := registry.tasks.Get("c9"); !errors.Is(err, ErrUnknownTask) {
+		t.Errorf("the tombstone was kept: %v", err)
+	}
+	clock.advance(time.Hour)
+	if pruned := registry.tasks.Prune(Now()); pruned != 1 {
+		t.Errorf("%d tasks were pruned past the retention of the terminated tasks", pruned)
+	}
+	if tasks := registry.tasks.List("", "", ""); len(tasks) != 1 || tasks[0].ID != "c2" {
+		t.Errorf("the table kept %+v", tasks)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//embedded time-series store fed by the history recorder (sink kind "timeseries"). Samples are kept as they arrive
+//for the raw retention, then folded into buckets of the downsample step which are kept until the retention ends.
+//Queries aggregate both into steps with min/avg/max and percentiles; percentiles of steps covering downsampled
+//buckets are the count-weighted mean of the bucket percentiles, so they are an approximation
+
+const (
+	SeriesCPU             = "cpu"
+	SeriesMemory          = "memory"
+	SeriesTotal           = "total"
+	SeriesAllocatedCPUs   = "allocatedcpus"
+	SeriesAllocatedMemory = "allocatedmemory"
+)
+
+var AllSeries = []string{SeriesCPU, SeriesMemory, SeriesTotal, SeriesAllocatedCPUs, SeriesAllocatedMemory}
+
+//percentiles kept per downsampled bucket and returned per step
+var seriesPercentiles = []float64{50, 90, 95, 99}
+
+//longest answer of a query, in steps
+const maxHistorySteps = 10000
+
+type SeriesPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+//aggregate of the points of one downsample step
+type SeriesBucket struct {
+	Start       time.Time
+	Count       int
+	Min         float64
+	Max         float64
+	Sum         float64
+	Percentiles []float64 //same order as seriesPercentiles
+}
+
+type hostSeries struct {
+	raw         map[string][]SeriesPoint //by series, ordered by time
+	downsampled map[string][]SeriesBucket
+}
+
+type TimeSeriesStore struct {
+	mutex          *sync.RWMutex
+	retention      time.Duration
+	rawRetention   time.Duration
+	downsampleStep time.Duration
+	hosts          map[string]*hostSeries
+}
+
+func NewTimeSeriesStore(sinkConfig SinkConfig) (*TimeSeriesStore, error) {
+	retention, err := time.ParseDuration(sinkConfig.Retention)
+	if err != nil {
+		return nil, fmt.Errorf("retention: %v", err)
+	}
+	rawRetention, err := time.ParseDuration(sinkConfig.RawRetention)
+	if err != nil {
+		return nil, fmt.Errorf("rawretention: %v", err)
+	}
+	downsampleStep, err := time.ParseDuration(sinkConfig.DownsampleStep)
+	if err != nil {
+		return nil, fmt.Errorf("downsamplestep: %v", err)
+	}
+	store := &TimeSeriesStore{mutex: &sync.RWMutex{}, retention: retention, rawRetention: rawRetention, downsampleStep: downsampleStep, hosts: make(map[string]*hostSeries)}
+	go store.runCompaction()
+	return store, nil
+}
+
+func validTimeSeriesConfig(sinkConfig SinkConfig) error {
+	retention, err := time.ParseDuration(sinkConfig.Retention)
+	if err != nil || retention <= 0 {
+		return fmt.Errorf("timeseries sink needs a positive retention")
+	}
+	rawRetention, err := time.ParseDuration(sinkConfig.RawRetention)
+	if err != nil || rawRetention <= 0 || rawRetention > retention {
+		return fmt.Errorf("timeseries sink needs a positive rawretention not longer than the retention")
+	}
+	downsampleStep, err := time.ParseDuration(sinkConfig.DownsampleStep)
+	if err != nil || downsampleStep <= 0 {
+		return fmt.Errorf("timeseries sink needs a positive downsamplestep")
+	}
+	return nil
+}
+
+//takes the monitor samples and allocation changes, the other records are not kept
+func (s *TimeSeriesStore) Write(records []HistoryRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, record := range records {
+		switch record.Kind {
+		case RecordUtilization:
+			s.append(record.HostIP, SeriesCPU, record.Time, record.CPU)
+			s.append(record.HostIP, SeriesMemory, record.Time, record.Memory)
+			s.append(record.HostIP, SeriesTotal, record.Time, math.Max(record.CPU, record.Memory))
+		case RecordAllocation:
+			s.append(record.HostIP, SeriesAllocatedCPUs, record.Time, float64(record.AllocatedCPUs))
+			s.append(record.HostIP, SeriesAllocatedMemory, record.Time, float64(record.AllocatedMemory))
+		}
+	}
+	return nil
+}
+
+func (s *TimeSeriesStore) Close() error {
+	return nil
+}
+
+//must be called with the mutex held
+func (s *TimeSeriesStore) append(hostIP string, series string, at time.Time, value float64) {
+	if hostIP == "" {
+		return
+	}
+	host, ok := s.hosts[hostIP]
+	if !ok {
+		host = &hostSeries{raw: make(map[string][]SeriesPoint), downsampled: make(map[string][]SeriesBucket)}
+		s.hosts[hostIP] = host
+	}
+	points := append(host.raw[series], SeriesPoint{Time: at, Value: value})
+	//records of concurrent handlers may be queued slightly out of order
+	for i := len(points) - 1; i > 0 && points[i].Time.Before(points[i-1].Time); i-- {
+		points[i], points[i-1] = points[i-1], points[i]
+	}
+	host.raw[series] = points
+}
+
+func (s *TimeSeriesStore) runCompaction() {
+	ticker := time.NewTicker(s.downsampleStep)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.Compact(now)
+	}
+}
+
+//folds raw points older than the raw retention into buckets and drops what is older than the retention
+func (s *TimeSeriesStore) Compact(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	//only whole buckets are folded, the newest raw points of a bucket wait for the next compaction
+	rawCutoff := now.Add(-s.rawRetention).Truncate(s.downsampleStep)
+	cutoff := now.Add(-s.retention)
+	for hostIP, host := range s.hosts {
+		for series, points := range host.raw {
+			old := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(rawCutoff) })
+			buckets := host.downsampled[series]
+			for start := 0; start < old; {
+				bucketStart := points[start].Time.Truncate(s.downsampleStep)
+				end := start
+				values := make([]float64, 0)
+				for end < old && points[end].Time.Truncate(s.downsampleStep).Equal(bucketStart) {
+					values = append(values, points[end].Value)
+					end++
+				}
+				buckets = append(buckets, summarize(bucketStart, values))
+				start = end
+			}
+			//a late sample may start a bucket older than the last one
+			sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+			expired := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Start.Before(cutoff) })
+			host.downsampled[series] = append([]SeriesBucket{}, buckets[expired:]...)
+			host.raw[series] = append([]SeriesPoint{}, points[old:]...)
+		}
+		empty := true
+		for series := range host.raw {
+			if len(host.raw[series]) > 0 || len(host.downsampled[series]) > 0 {
+				empty = false
+			}
+		}
+		if empty {
+			delete(s.hosts, hostIP)
+		}
+	}
+}
+
+func summarize(start time.Time, values []float64) SeriesBucket {
+	sort.Float64s(values)
+	bucket := SeriesBucket{Start: start, Count: len(values), Min: values[0], Max: values[len(values)-1]}
+	for _, value := range values {
+		bucket.Sum += value
+	}
+	for _, percentile := range seriesPercentiles {
+		bucket.Percentiles = append(bucket.Percentiles, percentileOf(values, percentile))
+	}
+	return bucket
+}
+
+//linear interpolation between the closest ranks of sorted values
+func percentileOf(sorted []float64, percentile float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := percentile / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+type HistoryStep struct {
+	Time  time.Time `json:"time"` //start of the step
+	Count int       `json:"count"`
+	Min   float64   `json:"min"`
+	Avg   float64   `json:"avg"`
+	Max   float64   `json:"max"`
+	P50   float64   `json:"p50"`
+	P90   float64   `json:"p90"`
+	P95   float64   `json:"p95"`
+	P99   float64   `json:"p99"`
+}
+
+type HistoryQuery struct {
+	HostIP string                   `json:"hostip"`
+	From   time.Time                `json:"from"`
+	To     time.Time                `json:"to"`
+	Step   string                   `json:"step"`
+	Series map[string][]HistoryStep `json:"series"` //steps without samples are left out
+}
+
+func (s *TimeSeriesStore) HasHost(hostIP string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.hosts[hostIP]
+	return ok
+}
+
+//aggregates the series of a host over [from, to) in steps of step
+func (s *TimeSeriesStore) Query(hostIP string, series []string, from time.Time, to time.Time, step time.Duration) HistoryQuery {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := HistoryQuery{HostIP: hostIP, From: from, To: to, Step: step.String(), Series: make(map[string][]HistoryStep)}
+	host := s.hosts[hostIP]
+	for _, name := range series {
+		steps := make([]HistoryStep, 0)
+		if host == nil {
+			result.Series[name] = steps
+			continue
+		}
+		points := host.raw[name]
+		buckets := host.downsampled[name]
+		for start := from; start.Before(to); start = start.Add(step) {
+			end := start.Add(step)
+			if end.After(to) {
+				end = to
+			}
+			first := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(start) })
+			last := sort.Search(len(points), func(i int) bool { return !points[i].Time.Before(end) })
+			firstBucket := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Start.Before(start) })
+			lastBucket := sort.Search(len(buckets), func(i int) bool { return !buckets[i].Start.Before(end) })
+
+			parts := append([]SeriesBucket{}, buckets[firstBucket:lastBucket]...)
+			if first < last {
+				values := make([]float64, 0, last-first)
+				for _, point := range points[first:last] {
+					values = append(values, point.Value)
+				}
+				parts = append(parts, summarize(start, values))
+			}
+			if len(parts) > 0 {
+				steps = append(steps, mergeBuckets(start, parts))
+			}
+		}
+		result.Series[name] = steps
+	}
+	return result
+}
+
+func mergeBuckets(start time.Time, parts []SeriesBucket) HistoryStep {
+	step := HistoryStep{Time: start, Min: parts[0].Min, Max: parts[0].Max}
+	sum := 0.0
+	percentiles := make([]float64, len(seriesPercentiles))
+	for _, part := range parts {
+		step.Count += part.Count
+		sum += part.Sum
+		step.Min = math.Min(step.Min, part.Min)
+		step.Max = math.Max(step.Max, part.Max)
+		for i := range percentiles {
+			percentiles[i] += part.Percentiles[i] * float64(part.Count)
+		}
+	}
+	step.Avg = sum / float64(step.Count)
+	step.P50 = percentiles[0] / float64(step.Count)
+	step.P90 = percentiles[1] / float64(step.Count)
+	step.P95 = percentiles[2] / float64(step.Count)
+	step.P99 = percentiles[3] / float64(step.Count)
+	return step
+}
+
+//the time-series store of the history recorder, if one is configured
+func (r *HistoryRecorder) TimeSeries() *TimeSeriesStore {
+	if r == nil {
+		return nil
+	}
+	for _, sink := range r.sinks {
+		if store, ok := sink.(*TimeSeriesStore); ok {
+			return store
+		}
+	}
+	return nil
+}
+
+//RFC 3339 or unix seconds
+func parseHistoryTime(field string, value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, &ValidationError{Field: field, Message: "must be RFC 3339 or unix seconds"}
+	}
+	return parsed, nil
+}
+
+//GET /v2/hosts/{ip}/history?from=&to=&step=&series=. By default the last hour in 60 steps, every series
+func (r *Registry) GetHostHistory(w http.ResponseWriter, req *http.Request) {
+	store := r.history.TimeSeries()
+	if store == nil {
+		WriteJSON(w, http.StatusNotFound, ErrorDocument{Status: http.StatusNotFound, Code: "no_timeseries", Message: "no timeseries history sink is configured"})
+		return
+	}
+	hostIP := mux.Vars(req)["hostip"]
+	if _, err := r.LookupHost(hostIP); err != nil && !store.HasHost(hostIP) {
+		WriteError(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+	to, err := parseHistoryTime("to", query.Get("to"), Now())
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	from, err := parseHistoryTime("from", query.Get("from"), to.Add(-time.Hour))
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	if !from.Before(to) {
+		WriteError(w, &ValidationError{Field: "from", Message: "must be before to"})
+		return
+	}
+	step := to.Sub(from) / 60
+	if value := query.Get("step"); value != "" {
+		if step, err = time.ParseDuration(value); err != nil || step <= 0 {
+			WriteError(w, &ValidationError{Field: "step", Message: "must be a positive duration, e.g. 1m"})
+			return
+		}
+	}
+	if step < time.Second {
+		step = time.Second
+	}
+	if to.Sub(from)/step > maxHistorySteps {
+		WriteError(w, &ValidationError{Field: "step", Message: fmt.Sprintf("too small, at most %d steps are returned", maxHistorySteps)})
+		return
+	}
+
+	series := AllSeries
+	if value := query.Get("series"); value != "" {
+		series = strings.Split(value, ",")
+		for _, name := range series {
+			known := false
+			for _, candidate := range AllSeries {
+				known = known || candidate == name
+			}
+			if !known {
+				WriteError(w, &ValidationError{Field: "series", Message: fmt.Sprintf("unknown series %q, expected one of %s", name, strings.Join(AllSeries, ","))})
+				return
+			}
+		}
+	}
+	WriteJSON(w, http.StatusOK, store.Query(hostIP, series, from, to, step))
+}
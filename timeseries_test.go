@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//a store whose compaction is only run by the test, its ticker being much slower than the tests
+func newTestTimeSeries(t *testing.T) *TimeSeriesStore {
+	t.Helper()
+	store, err := NewTimeSeriesStore(SinkConfig{Kind: "timeseries", Retention: "24h", RawRetention: "1h", DownsampleStep: "10m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+//a utilization sample of 10.0.0.1 every minute from start, with the cpu values given
+func writeSamples(store *TimeSeriesStore, start time.Time, values ...float64) {
+	records := make([]HistoryRecord, 0, len(values))
+	for i, value := range values {
+		records = append(records, HistoryRecord{Time: start.Add(time.Duration(i) * time.Minute), Kind: RecordUtilization, HostIP: "10.0.0.1", CPU: value, Memory: value / 2})
+	}
+	store.Write(records)
+}
+
+func TestTimeSeriesQuery(t *testing.T) {
+	store := newTestTimeSeries(t)
+	start := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	writeSamples(store, start, 0.1, 0.2, 0.3, 0.4, 0.5)
+	//other records are not kept
+	store.Write([]HistoryRecord{{Time: start, Kind: RecordKill, HostIP: "10.0.0.1"}})
+
+	query := store.Query("10.0.0.1", []string{SeriesCPU, SeriesTotal, SeriesAllocatedCPUs}, start, start.Add(10*time.Minute), 5*time.Minute)
+	steps := query.Series[SeriesCPU]
+	if len(steps) != 1 || steps[0].Count != 5 || steps[0].Min != 0.1 || steps[0].Max != 0.5 || !near(steps[0].Avg, 0.3) || !near(steps[0].P50, 0.3) || !near(steps[0].P90, 0.46) {
+		t.Errorf("the cpu series was aggregated as %+v", steps)
+	}
+	if total := query.Series[SeriesTotal]; len(total) != 1 || total[0].Max != 0.5 {
+		t.Errorf("the total series was aggregated as %+v", total)
+	}
+	if allocated := query.Series[SeriesAllocatedCPUs]; allocated == nil || len(allocated) != 0 {
+		t.Errorf("a series without samples was answered as %+v", allocated)
+	}
+	if query = store.Query("10.0.0.2", []string{SeriesCPU}, start, start.Add(time.Hour), time.Minute); len(query.Series[SeriesCPU]) != 0 {
+		t.Errorf("an unknown host was answered with %+v", query.Series)
+	}
+}
+
+func TestTimeSeriesCompaction(t *testing.T) {
+	store := newTestTimeSeries(t)
+	start := time.Date(2026, 1, 5, 8, 0, 0, 0, time.UTC)
+	writeSamples(store, start, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0, 0.1, 0.3)
+
+	//the first bucket is folded, the two samples of the second one stay raw until their bucket is whole
+	store.Compact(start.Add(time.Hour + 11*time.Minute))
+	host := store.hosts["10.0.0.1"]
+	if buckets := host.downsampled[SeriesCPU]; len(buckets) != 1 || buckets[0].Count != 10 || len(host.raw[SeriesCPU]) != 2 {
+		t.Fatalf("compaction kept %d buckets and %d raw points", len(host.downsampled[SeriesCPU]), len(host.raw[SeriesCPU]))
+	}
+	steps := store.Query("10.0.0.1", []string{SeriesCPU}, start, start.Add(20*time.Minute), 20*time.Minute).Series[SeriesCPU]
+	if len(steps) != 1 || steps[0].Count != 12 || steps[0].Min != 0.1 || steps[0].Max != 1.0 || !near(steps[0].Avg, 5.9/12) {
+		t.Errorf("the downsampled and raw samples were aggregated as %+v", steps)
+	}
+
+	//a host whose samples are all past the retention is forgotten
+	store.Compact(start.Add(48 * time.Hour))
+	if store.HasHost("10.0.0.1") {
+		t.Errorf("the samples past the retention were kept")
+	}
+}
+
+func TestHostHistoryEndpoint(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	recorder, err := NewHistoryRecorder(HistoryConfig{Buffer: 16, FlushInterval: "1h", Sinks: []SinkConfig{{Kind: "timeseries", Retention: "24h", RawRetention: "1h", DownsampleStep: "1h"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := newTestRegistry(t, "10.0.0.1")
+	registry.history = recorder
+	for _, value := range []float64{0.2, 0.4} {
+		cpu, memory := value, value
+		if err = registry.SetUtilization("10.0.0.1", &cpu, &memory); err != nil {
+			t.Fatal(err)
+		}
+		clock.advance(time.Minute)
+	}
+	recorder.Flush()
+
+	//by default the last hour, in 60 steps
+	status, body := serve(t, registry, http.MethodGet, "/v2/hosts/10.0.0.1/history?series=cpu,memory", nil)
+	var query HistoryQuery
+	if err = json.Unmarshal(body, &query); status != http.StatusOK || err != nil {
+		t.Fatalf("the history was answered with %d %s", status, body)
+	}
+	if !query.To.Equal(clock.now) || query.Step != "1m0s" || len(query.Series) != 2 || len(query.Series[SeriesCPU]) != 2 || query.Series[SeriesCPU][1].Max != 0.4 {
+		t.Errorf("the history was answered with %s", body)
+	}
+
+	from := clock.now.Add(-time.Hour).Unix()
+	for _, test := range []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{fmt.Sprintf("/v2/hosts/10.0.0.1/history?from=%d&step=1h", from), http.StatusOK, ""},
+		{"/v2/hosts/10.0.0.2/history", http.StatusNotFound, "unknown_host"},
+		{"/v2/hosts/10.0.0.1/history?series=disk", http.StatusBadRequest, "invalid_argument"},
+		{"/v2/hosts/10.0.0.1/history?from=yesterday", http.StatusBadRequest, "invalid_argument"},
+		{fmt.Sprintf("/v2/hosts/10.0.0.1/history?from=%d&to=%d", from, from), http.StatusBadRequest, "invalid_argument"},
+		{"/v2/hosts/10.0.0.1/history?step=1ms&from=0", http.StatusBadRequest, "invalid_argument"},
+	} {
+		status, body = serve(t, registry, http.MethodGet, test.path, nil)
+		if status != test.status || (test.code != "" && errorCode(t, body) != test.code) {
+			t.Errorf("%s was answered with %d %s", test.path, status, body)
+		}
+	}
+}
+
+func near(value float64, expected float64) bool {
+	return value > expected-1e-9 && value < expected+1e-9
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//record and replay of the API traffic. With -trace every request a node serves is appended to a JSON Lines file with
+//the time it arrived, its body and the status it got. Requests refused by the authentication change nothing and are
+//not recorded, the writes a follower forwards are recorded by the leader serving them. The replay subcommand feeds a
+//trace to a fresh registry on the fake runtime, on a clock following the trace, in real time, faster or as fast as
+//possible, so the sequence of updates that led to a region layout can be reproduced offline. The benchmark files of
+//the hosts can be replayed along with it as monitor updates. Reservations get new ids when replayed, the requests
+//naming a recorded one fail and show up as mismatches
+
+var traceFile = flag.String("trace", "", "file every API request served is appended to as JSON lines, for the replay command (empty disables recording)")
+
+type TraceEntry struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	URI      string    `json:"uri"` //path and query
+	Body     string    `json:"body,omitempty"`
+	Identity string    `json:"identity,omitempty"` //name of the authenticated client
+	Status   int       `json:"status"`
+}
+
+type TraceRecorder struct {
+	mutex   *sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+var traceRecorder *TraceRecorder
+
+//records to path, nothing when it is empty
+func InitTraceRecorder(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("trace: %w", err)
+	}
+	traceRecorder = &TraceRecorder{mutex: &sync.Mutex{}, file: file, encoder: json.NewEncoder(file)}
+	return nil
+}
+
+//entries are written once answered, so concurrent requests may not be in the order they arrived
+func (r *TraceRecorder) Record(entry TraceEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.encoder.Encode(entry); err != nil {
+		log.Printf("trace: %v", err)
+	}
+}
+
+//metrics scrapes, consensus traffic and event streams are neither recorded nor replayed
+func traced(path string) bool {
+	return path != "/metrics" && path != "/v2/events" && !strings.HasPrefix(path, "/raft/")
+}
+
+//router middleware recording the requests served when a trace is set
+func RecordTraffic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if traceRecorder == nil || !traced(req.URL.Path) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		entry := TraceEntry{Time: Now(), Method: req.Method, URI: req.URL.RequestURI()}
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxRequestBody+1))
+		if err != nil {
+			WriteError(w, &ValidationError{Field: "body", Message: err.Error()})
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		entry.Body = string(body)
+		if identity := RequestIdentity(req); identity != nil {
+			entry.Identity = identity.Name
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, req)
+		entry.Status = recorder.status
+		traceRecorder.Record(entry)
+	})
+}
+
+func LoadTrace(path string) ([]TraceEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("trace: %w", err)
+	}
+	defer file.Close()
+
+	entries := make([]TraceEntry, 0)
+	decoder := json.NewDecoder(file)
+	for {
+		var entry TraceEntry
+		if err = decoder.Decode(&entry); errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("trace: %s entry %d: %w", path, len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+//the benchmark samples of every host in dir as the monitor updates that reported them
+func BenchmarkUpdates(dir string) ([]ReplayEntry, error) {
+	hostIPs, err := BenchmarkHosts(dir)
+	if err != nil {
+		return nil, err
+	}
+	percent := func(value float64) string {
+		return strconv.FormatFloat(math.Min(math.Max(value/100, 0), 1), 'f', -1, 64)
+	}
+	updates := make([]ReplayEntry, 0)
+	for _, hostIP := range hostIPs {
+		samples, err := ReadBenchmarkHost(dir, hostIP)
+		if err != nil {
+			return nil, err
+		}
+		for _, sample := range samples {
+			updates = append(updates, ReplayEntry{Monitored: hostIP, TraceEntry: TraceEntry{Time: sample.Time, Method: http.MethodGet,
+				URI: "/host/updateboth/" + hostIP + "&" + percent(sample.CPU) + "&" + percent(sample.Memory), Status: http.StatusOK}})
+		}
+	}
+	return updates, nil
+}
+
+type ReplayEntry struct {
+	TraceEntry
+	Monitored string //host of a benchmark update, registered if the trace has not done it by then
+}
+
+type ReplayMismatch struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	URI      string    `json:"uri"`
+	Recorded int       `json:"recorded"`
+	Replayed int       `json:"replayed"`
+	Response string    `json:"response,omitempty"`
+}
+
+type ReplayReport struct {
+	Start      time.Time                      `json:"start"` //of the trace
+	End        time.Time                      `json:"end"`
+	Requests   int                            `json:"requests"`   //replayed from the trace
+	Updates    int                            `json:"updates"`    //replayed from the benchmark files
+	Registered []string                       `json:"registered"` //benchmark hosts the trace did not register
+	Mismatches []ReplayMismatch               `json:"mismatches"` //requests answered with another status than recorded
+	Layout     map[string]map[string][]string `json:"layout"`     //hosts by region and class, in list order
+	Hosts      []Host                         `json:"hosts"`
+}
+
+type Replay struct {
+	entries    []ReplayEntry
+	speed      float64 //1 for real time, 0 for as fast as possible
+	hostCPUs   int64   //of the benchmark hosts registered by the replay, in shares
+	hostMemory int64
+	registry   *Registry
+	router     *mux.Router
+	report     ReplayReport
+}
+
+//entries are replayed by time, the ones at the same time in the given order
+func NewReplay(entries []ReplayEntry, speed float64, hostCPUs int64, hostMemory int64) *Replay {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	registry := NewRegistry(NewFakeRuntime())
+	//the list updates must be done before the next entry, as the monitor reports arrive seconds apart
+	registry.background = func(update func()) { update() }
+	router := mux.NewRouter()
+	registry.RegisterRoutes(router)
+	return &Replay{entries: entries, speed: speed, hostCPUs: hostCPUs, hostMemory: hostMemory, registry: registry, router: router,
+		report: ReplayReport{Registered: make([]string, 0), Mismatches: make([]ReplayMismatch, 0)}}
+}
+
+//replays on a fresh registry, the state reached is left in place
+func (r *Replay) Run() ReplayReport {
+	if len(r.entries) == 0 {
+		return r.report
+	}
+	start := r.entries[0].Time
+	r.report.Start, r.report.End = start, r.entries[len(r.entries)-1].Time
+
+	//the clock starts at the first entry and runs speed times faster than the wall clock, or jumps from one entry to
+	//the next when replaying as fast as possible
+	wallStart := time.Now()
+	current := start
+	if r.speed > 0 {
+		Now = func() time.Time { return start.Add(time.Duration(float64(time.Since(wallStart)) * r.speed)) }
+	} else {
+		Now = func() time.Time { return current }
+	}
+	defer func() { Now = time.Now }()
+
+	nextCheck := start.Add(*livenessInterval)
+	for _, entry := range r.entries {
+		if r.speed > 0 {
+			time.Sleep(time.Until(wallStart.Add(time.Duration(float64(entry.Time.Sub(start)) / r.speed))))
+		} else {
+			current = entry.Time
+		}
+		//the liveness tracker would have run in the meantime
+		if !entry.Time.Before(nextCheck) {
+			r.registry.CheckLiveness()
+			nextCheck = nextCheck.Add((entry.Time.Sub(nextCheck)/(*livenessInterval) + 1) * (*livenessInterval))
+		}
+		r.serve(entry)
+	}
+
+	r.report.Layout = r.registry.RegionLayout()
+	r.report.Hosts = r.registry.HostSnapshots()
+	sort.Slice(r.report.Hosts, func(i, j int) bool { return r.report.Hosts[i].HostIP < r.report.Hosts[j].HostIP })
+	return r.report
+}
+
+func (r *Replay) serve(entry ReplayEntry) {
+	req, err := http.NewRequest(entry.Method, entry.URI, strings.NewReader(entry.Body))
+	if err != nil {
+		r.mismatch(entry, 0, err.Error())
+		return
+	}
+	if !traced(req.URL.Path) {
+		return
+	}
+	if entry.Identity != "" {
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Name: entry.Identity, Method: "replay"}))
+	}
+	if entry.Monitored != "" {
+		r.report.Updates++
+		if _, err = r.registry.LookupHost(entry.Monitored); errors.Is(err, ErrUnknownHost) {
+			if _, err = r.registry.RegisterHost(entry.Monitored, r.hostMemory, r.hostCPUs); err != nil {
+				r.mismatch(entry, 0, err.Error())
+				return
+			}
+			r.report.Registered = append(r.report.Registered, entry.Monitored)
+		}
+	} else {
+		r.report.Requests++
+	}
+
+	response := httptest.NewRecorder()
+	r.router.ServeHTTP(response, req)
+	if response.Code != entry.Status {
+		r.mismatch(entry, response.Code, strings.TrimSpace(response.Body.String()))
+	}
+}
+
+func (r *Replay) mismatch(entry ReplayEntry, status int, response string) {
+	log.Printf("replay: %s %s at %s answered %d, recorded %d", entry.Method, entry.URI, entry.Time.Format(time.RFC3339Nano), status, entry.Status)
+	r.report.Mismatches = append(r.report.Mismatches, ReplayMismatch{Time: entry.Time, Method: entry.Method, URI: entry.URI,
+		Recorded: entry.Status, Replayed: status, Response: response})
+}
+
+//the addresses of the hosts of every non empty list, in list order
+func (r *Registry) RegionLayout() map[string]map[string][]string {
+	layout := make(map[string]map[string][]string)
+	for _, region := range config.Regions {
+		for _, class := range config.Classes {
+			r.locks[region.Name].classHosts[class].Lock()
+			for _, host := range r.regions[region.Name].classHosts[class] {
+				if layout[region.Name] == nil {
+					layout[region.Name] = make(map[string][]string)
+				}
+				layout[region.Name][class] = append(layout[region.Name][class], host.HostIP)
+			}
+			r.locks[region.Name].classHosts[class].Unlock()
+		}
+	}
+	return layout
+}
+
+func RunReplayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	tracePath := flags.String("trace", "", "JSON Lines trace recorded with -trace")
+	benchmarkDir := flags.String("benchmarks", "", "directory whose <ip>Cpu.txt, <ip>Memory.txt and <ip>Time.txt files are replayed as monitor updates")
+	configPath := flags.String("config", "", "registry configuration the trace was recorded with")
+	speed := flags.Float64("speed", 0, "1 replays in real time, 10 ten times faster, 0 as fast as possible")
+	hostCPUs := flags.Int64("hostcpus", 4, "cores of the benchmark hosts the trace does not register")
+	hostMemory := flags.String("hostmemory", "8g", "memory of the benchmark hosts the trace does not register")
+	out := flags.String("out", "", "file the JSON report is written to, standard output when empty")
+	listen := flags.String("listen", "", "address the replayed registry is served on afterwards, to inspect it (none when empty)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *tracePath == "" && *benchmarkDir == "" {
+		log.Print("replay: -trace or -benchmarks is required")
+		return 2
+	}
+	if *speed < 0 {
+		log.Print("replay: -speed must not be negative")
+		return 2
+	}
+	memory, err := ParseMemory(*hostMemory)
+	if err != nil || memory <= 0 || *hostCPUs <= 0 {
+		log.Print("replay: -hostcpus and -hostmemory must be positive")
+		return 2
+	}
+
+	if config, err = LoadConfig(*configPath); err != nil {
+		log.Print(err)
+		return 1
+	}
+	if err = catalog.Load(config.Catalog); err != nil {
+		log.Printf("replay: %v, reschedules will fail", err)
+	}
+	entries := make([]ReplayEntry, 0)
+	if *tracePath != "" {
+		trace, err := LoadTrace(*tracePath)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		for _, entry := range trace {
+			entries = append(entries, ReplayEntry{TraceEntry: entry})
+		}
+	}
+	if *benchmarkDir != "" {
+		updates, err := BenchmarkUpdates(*benchmarkDir)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		entries = append(entries, updates...)
+	}
+
+	replay := NewReplay(entries, *speed, *hostCPUs*1024, memory)
+	report := replay.Run()
+	log.Printf("replay: %d requests and %d monitor updates from %s to %s, %d mismatches",
+		report.Requests, report.Updates, report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339), len(report.Mismatches))
+
+	output := os.Stdout
+	if *out != "" {
+		if output, err = os.Create(*out); err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer output.Close()
+	}
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(report); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if *listen != "" {
+		log.Printf("replay: serving the replayed registry on %s", *listen)
+		log.Print(http.ListenAndServe(*listen, replay.router))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//records the traffic of every router to a file of the test, returned
+func useTraceRecorder(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	if err := InitTraceRecorder(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		traceRecorder.file.Close()
+		traceRecorder = nil
+	})
+	return path
+}
+
+//writes the utilization files the benchmarks leave for a host, the samples in percent
+func writeBenchmarkHost(t *testing.T, dir string, hostIP string, samples []BenchmarkSample) {
+	t.Helper()
+	var cpu, memory, times strings.Builder
+	for _, sample := range samples {
+		cpu.WriteString(strconv.FormatFloat(sample.CPU, 'f', -1, 64) + "\n")
+		memory.WriteString(strconv.FormatFloat(sample.Memory, 'f', -1, 64) + "\n")
+		times.WriteString(sample.Time.String() + "\n")
+	}
+	files := map[string]string{benchmarkCPUSuffix: cpu.String(), benchmarkMemorySuffix: memory.String(), benchmarkTimeSuffix: times.String()}
+	for suffix, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, hostIP+suffix), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//traffic that leaves 10.0.0.1 busy with an allocation and 10.0.0.2 idle, with a request of each kind that fails
+func recordTraffic(t *testing.T, clock *testClock, registry *Registry) {
+	t.Helper()
+	requests := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+	}{
+		{http.MethodGet, "/host/createhost/10.0.0.1&1073741824&4", nil, http.StatusOK},
+		{http.MethodGet, "/host/createhost/10.0.0.2&1073741824&4", nil, http.StatusOK},
+		{http.MethodPost, "/v2/hosts/10.0.0.1/allocations", Allocation{CPU: 1024, Memory: 256 << 20}, http.StatusOK},
+		{http.MethodGet, "/host/updateboth/10.0.0.1&0.9&0.2", nil, http.StatusOK},
+		{http.MethodGet, "/host/updateboth/10.0.0.9&0.5&0.5", nil, http.StatusNotFound},
+		{http.MethodGet, "/metrics", nil, http.StatusOK},
+	}
+	for _, request := range requests {
+		clock.advance(10 * time.Second)
+		if status, body := serve(t, registry, request.method, request.path, request.body); status != request.status {
+			t.Fatalf("%s %s: %d %s", request.method, request.path, status, body)
+		}
+	}
+}
+
+func TestRecordTraffic(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	start := clock.now
+	path := useTraceRecorder(t)
+	recordTraffic(t, clock, newTestRegistry(t))
+
+	trace, err := LoadTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the metrics scrape is not recorded
+	if len(trace) != 5 {
+		t.Fatalf("%d entries are recorded", len(trace))
+	}
+	allocation := trace[2]
+	if allocation.Method != http.MethodPost || allocation.URI != "/v2/hosts/10.0.0.1/allocations" || allocation.Status != http.StatusOK ||
+		!allocation.Time.Equal(start.Add(30*time.Second)) || !strings.Contains(allocation.Body, `"cpu":1024`) {
+		t.Errorf("the allocation is recorded as %+v", allocation)
+	}
+	if trace[4].Status != http.StatusNotFound || trace[4].Body != "" {
+		t.Errorf("the update of an unknown host is recorded as %+v", trace[4])
+	}
+}
+
+func TestReplayTrace(t *testing.T) {
+	useDefaultConfig(t)
+	clock := useClock(t)
+	path := useTraceRecorder(t)
+	recorded := newTestRegistry(t)
+	recordTraffic(t, clock, recorded)
+	layout := recorded.RegionLayout()
+
+	trace, err := LoadTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]ReplayEntry, 0)
+	for _, entry := range trace {
+		entries = append(entries, ReplayEntry{TraceEntry: entry})
+	}
+	report := NewReplay(entries, 0, 4*1024, 1<<30).Run()
+	if report.Requests != 5 || report.Updates != 0 || len(report.Mismatches) != 0 {
+		t.Errorf("%d requests and %d updates replayed, mismatches %+v", report.Requests, report.Updates, report.Mismatches)
+	}
+	if !report.Start.Equal(trace[0].Time) || !report.End.Equal(trace[4].Time) {
+		t.Errorf("the replay ran from %s to %s", report.Start, report.End)
+	}
+	if !reflect.DeepEqual(report.Layout, layout) {
+		t.Errorf("the replay left %v instead of %v", report.Layout, layout)
+	}
+	if len(report.Hosts) != 2 || report.Hosts[0].HostIP != "10.0.0.1" || report.Hosts[0].AllocatedCPUs != 1024 || report.Hosts[0].TotalResourcesUtilization != 0.9 {
+		t.Errorf("the replayed hosts are %+v", report.Hosts)
+	}
+
+	//a request answered otherwise than recorded is reported
+	unknown := ReplayEntry{TraceEntry: TraceEntry{Time: trace[1].Time, Method: http.MethodGet, URI: "/host/updateboth/10.0.0.3&0.5&0.5", Status: http.StatusOK}}
+	report = NewReplay([]ReplayEntry{entries[0], unknown}, 0, 4*1024, 1<<30).Run()
+	if len(report.Mismatches) != 1 || report.Mismatches[0].URI != unknown.URI || report.Mismatches[0].Replayed != http.StatusNotFound {
+		t.Errorf("the mismatches are %+v", report.Mismatches)
+	}
+}
+
+func TestReplayBenchmarks(t *testing.T) {
+	useDefaultConfig(t)
+	dir := t.TempDir()
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	writeBenchmarkHost(t, dir, "10.0.0.5", []BenchmarkSample{{Time: start, CPU: 20, Memory: 30}, {Time: start.Add(5 * time.Second), CPU: 90, Memory: 150}})
+
+	updates, err := BenchmarkUpdates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updates) != 2 || updates[1].Monitored != "10.0.0.5" || updates[1].URI != "/host/updateboth/10.0.0.5&0.9&1" || !updates[1].Time.Equal(start.Add(5*time.Second)) {
+		t.Fatalf("the updates are %+v", updates)
+	}
+
+	//the host is registered by the replay, the trace not doing it
+	report := NewReplay(updates, 0, 4*1024, 1<<30).Run()
+	if report.Updates != 2 || report.Requests != 0 || !reflect.DeepEqual(report.Registered, []string{"10.0.0.5"}) || len(report.Mismatches) != 0 {
+		t.Errorf("the report is %+v", report)
+	}
+	if hosts := report.Layout["EED"]; len(hosts) != 1 {
+		t.Errorf("the replay left %v", report.Layout)
+	}
+}
+
+func TestReplayCommand(t *testing.T) {
+	useDefaultConfig(t)
+	useCatalog(t)
+	clock := useClock(t)
+	path := useTraceRecorder(t)
+	recordTraffic(t, clock, newTestRegistry(t))
+	out := filepath.Join(t.TempDir(), "report.json")
+
+	if code := RunReplayCommand(nil); code != 2 {
+		t.Errorf("without a trace the command exits with %d", code)
+	}
+	if code := RunReplayCommand([]string{"-trace", path, "-speed", "-1"}); code != 2 {
+		t.Errorf("with a negative speed the command exits with %d", code)
+	}
+
+	//40 seconds of trace at 1000 times the real time
+	began := time.Now()
+	if code := RunReplayCommand([]string{"-trace", path, "-speed", "1000", "-out", out}); code != 0 {
+		t.Fatalf("the command exits with %d", code)
+	}
+	if elapsed := time.Since(began); elapsed < 40*time.Millisecond {
+		t.Errorf("the replay took %s", elapsed)
+	}
+	var report ReplayReport
+	if data, err := os.ReadFile(out); err != nil || json.Unmarshal(data, &report) != nil {
+		t.Fatalf("the report cannot be read: %v", err)
+	}
+	if report.Requests != 5 || len(report.Mismatches) != 0 || len(report.Hosts) != 2 {
+		t.Errorf("the report is %+v", report)
+	}
+}